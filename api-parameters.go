@@ -0,0 +1,300 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A file parameter, true when the file is uploaded or an earlier upload is referenced with <name>Digest
+type FormFile bool
+
+// The roster of a lab, for the operations that add students
+type RosterParameters struct {
+	Students       FormFile `form:"students" description:"a CSV, XLSX or JSON file, not used when the roster comes from an external system"`
+	RosterSource   string   `form:"rosterSource" default:"CSV" enum:"BRIGHTSPACE,CANVAS,CSV,JSON,LDAP,XLSX"`
+	Roster         string   `form:"roster" description:"required for CANVAS, BRIGHTSPACE and LDAP: the course, org unit or group DN of the students"`
+	GroupCategory  string   `form:"groupCategory" description:"the group set of CANVAS or BRIGHTSPACE the groups are taken from"`
+	StudentsDigest string   `form:"studentsDigest" description:"the SHA-256 of an earlier upload of the students that is reused from the object store"`
+}
+
+// The manifest of a lab, for the operations that deploy one
+type ManifestParameters struct {
+	DeploymentMode string   `form:"deploymentMode" required:"true" enum:"CHART,CHART_URL,KUSTOMIZE,PRESET,YAML"`
+	Config         string   `form:"config" description:"a YAML file, a TAR file or a string: the manifest, the chart, the URL of the chart (or of its repository) or the name of the preset"`
+	Chart          string   `form:"chart" description:"optional for CHART_URL, the name of the chart in the repository of which config is the URL"`
+	ChartVersion   string   `form:"chartVersion" description:"the version (or semver range) of chart, default the latest version"`
+	Values         FormFile `form:"values" description:"a YAML file that overrides the values of the chart, validated against its values.schema.json"`
+	ValuesProfile  string   `form:"valuesProfile" description:"a values profile stored in the chart as profiles/<valuesProfile>.yaml"`
+	ConfigDigest   string   `form:"configDigest" description:"the SHA-256 of an earlier upload of config that is reused from the object store"`
+	ValuesDigest   string   `form:"valuesDigest" description:"the SHA-256 of an earlier upload of values that is reused from the object store"`
+}
+
+// How the credentials of new namespaces are returned
+type CredentialsParameters struct {
+	Format string `form:"format" default:"token" enum:"token,kubeconfig,zip" description:"kubeconfigs per student as JSON or as a zip file"`
+	Async  bool   `form:"async" description:"responds with a job right away and creates the namespaces in the background, see GET /job/{id}"`
+}
+
+// The place of a lab in the provisioning queue
+type ProvisioningParameters struct {
+	Priority   string `form:"priority" default:"normal" enum:"exam,normal,low" description:"labs submitted at the same time are provisioned by priority"`
+	Instructor string `form:"instructor" description:"labs of instructors are provisioned fairly, the impersonated user is used when impersonation is enabled"`
+}
+
+// Who is notified when a cluster admin decides on a lab that needs approval
+type ApprovalNotifyParameters struct {
+	NotifyChannel string `form:"notifyChannel" enum:"EMAIL,SLACK,TEAMS,WEBHOOK" description:"the instructor is notified on it when a cluster admin decides on a lab that needs approval"`
+	NotifyTarget  string `form:"notifyTarget" description:"required with notifyChannel, the email address or webhook URL that is notified"`
+}
+
+// The instructions of a lab
+type InstructionsParameters struct {
+	Instructions string `form:"instructions" description:"the instructions of the lab (e.g. Markdown) that students see in their portal"`
+}
+
+// POST /lab, also accepted by POST /validate. The options of the lab spec are parameters as well, see getLabOptions.
+type LabParameters struct {
+	RosterParameters
+	ManifestParameters
+	CredentialsParameters
+	ProvisioningParameters
+	ApprovalNotifyParameters
+	InstructionsParameters
+	LabName        string   `form:"labName" description:"required unless the spec has a name"`
+	IsIndividual   bool     `form:"isIndividual" default:"true"`
+	IsHybrid       bool     `form:"isHybrid" description:"every group gets a shared namespace and every member a personal namespace"`
+	DryRun         bool     `form:"dryRun" description:"creates nothing and returns the namespaces and objects the lab would create"`
+	Spec           FormFile `form:"spec" description:"a lab spec with the other parameters, see GET /lab-spec/schema, parameters sent next to it override it"`
+	SpecDigest     string   `form:"specDigest" description:"the SHA-256 of an earlier upload of the spec that is reused from the object store"`
+	Roles          FormFile `form:"roles" description:"named roles with their RBAC rules, assigned to students with the Role column"`
+	SharedRules    FormFile `form:"sharedRules" description:"extra RBAC rules for the students in the lab namespace"`
+	ScheduledTasks FormFile `form:"scheduledTasks" description:"tasks that run as CronJobs in the lab namespace or every namespace"`
+}
+
+// POST /estimate
+type EstimateParameters struct {
+	LabParameters
+	StudentCount *int `form:"studentCount" description:"required unless a roster is sent, the expected amount of students"`
+	GroupCount   *int `form:"groupCount" description:"required for group and hybrid labs without a roster, the expected amount of groups"`
+}
+
+// PUT and PATCH /lab/{labName}
+type LabUpdateParameters struct {
+	ManifestParameters
+	InstructionsParameters
+	Prune bool `form:"prune" description:"deletes the objects of the previous manifest that are no longer part of the new manifest"`
+}
+
+// DELETE /lab/{labName}
+type LabDeletionParameters struct {
+	SkipHooks bool `form:"skipHooks" description:"deletes the lab without running its pre-delete hooks"`
+}
+
+// POST /lab/{labName}/students
+type StudentsParameters struct {
+	RosterParameters
+	CredentialsParameters
+}
+
+// POST /lab/{labName}/students/{username}
+type ReprovisionParameters struct {
+	Identity string `form:"identity" description:"required when the lab uses an identity provider"`
+	SshKey   string `form:"sshKey"`
+	Role     string `form:"role" description:"one of the roles of the lab"`
+}
+
+// POST /lab/{labName}/tokens
+type TokenIssuanceParameters struct {
+	Usernames  []string `form:"usernames" description:"default every student of the lab"`
+	Regenerate bool     `form:"regenerate" description:"replaces the ServiceAccounts so every earlier token stops working"`
+}
+
+// POST /lab/{labName}/groups/{groupNumber}/merge
+type GroupMergeParameters struct {
+	Into          *int     `form:"into" required:"true" description:"the group the group is merged into"`
+	CopyResources []string `form:"copyResources" description:"the resources (e.g. \"configmaps,deployments.apps\") copied to the other namespace"`
+	GracePeriod   string   `form:"gracePeriod" default:"24h" description:"how long the namespace of the group is kept"`
+}
+
+// GET /approvals
+type ApprovalListParameters struct {
+	Status string `form:"status" default:"Pending" enum:"Pending,Approved,Rejected"`
+}
+
+// POST /approvals/{id}/{decision} and POST /lab/{labName}/quota-requests/{id}/{decision}
+type DecisionParameters struct {
+	Comment string `form:"comment" description:"e.g. why it was rejected"`
+}
+
+// GET /artifacts
+type ArtifactListParameters struct {
+	Field string `form:"field" description:"only the uploads of this file, e.g. config or values"`
+}
+
+// GET /archives
+type ArchiveListParameters struct {
+	Lab string `form:"lab" description:"only the archives of this lab"`
+}
+
+// GET and POST /lti/login
+type LtiLoginParameters struct {
+	Iss            string `form:"iss" required:"true" description:"the issuer of the platform"`
+	LoginHint      string `form:"login_hint" required:"true"`
+	TargetLinkUri  string `form:"target_link_uri" required:"true" description:"the launch endpoint"`
+	LtiMessageHint string `form:"lti_message_hint"`
+	ClientId       string `form:"client_id" description:"required when ScaLaMa has multiple registrations on the platform"`
+}
+
+// POST /lti/launch
+type LtiLaunchParameters struct {
+	IdToken string `form:"id_token" required:"true"`
+	State   string `form:"state" required:"true"`
+}
+
+// POST /lab/{labName}/announcements
+type AnnouncementParameters struct {
+	Message string `form:"message" required:"true" description:"e.g. \"Re-pull the image of exercise 2\""`
+	Motd    bool   `form:"motd" description:"shows the announcement as message of the day in the portal"`
+}
+
+// POST /lab/{labName}/students/{username}/quota/requests
+type QuotaRequestParameters struct {
+	Resources string `form:"resources" required:"true" description:"the requested limits, e.g. \"requests.cpu=4,limits.memory=8Gi\""`
+	Quota     string `form:"quota" description:"the name of the ResourceQuota, required if the namespace has multiple quotas"`
+	Reason    string `form:"reason"`
+}
+
+// GET /lab/{labName}/quota-requests
+type QuotaRequestListParameters struct {
+	Status string `form:"status" default:"Pending" enum:"Pending,Approved,Denied"`
+}
+
+// GET /lab/{labName}/alerts
+type AlertListParameters struct {
+	Kind     string `form:"kind" enum:"token-ips,privilege-escalation,unexpected-registry"`
+	Username string `form:"username" description:"only the alerts of this user"`
+}
+
+// POST /lab/{labName}/notifications
+type SubscriptionParameters struct {
+	Instructor string   `form:"instructor" required:"true" description:"e.g. the username of the instructor"`
+	Channel    string   `form:"channel" required:"true" enum:"EMAIL,SLACK,TEAMS,WEBHOOK"`
+	Target     string   `form:"target" required:"true" description:"the email address or the URL of the (incoming) webhook"`
+	Events     []string `form:"events" enum:"alert,lab-deleted,pod-terminated,quota-request" description:"default every event"`
+}
+
+// DELETE /lab/{labName}/notifications/{instructor}
+type UnsubscribeParameters struct {
+	Channel string `form:"channel" description:"only unsubscribes from this channel"`
+}
+
+// POST /lab/{labName}/spectators
+type SpectatorParameters struct {
+	Name     string `form:"name" required:"true" description:"a DNS label"`
+	Duration string `form:"duration" default:"8h" description:"at least 10m"`
+}
+
+var formFileType = reflect.TypeOf(FormFile(false))
+
+/*
+Decodes the form (or query) of a request into the fields of parameters, a pointer to a struct of parameters. The OpenAPI document
+is generated from the same structs, so it documents exactly what the handlers read.
+A field is a parameter if it has a form tag, embedded structs add their parameters. Requests without a parameter with tag required
+are rejected (parameters that are only required sometimes say so in their description), tag default is the value of a parameter
+that is not sent, tag enum has the comma-separated values a parameter (or every item of a list) must be one of, and tag description
+describes it in the OpenAPI document.
+Parameters are strings, bools (true when "true"), non-negative ints (nil when not sent), comma-separated lists or files.
+Every parameter is decoded, the first invalid parameter is returned as error.
+*/
+func decodeForm(r *http.Request, parameters interface{}) *Error {
+	return decodeFormStruct(r, reflect.ValueOf(parameters).Elem())
+}
+
+func decodeFormStruct(r *http.Request, parameters reflect.Value) *Error {
+	var result *Error
+
+	for i := 0; i < parameters.NumField(); i++ {
+		field := parameters.Type().Field(i)
+
+		var e *Error
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			e = decodeFormStruct(r, parameters.Field(i))
+		} else if name := field.Tag.Get("form"); name != "" {
+			e = decodeFormField(r, field, name, parameters.Field(i))
+		}
+
+		if result == nil {
+			result = e
+		}
+	}
+
+	return result
+}
+
+func decodeFormField(r *http.Request, field reflect.StructField, name string, value reflect.Value) *Error {
+	if field.Type == formFileType {
+		_, _, err := r.FormFile(name)
+		value.SetBool(err == nil || r.FormValue(name+"Digest") != "")
+		return nil
+	}
+
+	formValue := r.FormValue(name)
+	if strings.TrimSpace(formValue) == "" {
+		if field.Tag.Get("required") == "true" {
+			return &Error{status: http.StatusBadRequest, message: name + " is required"}
+		}
+		if formValue == "" {
+			formValue = field.Tag.Get("default")
+		}
+	}
+
+	var enum []string
+	if values := field.Tag.Get("enum"); values != "" {
+		enum = strings.Split(values, ",")
+	}
+
+	switch field.Type.Kind() {
+	case reflect.String:
+		if formValue != "" && enum != nil && !contains(enum, formValue) {
+			return &Error{status: http.StatusBadRequest, message: name + " must be one of " + strings.Join(enum, ", ")}
+		}
+		value.SetString(formValue)
+	case reflect.Bool:
+		if formValue == "" {
+			return nil
+		}
+
+		enabled, err := strconv.ParseBool(formValue)
+		if err != nil {
+			return &Error{status: http.StatusBadRequest, message: name + " must be true or false"}
+		}
+		value.SetBool(enabled)
+	case reflect.Ptr:
+		if formValue == "" {
+			return nil
+		}
+
+		number, err := strconv.Atoi(formValue)
+		if err != nil || number < 0 {
+			return &Error{status: http.StatusBadRequest, message: name + " must be a positive number"}
+		}
+		value.Set(reflect.ValueOf(&number))
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(formValue, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+
+			if enum != nil && !contains(enum, item) {
+				return &Error{status: http.StatusBadRequest, message: name + " must be one of " + strings.Join(enum, ", ")}
+			}
+			list = append(list, item)
+		}
+		value.Set(reflect.ValueOf(list))
+	}
+
+	return nil
+}
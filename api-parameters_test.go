@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newFormRequest(form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestDecodeForm(t *testing.T) {
+	var parameters LabParameters
+	e := decodeForm(newFormRequest(url.Values{"deploymentMode": {"YAML"}, "isHybrid": {"true"}, "priority": {"exam"}}), &parameters)
+	if e != nil {
+		t.Fatal(e.message)
+	}
+
+	if parameters.DeploymentMode != "YAML" || !parameters.IsHybrid || parameters.Priority != "exam" {
+		t.Fatalf("expected the sent parameters, got %+v", parameters)
+	}
+
+	// Parameters that are not sent get their default
+	if !parameters.IsIndividual || parameters.Format != "token" || parameters.RosterSource != "CSV" {
+		t.Fatalf("expected the defaults of the parameters, got %+v", parameters)
+	}
+}
+
+func TestDecodeFormRejectsInvalidParameters(t *testing.T) {
+	tests := map[string]struct {
+		form       url.Values
+		parameters interface{}
+		message    string
+	}{
+		"required":  {url.Values{}, &ManifestParameters{}, "deploymentMode is required"},
+		"blank":     {url.Values{"message": {"  "}}, &AnnouncementParameters{}, "message is required"},
+		"enum":      {url.Values{"deploymentMode": {"HELM"}}, &ManifestParameters{}, "deploymentMode must be one of CHART, CHART_URL, KUSTOMIZE, PRESET, YAML"},
+		"list enum": {url.Values{"instructor": {"ann"}, "channel": {"EMAIL"}, "target": {"ann@example.com"}, "events": {"alert,unknown"}}, &SubscriptionParameters{}, "events must be one of alert, lab-deleted, pod-terminated, quota-request"},
+		"number":    {url.Values{"into": {"-1"}}, &GroupMergeParameters{}, "into must be a positive number"},
+		"bool":      {url.Values{"skipHooks": {"yes"}}, &LabDeletionParameters{}, "skipHooks must be true or false"},
+	}
+
+	for name, test := range tests {
+		e := decodeForm(newFormRequest(test.form), test.parameters)
+		if e == nil || e.status != http.StatusBadRequest || e.message != test.message {
+			t.Errorf("%s: expected %q, got %+v", name, test.message, e)
+		}
+	}
+}
+
+func TestDecodeFormLists(t *testing.T) {
+	var parameters TokenIssuanceParameters
+	if e := decodeForm(newFormRequest(url.Values{"usernames": {"ann-lee, ,bob-ray"}}), &parameters); e != nil {
+		t.Fatal(e.message)
+	}
+
+	if !reflect.DeepEqual(parameters.Usernames, []string{"ann-lee", "bob-ray"}) {
+		t.Fatalf("expected the usernames without empty items, got %v", parameters.Usernames)
+	}
+}
+
+func getParameterEnum(t *testing.T, parameters interface{}, name string) []string {
+	schemas, _ := getParameterSchemas(reflect.TypeOf(parameters))
+	schema, ok := schemas[name].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected parameter %s", name)
+	}
+
+	enum, _ := schema["enum"].([]string)
+	enum = append([]string(nil), enum...)
+	sort.Strings(enum)
+	return enum
+}
+
+func getSortedKeys[T any](values map[string]T) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// The enums of the parameters are the values the handlers support
+func TestParameterEnums(t *testing.T) {
+	sorted := func(values ...string) []string {
+		values = append([]string(nil), values...)
+		sort.Strings(values)
+		return values
+	}
+
+	tests := map[string]struct {
+		enum     []string
+		expected []string
+	}{
+		"deploymentMode": {getParameterEnum(t, ManifestParameters{}, "deploymentMode"), getDeploymentModes()},
+		"rosterSource":   {getParameterEnum(t, RosterParameters{}, "rosterSource"), getRosterSources()},
+		"format":         {getParameterEnum(t, CredentialsParameters{}, "format"), sorted(credentialsFormats...)},
+		"priority":       {getParameterEnum(t, ProvisioningParameters{}, "priority"), sorted(priorities...)},
+		"notifyChannel":  {getParameterEnum(t, ApprovalNotifyParameters{}, "notifyChannel"), getSortedKeys(newNotifiers())},
+		"channel":        {getParameterEnum(t, SubscriptionParameters{}, "channel"), getSortedKeys(newNotifiers())},
+		"kind":           {getParameterEnum(t, AlertListParameters{}, "kind"), sorted(alertTokenIps, alertPrivilegeEscalation, alertUnexpectedRegistry)},
+		"approvals":      {getParameterEnum(t, ApprovalListParameters{}, "status"), sorted(labApprovalPending, labApprovalApproved, labApprovalRejected)},
+		"quota requests": {getParameterEnum(t, QuotaRequestListParameters{}, "status"), sorted(quotaRequestPending, quotaRequestApproved, quotaRequestDenied)},
+	}
+
+	for name, test := range tests {
+		if !reflect.DeepEqual(test.enum, test.expected) {
+			t.Errorf("%s: expected enum %v, got %v", name, test.expected, test.enum)
+		}
+	}
+
+	events := reflect.TypeOf(SubscriptionParameters{})
+	field, _ := events.FieldByName("Events")
+	if !reflect.DeepEqual(sorted(strings.Split(field.Tag.Get("enum"), ",")...), sorted(notificationEvents...)) {
+		t.Errorf("events: expected enum %v, got %s", notificationEvents, field.Tag.Get("enum"))
+	}
+}
+
+func TestOpenApiRequestBody(t *testing.T) {
+	s := newServer(getFakeClientSet())
+	document, err := s.getOpenApiDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merge := document["paths"].(map[string]interface{})["/lab/{labName}/groups/{groupNumber}/merge"].(map[string]interface{})["post"].(map[string]interface{})
+	schema := merge["requestBody"].(map[string]interface{})["content"].(map[string]interface{})["application/x-www-form-urlencoded"].(map[string]interface{})["schema"].(map[string]interface{})
+
+	if !reflect.DeepEqual(schema["required"], []string{"into"}) {
+		t.Errorf("expected into to be required, got %v", schema["required"])
+	}
+
+	properties := schema["properties"].(map[string]interface{})
+	if properties["into"].(map[string]interface{})["type"] != "integer" || properties["gracePeriod"].(map[string]interface{})["default"] != "24h" {
+		t.Errorf("expected the schemas of the parameters of GroupMergeParameters, got %v", properties)
+	}
+
+	// Operations with files are multipart
+	lab := document["paths"].(map[string]interface{})["/lab"].(map[string]interface{})["post"].(map[string]interface{})
+	if _, ok := lab["requestBody"].(map[string]interface{})["content"].(map[string]interface{})["multipart/form-data"]; !ok {
+		t.Errorf("expected POST /lab to be multipart, got %v", lab["requestBody"])
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A rendered chart and the moment it stops being valid
+type cachedManifest struct {
+	manifest  string
+	expiresAt time.Time
+}
+
+// The rendered charts of a server, by chart digest
+type manifestCache struct {
+	sync.Mutex
+	manifests map[string]cachedManifest
+}
+
+/*
+Returns how long a rendered chart is cached, configured by SCALAMA_CHART_CACHE_TTL (e.g. "30m").
+Caching is disabled when the TTL is 0.
+*/
+func getChartCacheTtl() (time.Duration, error) {
+	value := os.Getenv("SCALAMA_CHART_CACHE_TTL")
+	if value == "" {
+		return time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+/*
+Returns the digest of a chart (the archive or its URL) combined with the values profile and values it is rendered with.
+*/
+func getChartDigest(chartSource []byte, profile string, values map[string]interface{}) (string, error) {
+	// Maps are encoded with sorted keys, so equal values always have the same encoding
+	encodedValues, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(chartSource)
+	hash.Write([]byte{0})
+	hash.Write([]byte(profile))
+	hash.Write([]byte{0})
+	hash.Write(encodedValues)
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+Returns the rendered manifest of a chart digest, if it is cached and not expired.
+*/
+func (s *Server) getCachedManifest(ctx context.Context, digest string) (string, bool) {
+	s.chartCache.Lock()
+	cached, ok := s.chartCache.manifests[digest]
+	if ok && time.Now().After(cached.expiresAt) {
+		delete(s.chartCache.manifests, digest)
+		ok = false
+	}
+	s.chartCache.Unlock()
+
+	if !ok {
+		return s.getStoredManifest(ctx, digest)
+	}
+
+	return cached.manifest, true
+}
+
+/*
+Caches the rendered manifest of a chart digest. Expired manifests are removed at the same time.
+*/
+func (s *Server) cacheManifest(ctx context.Context, digest string, manifest string) error {
+	ttl, err := getChartCacheTtl()
+	if err != nil {
+		return err
+	}
+
+	// Other replicas find the manifest in the object store
+	if ttl > 0 && s.objectStore != nil {
+		ctx, cancel := withOperationTimeout(ctx)
+		defer cancel()
+
+		if err := s.objectStore.putObject(ctx, getChartCacheKey(digest), []byte(manifest), "text/yaml"); err != nil {
+			fmt.Println("Something went wrong while storing rendered chart "+digest+":", err)
+		}
+	}
+
+	s.chartCache.Lock()
+	defer s.chartCache.Unlock()
+
+	now := time.Now()
+	for key, cached := range s.chartCache.manifests {
+		if now.After(cached.expiresAt) {
+			delete(s.chartCache.manifests, key)
+		}
+	}
+
+	if ttl > 0 {
+		s.chartCache.manifests[digest] = cachedManifest{manifest: manifest, expiresAt: now.Add(ttl)}
+	}
+
+	return nil
+}
+
+/*
+Returns the key of a rendered chart in the object store.
+*/
+func getChartCacheKey(digest string) string {
+	return "charts/" + digest + ".yaml"
+}
+
+/*
+Returns the rendered manifest of a chart digest from the object store, if it was stored less than the TTL ago.
+The manifest is cached in memory again for the rest of its TTL.
+*/
+func (s *Server) getStoredManifest(ctx context.Context, digest string) (string, bool) {
+	if s.objectStore == nil {
+		return "", false
+	}
+
+	ttl, err := getChartCacheTtl()
+	if err != nil || ttl <= 0 {
+		return "", false
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	data, storedAt, err := s.objectStore.getObject(ctx, getChartCacheKey(digest))
+	if err != nil || time.Since(storedAt) > ttl {
+		return "", false
+	}
+
+	s.chartCache.Lock()
+	s.chartCache.manifests[digest] = cachedManifest{manifest: string(data), expiresAt: storedAt.Add(ttl)}
+	s.chartCache.Unlock()
+
+	return string(data), true
+}
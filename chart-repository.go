@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// A repository index and the moment it was downloaded
+type cachedIndex struct {
+	index     *repo.IndexFile
+	fetchedAt time.Time
+}
+
+// The downloaded indexes of chart repositories, by repository URL
+type repositoryIndexCache struct {
+	sync.Mutex
+	indexes map[string]cachedIndex
+}
+
+/*
+Returns how long repository indexes and downloaded charts are used before they are downloaded again, configured by
+SCALAMA_CHART_REPOSITORY_CACHE_TTL (default 10m). With a TTL of 0 they are downloaded every time, but cached copies are still
+used while the repository is unreachable.
+*/
+func getChartRepositoryCacheTtl() (time.Duration, error) {
+	value := os.Getenv("SCALAMA_CHART_REPOSITORY_CACHE_TTL")
+	if value == "" {
+		return 10 * time.Minute, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("SCALAMA_CHART_REPOSITORY_CACHE_TTL must be a duration of at least 0, e.g. 10m")
+	}
+
+	return ttl, nil
+}
+
+/*
+Returns the directory downloaded indexes and charts are cached in, configured by SCALAMA_CHART_REPOSITORY_CACHE_DIR.
+*/
+func getChartRepositoryCacheDir() string {
+	if dir := os.Getenv("SCALAMA_CHART_REPOSITORY_CACHE_DIR"); dir != "" {
+		return dir
+	}
+
+	return filepath.Join(os.TempDir(), "scalama-chart-repositories")
+}
+
+/*
+Returns the path a download is cached at, named after the digest of its URL with the extension of the URL.
+*/
+func getChartRepositoryCachePath(fileUrl string) string {
+	// The provenance file of a chart is cached next to the chart, where VerifyChart looks for it
+	if chartUrl := strings.TrimSuffix(fileUrl, ".prov"); chartUrl != fileUrl {
+		return getChartRepositoryCachePath(chartUrl) + ".prov"
+	}
+
+	extension := ""
+	if parsedUrl, err := url.Parse(fileUrl); err == nil {
+		extension = path.Ext(parsedUrl.Path)
+	}
+
+	digest := sha256.Sum256([]byte(fileUrl))
+	return filepath.Join(getChartRepositoryCacheDir(), hex.EncodeToString(digest[:])+extension)
+}
+
+/*
+Downloads a file (an index, a chart or its provenance file) to the cache, unless it was downloaded less than the TTL ago.
+When the download fails, e.g. during an outage of the repository, a file that was downloaded before is used anyway.
+Returns the path of the cached file.
+*/
+func fetchCachedFile(ctx context.Context, fileUrl string) (string, error) {
+	ttl, err := getChartRepositoryCacheTtl()
+	if err != nil {
+		return "", err
+	}
+
+	cachePath := getChartRepositoryCachePath(fileUrl)
+	info, statErr := os.Stat(cachePath)
+	if statErr == nil && time.Since(info.ModTime()) < ttl {
+		return cachePath, nil
+	}
+
+	data, err := downloadChartFile(ctx, fileUrl)
+	if err != nil {
+		if statErr == nil {
+			fmt.Println("Something went wrong while downloading "+fileUrl+", the copy of "+info.ModTime().Format(time.RFC3339)+" is used:", err)
+			return cachePath, nil
+		}
+
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+		return "", err
+	}
+
+	// Other requests never read a partially written file
+	temp, err := os.CreateTemp(filepath.Dir(cachePath), ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return cachePath, os.Rename(temp.Name(), cachePath)
+}
+
+/*
+Downloads a file with the getter Helm uses for the scheme of its URL.
+*/
+func downloadChartFile(ctx context.Context, fileUrl string) ([]byte, error) {
+	parsedUrl, err := url.Parse(fileUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	chartGetter, err := getter.All(cli.New()).ByScheme(parsedUrl.Scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := chartGetter.Get(fileUrl, getter.WithTimeout(getContextOperationTimeout(ctx)))
+	if err != nil {
+		return nil, err
+	}
+
+	return data.Bytes(), nil
+}
+
+/*
+Returns the index of a chart repository, read from the cache while it is younger than the TTL.
+*/
+func (s *Server) getRepositoryIndex(ctx context.Context, repositoryUrl string) (*repo.IndexFile, error) {
+	ttl, err := getChartRepositoryCacheTtl()
+	if err != nil {
+		return nil, err
+	}
+
+	s.chartRepositoryCache.Lock()
+	cached, ok := s.chartRepositoryCache.indexes[repositoryUrl]
+	s.chartRepositoryCache.Unlock()
+	if ok && time.Since(cached.fetchedAt) < ttl {
+		return cached.index, nil
+	}
+
+	indexPath, err := fetchCachedFile(ctx, strings.TrimSuffix(repositoryUrl, "/")+"/index.yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := repo.LoadIndexFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s.chartRepositoryCache.Lock()
+	s.chartRepositoryCache.indexes[repositoryUrl] = cachedIndex{index: index, fetchedAt: time.Now()}
+	s.chartRepositoryCache.Unlock()
+
+	return index, nil
+}
+
+/*
+Returns the URL of a version of a chart in a repository, the latest version when version is empty (or a semver range, e.g. ^1.2).
+*/
+func (s *Server) getRepositoryChartUrl(ctx context.Context, repositoryUrl string, chartName string, version string) (string, error) {
+	index, err := s.getRepositoryIndex(ctx, repositoryUrl)
+	if err != nil {
+		return "", err
+	}
+
+	chartVersion, err := index.Get(chartName, version)
+	if err != nil {
+		return "", fmt.Errorf("chart %s %s is not in repository %s", chartName, version, repositoryUrl)
+	}
+
+	if len(chartVersion.URLs) == 0 {
+		return "", fmt.Errorf("chart %s %s of repository %s has no download URL", chartName, chartVersion.Version, repositoryUrl)
+	}
+
+	return repo.ResolveReferenceURL(repositoryUrl, chartVersion.URLs[0])
+}
+
+/*
+Downloads a chart archive to the cache and returns its path. With a keyring its provenance file is downloaded as well,
+and the chart is only returned when its signature is valid.
+*/
+func getCachedChart(ctx context.Context, chartUrl string, keyring string) (string, error) {
+	chartPath, err := fetchCachedFile(ctx, chartUrl)
+	if err != nil {
+		return "", err
+	}
+
+	if keyring == "" {
+		return chartPath, nil
+	}
+
+	if _, err := fetchCachedFile(ctx, chartUrl+".prov"); err != nil {
+		return "", err
+	}
+
+	if _, err := downloader.VerifyChart(chartPath, keyring); err != nil {
+		return "", err
+	}
+
+	return chartPath, nil
+}
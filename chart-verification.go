@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+)
+
+/*
+Checks whether charts located by their URL must be signed, which is the case once a keyring (SCALAMA_CHART_KEYRING)
+or a cosign key (SCALAMA_COSIGN_KEY) is configured.
+*/
+func isChartVerificationEnabled() bool {
+	return os.Getenv("SCALAMA_CHART_KEYRING") != "" || os.Getenv("SCALAMA_COSIGN_KEY") != ""
+}
+
+/*
+Returns the keyring (SCALAMA_CHART_KEYRING) the provenance file of a chart in a chart repository is verified against.
+*/
+func getChartKeyring(chartUrl string) (string, *Error) {
+	keyring := os.Getenv("SCALAMA_CHART_KEYRING")
+	if keyring == "" {
+		return "", &Error{status: http.StatusBadRequest, message: "Chart " + chartUrl + " can't be verified, only OCI charts signed with cosign are allowed"}
+	}
+
+	return keyring, nil
+}
+
+/*
+Configures the install action to verify the provenance file (.prov) of a chart in a chart repository against the keyring
+configured by SCALAMA_CHART_KEYRING, like helm install --verify.
+*/
+func setChartVerification(iCli *action.Install, chartUrl string) *Error {
+	keyring, e := getChartKeyring(chartUrl)
+	if e != nil {
+		return e
+	}
+
+	iCli.ChartPathOptions.Verify = true
+	iCli.ChartPathOptions.Keyring = keyring
+
+	return nil
+}
+
+/*
+Verifies the signature of a chart in an OCI registry with cosign and the key configured by SCALAMA_COSIGN_KEY
+(a file, a KMS URI or a k8s://<namespace>/<secret> reference).
+*/
+func verifyOciChart(ctx context.Context, chartUrl string) *Error {
+	key := os.Getenv("SCALAMA_COSIGN_KEY")
+	if key == "" {
+		return &Error{status: http.StatusBadRequest, message: "Chart " + chartUrl + " can't be verified, only charts with a provenance file are allowed"}
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "cosign", "verify", "--key", key, strings.TrimPrefix(chartUrl, "oci://")).CombinedOutput()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return &Error{status: http.StatusInternalServerError, message: "cosign must be installed to verify OCI charts"}
+		}
+
+		return &Error{status: http.StatusBadRequest, message: "The signature of chart " + chartUrl + " could not be verified:\n" + string(output)}
+	}
+
+	return nil
+}
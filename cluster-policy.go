@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Names of the ResourceQuota and NetworkPolicy the cluster policy creates in every student (and group) namespace
+const (
+	clusterPolicyQuotaName         = "cluster-policy-quota"
+	clusterPolicyNetworkPolicyName = "cluster-policy-network"
+)
+
+// Label the Pod Security admission controller enforces the level of a namespace with
+const podSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+
+var podSecurityLevels = []string{"privileged", "baseline", "restricted"}
+
+// Every verb of the Kubernetes API, a wildcard in a rule is expanded to these when a verb is forbidden
+var policyVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete", "deletecollection", "use", "bind", "escalate", "impersonate", "approve", "sign"}
+
+// The baseline cluster admins set for every lab, whatever the instructor asks for
+type ClusterPolicy struct {
+	QuotaFloor       map[string]string               `json:"quotaFloor,omitempty"`
+	QuotaCeiling     map[string]string               `json:"quotaCeiling,omitempty"`
+	NetworkPolicy    *networkingv1.NetworkPolicySpec `json:"networkPolicy,omitempty"`
+	ForbiddenVerbs   []string                        `json:"forbiddenVerbs,omitempty"`
+	PodSecurityLevel string                          `json:"podSecurityLevel,omitempty"`
+}
+
+/*
+Reads the cluster policy from the file configured by SCALAMA_CLUSTER_POLICY, e.g.
+{quotaFloor: {pods: "2"}, quotaCeiling: {requests.cpu: "4"}, networkPolicy: {podSelector: {}, policyTypes: [Ingress], ingress: [{from: [{podSelector: {}}]}]},
+forbiddenVerbs: [escalate, bind, impersonate], podSecurityLevel: baseline}
+*/
+func loadClusterPolicy() (*ClusterPolicy, error) {
+	path := os.Getenv("SCALAMA_CLUSTER_POLICY")
+	if path == "" {
+		return &ClusterPolicy{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &ClusterPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, err
+	}
+
+	for name, value := range policy.QuotaFloor {
+		floor, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("the quota floor of %s is not a quantity", name)
+		}
+
+		if ceiling, ok := policy.QuotaCeiling[name]; ok {
+			if ceilingQuantity, err := resource.ParseQuantity(ceiling); err == nil && floor.Cmp(ceilingQuantity) > 0 {
+				return nil, fmt.Errorf("the quota floor of %s is higher than its ceiling", name)
+			}
+		}
+	}
+
+	for name, value := range policy.QuotaCeiling {
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return nil, fmt.Errorf("the quota ceiling of %s is not a quantity", name)
+		}
+	}
+
+	for _, verb := range policy.ForbiddenVerbs {
+		if !contains(policyVerbs, verb) {
+			return nil, fmt.Errorf("forbidden verb %q is not a verb of the Kubernetes API", verb)
+		}
+	}
+
+	if policy.PodSecurityLevel != "" && !contains(podSecurityLevels, policy.PodSecurityLevel) {
+		return nil, fmt.Errorf("podSecurityLevel must be one of privileged, baseline or restricted")
+	}
+
+	return policy, nil
+}
+
+/*
+Returns the labels the cluster policy puts on every namespace of a lab, nil without a pod security level.
+*/
+func (policy *ClusterPolicy) getNamespaceLabels() map[string]string {
+	if policy.PodSecurityLevel == "" {
+		return nil
+	}
+
+	return map[string]string{podSecurityEnforceLabel: policy.PodSecurityLevel}
+}
+
+/*
+Removes the forbidden verbs from RBAC rules, wildcard verbs are expanded to every verb that isn't forbidden.
+Rules that have no verbs left are dropped.
+*/
+func (policy *ClusterPolicy) restrictRules(rules []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	if len(policy.ForbiddenVerbs) == 0 {
+		return rules
+	}
+
+	var restricted []rbacv1.PolicyRule
+	for _, rule := range rules {
+		verbs := rule.Verbs
+		if contains(verbs, rbacv1.VerbAll) {
+			verbs = policyVerbs
+		}
+
+		var allowed []string
+		for _, verb := range verbs {
+			if !contains(policy.ForbiddenVerbs, verb) {
+				allowed = append(allowed, verb)
+			}
+		}
+
+		if len(allowed) > 0 {
+			rule = *rule.DeepCopy()
+			rule.Verbs = allowed
+			restricted = append(restricted, rule)
+		}
+	}
+
+	return restricted
+}
+
+/*
+Changes an object of the manifest according to the cluster policy: the hard limits of ResourceQuotas are kept between the floor
+and the ceiling, and the forbidden verbs are removed from Roles and ClusterRoles.
+*/
+func (policy *ClusterPolicy) applyToObject(obj *unstructured.Unstructured) {
+	switch obj.GetKind() {
+	case "ResourceQuota":
+		hard, found, _ := unstructured.NestedStringMap(obj.Object, "spec", "hard")
+		if !found {
+			return
+		}
+
+		for name, value := range hard {
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil {
+				continue
+			}
+
+			if floor, ok := policy.QuotaFloor[name]; ok && quantity.Cmp(resource.MustParse(floor)) < 0 {
+				hard[name] = floor
+			}
+			if ceiling, ok := policy.QuotaCeiling[name]; ok && quantity.Cmp(resource.MustParse(ceiling)) > 0 {
+				hard[name] = ceiling
+			}
+		}
+
+		unstructured.SetNestedStringMap(obj.Object, hard, "spec", "hard")
+	case "Role", "ClusterRole":
+		if len(policy.ForbiddenVerbs) == 0 {
+			return
+		}
+
+		var role rbacv1.ClusterRole
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &role); err != nil {
+			return
+		}
+
+		rules, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&rbacv1.ClusterRole{Rules: policy.restrictRules(role.Rules)})
+		if err != nil {
+			return
+		}
+
+		if rules["rules"] == nil {
+			unstructured.RemoveNestedField(obj.Object, "rules")
+			return
+		}
+		obj.Object["rules"] = rules["rules"]
+	}
+}
+
+/*
+Creates the quota ceiling and the required NetworkPolicy of the cluster policy in a student (or group) namespace.
+*/
+func (s *Server) applyClusterPolicy(ctx context.Context, clientset kubernetes.Interface, namespace string) *Error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	labels := map[string]string{managedByLabel: managedByLabelVal}
+
+	if len(s.clusterPolicy.QuotaCeiling) > 0 {
+		hard := corev1.ResourceList{}
+		for name, value := range s.clusterPolicy.QuotaCeiling {
+			hard[corev1.ResourceName(name)] = resource.MustParse(value)
+		}
+
+		quota := &corev1.ResourceQuota{
+			TypeMeta:   v1.TypeMeta{APIVersion: "v1", Kind: "ResourceQuota"},
+			ObjectMeta: v1.ObjectMeta{Name: clusterPolicyQuotaName, Namespace: namespace, Labels: labels},
+			Spec:       corev1.ResourceQuotaSpec{Hard: hard},
+		}
+
+		if _, err := clientset.CoreV1().ResourceQuotas(namespace).Create(ctx, quota, v1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating the quota of the cluster policy for namespace " + namespace}
+		}
+	}
+
+	if s.clusterPolicy.NetworkPolicy != nil {
+		networkPolicy := &networkingv1.NetworkPolicy{
+			TypeMeta:   v1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy"},
+			ObjectMeta: v1.ObjectMeta{Name: clusterPolicyNetworkPolicyName, Namespace: namespace, Labels: labels},
+			Spec:       *s.clusterPolicy.NetworkPolicy,
+		}
+
+		if _, err := clientset.NetworkingV1().NetworkPolicies(namespace).Create(ctx, networkPolicy, v1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating the NetworkPolicy of the cluster policy for namespace " + namespace}
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns the cluster policy every lab is held to, so instructors know the limits before they create a lab.
+*/
+func (s *Server) getClusterPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.clusterPolicy)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+)
+
+// Verbs the students need on the objects of their own namespace, and on the shared objects of the lab namespace
+var (
+	studentObjectVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+	sharedObjectVerbs  = []string{"get", "list", "watch"}
+)
+
+/*
+Returns the user that is impersonated to act as a subject of a RoleBinding.
+A group can't be impersonated on its own, so it is impersonated as an anonymous member.
+*/
+func getSubjectUser(subject rbacv1.Subject) *authenticationv1.UserInfo {
+	switch subject.Kind {
+	case "ServiceAccount":
+		return &authenticationv1.UserInfo{
+			Username: "system:serviceaccount:" + subject.Namespace + ":" + subject.Name,
+			Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:" + subject.Namespace, "system:authenticated"},
+		}
+	case "Group":
+		return &authenticationv1.UserInfo{
+			Username: "scalama:access-review",
+			Groups:   []string{subject.Name, "system:authenticated"},
+		}
+	default:
+		return &authenticationv1.UserInfo{
+			Username: subject.Name,
+			Groups:   []string{"system:authenticated"},
+		}
+	}
+}
+
+/*
+Returns the verbs of a resource the user in ctx is not allowed to use inside of a namespace, according to a SelfSubjectAccessReview.
+*/
+func getDeniedVerbs(ctx context.Context, clientset kubernetes.Interface, resource string, group string, namespace string, verbs []string) ([]string, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	var denied []string
+	for _, verb := range verbs {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      verb,
+					Group:     group,
+					Resource:  resource,
+				},
+			},
+		}
+
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, v1.CreateOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		if !review.Status.Allowed {
+			denied = append(denied, verb)
+		}
+	}
+
+	return denied, nil
+}
+
+/*
+Simulates whether a subject of a student namespace can manage the objects of the manifest in that namespace,
+and read the shared objects in the lab namespace, by impersonating the subject. The roles have to exist already.
+Returns a warning for every resource the subject can't fully use.
+*/
+func reviewStudentAccess(ctx context.Context, clientset kubernetes.Interface, labName string, namespace string, subject rbacv1.Subject, objects []*unstructured.Unstructured) ([]string, error) {
+	gr, err := restmapper.GetAPIGroupResources(clientset.Discovery())
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(gr)
+
+	ctx = context.WithValue(ctx, impersonatedUserKey{}, getSubjectUser(subject))
+
+	// Every resource is only reviewed once per namespace
+	reviewed := make(map[string]bool)
+	var warnings []string
+
+	for _, unstructuredObj := range objects {
+		gvk := unstructuredObj.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil || mapping.Scope.Name() != meta.RESTScopeNameNamespace || isSharedExternal(unstructuredObj) {
+			// Unknown kinds fail on deployment anyway, cluster-scoped and shared external objects are not managed by students
+			continue
+		}
+
+		objectNamespace, verbs := namespace, studentObjectVerbs
+		if isSingleInstance(unstructuredObj.Object) {
+			objectNamespace, verbs = "ns-"+labName, sharedObjectVerbs
+		}
+
+		resource := mapping.Resource.GroupResource().String()
+		if reviewed[objectNamespace+"/"+resource] {
+			continue
+		}
+		reviewed[objectNamespace+"/"+resource] = true
+
+		denied, err := getDeniedVerbs(ctx, clientset, mapping.Resource.Resource, mapping.Resource.Group, objectNamespace, verbs)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(denied) > 0 {
+			warnings = append(warnings, subject.Kind+" "+subject.Name+" cannot "+strings.Join(denied, ", ")+" "+resource+" in namespace "+objectNamespace)
+		}
+	}
+
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
+/*
+Formats a warning as the value of a Warning HTTP header, like the warnings of the Kubernetes API.
+*/
+func getWarningHeader(warning string) string {
+	return "299 - " + strconv.Quote(warning)
+}
+
+/*
+Reviews the access of the students of new namespaces to the objects of the manifest, once for every role.
+Returns the warnings for the instructor, the review itself failing is also only a warning.
+*/
+func reviewLabAccess(ctx context.Context, clientset kubernetes.Interface, labName string, namespaces []string, namespaceStudents map[string][]Student, options *LabOptions, objects []*unstructured.Unstructured) []string {
+	// Nothing is persisted in dry-run mode, so the roles can't be reviewed
+	if *dryRunMode {
+		return nil
+	}
+
+	reviewedRoles := make(map[string]bool)
+	var warnings []string
+
+	for _, namespace := range namespaces {
+		username := strings.TrimPrefix(namespace, "ns-"+labName+"-")
+
+		for role, roleStudents := range getStudentsPerRole(namespaceStudents[namespace]) {
+			if reviewedRoles[role] {
+				continue
+			}
+			reviewedRoles[role] = true
+
+			subjects := getNamespaceSubjects(username, namespace, roleStudents, options)
+			if len(subjects) == 0 {
+				continue
+			}
+
+			roleWarnings, err := reviewStudentAccess(ctx, clientset, labName, namespace, subjects[0], objects)
+			if err != nil {
+				warnings = append(warnings, "The access of "+username+" to the objects of the manifest could not be reviewed")
+				continue
+			}
+			warnings = append(warnings, roleWarnings...)
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// What students keep of their namespace outside the access windows of a lab
+const (
+	closedAccessReadOnly = "read-only"
+	closedAccessNone     = "none"
+)
+
+var closedAccesses = []string{closedAccessReadOnly, closedAccessNone}
+
+// Annotation on a closed student RoleBinding with the role and subjects it gets back when the lab opens again
+const openBindingAnnotation = "scalama.io/open-binding"
+
+// How often the access windows of every lab are enforced
+const accessWindowInterval = time.Minute
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// The days of the week and the hours (in minutes since midnight) in which students have access
+type accessWindow struct {
+	days  map[time.Weekday]bool
+	start int
+	end   int
+}
+
+// The role and subjects of an open student RoleBinding
+type openBinding struct {
+	RoleRef  rbacv1.RoleRef   `json:"roleRef"`
+	Subjects []rbacv1.Subject `json:"subjects"`
+}
+
+/*
+Parses a time of day (08:00, 24:00 for the end of the day) to minutes since midnight.
+*/
+func parseTimeOfDay(value string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("%s is not a time of day", value)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+/*
+Parses an access window of the form "<days> <start>-<end>", e.g. "mon-fri 08:00-22:00" or "sat,sun 10:00-16:00".
+*/
+func parseAccessWindow(value string) (accessWindow, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return accessWindow{}, fmt.Errorf("access window %q must be of the form \"mon-fri 08:00-22:00\"", value)
+	}
+
+	window := accessWindow{days: make(map[time.Weekday]bool)}
+	for _, days := range strings.Split(fields[0], ",") {
+		bounds := strings.SplitN(days, "-", 2)
+		from, ok := weekdays[bounds[0]]
+		to, ok2 := weekdays[bounds[len(bounds)-1]]
+		if !ok || !ok2 {
+			return accessWindow{}, fmt.Errorf("the days of access window %q must be mon, tue, wed, thu, fri, sat or sun", value)
+		}
+
+		// Ranges can wrap around the end of the week, e.g. fri-mon
+		for day := from; ; day = (day + 1) % 7 {
+			window.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	hours := strings.Split(fields[1], "-")
+	if len(hours) != 2 {
+		return accessWindow{}, fmt.Errorf("the hours of access window %q must be of the form 08:00-22:00", value)
+	}
+
+	var err error
+	if window.start, err = parseTimeOfDay(hours[0]); err != nil {
+		return accessWindow{}, err
+	}
+	if window.end, err = parseTimeOfDay(hours[1]); err != nil {
+		return accessWindow{}, err
+	}
+	if window.start >= window.end {
+		return accessWindow{}, fmt.Errorf("access window %q must start before it ends", value)
+	}
+
+	return window, nil
+}
+
+/*
+Checks whether a time falls in one of the access windows of a lab, in the time zone of the lab.
+*/
+func isAccessOpen(windows []string, timezone string, now time.Time) (bool, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return false, err
+	}
+	now = now.In(location)
+	minutes := now.Hour()*60 + now.Minute()
+
+	for _, value := range windows {
+		window, err := parseAccessWindow(value)
+		if err != nil {
+			return false, err
+		}
+
+		if window.days[now.Weekday()] && minutes >= window.start && minutes < window.end {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+/*
+Replaces a RoleBinding, since the role of a RoleBinding can't be changed.
+*/
+func replaceRoleBinding(ctx context.Context, clientset kubernetes.Interface, binding *rbacv1.RoleBinding) error {
+	err := clientset.RbacV1().RoleBindings(binding.Namespace).Delete(ctx, binding.Name, v1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	binding.ResourceVersion = ""
+	binding.UID = ""
+	_, err = clientset.RbacV1().RoleBindings(binding.Namespace).Create(ctx, binding, v1.CreateOptions{})
+	return err
+}
+
+/*
+Closes or opens the student RoleBindings of a namespace. Closed bindings give the students read-only access (the view ClusterRole)
+or no access at all, and remember their role and subjects so opening restores them. Returns whether any binding was changed.
+*/
+func setNamespaceAccess(ctx context.Context, clientset kubernetes.Interface, namespace string, open bool, closedAccess string) (bool, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	bindings, err := clientset.RbacV1().RoleBindings(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+
+	for i := range bindings.Items {
+		binding := &bindings.Items[i]
+		stored, closed := binding.Annotations[openBindingAnnotation]
+		if !strings.HasPrefix(binding.Name, "student-binding") || open != closed {
+			continue
+		}
+
+		if open {
+			var original openBinding
+			if err := json.Unmarshal([]byte(stored), &original); err != nil {
+				return changed, err
+			}
+
+			delete(binding.Annotations, openBindingAnnotation)
+			binding.RoleRef = original.RoleRef
+			binding.Subjects = original.Subjects
+		} else {
+			encoded, err := json.Marshal(openBinding{RoleRef: binding.RoleRef, Subjects: binding.Subjects})
+			if err != nil {
+				return changed, err
+			}
+
+			if binding.Annotations == nil {
+				binding.Annotations = map[string]string{}
+			}
+			binding.Annotations[openBindingAnnotation] = string(encoded)
+
+			if closedAccess == closedAccessNone {
+				binding.Subjects = nil
+			} else {
+				binding.RoleRef = rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: "view"}
+			}
+		}
+
+		if err := replaceRoleBinding(ctx, clientset, binding); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
+
+/*
+Opens or closes the student (and group) namespaces of a lab depending on whether the time falls in one of its access windows.
+Labs without access windows are always open.
+*/
+func (s *Server) enforceAccessWindows(ctx context.Context, clientset kubernetes.Interface, labName string, options *LabOptions, now time.Time) error {
+	if len(options.AccessWindows) == 0 {
+		return nil
+	}
+
+	open, err := isAccessOpen(options.AccessWindows, options.AccessTimezone, now)
+	if err != nil {
+		return err
+	}
+
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return err
+	}
+
+	eventType := timelineLocked
+	if open {
+		eventType = timelineUnlocked
+	}
+
+	// Namespaces that were locked or unlocked are recorded also when a later namespace fails
+	var timeline []TimelineEvent
+	defer func() {
+		s.logTimeline(ctx, labName, timeline...)
+	}()
+
+	for _, namespace := range namespaces {
+		changed, err := setNamespaceAccess(ctx, clientset, namespace, open, options.ClosedAccess)
+		if changed {
+			timeline = append(timeline, TimelineEvent{Namespace: namespace, Type: eventType, Detail: "access window"})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Enforces the access windows of every lab every minute. Errors are logged, the loop only stops when ctx is cancelled.
+*/
+func (s *Server) startAccessWindowLoop(ctx context.Context, clientset kubernetes.Interface) {
+	ticker := time.NewTicker(accessWindowInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		labNames, err := s.getLabNames(ctx, clientset)
+		if err != nil {
+			fmt.Println("Something went wrong while listing the labs:", err)
+			continue
+		}
+
+		now := time.Now()
+		for _, labName := range labNames {
+			labData, err := s.getLabData(ctx, labName)
+			if err != nil {
+				fmt.Println("Something went wrong while fetching lab "+labName+":", err)
+				continue
+			}
+
+			options, err := getStoredLabOptions(labData)
+			if err != nil {
+				fmt.Println("Something went wrong while reading the options of lab "+labName+":", err)
+				continue
+			}
+
+			if err := s.enforceAccessWindows(ctx, clientset, labName, options, now); err != nil {
+				fmt.Println("Something went wrong while enforcing the access windows of lab "+labName+":", err)
+			}
+		}
+	}
+}
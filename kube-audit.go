@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	corev1 "k8s.io/api/core/v1"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// A token used from more IPs than this within tokenIpWindow raises an alert, unless SCALAMA_ALERT_MAX_IPS is set
+const (
+	defaultMaxTokenIps = 3
+	tokenIpWindow      = time.Hour
+)
+
+// Verbs that only make sense to gain more permissions than the role of a student gives
+var escalationVerbs = map[string]bool{"escalate": true, "bind": true, "impersonate": true}
+
+// Subresources that give access to the processes or credentials of other workloads
+var escalationSubresources = map[string]bool{"exec": true, "attach": true, "portforward": true, "token": true}
+
+// The IPs every user of a lab used recently, and when they were last alerted about
+type ipTracker struct {
+	lock    sync.Mutex
+	seen    map[string]map[string]time.Time
+	alerted map[string]time.Time
+}
+
+func newIpTracker() *ipTracker {
+	return &ipTracker{seen: make(map[string]map[string]time.Time), alerted: make(map[string]time.Time)}
+}
+
+/*
+Returns the token that the audit webhook of the API server (--audit-webhook-config-file) must send as bearer token,
+configured by SCALAMA_AUDIT_TOKEN. The audit endpoint is disabled when the variable is not set.
+*/
+func getAuditToken() string {
+	return os.Getenv("SCALAMA_AUDIT_TOKEN")
+}
+
+/*
+Returns the amount of IPs a token can be used from within an hour before an alert is raised, configured by SCALAMA_ALERT_MAX_IPS.
+*/
+func getMaxTokenIps() (int, error) {
+	value := os.Getenv("SCALAMA_ALERT_MAX_IPS")
+	if value == "" {
+		return defaultMaxTokenIps, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+/*
+Returns the lab of a namespace of a lab (ns-<lab> or ns-<lab>-<user>), empty for other namespaces.
+*/
+func getNamespaceLab(namespace string) string {
+	if !strings.HasPrefix(namespace, "ns-") {
+		return ""
+	}
+
+	// Lab names never contain a -
+	return strings.SplitN(strings.TrimPrefix(namespace, "ns-"), "-", 2)[0]
+}
+
+/*
+Returns the lab an audit event belongs to and whether a student (or another user of the lab) caused it.
+Events of ServiceAccounts of a lab belong to that lab, other events to the lab of the namespace of their object.
+System users (e.g. controllers creating the pods of a Deployment) are never students.
+*/
+func getEventLab(event *auditv1.Event) (string, bool) {
+	username := event.User.Username
+	if strings.HasPrefix(username, "system:serviceaccount:") {
+		parts := strings.Split(username, ":")
+		if labName := getNamespaceLab(parts[2]); labName != "" {
+			return labName, true
+		}
+	}
+
+	if event.ObjectRef == nil {
+		return "", false
+	}
+
+	return getNamespaceLab(event.ObjectRef.Namespace), !strings.HasPrefix(username, "system:")
+}
+
+/*
+Records the IP a user used at a time. Returns the IPs of the user within tokenIpWindow and true when there are more than max,
+at most once per window.
+*/
+func (tracker *ipTracker) observe(username string, ip string, now time.Time, max int) ([]string, bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	seen, ok := tracker.seen[username]
+	if !ok {
+		seen = make(map[string]time.Time)
+		tracker.seen[username] = seen
+	}
+	seen[ip] = now
+
+	var ips []string
+	for seenIp, lastSeen := range seen {
+		if now.Sub(lastSeen) > tokenIpWindow {
+			delete(seen, seenIp)
+			continue
+		}
+
+		ips = append(ips, seenIp)
+	}
+
+	if len(ips) <= max || now.Sub(tracker.alerted[username]) < tokenIpWindow {
+		return nil, false
+	}
+
+	tracker.alerted[username] = now
+	sort.Strings(ips)
+	return ips, true
+}
+
+/*
+Returns why a request of a student is an attempt to gain more permissions, empty if it is not.
+*/
+func getEscalationAttempt(event *auditv1.Event) string {
+	if event.ObjectRef == nil {
+		return ""
+	}
+
+	resource := event.ObjectRef.Resource
+	if event.ObjectRef.Subresource != "" {
+		resource += "/" + event.ObjectRef.Subresource
+	}
+
+	if escalationVerbs[event.Verb] {
+		return fmt.Sprintf("Tried to %s %s", event.Verb, resource)
+	}
+
+	if event.ResponseStatus == nil || event.ResponseStatus.Code != 403 {
+		return ""
+	}
+
+	if event.ObjectRef.APIGroup == "rbac.authorization.k8s.io" || escalationSubresources[event.ObjectRef.Subresource] {
+		namespace := event.ObjectRef.Namespace
+		if namespace == "" {
+			namespace = "the cluster"
+		}
+
+		return fmt.Sprintf("Was forbidden to %s %s in %s", event.Verb, resource, namespace)
+	}
+
+	return ""
+}
+
+/*
+Returns why a pod escapes the isolation of its namespace (privileged containers, host namespaces or host paths), empty if it doesn't.
+*/
+func getPrivilegedPod(pod *corev1.Pod) string {
+	var reasons []string
+	if pod.Spec.HostNetwork || pod.Spec.HostPID || pod.Spec.HostIPC {
+		reasons = append(reasons, "host namespaces")
+	}
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.HostPath != nil {
+			reasons = append(reasons, "host path "+volume.HostPath.Path)
+		}
+	}
+
+	for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		if security := container.SecurityContext; security != nil && security.Privileged != nil && *security.Privileged {
+			reasons = append(reasons, "privileged container "+container.Name)
+		}
+	}
+
+	if len(reasons) == 0 {
+		return ""
+	}
+
+	return "Created pod " + pod.Name + " with " + strings.Join(reasons, ", ")
+}
+
+/*
+Returns the images of a pod that come from a registry outside the allowed registries of a lab.
+*/
+func getUnexpectedImages(pod *corev1.Pod, allowedRegistries []string) []string {
+	allowed := make(map[string]bool)
+	for _, registry := range allowedRegistries {
+		allowed[registry] = true
+	}
+
+	var images []string
+	for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		named, err := docker.ParseDockerRef(container.Image)
+		if err != nil || !allowed[docker.Domain(named)] {
+			images = append(images, container.Image)
+		}
+	}
+
+	return images
+}
+
+/*
+Applies the detection heuristics to an audit event of the API server and stores an alert with its lab for every suspicious activity:
+a token used from many IPs, attempts to gain more permissions, and pods that are privileged or pull images from unexpected registries.
+*/
+func (s *Server) processAuditEvent(ctx context.Context, event *auditv1.Event, now time.Time) error {
+	// Every request is reported once it has a response
+	if event.Stage != auditv1.StageResponseComplete {
+		return nil
+	}
+
+	labName, isStudent := getEventLab(event)
+	if labName == "" {
+		return nil
+	}
+
+	labData, err := s.getLabData(ctx, labName)
+	if err != nil {
+		// Namespaces that look like they belong to a lab, but don't
+		return nil
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		return err
+	}
+
+	namespace := ""
+	if event.ObjectRef != nil {
+		namespace = event.ObjectRef.Namespace
+	}
+
+	var alerts []Alert
+	if isStudent && len(event.SourceIPs) > 0 {
+		max, err := getMaxTokenIps()
+		if err != nil {
+			return err
+		}
+
+		if ips, ok := s.tokenIps.observe(event.User.Username, event.SourceIPs[0], now, max); ok {
+			alerts = append(alerts, Alert{Kind: alertTokenIps, Username: event.User.Username, Message: fmt.Sprintf("Token used from %d IPs within an hour: %s", len(ips), strings.Join(ips, ", "))})
+		}
+	}
+
+	if isStudent {
+		if message := getEscalationAttempt(event); message != "" {
+			alerts = append(alerts, Alert{Kind: alertPrivilegeEscalation, Username: event.User.Username, Namespace: namespace, Message: message})
+		}
+	}
+
+	// Pods are also created by controllers on behalf of students, so every pod of the namespaces of a lab is checked
+	if event.ObjectRef != nil && event.ObjectRef.Resource == "pods" && event.ObjectRef.Subresource == "" && event.Verb == "create" && event.RequestObject != nil {
+		pod := &corev1.Pod{}
+		if err := json.Unmarshal(event.RequestObject.Raw, pod); err != nil {
+			return err
+		}
+
+		// Pods that ScaLaMa deployed itself (e.g. SSH bastions) are trusted
+		if pod.Labels[managedByLabel] != managedByLabelVal {
+			if message := getPrivilegedPod(pod); message != "" {
+				alerts = append(alerts, Alert{Kind: alertPrivilegeEscalation, Username: event.User.Username, Namespace: namespace, Message: message})
+			}
+
+			if images := getUnexpectedImages(pod, options.AllowedRegistries); len(options.AllowedRegistries) > 0 && len(images) > 0 {
+				alerts = append(alerts, Alert{Kind: alertUnexpectedRegistry, Username: event.User.Username, Namespace: namespace, Message: "Pulled images from unexpected registries: " + strings.Join(images, ", ")})
+			}
+		}
+	}
+
+	for _, alert := range alerts {
+		if err := s.addAlert(ctx, labName, alert); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
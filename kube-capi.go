@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var capiClusterResource = schema.GroupVersionResource{Group: "cluster.x-k8s.io", Version: "v1beta1", Resource: "clusters"}
+
+/*
+Returns the pod network of the clusters created with Cluster API, configured by SCALAMA_CLUSTER_POD_CIDR.
+*/
+func getClusterPodCidr() string {
+	if cidr := os.Getenv("SCALAMA_CLUSTER_POD_CIDR"); cidr != "" {
+		return cidr
+	}
+
+	return "192.168.0.0/16"
+}
+
+/*
+Creates a Cluster API cluster with a name inside of a namespace, based on a ClusterClass.
+Cluster API provisions the cluster in the background and deletes it again when the Cluster (or its namespace) is deleted.
+*/
+func createWorkloadCluster(ctx context.Context, dynamicInterface dynamic.Interface, name string, namespace string, labName string, clusterClass string, version string, workers int) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	cluster := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cluster.x-k8s.io/v1beta1",
+		"kind":       "Cluster",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+			"labels": map[string]interface{}{
+				managedByLabel: managedByLabelVal,
+				labLabel:       labName,
+			},
+		},
+		"spec": map[string]interface{}{
+			"clusterNetwork": map[string]interface{}{
+				"pods": map[string]interface{}{
+					"cidrBlocks": []interface{}{getClusterPodCidr()},
+				},
+			},
+			"topology": map[string]interface{}{
+				"class":   clusterClass,
+				"version": version,
+				"controlPlane": map[string]interface{}{
+					"replicas": int64(1),
+				},
+				"workers": map[string]interface{}{
+					"machineDeployments": []interface{}{
+						map[string]interface{}{
+							"class":    "default-worker",
+							"name":     "md-0",
+							"replicas": int64(workers),
+						},
+					},
+				},
+			},
+		},
+	}}
+
+	_, err := dynamicInterface.Resource(capiClusterResource).Namespace(namespace).Create(ctx, cluster, metav1.CreateOptions{FieldManager: fieldManager})
+	return err
+}
+
+/*
+Returns the admin kubeconfig of a Cluster API cluster. Cluster API stores it in the Secret <name>-kubeconfig once the cluster is provisioned.
+*/
+func getWorkloadClusterKubeconfig(ctx context.Context, clientset kubernetes.Interface, name string, namespace string) ([]byte, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, name+"-kubeconfig", metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return secret.Data["value"], nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	dashboardName = "dashboard"
+	dashboardPort = 4466
+)
+
+/*
+Returns the image of the dashboard, configured by SCALAMA_DASHBOARD_IMAGE.
+*/
+func getDashboardImage() string {
+	if image := os.Getenv("SCALAMA_DASHBOARD_IMAGE"); image != "" {
+		return image
+	}
+
+	return "ghcr.io/headlamp-k8s/headlamp:latest"
+}
+
+/*
+Returns nil if err is nil or an AlreadyExists error.
+*/
+func ignoreAlreadyExists(err error) error {
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+
+	return err
+}
+
+/*
+Deploys the Headlamp dashboard inside of the lab namespace, exposed with a Service of serviceType.
+The dashboard has no permissions of its own, students log in with their own token so they only see what their RBAC allows.
+*/
+func createDashboard(ctx context.Context, clientset kubernetes.Interface, labName string, serviceType string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	namespace := "ns-" + labName
+	labels := map[string]string{"app": dashboardName, managedByLabel: managedByLabelVal, labLabel: labName}
+
+	serviceAccount := &corev1.ServiceAccount{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ServiceAccount",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      dashboardName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		AutomountServiceAccountToken: new(bool),
+	}
+
+	_, err := clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, serviceAccount, v1.CreateOptions{})
+	if err = ignoreAlreadyExists(err); err != nil {
+		return err
+	}
+
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      dashboardName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &v1.LabelSelector{
+				MatchLabels: map[string]string{"app": dashboardName},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: dashboardName,
+					Containers: []corev1.Container{
+						0: {
+							Name:  dashboardName,
+							Image: getDashboardImage(),
+							Args:  []string{"-in-cluster", "-plugins-dir=/headlamp/plugins"},
+							Ports: []corev1.ContainerPort{
+								0: {Name: "http", ContainerPort: dashboardPort},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	_, err = clientset.AppsV1().Deployments(namespace).Create(ctx, deployment, v1.CreateOptions{})
+	if err = ignoreAlreadyExists(err); err != nil {
+		return err
+	}
+
+	service := &corev1.Service{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      dashboardName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceType(serviceType),
+			Selector: map[string]string{"app": dashboardName},
+			Ports: []corev1.ServicePort{
+				0: {
+					Name:       "http",
+					Protocol:   corev1.ProtocolTCP,
+					Port:       80,
+					TargetPort: intstr.FromInt(dashboardPort),
+				},
+			},
+		},
+	}
+
+	_, err = clientset.CoreV1().Services(namespace).Create(ctx, service, v1.CreateOptions{})
+	return ignoreAlreadyExists(err)
+}
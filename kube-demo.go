@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+var demoMode = flag.Bool("demo", false, "(optional) run against an in-memory fake cluster instead of a real one")
+
+// Resources the fake cluster knows about, per group version
+var demoResources = map[string][]metav1.APIResource{
+	"v1": {
+		{Name: "namespaces", Kind: "Namespace"},
+		{Name: "pods", Kind: "Pod", Namespaced: true},
+		{Name: "services", Kind: "Service", Namespaced: true},
+		{Name: "configmaps", Kind: "ConfigMap", Namespaced: true},
+		{Name: "secrets", Kind: "Secret", Namespaced: true},
+		{Name: "serviceaccounts", Kind: "ServiceAccount", Namespaced: true},
+		{Name: "persistentvolumeclaims", Kind: "PersistentVolumeClaim", Namespaced: true},
+		{Name: "resourcequotas", Kind: "ResourceQuota", Namespaced: true},
+	},
+	"apps/v1": {
+		{Name: "deployments", Kind: "Deployment", Namespaced: true},
+		{Name: "statefulsets", Kind: "StatefulSet", Namespaced: true},
+		{Name: "daemonsets", Kind: "DaemonSet", Namespaced: true},
+		{Name: "replicasets", Kind: "ReplicaSet", Namespaced: true},
+	},
+	"batch/v1": {
+		{Name: "jobs", Kind: "Job", Namespaced: true},
+		{Name: "cronjobs", Kind: "CronJob", Namespaced: true},
+	},
+	"networking.k8s.io/v1": {
+		{Name: "ingresses", Kind: "Ingress", Namespaced: true},
+		{Name: "networkpolicies", Kind: "NetworkPolicy", Namespaced: true},
+	},
+	"rbac.authorization.k8s.io/v1": {
+		{Name: "roles", Kind: "Role", Namespaced: true},
+		{Name: "rolebindings", Kind: "RoleBinding", Namespaced: true},
+		{Name: "clusterroles", Kind: "ClusterRole"},
+		{Name: "clusterrolebindings", Kind: "ClusterRoleBinding"},
+	},
+	"storage.k8s.io/v1": {
+		{Name: "storageclasses", Kind: "StorageClass"},
+	},
+}
+
+/*
+Returns clients of an in-memory fake cluster, so the API can be used without a real cluster.
+ServiceAccounts immediately get a token Secret, like on clusters that still create them.
+*/
+func getFakeClientSet() (kubernetes.Interface, dynamic.Interface) {
+	fakeClientset := fake.NewSimpleClientset()
+
+	listKinds := map[schema.GroupVersionResource]string{}
+	for groupVersion, resources := range demoResources {
+		gv, _ := schema.ParseGroupVersion(groupVersion)
+
+		fakeClientset.Resources = append(fakeClientset.Resources, &metav1.APIResourceList{GroupVersion: groupVersion, APIResources: resources})
+		for _, resource := range resources {
+			listKinds[gv.WithResource(resource.Name)] = resource.Kind + "List"
+		}
+	}
+
+	fakeClientset.PrependReactor("create", "serviceaccounts", func(action ktesting.Action) (bool, runtime.Object, error) {
+		// Tokens requested with the TokenRequest API
+		if action.GetSubresource() == "token" {
+			tokenRequest := action.(ktesting.CreateAction).GetObject().(*authenticationv1.TokenRequest).DeepCopy()
+			tokenRequest.Status.Token = "demo-token-" + action.GetNamespace() + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+			return true, tokenRequest, nil
+		}
+
+		serviceAccount := action.(ktesting.CreateAction).GetObject().(*corev1.ServiceAccount)
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      serviceAccount.Name + "-token",
+				Namespace: serviceAccount.Namespace,
+			},
+			Type: corev1.SecretTypeServiceAccountToken,
+			Data: map[string][]byte{"token": []byte("demo-token-" + serviceAccount.Namespace)},
+		}
+		if err := fakeClientset.Tracker().Add(secret); err != nil {
+			return true, nil, err
+		}
+
+		// Let the default reactor store the ServiceAccount with a reference to the Secret
+		serviceAccount.Secrets = append(serviceAccount.Secrets, corev1.ObjectReference{Name: secret.Name})
+		return false, nil, nil
+	})
+
+	// The token Secret is deleted together with its ServiceAccount, like the token controller of a cluster does
+	fakeClientset.PrependReactor("delete", "serviceaccounts", func(action ktesting.Action) (bool, runtime.Object, error) {
+		deleteAction := action.(ktesting.DeleteAction)
+		err := fakeClientset.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("secrets"), deleteAction.GetNamespace(), deleteAction.GetName()+"-token")
+		if err != nil && !errors.IsNotFound(err) {
+			return true, nil, err
+		}
+
+		return false, nil, nil
+	})
+
+	// Every bearer token is valid in demo mode and belongs to the user with the same name
+	fakeClientset.PrependReactor("create", "tokenreviews", func(action ktesting.Action) (bool, runtime.Object, error) {
+		tokenReview := action.(ktesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		tokenReview.Status.Authenticated = true
+		tokenReview.Status.User = authenticationv1.UserInfo{Username: tokenReview.Spec.Token, Groups: []string{"system:authenticated"}}
+		return true, tokenReview, nil
+	})
+
+	// RBAC is not evaluated in demo mode, so every access review is allowed
+	fakeClientset.PrependReactor("create", "selfsubjectaccessreviews", func(action ktesting.Action) (bool, runtime.Object, error) {
+		review := action.(ktesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).DeepCopy()
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds)
+
+	return fakeClientset, dynamicClient
+}
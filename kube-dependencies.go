@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// Annotations that order the objects of a manifest: depends-on lists the objects (Kind/name, comma-separated) that have to be applied first,
+// wait-for-ready makes the deployer wait until the object is ready before it applies the next object
+const (
+	dependsOnAnnotation    = "scalama.io/depends-on"
+	waitForReadyAnnotation = "scalama.io/wait-for-ready"
+)
+
+/*
+Returns the timeout of waiting for an object of the manifest to be ready, configured by SCALAMA_WAIT_TIMEOUT (e.g. "10m").
+*/
+func getWaitTimeout() (time.Duration, error) {
+	value := os.Getenv("SCALAMA_WAIT_TIMEOUT")
+	if value == "" {
+		return 5 * time.Minute, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+/*
+Returns the key other objects use to depend on an object: Kind/name.
+*/
+func getDependencyKey(unstructuredObj *unstructured.Unstructured) string {
+	return unstructuredObj.GetKind() + "/" + unstructuredObj.GetName()
+}
+
+/*
+Returns the objects of a manifest in dependency order, an object comes after every object it depends on.
+Objects without dependencies keep their order in the manifest.
+*/
+func sortManifestObjects(objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	byKey := make(map[string]*unstructured.Unstructured)
+	for _, unstructuredObj := range objects {
+		byKey[getDependencyKey(unstructuredObj)] = unstructuredObj
+	}
+
+	var sorted []*unstructured.Unstructured
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(unstructuredObj *unstructured.Unstructured) error
+	visit = func(unstructuredObj *unstructured.Unstructured) error {
+		key := getDependencyKey(unstructuredObj)
+		if visited[key] {
+			return nil
+		}
+		if visiting[key] {
+			return fmt.Errorf("%s is part of a dependency cycle", key)
+		}
+		visiting[key] = true
+
+		for _, dependency := range strings.Split(unstructuredObj.GetAnnotations()[dependsOnAnnotation], ",") {
+			if dependency = strings.TrimSpace(dependency); dependency == "" {
+				continue
+			}
+
+			dependencyObj, ok := byKey[dependency]
+			if !ok {
+				return fmt.Errorf("%s depends on %s, which is not part of the manifest", key, dependency)
+			}
+
+			if err := visit(dependencyObj); err != nil {
+				return err
+			}
+		}
+
+		visiting[key] = false
+		visited[key] = true
+		sorted = append(sorted, unstructuredObj)
+		return nil
+	}
+
+	for _, unstructuredObj := range objects {
+		if err := visit(unstructuredObj); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+/*
+Checks the dependencies between the objects of a manifest before anything is created.
+*/
+func validateManifestDependencies(manifest string) *Error {
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		return &Error{status: http.StatusBadRequest, message: "Something went wrong while decoding the manifest"}
+	}
+
+	if _, err := sortManifestObjects(objects); err != nil {
+		return &Error{status: http.StatusBadRequest, message: "The dependencies of the manifest are invalid: " + err.Error()}
+	}
+
+	return nil
+}
+
+/*
+Returns the status condition of an object with a type (e.g. Ready), and whether the object has it.
+*/
+func getStatusCondition(unstructuredObj *unstructured.Unstructured, conditionType string) (string, bool) {
+	conditions, _, _ := unstructured.NestedSlice(unstructuredObj.Object, "status", "conditions")
+	for _, condition := range conditions {
+		conditionMap, ok := condition.(map[string]interface{})
+		if ok && conditionMap["type"] == conditionType {
+			status, _ := conditionMap["status"].(string)
+			return status, true
+		}
+	}
+
+	return "", false
+}
+
+/*
+Checks whether an object is ready: workloads have all their replicas ready, Jobs have succeeded and CRDs are established.
+Other objects are ready when their Ready or Available condition is true, or as soon as they exist if they have neither.
+*/
+func isObjectReady(unstructuredObj *unstructured.Unstructured) bool {
+	generation := unstructuredObj.GetGeneration()
+	observedGeneration, _, _ := unstructured.NestedInt64(unstructuredObj.Object, "status", "observedGeneration")
+
+	switch unstructuredObj.GetKind() {
+	case "Deployment", "StatefulSet", "ReplicaSet":
+		replicas, found, _ := unstructured.NestedInt64(unstructuredObj.Object, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+		readyReplicas, _, _ := unstructured.NestedInt64(unstructuredObj.Object, "status", "readyReplicas")
+
+		return observedGeneration >= generation && readyReplicas >= replicas
+	case "DaemonSet":
+		desired, _, _ := unstructured.NestedInt64(unstructuredObj.Object, "status", "desiredNumberScheduled")
+		ready, _, _ := unstructured.NestedInt64(unstructuredObj.Object, "status", "numberReady")
+
+		return observedGeneration >= generation && ready >= desired
+	case "Job":
+		succeeded, _, _ := unstructured.NestedInt64(unstructuredObj.Object, "status", "succeeded")
+		return succeeded > 0
+	case "CustomResourceDefinition":
+		status, _ := getStatusCondition(unstructuredObj, "Established")
+		return status == "True"
+	}
+
+	for _, conditionType := range []string{"Ready", "Available"} {
+		if status, ok := getStatusCondition(unstructuredObj, conditionType); ok {
+			return status == "True"
+		}
+	}
+
+	return true
+}
+
+/*
+Waits until an object of the manifest is ready inside of a namespace, if it is annotated with wait-for-ready.
+Objects are not created in demo and dry-run mode, so they are never waited for.
+*/
+func waitForReady(ctx context.Context, dynamicInterface dynamic.Interface, mapping *meta.RESTMapping, unstructuredObj *unstructured.Unstructured, namespace string) error {
+	if unstructuredObj.GetAnnotations()[waitForReadyAnnotation] != "true" || *demoMode || *dryRunMode {
+		return nil
+	}
+
+	timeout, err := getWaitTimeout()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		obj, err := dynamicInterface.Resource(mapping.Resource).Namespace(namespace).Get(ctx, unstructuredObj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if isObjectReady(obj) {
+			return nil
+		}
+
+		if err := sleepContext(ctx); err != nil {
+			return fmt.Errorf("%s in namespace %s was not ready within %s", getDependencyKey(unstructuredObj), namespace, timeout)
+		}
+	}
+}
+
+/*
+Waits before an object is polled again. Returns an error if ctx is done first.
+*/
+func sleepContext(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(2 * time.Second):
+		return nil
+	}
+}
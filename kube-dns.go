@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Annotation with the hostnames ExternalDNS creates records for
+const externalDnsHostnameAnnotation = "external-dns.alpha.kubernetes.io/hostname"
+
+/*
+Returns the host of an Ingress rule inside of namespace.
+Hosts of student namespaces are prefixed with the username, so every student gets their own subdomain.
+Rules without a host get a subdomain of domain.
+*/
+func getIngressHost(host string, labName string, namespace string, domain string) string {
+	username := strings.TrimPrefix(namespace, "ns-"+labName+"-")
+	isStudent := username != namespace
+
+	if host == "" {
+		if isStudent {
+			return username + "." + labName + "." + domain
+		}
+
+		return labName + "." + domain
+	}
+
+	if isStudent {
+		return username + "." + host
+	}
+
+	return host
+}
+
+/*
+Gives the rules of an Ingress a unique host per namespace when an ingress domain is set,
+and annotates the Ingress so ExternalDNS creates records for its hosts. The namespace of the Ingress has to be set.
+*/
+func setIngressHosts(ingress *unstructured.Unstructured, labName string, options *LabOptions) {
+	if options.IngressDomain == "" && !options.ExternalDns {
+		return
+	}
+
+	namespace := ingress.GetNamespace()
+	var hosts []string
+
+	rules, _, _ := unstructured.NestedSlice(ingress.Object, "spec", "rules")
+	for _, rule := range rules {
+		ruleMap, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		host, _ := ruleMap["host"].(string)
+		if options.IngressDomain != "" {
+			host = getIngressHost(host, labName, namespace, options.IngressDomain)
+			ruleMap["host"] = host
+		}
+
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(rules) > 0 {
+		unstructured.SetNestedSlice(ingress.Object, rules, "spec", "rules")
+	}
+
+	// The certificates have to match the new hosts
+	tlsList, _, _ := unstructured.NestedSlice(ingress.Object, "spec", "tls")
+	for _, tls := range tlsList {
+		tlsMap, ok := tls.(map[string]interface{})
+		if !ok || options.IngressDomain == "" {
+			continue
+		}
+
+		tlsHosts, _, _ := unstructured.NestedStringSlice(tlsMap, "hosts")
+		for i, host := range tlsHosts {
+			tlsHosts[i] = getIngressHost(host, labName, namespace, options.IngressDomain)
+		}
+		unstructured.SetNestedStringSlice(tlsMap, tlsHosts, "hosts")
+	}
+	if len(tlsList) > 0 {
+		unstructured.SetNestedSlice(ingress.Object, tlsList, "spec", "tls")
+	}
+
+	if options.ExternalDns && len(hosts) > 0 {
+		annotations := ingress.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+
+		annotations[externalDnsHostnameAnnotation] = strings.Join(hosts, ",")
+		ingress.SetAnnotations(annotations)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Label on student (and group) namespaces with the identity their egress traffic is attributed to, <lab>-<username>.
+// Egress gateway policies (CiliumEgressGatewayPolicy, Calico EgressGatewayPolicy) select namespaces by it, e.g. to give every student a static egress IP
+const egressIdentityLabel = "scalama.io/egress-identity"
+
+/*
+Returns the egress identity of a student (or group) namespace.
+*/
+func getEgressIdentity(labName string, namespace string) string {
+	return labName + "-" + strings.TrimPrefix(namespace, "ns-"+labName+"-")
+}
+
+/*
+Labels a student (or group) namespace with its egress identity and the egress labels of the lab,
+so egress gateways can route (and external systems can recognize) the traffic of every student.
+*/
+func labelEgressNamespace(ctx context.Context, clientset kubernetes.Interface, labName string, namespace string, options *LabOptions) error {
+	if !options.EgressIdentity && len(options.EgressLabels) == 0 {
+		return nil
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	for key, value := range options.EgressLabels {
+		ns.Labels[key] = value
+	}
+	if options.EgressIdentity {
+		ns.Labels[egressIdentityLabel] = getEgressIdentity(labName, namespace)
+	}
+
+	_, err = clientset.CoreV1().Namespaces().Update(ctx, ns, v1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	gpuResource = "nvidia.com/gpu"
+
+	// Label that nodes of the NVIDIA GPU operator get when they have a GPU
+	gpuNodeLabel = "nvidia.com/gpu.present"
+
+	// Label that selects the device plugin configuration of a node, the value is a key of the time-slicing ConfigMap
+	gpuConfigNodeLabel = "nvidia.com/device-plugin.config"
+
+	timeSlicingConfigMapName = "time-slicing-config"
+)
+
+/*
+Returns the namespace of the NVIDIA GPU operator, configured by SCALAMA_GPU_OPERATOR_NAMESPACE.
+*/
+func getGpuOperatorNamespace() string {
+	if namespace := os.Getenv("SCALAMA_GPU_OPERATOR_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+
+	return "gpu-operator"
+}
+
+/*
+Creates a ResourceQuota in a namespace that limits the amount of GPUs that can be requested.
+*/
+func createGpuQuota(ctx context.Context, clientset kubernetes.Interface, namespace string, count int) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	quota := &corev1.ResourceQuota{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ResourceQuota",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "gpu-quota",
+			Namespace: namespace,
+		},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{
+				"requests." + gpuResource: resource.MustParse(strconv.Itoa(count)),
+			},
+		},
+	}
+
+	if _, err := clientset.CoreV1().ResourceQuotas(namespace).Create(ctx, quota, v1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+Adds the time-slicing configuration of a lab to the ConfigMap of the device plugin, every GPU is shared by replicas pods.
+Nodes labeled with nvidia.com/device-plugin.config=labName use this configuration.
+*/
+func saveTimeSlicingConfig(ctx context.Context, clientset kubernetes.Interface, labName string, replicas int) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	config := fmt.Sprintf("version: v1\nsharing:\n  timeSlicing:\n    resources:\n    - name: %s\n      replicas: %d\n", gpuResource, replicas)
+
+	namespace := getGpuOperatorNamespace()
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+
+	configMap, err := configMaps.Get(ctx, timeSlicingConfigMapName, v1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		configMap = &corev1.ConfigMap{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      timeSlicingConfigMapName,
+				Namespace: namespace,
+			},
+			Data: map[string]string{labName: config},
+		}
+
+		_, err = configMaps.Create(ctx, configMap, v1.CreateOptions{})
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[labName] = config
+
+	_, err = configMaps.Update(ctx, configMap, v1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// The result of the readiness checks, every check is "ok" or the reason it failed
+type ServerReadiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+/*
+Liveness probe: responds as long as the server handles requests, without calling the cluster so an unreachable API server doesn't restart ScaLaMa.
+*/
+func getServerHealth(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+/*
+Readiness probe: checks whether the Kubernetes API is reachable and the read-namespaces-cr ClusterRole exists.
+Responds with 503 and the failed checks when ScaLaMa can't create labs.
+*/
+func (s *Server) getServerReadiness(w http.ResponseWriter, r *http.Request) {
+	readiness := ServerReadiness{Ready: true, Checks: map[string]string{"kubernetes": "ok", "clusterRole": "ok"}}
+
+	if _, err := s.clientset.Discovery().ServerVersion(); err != nil {
+		readiness.Ready = false
+		readiness.Checks["kubernetes"] = "The Kubernetes API is not reachable: " + err.Error()
+	}
+
+	exists, err := readNamespaceClusterRoleExists(r.Context(), s.clientset)
+	if err != nil {
+		readiness.Ready = false
+		readiness.Checks["clusterRole"] = "Something went wrong while getting ClusterRole read-namespaces-cr: " + err.Error()
+	} else if !exists {
+		readiness.Ready = false
+		readiness.Checks["clusterRole"] = "ClusterRole read-namespaces-cr does not exist"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/kube"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+/*
+Returns a Helm action configuration for namespace. Releases are stored with the driver configured by HELM_DRIVER.
+*/
+func getHelmActionConfig(namespace string) (*action.Configuration, error) {
+	actionConfig := new(action.Configuration)
+
+	if err := actionConfig.Init(kube.GetConfig(*kubeconfig, "", namespace), namespace, os.Getenv("HELM_DRIVER"), nil); err != nil {
+		return nil, err
+	}
+
+	return actionConfig, nil
+}
+
+/*
+Parses the optional values file that overrides the values of a chart, returns nil if no values file is uploaded.
+*/
+func (s *Server) getChartValues(r *http.Request, parameters *ManifestParameters) (map[string]interface{}, *Error) {
+	if !parameters.Values {
+		return nil, nil
+	}
+
+	valuesFile, e := s.getFormFile(r, "values", "text/yaml", "application/x-yaml")
+	if e != nil {
+		return nil, e
+	}
+	defer valuesFile.Close()
+
+	data, err := io.ReadAll(valuesFile)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the values"}
+	}
+
+	values, err := chartutil.ReadValues(data)
+	if err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "values must be a YAML file: " + err.Error()}
+	}
+
+	return values, nil
+}
+
+/*
+Returns the names of the values profiles stored with a chart as profiles/<name>.yaml, sorted.
+*/
+func getChartProfiles(chart *chart.Chart) []string {
+	profiles := []string{}
+	for _, file := range chart.Files {
+		if !strings.HasPrefix(file.Name, "profiles/") || !strings.HasSuffix(file.Name, ".yaml") {
+			continue
+		}
+
+		// Profiles have the same names as presets, files in subdirectories of profiles/ aren't profiles
+		name := strings.TrimSuffix(strings.TrimPrefix(file.Name, "profiles/"), ".yaml")
+		if presetNameRegex.MatchString(name) {
+			profiles = append(profiles, name)
+		}
+	}
+
+	sort.Strings(profiles)
+	return profiles
+}
+
+/*
+Combines the values of a profile of a chart (e.g. small or large for the size of a class) with the values,
+the values override the profile. Without a profile the values are returned as they are.
+*/
+func applyChartProfile(chart *chart.Chart, profile string, values map[string]interface{}) (map[string]interface{}, *Error) {
+	if profile == "" {
+		return values, nil
+	}
+
+	for _, file := range chart.Files {
+		if file.Name != "profiles/"+profile+".yaml" {
+			continue
+		}
+
+		profileValues, err := chartutil.ReadValues(file.Data)
+		if err != nil {
+			return nil, &Error{status: http.StatusBadRequest, message: "Values profile " + profile + " of the chart is not a YAML file: " + err.Error()}
+		}
+
+		return chartutil.CoalesceTables(values, profileValues), nil
+	}
+
+	profiles := getChartProfiles(chart)
+	if len(profiles) == 0 {
+		return nil, &Error{status: http.StatusBadRequest, message: "The chart has no values profiles"}
+	}
+
+	return nil, &Error{status: http.StatusBadRequest, message: "valuesProfile must be one of " + strings.Join(profiles, ", ")}
+}
+
+/*
+Validates the values of a chart (defaults combined with the overrides) against the values.schema.json of the chart and its dependencies.
+Charts without a schema always pass.
+*/
+func validateChartValues(chart *chart.Chart, values map[string]interface{}) *Error {
+	combinedValues, err := chartutil.CoalesceValues(chart, values)
+	if err != nil {
+		return &Error{status: http.StatusBadRequest, message: "Something went wrong while combining the values with the defaults of the chart"}
+	}
+
+	if err := chartutil.ValidateAgainstSchema(chart, combinedValues); err != nil {
+		return &Error{status: http.StatusBadRequest, message: "The values don't match values.schema.json of the chart:\n" + err.Error()}
+	}
+
+	return nil
+}
+
+/*
+Uninstalls every Helm release inside of namespace, including the cluster-scoped objects the releases created.
+Deleting the namespace alone would leave those behind.
+*/
+func uninstallHelmReleases(namespace string) error {
+	// The fake cluster has no Helm releases
+	if *demoMode {
+		return nil
+	}
+
+	actionConfig, err := getHelmActionConfig(namespace)
+	if err != nil {
+		return err
+	}
+
+	list := action.NewList(actionConfig)
+	list.All = true
+	list.SetStateMask()
+
+	releases, err := list.Run()
+	if err != nil {
+		return err
+	}
+
+	for _, release := range releases {
+		uninstall := action.NewUninstall(actionConfig)
+		uninstall.DryRun = *dryRunMode
+
+		if _, err := uninstall.Run(release.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns every resource of the cluster of which objects can be listed and deleted, except namespaces.
+*/
+func getDeletableResources(clientset kubernetes.Interface) ([]schema.GroupVersionResource, error) {
+	resourceLists, err := clientset.Discovery().ServerPreferredResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	}
+
+	var resources []schema.GroupVersionResource
+	for _, resourceList := range discovery.FilteredBy(discovery.SupportsAllVerbs{Verbs: []string{"list", "delete"}}, resourceLists) {
+		groupVersion, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, resource := range resourceList.APIResources {
+			if resource.Name != "namespaces" {
+				resources = append(resources, groupVersion.WithResource(resource.Name))
+			}
+		}
+	}
+
+	return resources, nil
+}
+
+/*
+Deletes every object labeled as managed by ScaLaMa for a lab that is not deleted together with the namespaces of the lab:
+cluster-scoped objects (CRDs, ClusterRoles, ...) and shared external objects in other namespaces.
+The namespaces of shared external objects are kept, since other labs or applications can use them.
+*/
+func deleteManagedClusterObjects(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string) error {
+	resources, err := getDeletableResources(clientset)
+	if err != nil {
+		return err
+	}
+
+	selector := managedByLabel + "=" + managedByLabelVal + "," + labLabel + "=" + labName
+
+	for _, resource := range resources {
+		objects, err := dynamicInterface.Resource(resource).List(ctx, v1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+
+		for _, object := range objects.Items {
+			// Objects in the namespaces of the lab are deleted together with the namespaces
+			namespace := object.GetNamespace()
+			if namespace == "ns-"+labName || strings.HasPrefix(namespace, "ns-"+labName+"-") {
+				continue
+			}
+
+			err := dynamicInterface.Resource(resource).Namespace(namespace).Delete(ctx, object.GetName(), v1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
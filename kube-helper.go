@@ -1,21 +1,27 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/engine"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer/yaml"
 	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/dynamic"
@@ -26,37 +32,96 @@ import (
 	"k8s.io/client-go/util/homedir"
 )
 
-// Singleton
-var kubeconfig *string
+var kubeconfig = flag.String("kubeconfig", getDefaultKubeconfig(), "(optional) absolute path to the kubeconfig file")
 
-func getKubeConfig() *string {
-	if kubeconfig != nil {
-		return kubeconfig
+// The timeout of a single Kubernetes operation when SCALAMA_OPERATION_TIMEOUT is not set
+const defaultOperationTimeout = 30 * time.Second
+
+type operationTimeoutKey struct{}
+
+// Field manager and labels that identify objects managed by ScaLaMa
+const (
+	fieldManager      = "scalama"
+	managedByLabel    = "app.kubernetes.io/managed-by"
+	managedByLabelVal = "scalama"
+	labLabel          = "scalama.io/lab"
+	manifestLabel     = "scalama.io/manifest"
+)
+
+// Annotation that keeps the declared namespace of a manifest object, for charts that expect fixed namespaces (e.g. monitoring)
+const sharedExternalAnnotation = "scalama.io/shared-external"
+
+/*
+Returns the timeout of a single Kubernetes operation, configured by SCALAMA_OPERATION_TIMEOUT (e.g. "1m").
+*/
+func getOperationTimeout() (time.Duration, error) {
+	value := os.Getenv("SCALAMA_OPERATION_TIMEOUT")
+	if value == "" {
+		return defaultOperationTimeout, nil
 	}
 
-	// Initialize singleton
+	return time.ParseDuration(value)
+}
+
+/*
+Returns a context that carries the timeout of the Kubernetes operations started with it.
+*/
+func withOperationTimeoutValue(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, operationTimeoutKey{}, timeout)
+}
+
+/*
+Returns the timeout of a single operation carried by ctx, the default timeout if it carries none.
+*/
+func getContextOperationTimeout(ctx context.Context) time.Duration {
+	if timeout, ok := ctx.Value(operationTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+
+	return defaultOperationTimeout
+}
+
+/*
+Returns a context for a single Kubernetes operation, cancelled when ctx is cancelled (e.g. the client disconnects) or the operation times out.
+*/
+func withOperationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, getContextOperationTimeout(ctx))
+}
+
+/*
+Returns the default path of the kubeconfig file, ~/.kube/config if there is a home directory.
+*/
+func getDefaultKubeconfig() string {
 	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+		return filepath.Join(home, ".kube", "config")
 	}
-	flag.Parse()
 
-	return kubeconfig
+	return ""
 }
 
-func getClientSet() (*kubernetes.Clientset, dynamic.Interface, error) {
+func getClientSet() (kubernetes.Interface, dynamic.Interface, error) {
 	// Attempts to build config inside cluster, if it fails build outside cluster
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		kubeConfig := getKubeConfig()
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeConfig)
+		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
 
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 
+	// Every change is validated by the API server but not persisted
+	if *dryRunMode {
+		config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &dryRunTransport{next: rt}
+		})
+	}
+
+	// Requests made in the context of an instructor are performed as that instructor
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &impersonationTransport{next: rt}
+	})
+
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, nil, err
@@ -70,33 +135,119 @@ func getClientSet() (*kubernetes.Clientset, dynamic.Interface, error) {
 	return clientset, dynamicInterface, nil
 }
 
-func createNamespace(clientSet *kubernetes.Clientset, name string) error {
-	nsSpec := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+func (s *Server) createNamespace(ctx context.Context, clientSet kubernetes.Interface, dynamicInterface dynamic.Interface, name string) error {
+	// OpenShift namespaces are created as projects
+	if s.isOpenShift {
+		return createProject(ctx, dynamicInterface, name)
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	// Pod Security admission enforces the level of the cluster policy in every namespace of a lab
+	nsSpec := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: s.clusterPolicy.getNamespaceLabels()}}
 
-	_, err := clientSet.CoreV1().Namespaces().Create(context.TODO(), nsSpec, metav1.CreateOptions{})
+	namespace, err := clientSet.CoreV1().Namespaces().Create(ctx, nsSpec, metav1.CreateOptions{})
 	if err != nil {
 		return err
 	}
 
+	if s.informerFactory != nil {
+		addToCache(s.informerFactory.Core().V1().Namespaces().Informer(), namespace)
+	}
+
 	return nil
 }
 
-func namespaceExists(clientset *kubernetes.Clientset, name string) (bool, error) {
-	namespaces, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+func (s *Server) namespaceExists(ctx context.Context, clientset kubernetes.Interface, name string) (bool, error) {
+	if s.informerFactory != nil {
+		_, err := s.informerFactory.Core().V1().Namespaces().Lister().Get(name)
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	_, err := clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+
 		return false, err
 	}
 
-	for _, namespace := range namespaces.Items {
-		if namespace.Name == name {
-			return true, nil
+	return true, nil
+}
+
+/*
+Returns the names of every namespace in the cluster with a single List, to check many namespaces without a request per namespace.
+*/
+func (s *Server) getExistingNamespaces(ctx context.Context, clientset kubernetes.Interface) (map[string]bool, error) {
+	names, err := s.listNamespaceNames(ctx, clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[name] = true
+	}
+
+	return existing, nil
+}
+
+/*
+Returns the names of all labs, based on the lab namespaces (ns-labName) in the cluster.
+*/
+func (s *Server) getLabNames(ctx context.Context, clientset kubernetes.Interface) ([]string, error) {
+	namespaces, err := s.listNamespaceNames(ctx, clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	var labNames []string
+	for _, namespace := range namespaces {
+		// Lab names never contain a -, student namespaces always do
+		labName := strings.TrimPrefix(namespace, "ns-")
+		if labName != namespace && labName != "" && !strings.Contains(labName, "-") {
+			labNames = append(labNames, labName)
 		}
 	}
 
-	return false, nil
+	return labNames, nil
 }
 
-func convertChartToYaml(chart *chart.Chart) (*string, error) {
+/*
+Returns the names of the student (or group) namespaces of a lab, the lab namespace itself is not included.
+*/
+func (s *Server) getLabNamespaces(ctx context.Context, clientset kubernetes.Interface, labName string) ([]string, error) {
+	namespaces, err := s.listNamespaceNames(ctx, clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	var labNamespaces []string
+	for _, namespace := range namespaces {
+		if strings.HasPrefix(namespace, "ns-"+labName+"-") {
+			labNamespaces = append(labNamespaces, namespace)
+		}
+	}
+
+	// The cache is not ordered
+	sort.Strings(labNamespaces)
+
+	return labNamespaces, nil
+}
+
+/*
+Renders the templates of a chart to a single YAML manifest. The values override the default values of the chart.
+*/
+func convertChartToYaml(chart *chart.Chart, overrides map[string]interface{}) (*string, error) {
 	options := chartutil.ReleaseOptions{
 		Name:      "test-name",
 		Namespace: "default",
@@ -104,7 +255,7 @@ func convertChartToYaml(chart *chart.Chart) (*string, error) {
 
 	caps := chartutil.Capabilities{}
 
-	values, err := chartutil.ToRenderValues(chart, chart.Values, options, &caps)
+	values, err := chartutil.ToRenderValues(chart, overrides, options, &caps)
 	if err != nil {
 		return nil, err
 	}
@@ -134,7 +285,7 @@ func convertChartToYaml(chart *chart.Chart) (*string, error) {
 	return &kubeYaml, nil
 }
 
-func handleManifestHelper(decoder *yamlutil.YAMLOrJSONDecoder) (*unstructured.Unstructured, map[string]interface{}, *meta.RESTMapping, error) {
+func handleManifestHelper(clientset kubernetes.Interface, decoder *yamlutil.YAMLOrJSONDecoder) (*unstructured.Unstructured, map[string]interface{}, *meta.RESTMapping, error) {
 	var rawObj runtime.RawExtension
 	if err := decoder.Decode(&rawObj); err != nil {
 		return nil, nil, nil, err
@@ -152,106 +303,241 @@ func handleManifestHelper(decoder *yamlutil.YAMLOrJSONDecoder) (*unstructured.Un
 
 	unstructuredObj := &unstructured.Unstructured{Object: unstructuredMap}
 
-	gr, err := restmapper.GetAPIGroupResources(clientset.Discovery())
+	mapping, err := getObjectMapping(clientset, gvk)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	mapper := restmapper.NewDiscoveryRESTMapper(gr)
-	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	return unstructuredObj, unstructuredMap, mapping, nil
+}
+
+/*
+Returns the resource of a kind. The API resources are discovered again every time, so kinds of CRDs created by the manifest are found.
+*/
+func getObjectMapping(clientset kubernetes.Interface, gvk *schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	gr, err := restmapper.GetAPIGroupResources(clientset.Discovery())
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
-	return unstructuredObj, unstructuredMap, mapping, nil
+	mapper := restmapper.NewDiscoveryRESTMapper(gr)
+	return mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
+
+/*
+Checks whether an object of the manifest should only be created once in the lab namespace.
+Objects are single instance unless metadata.single_instance is set to false.
+*/
+func isSingleInstance(unstructuredMap map[string]interface{}) bool {
+	metadata, ok := unstructuredMap["metadata"].(map[string]interface{})
+	if !ok || metadata["single_instance"] == nil {
+		return true
+	}
+
+	singleInstance, ok := metadata["single_instance"].(bool)
+	return !ok || singleInstance
 }
 
-// Creates objects from YAML manifest in every namespace
-func handleManifest(clientset *kubernetes.Clientset, dynamicInterface dynamic.Interface, file io.Reader, labName string, namespaces []string, labExists bool) error {
-	var file1 bytes.Buffer
+/*
+Checks whether the objects of a mapping don't belong to a namespace (CRDs, ClusterRoles, StorageClasses, ...).
+*/
+func isClusterScoped(mapping *meta.RESTMapping) bool {
+	return mapping.Scope.Name() == meta.RESTScopeNameRoot
+}
 
-	var decoder *yamlutil.YAMLOrJSONDecoder
-	var err error
+/*
+Checks whether an object of the manifest is annotated as shared external and declares its own namespace.
+*/
+func isSharedExternal(unstructuredObj *unstructured.Unstructured) bool {
+	return unstructuredObj.GetAnnotations()[sharedExternalAnnotation] == "true" && unstructuredObj.GetNamespace() != ""
+}
 
-	// If lab doesn't exist, create the singleInstance stuff
-	if !labExists {
-		file2 := io.TeeReader(file, &file1)
+/*
+Checks whether an object of the manifest is only created once for the lab instead of in every student namespace.
+*/
+func isCreatedOnce(unstructuredObj *unstructured.Unstructured, mapping *meta.RESTMapping) bool {
+	return isSingleInstance(unstructuredObj.Object) || isClusterScoped(mapping) || isSharedExternal(unstructuredObj)
+}
 
-		decoder = yamlutil.NewYAMLOrJSONDecoder(file2, 100)
+/*
+Returns the namespace of an object that is only created once for the lab.
+This is empty for cluster-scoped objects and the declared namespace for shared external objects.
+*/
+func getSharedNamespace(unstructuredObj *unstructured.Unstructured, mapping *meta.RESTMapping, labName string) string {
+	if isClusterScoped(mapping) {
+		return ""
+	}
 
-		// Loop through manifest and create all singleInstances
-		for {
-			unstructuredObj, unstructuredMap, mapping, e := handleManifestHelper(decoder)
-			err = e
-			if err != nil {
-				break
-			}
+	if isSharedExternal(unstructuredObj) {
+		return unstructuredObj.GetNamespace()
+	}
+
+	return "ns-" + labName
+}
+
+/*
+Labels an object of the manifest as managed by ScaLaMa for a lab.
+The manifest label separates the objects of the manifest from the objects ScaLaMa creates itself.
+*/
+func setManagedLabels(unstructuredObj *unstructured.Unstructured, labName string) {
+	labels := unstructuredObj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	labels[managedByLabel] = managedByLabelVal
+	labels[labLabel] = labName
+	labels[manifestLabel] = "true"
+	unstructuredObj.SetLabels(labels)
+}
+
+/*
+Returns an object of the manifest as it is deployed in a namespace of the lab: labeled as managed by ScaLaMa, changed by the
+options of the lab (e.g. the hosts of Ingresses) and held to the cluster policy. The object of the manifest itself is not changed.
+*/
+func (s *Server) getDeployedObject(unstructuredObj *unstructured.Unstructured, labName string, namespace string, options *LabOptions) *unstructured.Unstructured {
+	obj := unstructuredObj.DeepCopy()
+	obj.SetNamespace(namespace)
+	setManagedLabels(obj, labName)
+	applyLabOptions(obj, labName, options)
+	s.clusterPolicy.applyToObject(obj)
+
+	return obj
+}
+
+/*
+Creates an object of the manifest inside of a namespace of the lab, or outside of any namespace when namespace is empty.
+An object that already exists is skipped or patched when the conflict strategy of the lab says so.
+Returns the created (or patched) object, which is nil when the object is skipped. The object of the manifest itself is not changed.
+*/
+func (s *Server) createManifestObject(ctx context.Context, dynamicInterface dynamic.Interface, mapping *meta.RESTMapping, unstructuredObj *unstructured.Unstructured, labName string, namespace string, options *LabOptions) (*unstructured.Unstructured, error) {
+	obj := s.getDeployedObject(unstructuredObj, labName, namespace, options)
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	dri := dynamicInterface.Resource(mapping.Resource).Namespace(namespace)
+	created, err := dri.Create(ctx, obj, metav1.CreateOptions{FieldManager: fieldManager})
+	if !errors.IsAlreadyExists(err) {
+		return created, err
+	}
+
+	switch options.ConflictStrategy {
+	case conflictStrategySkip:
+		fmt.Println("Skipped existing object", obj.GetKind(), obj.GetName(), "in namespace", namespace)
+		return nil, nil
+	case conflictStrategyPatch:
+		return s.applyObject(ctx, dynamicInterface, mapping, unstructuredObj, labName, namespace, options)
+	}
+
+	return nil, err
+}
+
+/*
+Creates the objects of a YAML manifest in every namespace, in the order of their dependencies.
+Objects annotated with wait-for-ready have to be ready before the next object is created.
+The post-deploy hooks are started in every namespace afterwards, the namespaces are ready once they completed.
+*/
+func (s *Server) handleManifest(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, file io.Reader, labName string, namespaces []string, labExists bool, options *LabOptions) (err error) {
+	// The created objects are recorded in the inventory, also when the deployment fails halfway
+	var created []InventoryEntry
+	defer func() {
+		if inventoryErr := updateInventory(ctx, clientset, labName, created, nil); err == nil {
+			err = inventoryErr
+		}
+	}()
+
+	manifest, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	objects, err := decodeManifestObjects(string(manifest))
+	if err != nil {
+		return err
+	}
 
-			metadata := unstructuredMap["metadata"].(map[string]interface{})
-			// Default value is true
-			singleInstance := true
-			if metadata != nil {
-				singleInstance = (metadata["single_instance"] == nil || metadata["single_instance"].(bool))
+	objects, err = sortManifestObjects(objects)
+	if err != nil {
+		return err
+	}
+
+	// The hooks only run once the other objects exist
+	objects, hooks := splitHooks(objects)
+
+	// If lab doesn't exist, create the singleInstance stuff
+	if !labExists {
+		// Loop through manifest and create all singleInstances, cluster-scoped and shared external objects are always created once
+		for _, unstructuredObj := range objects {
+			gvk := unstructuredObj.GroupVersionKind()
+			mapping, err := getObjectMapping(clientset, &gvk)
+			if err != nil {
+				return err
 			}
 
-			if !singleInstance {
+			if !isCreatedOnce(unstructuredObj, mapping) {
 				continue
 			}
 
-			var dri dynamic.ResourceInterface
-			unstructuredObj.SetNamespace("ns-" + labName)
-			dri = dynamicInterface.Resource(mapping.Resource).Namespace(unstructuredObj.GetNamespace())
+			// The declared namespace of a shared external object is kept, other labs or applications can also use it
+			if isSharedExternal(unstructuredObj) {
+				if err := s.createNamespace(ctx, clientset, dynamicInterface, unstructuredObj.GetNamespace()); err != nil && !errors.IsAlreadyExists(err) {
+					return err
+				}
+			}
 
-			if _, err := dri.Create(context.Background(), unstructuredObj, metav1.CreateOptions{}); err != nil {
+			namespace := getSharedNamespace(unstructuredObj, mapping, labName)
+			obj, err := s.createManifestObject(ctx, dynamicInterface, mapping, unstructuredObj, labName, namespace, options)
+			if err != nil {
 				return err
 			}
-		}
+			if obj != nil {
+				created = append(created, newInventoryEntry(mapping, obj))
+			}
+			getRequestCreationJob(ctx).addResourceDeployed()
 
-		if err != io.EOF {
-			return err
+			if err := waitForReady(ctx, dynamicInterface, mapping, unstructuredObj, namespace); err != nil {
+				return err
+			}
 		}
 	}
 
-	if !labExists {
-		decoder = yamlutil.NewYAMLOrJSONDecoder(&file1, 100)
-	} else {
-		decoder = yamlutil.NewYAMLOrJSONDecoder(file, 100)
-	}
-
-	// Keep reading objects until EOF
-	for {
-		unstructuredObj, unstructuredMap, mapping, err := handleManifestHelper(decoder)
+	for _, unstructuredObj := range objects {
+		gvk := unstructuredObj.GroupVersionKind()
+		mapping, err := getObjectMapping(clientset, &gvk)
 		if err != nil {
-			break
-		}
-
-		metadata := unstructuredMap["metadata"].(map[string]interface{})
-		// Default value is true
-		singleInstance := true
-		if metadata != nil {
-			singleInstance = (metadata["single_instance"] == nil || metadata["single_instance"].(bool))
+			return err
 		}
 
 		// Skip the ones we only had to make once
-		if singleInstance {
+		if isCreatedOnce(unstructuredObj, mapping) {
 			continue
 		}
 
 		// Create objects from manifest in every namespace
 		for _, namespace := range namespaces {
-			var dri dynamic.ResourceInterface
-			unstructuredObj.SetNamespace(namespace)
-			dri = dynamicInterface.Resource(mapping.Resource).Namespace(unstructuredObj.GetNamespace())
+			obj, err := s.createManifestObject(ctx, dynamicInterface, mapping, unstructuredObj, labName, namespace, options)
+			if err != nil {
+				return err
+			}
+			if obj != nil {
+				created = append(created, newInventoryEntry(mapping, obj))
+			}
+			getRequestCreationJob(ctx).addResourceDeployed()
+		}
 
-			if _, err := dri.Create(context.Background(), unstructuredObj, metav1.CreateOptions{}); err != nil {
+		// The object is created in every namespace first, so they get ready at the same time
+		for _, namespace := range namespaces {
+			if err := waitForReady(ctx, dynamicInterface, mapping, unstructuredObj, namespace); err != nil {
 				return err
 			}
 		}
 	}
 
-	// If error is not EOF, then something is wrong
-	if err != io.EOF {
-		return err
+	if len(hooks) > 0 {
+		for _, namespace := range namespaces {
+			go s.runHooks(clientset, dynamicInterface, labName, namespace, hooks, options)
+		}
 	}
 
 	return nil
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Jobs of the manifest annotated as post-deploy hook run once in every student namespace, after the other objects of the manifest.
+// Pre-delete hooks run in every student namespace when the lab is deleted, before anything is deleted (e.g. to export the databases of the students).
+const (
+	hookAnnotation = "scalama.io/hook"
+	hookPostDeploy = "post-deploy"
+	hookPreDelete  = "pre-delete"
+)
+
+// Annotation on a namespace with the status of its hooks, a namespace is only ready once its hooks succeeded
+const (
+	hookStatusAnnotation = "scalama.io/hook-status"
+	hookStatusRunning    = "Running"
+	hookStatusSucceeded  = "Succeeded"
+	hookStatusFailed     = "Failed"
+)
+
+// Readiness of a namespace of a lab
+type NamespaceReadiness struct {
+	Ready      bool   `json:"ready"`
+	HookStatus string `json:"hookStatus,omitempty"`
+}
+
+/*
+Checks whether an object of the manifest is a post-deploy or pre-delete hook.
+*/
+func isHook(unstructuredObj *unstructured.Unstructured) bool {
+	hook := unstructuredObj.GetAnnotations()[hookAnnotation]
+	return hook == hookPostDeploy || hook == hookPreDelete
+}
+
+/*
+Splits the objects of a manifest in the post-deploy hooks and the other objects, both keep their order.
+Pre-delete hooks are left out, they only run when the lab is deleted.
+*/
+func splitHooks(objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, []*unstructured.Unstructured) {
+	var others, hooks []*unstructured.Unstructured
+	for _, unstructuredObj := range objects {
+		switch unstructuredObj.GetAnnotations()[hookAnnotation] {
+		case hookPostDeploy:
+			hooks = append(hooks, unstructuredObj)
+		case hookPreDelete:
+		default:
+			others = append(others, unstructuredObj)
+		}
+	}
+
+	return others, hooks
+}
+
+/*
+Returns the pre-delete hooks of a manifest in their order.
+*/
+func getPreDeleteHooks(objects []*unstructured.Unstructured) []*unstructured.Unstructured {
+	var hooks []*unstructured.Unstructured
+	for _, unstructuredObj := range objects {
+		if unstructuredObj.GetAnnotations()[hookAnnotation] == hookPreDelete {
+			hooks = append(hooks, unstructuredObj)
+		}
+	}
+
+	return hooks
+}
+
+/*
+Checks that only Jobs are hooks, other objects can't complete.
+*/
+func validateManifestHooks(manifest string) *Error {
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		return &Error{status: http.StatusBadRequest, message: "Something went wrong while decoding the manifest"}
+	}
+
+	for _, unstructuredObj := range objects {
+		if isHook(unstructuredObj) && unstructuredObj.GetKind() != "Job" {
+			return &Error{status: http.StatusBadRequest, message: "Only Jobs can be a hook, " + getDependencyKey(unstructuredObj) + " is not a Job"}
+		}
+	}
+
+	return nil
+}
+
+/*
+Sets the status of the hooks of a namespace.
+*/
+func setHookStatus(clientset kubernetes.Interface, namespace string, status string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, hookStatusAnnotation, status)
+	_, err := clientset.CoreV1().Namespaces().Patch(context.TODO(), namespace, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
+
+/*
+Waits until a hook Job completes inside of a namespace. Returns an error if the Job failed or didn't complete in time.
+Jobs are not created in demo and dry-run mode, so they are never waited for.
+*/
+func waitForHook(ctx context.Context, dynamicInterface dynamic.Interface, mapping *meta.RESTMapping, name string, namespace string) error {
+	if *demoMode || *dryRunMode {
+		return nil
+	}
+
+	timeout, err := getWaitTimeout()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		job, err := dynamicInterface.Resource(mapping.Resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if status, _ := getStatusCondition(job, "Failed"); status == "True" {
+			return fmt.Errorf("Job %s in namespace %s failed", name, namespace)
+		}
+
+		if isObjectReady(job) {
+			return nil
+		}
+
+		if err := sleepContext(ctx); err != nil {
+			return fmt.Errorf("Job %s in namespace %s did not complete within %s", name, namespace, timeout)
+		}
+	}
+}
+
+/*
+Runs the hooks of the manifest in a namespace one after the other, and records whether they succeeded on the namespace.
+The hooks run in the background, they don't stop when the request that deployed the manifest ends.
+*/
+func (s *Server) runHooks(clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string, namespace string, hooks []*unstructured.Unstructured, options *LabOptions) {
+	ctx := context.Background()
+
+	if err := setHookStatus(clientset, namespace, hookStatusRunning); err != nil {
+		fmt.Println("Something went wrong while setting the hook status of namespace "+namespace+":", err)
+		return
+	}
+
+	var created []InventoryEntry
+	status := hookStatusSucceeded
+	for _, hook := range hooks {
+		gvk := hook.GroupVersionKind()
+		mapping, err := getObjectMapping(clientset, &gvk)
+		if err == nil {
+			var obj *unstructured.Unstructured
+			if obj, err = s.createManifestObject(ctx, dynamicInterface, mapping, hook, labName, namespace, options); obj != nil {
+				created = append(created, newInventoryEntry(mapping, obj))
+			}
+		}
+		if err == nil {
+			err = waitForHook(ctx, dynamicInterface, mapping, hook.GetName(), namespace)
+		}
+
+		if err != nil {
+			fmt.Println("Something went wrong while running hook "+hook.GetName()+" in namespace "+namespace+":", err)
+			status = hookStatusFailed
+			break
+		}
+	}
+
+	if err := updateInventory(ctx, clientset, labName, created, nil); err != nil {
+		fmt.Println("Something went wrong while updating the inventory of lab "+labName+":", err)
+	}
+
+	if err := setHookStatus(clientset, namespace, status); err != nil {
+		fmt.Println("Something went wrong while setting the hook status of namespace "+namespace+":", err)
+	}
+}
+
+/*
+Returns the readiness of a namespace, namespaces without hooks are always ready.
+*/
+func getNamespaceReadiness(ctx context.Context, clientset kubernetes.Interface, namespace string) (NamespaceReadiness, error) {
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return NamespaceReadiness{}, err
+	}
+
+	status := ns.GetAnnotations()[hookStatusAnnotation]
+	return NamespaceReadiness{Ready: status == "" || status == hookStatusSucceeded, HookStatus: status}, nil
+}
+
+/*
+Runs the pre-delete hooks of the manifest in a namespace one after the other, and waits until they completed.
+Every run gets Jobs with a new name, so the hooks can run again when an earlier deletion of the lab failed.
+*/
+func (s *Server) runPreDeleteHooks(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string, namespace string, hooks []*unstructured.Unstructured, options *LabOptions) error {
+	suffix := "-" + strconv.FormatInt(time.Now().Unix(), 36)
+
+	for _, hook := range hooks {
+		gvk := hook.GroupVersionKind()
+		mapping, err := getObjectMapping(clientset, &gvk)
+		if err != nil {
+			return err
+		}
+
+		hook = hook.DeepCopy()
+		hook.SetName(hook.GetName() + suffix)
+
+		if _, err := s.createManifestObject(ctx, dynamicInterface, mapping, hook, labName, namespace, options); err != nil {
+			return err
+		}
+
+		if err := waitForHook(ctx, dynamicInterface, mapping, hook.GetName(), namespace); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Runs the pre-delete hooks of the stored manifest of a lab in every student namespace at the same time, and calls the pre-delete webhook of the lab.
+Returns an error if a hook or the webhook failed, so nothing of the lab is deleted before its data was exported.
+*/
+func (s *Server) runLabPreDeleteHooks(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string, labData map[string]string) *Error {
+	manifest, ok := labData["manifest"]
+	if !ok {
+		return nil
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the options of lab " + labName}
+	}
+
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while decoding the manifest of lab " + labName}
+	}
+
+	hooks := getPreDeleteHooks(objects)
+	if len(hooks) == 0 && options.PreDeleteWebhook == "" {
+		return nil
+	}
+
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while listing the namespaces of lab " + labName}
+	}
+
+	if len(hooks) > 0 {
+		var wg sync.WaitGroup
+		failed := make([]error, len(namespaces))
+		for i, namespace := range namespaces {
+			wg.Add(1)
+			go func(i int, namespace string) {
+				defer wg.Done()
+				failed[i] = s.runPreDeleteHooks(ctx, clientset, dynamicInterface, labName, namespace, hooks, options)
+			}(i, namespace)
+		}
+		wg.Wait()
+
+		for i, err := range failed {
+			if err != nil {
+				fmt.Println("Something went wrong while running the pre-delete hooks in namespace "+namespaces[i]+":", err)
+				return &Error{status: http.StatusInternalServerError, message: "Something went wrong while running the pre-delete hooks in namespace " + namespaces[i] + ", the lab was not deleted"}
+			}
+		}
+	}
+
+	if options.PreDeleteWebhook != "" {
+		if err := callPreDeleteWebhook(options.PreDeleteWebhook, labName, namespaces); err != nil {
+			fmt.Println("Something went wrong while calling the pre-delete webhook of lab "+labName+":", err)
+			return &Error{status: http.StatusBadGateway, message: "Something went wrong while calling the pre-delete webhook of lab " + labName + ", the lab was not deleted"}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Cloud providers of which the IAM identities can be mapped to students
+var identityProviders = []string{"eks", "gke", "aks"}
+
+// Entry of mapUsers in the aws-auth ConfigMap of EKS
+type awsAuthUser struct {
+	UserArn  string   `json:"userarn"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+/*
+Returns the cloud identities of a list of students, students without an identity are skipped.
+*/
+func getIdentities(students []Student) []string {
+	var identities []string
+
+	for _, student := range students {
+		if student.identity != "" {
+			identities = append(identities, student.identity)
+		}
+	}
+
+	return identities
+}
+
+/*
+Returns the RBAC subjects of cloud identities.
+GKE uses the Google account, AKS the Azure AD user and EKS the IAM ARN (mapped to the same username in aws-auth).
+*/
+func getIdentitySubjects(identities []string) []rbacv1.Subject {
+	var subjects []rbacv1.Subject
+
+	for _, identity := range identities {
+		subjects = append(subjects, rbacv1.Subject{
+			Kind:     "User",
+			Name:     identity,
+			APIGroup: "rbac.authorization.k8s.io",
+		})
+	}
+
+	return subjects
+}
+
+/*
+Returns the group that marks the aws-auth users of a lab.
+*/
+func getAwsAuthGroup(labName string) string {
+	return "scalama:" + labName
+}
+
+/*
+Checks whether the aws-auth ConfigMap of EKS exists.
+*/
+func awsAuthExists(ctx context.Context, clientset kubernetes.Interface) (bool, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	_, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "aws-auth", v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+/*
+Reads the users of the aws-auth ConfigMap, calls update on them and writes them back.
+*/
+func updateAwsAuthUsers(ctx context.Context, clientset kubernetes.Interface, update func([]awsAuthUser) []awsAuthUser) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	configMaps := clientset.CoreV1().ConfigMaps("kube-system")
+
+	configMap, err := configMaps.Get(ctx, "aws-auth", v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var users []awsAuthUser
+	if err := yaml.Unmarshal([]byte(configMap.Data["mapUsers"]), &users); err != nil {
+		return err
+	}
+
+	mapUsers, err := yaml.Marshal(update(users))
+	if err != nil {
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data["mapUsers"] = string(mapUsers)
+
+	_, err = configMaps.Update(ctx, configMap, v1.UpdateOptions{})
+	return err
+}
+
+/*
+Maps IAM ARNs to Kubernetes users with the same name in the aws-auth ConfigMap, so they can be used in RBAC subjects.
+The users are marked with a group of the lab, so they can be removed when the lab is deleted.
+*/
+func addAwsAuthUsers(ctx context.Context, clientset kubernetes.Interface, labName string, identities []string) error {
+	group := getAwsAuthGroup(labName)
+
+	return updateAwsAuthUsers(ctx, clientset, func(users []awsAuthUser) []awsAuthUser {
+		for _, identity := range identities {
+			found := false
+
+			for i := range users {
+				if users[i].UserArn == identity {
+					found = true
+					if !contains(users[i].Groups, group) {
+						users[i].Groups = append(users[i].Groups, group)
+					}
+				}
+			}
+
+			if !found {
+				users = append(users, awsAuthUser{UserArn: identity, Username: identity, Groups: []string{group}})
+			}
+		}
+
+		return users
+	})
+}
+
+/*
+Removes the group of a lab from the aws-auth users. Users without any group left are removed.
+*/
+func removeAwsAuthUsers(ctx context.Context, clientset kubernetes.Interface, labName string) error {
+	group := getAwsAuthGroup(labName)
+
+	return updateAwsAuthUsers(ctx, clientset, func(users []awsAuthUser) []awsAuthUser {
+		var remaining []awsAuthUser
+
+		for _, user := range users {
+			if !contains(user.Groups, group) {
+				remaining = append(remaining, user)
+				continue
+			}
+
+			var groups []string
+			for _, userGroup := range user.Groups {
+				if userGroup != group {
+					groups = append(groups, userGroup)
+				}
+			}
+
+			if len(groups) == 0 {
+				continue
+			}
+
+			user.Groups = groups
+			remaining = append(remaining, user)
+		}
+
+		return remaining
+	})
+}
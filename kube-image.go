@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	dockerremote "github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Architectures a lab can target
+var supportedArchitectures = []string{"amd64", "arm64"}
+
+/*
+Decodes every object of a manifest, without checking the objects against the cluster.
+*/
+func decodeManifestObjects(manifest string) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+
+	decoder := yamlutil.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 100)
+	for {
+		unstructuredObj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&unstructuredObj.Object); err != nil {
+			if err == io.EOF {
+				return objects, nil
+			}
+
+			return nil, err
+		}
+
+		// Empty documents (e.g. between two ---) have no content
+		if len(unstructuredObj.Object) == 0 {
+			continue
+		}
+
+		objects = append(objects, unstructuredObj)
+	}
+}
+
+/*
+Returns the images used by the workloads of a manifest, sorted and without duplicates.
+*/
+func getManifestImages(objects []*unstructured.Unstructured) []string {
+	visited := make(map[string]bool)
+	var images []string
+
+	for _, unstructuredObj := range objects {
+		podSpec, ok := getPodSpec(unstructuredObj)
+		if !ok {
+			continue
+		}
+
+		for _, container := range getContainers(podSpec) {
+			image, ok := container["image"].(string)
+			if ok && !visited[image] {
+				images = append(images, image)
+				visited[image] = true
+			}
+		}
+	}
+
+	sort.Strings(images)
+	return images
+}
+
+/*
+Fetches a blob (manifest, index or config) from a registry and decodes it into v.
+*/
+func fetchJson(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, v interface{}) error {
+	reader, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return json.NewDecoder(reader).Decode(v)
+}
+
+/*
+Returns the architectures an image is published for, by reading its manifest (list) from the registry.
+*/
+func getImageArchitectures(image string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	named, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := dockerremote.NewResolver(dockerremote.ResolverOptions{})
+	name, desc, err := resolver.Resolve(ctx, named.String())
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index ocispec.Index
+		if err := fetchJson(ctx, fetcher, desc, &index); err != nil {
+			return nil, err
+		}
+
+		var architectures []string
+		for _, manifest := range index.Manifests {
+			if manifest.Platform != nil {
+				architectures = append(architectures, manifest.Platform.Architecture)
+			}
+		}
+
+		return architectures, nil
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		// A single manifest only has an architecture in its config
+		var manifest ocispec.Manifest
+		if err := fetchJson(ctx, fetcher, desc, &manifest); err != nil {
+			return nil, err
+		}
+
+		var config ocispec.Image
+		if err := fetchJson(ctx, fetcher, manifest.Config, &config); err != nil {
+			return nil, err
+		}
+
+		return []string{config.Architecture}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported media type %s", desc.MediaType)
+}
+
+/*
+Checks whether every image of the manifest is published for architecture.
+Images that can't be inspected (e.g. private registries) are skipped.
+*/
+func validateImageArchitectures(manifest string, architecture string) *Error {
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		return &Error{status: http.StatusBadRequest, message: "Something went wrong while decoding the manifest"}
+	}
+
+	var unsupportedImages []string
+	for _, image := range getManifestImages(objects) {
+		architectures, err := getImageArchitectures(image)
+		if err != nil {
+			fmt.Println("Could not verify the architectures of image", image+":", err)
+			continue
+		}
+
+		supported := false
+		for _, imageArchitecture := range architectures {
+			if imageArchitecture == architecture {
+				supported = true
+				break
+			}
+		}
+
+		if !supported {
+			unsupportedImages = append(unsupportedImages, image)
+		}
+	}
+
+	if len(unsupportedImages) > 0 {
+		return &Error{status: http.StatusBadRequest, message: "Images " + strings.Join(unsupportedImages, ", ") + " are not published for " + architecture}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/transport"
+)
+
+// Key of the instructor that is impersonated in the context of a request
+type impersonatedUserKey struct{}
+
+// Transport that performs requests as the instructor in their context, instead of as ScaLaMa itself
+type impersonationTransport struct {
+	next http.RoundTripper
+}
+
+/*
+Checks whether provisioning impersonates the calling instructor, configured by SCALAMA_IMPERSONATION ("true").
+The instructor then authenticates with the same (OIDC) bearer token they use for the cluster.
+*/
+func isImpersonationEnabled() bool {
+	return os.Getenv("SCALAMA_IMPERSONATION") == "true"
+}
+
+/*
+Authenticates the bearer token of a request with a TokenReview.
+Returns the user the token belongs to, as the API server sees them.
+*/
+func getRequestUser(r *http.Request, clientset kubernetes.Interface) (*authenticationv1.UserInfo, *Error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return nil, &Error{status: http.StatusUnauthorized, message: "A bearer token is required"}
+	}
+
+	ctx, cancel := withOperationTimeout(r.Context())
+	defer cancel()
+
+	tokenReview := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token: token,
+		},
+	}
+
+	tokenReview, err := clientset.AuthenticationV1().TokenReviews().Create(ctx, tokenReview, v1.CreateOptions{})
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reviewing the bearer token"}
+	}
+
+	if !tokenReview.Status.Authenticated {
+		return nil, &Error{status: http.StatusUnauthorized, message: "The bearer token is not valid for the cluster"}
+	}
+
+	return &tokenReview.Status.User, nil
+}
+
+/*
+Authenticates the instructor when impersonation is enabled, so the Kubernetes requests of next are performed as them.
+Cluster RBAC then limits what every instructor can provision.
+*/
+func (s *Server) impersonationMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isImpersonationEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := getRequestUser(r, s.clientset)
+		if err != nil {
+			http.Error(w, err.message, err.status)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), impersonatedUserKey{}, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+/*
+Returns ctx without the impersonated user, for the Kubernetes requests ScaLaMa makes on its own behalf (e.g. storing the state of labs).
+*/
+func withoutImpersonation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, impersonatedUserKey{}, nil)
+}
+
+func (t *impersonationTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	user, ok := request.Context().Value(impersonatedUserKey{}).(*authenticationv1.UserInfo)
+	if !ok {
+		return t.next.RoundTrip(request)
+	}
+
+	extra := make(map[string][]string)
+	for key, value := range user.Extra {
+		extra[key] = value
+	}
+
+	impersonate := transport.ImpersonationConfig{
+		UserName: user.Username,
+		UID:      user.UID,
+		Groups:   user.Groups,
+		Extra:    extra,
+	}
+
+	return transport.NewImpersonatingRoundTripper(impersonate, t.next).RoundTrip(request)
+}
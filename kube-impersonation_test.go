@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func TestImpersonationMiddleware(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := map[string]struct {
+		enabled string
+		token   string
+		status  int
+		user    string
+	}{
+		"disabled":           {"", "", http.StatusOK, ""},
+		"disabled and token": {"", "ann", http.StatusOK, ""},
+		"no token":           {"true", "", http.StatusUnauthorized, ""},
+		"token":              {"true", "ann", http.StatusOK, "ann"},
+	}
+
+	for name, test := range tests {
+		t.Setenv("SCALAMA_IMPERSONATION", test.enabled)
+
+		var user string
+		next := func(w http.ResponseWriter, r *http.Request) {
+			if impersonated, ok := r.Context().Value(impersonatedUserKey{}).(*authenticationv1.UserInfo); ok {
+				user = impersonated.Username
+			}
+
+			// ScaLaMa's own requests never run as the user
+			if withoutImpersonation(r.Context()).Value(impersonatedUserKey{}) != nil {
+				t.Errorf("%s: expected no impersonated user without impersonation", name)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		s.impersonationMiddleware(next).ServeHTTP(w, newTestRequest(http.MethodPost, "/lab", test.token, nil))
+
+		if w.Code != test.status || user != test.user {
+			t.Errorf("%s: expected %d as %q, got %d as %q: %s", name, test.status, test.user, w.Code, user, w.Body.String())
+		}
+	}
+}
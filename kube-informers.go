@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+/*
+Starts shared informers for Namespaces, ClusterRoleBindings and the ClusterRoles managed by ScaLaMa,
+so existence checks, listings and deletion scans are served from a local cache instead of the API server.
+Blocks until the caches are synced.
+*/
+func (s *Server) startInformers(ctx context.Context, clientset kubernetes.Interface) error {
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	factory.Core().V1().Namespaces().Informer()
+	factory.Rbac().V1().ClusterRoleBindings().Informer()
+
+	managedFactory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = managedByLabel + "=" + managedByLabelVal
+	}))
+	managedFactory.Rbac().V1().ClusterRoles().Informer()
+
+	factory.Start(ctx.Done())
+	managedFactory.Start(ctx.Done())
+
+	syncCtx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	for informerType, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return fmt.Errorf("cache of %v did not sync", informerType)
+		}
+	}
+	for informerType, synced := range managedFactory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return fmt.Errorf("cache of %v did not sync", informerType)
+		}
+	}
+
+	s.informerFactory = factory
+	s.managedInformerFactory = managedFactory
+	return nil
+}
+
+/*
+Adds an object that was just created to the cache of an informer, so it can be read back before its watch event arrives.
+Objects created in dry-run mode don't exist, so they are never cached.
+*/
+func addToCache(informer cache.SharedIndexInformer, obj interface{}) {
+	if *dryRunMode {
+		return
+	}
+
+	informer.GetIndexer().Add(obj)
+}
+
+/*
+Returns every namespace in the cluster.
+*/
+func (s *Server) listNamespaces(ctx context.Context, clientset kubernetes.Interface) ([]*corev1.Namespace, error) {
+	if s.informerFactory != nil {
+		return s.informerFactory.Core().V1().Namespaces().Lister().List(labels.Everything())
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*corev1.Namespace
+	for i := range namespaces.Items {
+		result = append(result, &namespaces.Items[i])
+	}
+
+	return result, nil
+}
+
+/*
+Returns the names of every namespace in the cluster.
+*/
+func (s *Server) listNamespaceNames(ctx context.Context, clientset kubernetes.Interface) ([]string, error) {
+	namespaces, err := s.listNamespaces(ctx, clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, namespace := range namespaces {
+		names = append(names, namespace.Name)
+	}
+
+	return names, nil
+}
+
+/*
+Returns the names of every ClusterRoleBinding in the cluster.
+*/
+func (s *Server) listClusterRoleBindingNames(ctx context.Context, clientset kubernetes.Interface) ([]string, error) {
+	var names []string
+
+	if s.informerFactory != nil {
+		clusterRoleBindings, err := s.informerFactory.Rbac().V1().ClusterRoleBindings().Lister().List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, clusterRoleBinding := range clusterRoleBindings {
+			names = append(names, clusterRoleBinding.Name)
+		}
+
+		return names, nil
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, clusterRoleBinding := range clusterRoleBindings.Items {
+		names = append(names, clusterRoleBinding.Name)
+	}
+
+	return names, nil
+}
+
+/*
+Returns the names of the ClusterRoles labeled as managed by ScaLaMa for a lab.
+*/
+func (s *Server) listLabClusterRoleNames(ctx context.Context, clientset kubernetes.Interface, labName string) ([]string, error) {
+	var names []string
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: managedByLabelVal, labLabel: labName})
+
+	if s.managedInformerFactory != nil {
+		clusterRoles, err := s.managedInformerFactory.Rbac().V1().ClusterRoles().Lister().List(selector)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, clusterRole := range clusterRoles {
+			names = append(names, clusterRole.Name)
+		}
+
+		return names, nil
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	clusterRoles, err := clientset.RbacV1().ClusterRoles().List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, clusterRole := range clusterRoles.Items {
+		names = append(names, clusterRole.Name)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// Flows of the Logging operator (Fluent Bit + Fluentd) route the logs of the pods of their namespace to outputs
+var loggingFlowResource = schema.GroupVersionResource{Group: "logging.banzaicloud.io", Version: "v1beta1", Resource: "flows"}
+
+// Name of the Flow that forwards the logs of a namespace of a lab
+const logFlowName = "scalama-logs"
+
+/*
+Forwards the logs of every pod of a namespace of a lab to ClusterOutputs of the Logging operator (e.g. Loki or Elasticsearch).
+Every record gets the lab and user of the namespace, so outputs can use them as (Loki tenant) labels or index fields,
+and the logs of a student remain searchable after the namespace is deleted.
+*/
+func createLogFlow(ctx context.Context, dynamicInterface dynamic.Interface, labName string, namespace string, outputs []string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	user := ""
+	if namespace != "ns-"+labName {
+		user = strings.TrimPrefix(namespace, "ns-"+labName+"-")
+	}
+
+	var globalOutputRefs []interface{}
+	for _, output := range outputs {
+		globalOutputRefs = append(globalOutputRefs, output)
+	}
+
+	flow := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "logging.banzaicloud.io/v1beta1",
+		"kind":       "Flow",
+		"metadata": map[string]interface{}{
+			"name":      logFlowName,
+			"namespace": namespace,
+			"labels": map[string]interface{}{
+				managedByLabel: managedByLabelVal,
+				labLabel:       labName,
+			},
+		},
+		"spec": map[string]interface{}{
+			"filters": []interface{}{
+				map[string]interface{}{
+					"record_modifier": map[string]interface{}{
+						"records": []interface{}{
+							map[string]interface{}{"scalama_lab": labName},
+							map[string]interface{}{"scalama_namespace": namespace},
+							map[string]interface{}{"scalama_user": user},
+						},
+					},
+				},
+			},
+			"globalOutputRefs": globalOutputRefs,
+		},
+	}}
+
+	_, err := dynamicInterface.Resource(loggingFlowResource).Namespace(namespace).Create(ctx, flow, metav1.CreateOptions{})
+	return ignoreAlreadyExists(err)
+}
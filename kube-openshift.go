@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+var projectRequestResource = schema.GroupVersionResource{Group: "project.openshift.io", Version: "v1", Resource: "projectrequests"}
+
+/*
+Checks whether the cluster is OpenShift by looking for the project API.
+Can be overridden with SCALAMA_OPENSHIFT=true or SCALAMA_OPENSHIFT=false.
+*/
+func detectOpenShift(clientset kubernetes.Interface) (bool, error) {
+	switch os.Getenv("SCALAMA_OPENSHIFT") {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	_, err := clientset.Discovery().ServerResourcesForGroupVersion(projectRequestResource.GroupVersion().String())
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+/*
+Creates an OpenShift project (and its namespace) with a ProjectRequest.
+*/
+func createProject(ctx context.Context, dynamicInterface dynamic.Interface, name string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	projectRequest := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "project.openshift.io/v1",
+		"kind":       "ProjectRequest",
+		"metadata": map[string]interface{}{
+			"name": name,
+		},
+	}}
+
+	_, err := dynamicInterface.Resource(projectRequestResource).Create(ctx, projectRequest, metav1.CreateOptions{})
+	return err
+}
+
+/*
+Converts an Ingress to a Route for every path of every rule.
+The Routes keep the labels, annotations and single_instance setting of the Ingress.
+*/
+func convertIngressToRoutes(ingress *unstructured.Unstructured) []*unstructured.Unstructured {
+	// Hosts that have TLS enabled
+	tlsHosts := make(map[string]bool)
+	tlsList, _, _ := unstructured.NestedSlice(ingress.Object, "spec", "tls")
+	for _, tls := range tlsList {
+		tlsMap, ok := tls.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		hosts, _, _ := unstructured.NestedStringSlice(tlsMap, "hosts")
+		for _, host := range hosts {
+			tlsHosts[host] = true
+		}
+	}
+
+	type routeRule struct {
+		host    string
+		path    string
+		backend map[string]interface{}
+	}
+
+	var rules []routeRule
+	if backend, found, _ := unstructured.NestedMap(ingress.Object, "spec", "defaultBackend"); found {
+		rules = append(rules, routeRule{backend: backend})
+	}
+
+	ruleList, _, _ := unstructured.NestedSlice(ingress.Object, "spec", "rules")
+	for _, rule := range ruleList {
+		ruleMap, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		host, _, _ := unstructured.NestedString(ruleMap, "host")
+		paths, _, _ := unstructured.NestedSlice(ruleMap, "http", "paths")
+
+		for _, path := range paths {
+			pathMap, ok := path.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			pathValue, _, _ := unstructured.NestedString(pathMap, "path")
+			backend, _, _ := unstructured.NestedMap(pathMap, "backend")
+			rules = append(rules, routeRule{host: host, path: pathValue, backend: backend})
+		}
+	}
+
+	var routes []*unstructured.Unstructured
+	for i, rule := range rules {
+		name := ingress.GetName()
+		if len(rules) > 1 {
+			name = fmt.Sprintf("%s-%d", name, i)
+		}
+
+		serviceName, _, _ := unstructured.NestedString(rule.backend, "service", "name")
+		spec := map[string]interface{}{
+			"to": map[string]interface{}{
+				"kind":   "Service",
+				"name":   serviceName,
+				"weight": int64(100),
+			},
+		}
+
+		if portNumber, found, _ := unstructured.NestedFieldCopy(rule.backend, "service", "port", "number"); found {
+			spec["port"] = map[string]interface{}{"targetPort": portNumber}
+		} else if portName, found, _ := unstructured.NestedString(rule.backend, "service", "port", "name"); found {
+			spec["port"] = map[string]interface{}{"targetPort": portName}
+		}
+
+		if rule.host != "" {
+			spec["host"] = rule.host
+		}
+		if rule.path != "" && rule.path != "/" {
+			spec["path"] = rule.path
+		}
+		if tlsHosts[rule.host] {
+			spec["tls"] = map[string]interface{}{
+				"termination":                   "edge",
+				"insecureEdgeTerminationPolicy": "Redirect",
+			}
+		}
+
+		metadata := map[string]interface{}{"name": name}
+		ingressMetadata, _, _ := unstructured.NestedMap(ingress.Object, "metadata")
+		for _, key := range []string{"labels", "annotations", "single_instance"} {
+			if value, ok := ingressMetadata[key]; ok {
+				metadata[key] = value
+			}
+		}
+
+		routes = append(routes, &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "route.openshift.io/v1",
+			"kind":       "Route",
+			"metadata":   metadata,
+			"spec":       spec,
+		}})
+	}
+
+	return routes
+}
+
+/*
+Rewrites a manifest for OpenShift, every Ingress is replaced with Routes.
+*/
+func convertManifestForOpenShift(manifest string) (string, error) {
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	var documents []string
+	for _, unstructuredObj := range objects {
+		converted := []*unstructured.Unstructured{unstructuredObj}
+		if unstructuredObj.GetKind() == "Ingress" {
+			converted = convertIngressToRoutes(unstructuredObj)
+		}
+
+		for _, obj := range converted {
+			document, err := yaml.Marshal(obj.Object)
+			if err != nil {
+				return "", err
+			}
+
+			documents = append(documents, string(document))
+		}
+	}
+
+	return strings.Join(documents, "---\n"), nil
+}
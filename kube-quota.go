@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Usage of a resource limited by a ResourceQuota
+type ResourceUsage struct {
+	Hard    string `json:"hard"`
+	Used    string `json:"used"`
+	AtLimit bool   `json:"atLimit"`
+}
+
+/*
+Returns the usage of every resource limited by the ResourceQuotas of a namespace, per ResourceQuota.
+A resource is at its limit when nothing more of it can be requested.
+*/
+func getQuotaUsage(ctx context.Context, clientset kubernetes.Interface, namespace string) (map[string]map[string]ResourceUsage, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	quotas, err := clientset.CoreV1().ResourceQuotas(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]map[string]ResourceUsage)
+	for _, quota := range quotas.Items {
+		quotaUsage := make(map[string]ResourceUsage)
+
+		// The status is only filled in once the quota controller has seen the quota
+		hard := quota.Status.Hard
+		if hard == nil {
+			hard = quota.Spec.Hard
+		}
+
+		for name, hardQuantity := range hard {
+			used := quota.Status.Used[name]
+
+			quotaUsage[string(name)] = ResourceUsage{
+				Hard:    hardQuantity.String(),
+				Used:    used.String(),
+				AtLimit: used.Cmp(hardQuantity) >= 0,
+			}
+		}
+
+		usage[quota.Name] = quotaUsage
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	rancherProjectResource            = schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "projects"}
+	rancherProjectRoleBindingResource = schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "projectroletemplatebindings"}
+)
+
+// Label and annotation that attach a namespace to a Rancher project
+const rancherProjectIdKey = "field.cattle.io/projectId"
+
+/*
+Checks whether the cluster is managed by Rancher by looking for the management API.
+*/
+func detectRancher(clientset kubernetes.Interface) (bool, error) {
+	_, err := clientset.Discovery().ServerResourcesForGroupVersion(rancherProjectResource.GroupVersion().String())
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+/*
+Returns the ID of the cluster in Rancher, configured by SCALAMA_RANCHER_CLUSTER_ID.
+*/
+func getRancherClusterId() string {
+	if clusterId := os.Getenv("SCALAMA_RANCHER_CLUSTER_ID"); clusterId != "" {
+		return clusterId
+	}
+
+	return "local"
+}
+
+/*
+Returns the ID of the Rancher project of a lab.
+*/
+func getRancherProjectId(labName string) string {
+	return "p-" + labName
+}
+
+/*
+Creates the Rancher project of a lab if it does not yet exist.
+*/
+func createRancherProject(ctx context.Context, dynamicInterface dynamic.Interface, labName string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	clusterId := getRancherClusterId()
+
+	project := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "management.cattle.io/v3",
+		"kind":       "Project",
+		"metadata": map[string]interface{}{
+			"name":      getRancherProjectId(labName),
+			"namespace": clusterId,
+		},
+		"spec": map[string]interface{}{
+			"clusterName": clusterId,
+			"displayName": "lab-" + labName,
+		},
+	}}
+
+	_, err := dynamicInterface.Resource(rancherProjectResource).Namespace(clusterId).Create(ctx, project, metav1.CreateOptions{})
+	return ignoreAlreadyExists(err)
+}
+
+/*
+Attaches a namespace to the Rancher project of a lab.
+*/
+func attachNamespaceToRancherProject(ctx context.Context, clientset kubernetes.Interface, namespace string, labName string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	projectId := getRancherProjectId(labName)
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]string{rancherProjectIdKey: projectId},
+			"annotations": map[string]string{rancherProjectIdKey: getRancherClusterId() + ":" + projectId},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.CoreV1().Namespaces().Patch(ctx, namespace, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+/*
+Gives a Rancher user a role (e.g. project-owner, project-member, read-only) on the Rancher project of a lab.
+*/
+func createRancherProjectRoleBinding(ctx context.Context, dynamicInterface dynamic.Interface, labName string, userId string, roleTemplateName string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	projectId := getRancherProjectId(labName)
+
+	binding := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "management.cattle.io/v3",
+		"kind":       "ProjectRoleTemplateBinding",
+		"metadata": map[string]interface{}{
+			"name":      roleTemplateName + "-" + userId,
+			"namespace": projectId,
+		},
+		"projectName":      getRancherClusterId() + ":" + projectId,
+		"roleTemplateName": roleTemplateName,
+		"userName":         userId,
+	}}
+
+	_, err := dynamicInterface.Resource(rancherProjectRoleBindingResource).Namespace(projectId).Create(ctx, binding, metav1.CreateOptions{})
+	return ignoreAlreadyExists(err)
+}
+
+/*
+Deletes the Rancher project of a lab, if it exists.
+*/
+func deleteRancherProject(ctx context.Context, dynamicInterface dynamic.Interface, labName string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	err := dynamicInterface.Resource(rancherProjectResource).Namespace(getRancherClusterId()).Delete(ctx, getRancherProjectId(labName), metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
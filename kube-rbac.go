@@ -2,19 +2,29 @@ package main
 
 import (
 	"context"
+	"io"
+	"net/http"
+	"sort"
 	"strings"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
 )
 
 /*
 Checks whether the read-namespaces-cr ClusterRole exists.
 */
-func readNamespaceClusterRoleExists(clienset *kubernetes.Clientset) (bool, error) {
-	_, err := clientset.RbacV1().ClusterRoles().Get(context.TODO(), "read-namespaces-cr", v1.GetOptions{})
+func readNamespaceClusterRoleExists(ctx context.Context, clientset kubernetes.Interface) (bool, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	_, err := clientset.RbacV1().ClusterRoles().Get(ctx, "read-namespaces-cr", v1.GetOptions{})
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "not found") {
 			return false, nil
@@ -29,7 +39,10 @@ func readNamespaceClusterRoleExists(clienset *kubernetes.Clientset) (bool, error
 /*
 Creates the read-namespaces-cr ClusterRole. This ClusterRole defines permissions to "list" and "get" namespaces.
 */
-func createReadNamespacesClusterRole(clientset *kubernetes.Clientset) error {
+func createReadNamespacesClusterRole(ctx context.Context, clientset kubernetes.Interface) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
 	clusterRole := &rbacv1.ClusterRole{
 		TypeMeta: v1.TypeMeta{
 			APIVersion: "rbac.authorization.k8s.io/v1",
@@ -47,7 +60,7 @@ func createReadNamespacesClusterRole(clientset *kubernetes.Clientset) error {
 		},
 	}
 
-	if _, err := clientset.RbacV1().ClusterRoles().Create(context.TODO(), clusterRole, v1.CreateOptions{}); err != nil {
+	if _, err := clientset.RbacV1().ClusterRoles().Create(ctx, clusterRole, v1.CreateOptions{}); err != nil {
 		return err
 	}
 
@@ -55,44 +68,215 @@ func createReadNamespacesClusterRole(clientset *kubernetes.Clientset) error {
 }
 
 /*
-Creates a ClusterRoleBinding for the read-namespaces-cr ClusterRole. Binds the permissions to a ServiceAccount defined by username and namespace.
-The labName parameter is used to ensure the uniqueness of the ClusterRoleBinding name.
+Returns the subject of a ServiceAccount with username inside of namespace.
 */
-func createReadNamespacesClusterRoleBinding(clientset *kubernetes.Clientset, labName string, username string, namespace string) error {
-	clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+func getServiceAccountSubject(username string, namespace string) rbacv1.Subject {
+	return rbacv1.Subject{
+		Kind:      "ServiceAccount",
+		Name:      username,
+		Namespace: namespace,
+	}
+}
+
+/*
+Returns the name of the ClusterRole that lets the students of a lab read namespaces.
+With lab visibility the students can only read the namespaces of their own lab.
+*/
+func getReadNamespacesClusterRoleName(labName string, options *LabOptions) string {
+	if options.NamespaceVisibility == namespaceVisibilityLab {
+		return "read-namespaces-cr-" + labName
+	}
+
+	return "read-namespaces-cr"
+}
+
+/*
+Creates or updates the ClusterRole that only allows reading the namespaces of a lab.
+Namespaces can't be listed per name, so the students can only get the namespaces they know (e.g. from the namespaces endpoint of the lab).
+*/
+func (s *Server) updateLabNamespacesClusterRole(ctx context.Context, clientset kubernetes.Interface, labName string) error {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	clusterRole := &rbacv1.ClusterRole{
 		TypeMeta: v1.TypeMeta{
 			APIVersion: "rbac.authorization.k8s.io/v1",
-			Kind:       "ClusterRoleBinding",
+			Kind:       "ClusterRole",
 		},
 		ObjectMeta: v1.ObjectMeta{
-			Name:      "read-namespaces-crb-" + labName + "-" + username,
-			Namespace: namespace,
+			Name:   "read-namespaces-cr-" + labName,
+			Labels: map[string]string{managedByLabel: managedByLabelVal, labLabel: labName},
 		},
-		Subjects: []rbacv1.Subject{
+		Rules: []rbacv1.PolicyRule{
 			0: {
-				Kind:      "ServiceAccount",
-				Name:      username,
-				Namespace: namespace,
+				APIGroups:     []string{""},
+				Verbs:         []string{"get"},
+				Resources:     []string{"namespaces"},
+				ResourceNames: append([]string{"ns-" + labName}, namespaces...),
 			},
 		},
+	}
+
+	existing, err := clientset.RbacV1().ClusterRoles().Get(ctx, clusterRole.Name, v1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		created, err := clientset.RbacV1().ClusterRoles().Create(ctx, clusterRole, v1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+
+		if s.managedInformerFactory != nil {
+			addToCache(s.managedInformerFactory.Rbac().V1().ClusterRoles().Informer(), created)
+		}
+		return nil
+	}
+
+	existing.Rules = clusterRole.Rules
+	_, err = clientset.RbacV1().ClusterRoles().Update(ctx, existing, v1.UpdateOptions{})
+	return err
+}
+
+// Labels of ClusterRoles that are aggregated into the ClusterRole of one lab or of every lab
+const (
+	aggregateToLabLabel  = "scalama.io/aggregate-to-lab"
+	aggregateToLabsLabel = "scalama.io/aggregate-to-labs"
+)
+
+/*
+Returns the name of the aggregated ClusterRole of a lab.
+*/
+func getLabClusterRoleName(labName string) string {
+	return "scalama-lab-" + labName
+}
+
+/*
+Creates the aggregated ClusterRole of a lab if it doesn't exist yet. The ClusterRole has no rules of its own,
+it gets the rules of every ClusterRole labeled with scalama.io/aggregate-to-lab=<labName> or scalama.io/aggregate-to-labs=true.
+Lab-wide permissions (e.g. reading a course-wide CRD) can then be added without changing the bindings of the students.
+*/
+func (s *Server) createLabClusterRole(ctx context.Context, clientset kubernetes.Interface, labName string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	clusterRole := &rbacv1.ClusterRole{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "ClusterRole",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:   getLabClusterRoleName(labName),
+			Labels: map[string]string{managedByLabel: managedByLabelVal, labLabel: labName},
+		},
+		AggregationRule: &rbacv1.AggregationRule{
+			ClusterRoleSelectors: []v1.LabelSelector{
+				{MatchLabels: map[string]string{aggregateToLabLabel: labName}},
+				{MatchLabels: map[string]string{aggregateToLabsLabel: "true"}},
+			},
+		},
+	}
+
+	created, err := clientset.RbacV1().ClusterRoles().Create(ctx, clusterRole, v1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.managedInformerFactory != nil {
+		addToCache(s.managedInformerFactory.Rbac().V1().ClusterRoles().Informer(), created)
+	}
+
+	return nil
+}
+
+/*
+Binds the aggregated ClusterRole of a lab to the subjects of a user (or group).
+*/
+func (s *Server) createLabClusterRoleBinding(ctx context.Context, clientset kubernetes.Interface, labName string, username string, subjects []rbacv1.Subject) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "ClusterRoleBinding",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:   getLabClusterRoleName(labName) + "-" + username,
+			Labels: map[string]string{managedByLabel: managedByLabelVal, labLabel: labName},
+		},
+		Subjects: subjects,
+		RoleRef: rbacv1.RoleRef{
+			Kind:     "ClusterRole",
+			Name:     getLabClusterRoleName(labName),
+			APIGroup: "rbac.authorization.k8s.io",
+		},
+	}
+
+	created, err := clientset.RbacV1().ClusterRoleBindings().Create(ctx, clusterRoleBinding, v1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	if s.informerFactory != nil {
+		addToCache(s.informerFactory.Rbac().V1().ClusterRoleBindings().Informer(), created)
+	}
+
+	return nil
+}
+
+/*
+Creates a ClusterRoleBinding for the read-namespaces ClusterRole with clusterRoleName. Binds the permissions to the subjects of a user (or group) defined by username and namespace.
+The labName parameter is used to ensure the uniqueness of the ClusterRoleBinding name.
+*/
+func (s *Server) createReadNamespacesClusterRoleBinding(ctx context.Context, clientset kubernetes.Interface, labName string, username string, namespace string, subjects []rbacv1.Subject, clusterRoleName string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "ClusterRoleBinding",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name: "read-namespaces-crb-" + labName + "-" + username,
+		},
+		Subjects: subjects,
 		RoleRef: rbacv1.RoleRef{
 			Kind:     "ClusterRole",
-			Name:     "read-namespaces-cr",
+			Name:     clusterRoleName,
 			APIGroup: "rbac.authorization.k8s.io",
 		},
 	}
 
-	if _, err := clientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), clusterRoleBinding, v1.CreateOptions{}); err != nil {
+	created, err := clientset.RbacV1().ClusterRoleBindings().Create(ctx, clusterRoleBinding, v1.CreateOptions{})
+	if err != nil {
 		return err
 	}
 
+	if s.informerFactory != nil {
+		addToCache(s.informerFactory.Rbac().V1().ClusterRoleBindings().Informer(), created)
+	}
+
 	return nil
 }
 
 /*
 Creates a Role with a name inside of a namespace with the permissions defined in the verbs paramter on all resources of all APIGroups.
 */
-func createRole(clientset *kubernetes.Clientset, name string, namespace string, verbs []string) error {
+func (s *Server) createRole(ctx context.Context, clientset kubernetes.Interface, name string, namespace string, verbs []string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
 	role := &rbacv1.Role{
 		TypeMeta: v1.TypeMeta{
 			APIVersion: "rbac.authorization.k8s.io/v1",
@@ -102,16 +286,234 @@ func createRole(clientset *kubernetes.Clientset, name string, namespace string,
 			Name:      name,
 			Namespace: namespace,
 		},
-		Rules: []rbacv1.PolicyRule{
+		Rules: s.clusterPolicy.restrictRules([]rbacv1.PolicyRule{
 			0: {
 				APIGroups: []string{"*"},
 				Verbs:     verbs,
 				Resources: []string{"*"},
 			},
+		}),
+	}
+
+	if _, err := clientset.RbacV1().Roles(namespace).Create(ctx, role, v1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+Returns the kind and name of the full-permission role of a student namespace.
+On OpenShift a wildcard Role would allow the use of every SecurityContextConstraint, so the built-in admin ClusterRole is used instead.
+*/
+func (s *Server) getStudentRoleRef() (string, string) {
+	if s.isOpenShift {
+		return "ClusterRole", "admin"
+	}
+
+	return "Role", "student"
+}
+
+/*
+Creates the full-permission role of a student namespace, unless a built-in ClusterRole is used.
+*/
+func (s *Server) createStudentRole(ctx context.Context, clientset kubernetes.Interface, namespace string) error {
+	if roleKind, _ := s.getStudentRoleRef(); roleKind != "Role" {
+		return nil
+	}
+
+	return s.createRole(ctx, clientset, "student", namespace, []string{"*"})
+}
+
+/*
+Returns the kind and name of the role of a student. Students without a role get the full-permission role.
+*/
+func (s *Server) getRoleRef(role string) (string, string) {
+	if role == "" {
+		return s.getStudentRoleRef()
+	}
+
+	return "Role", "student-" + role
+}
+
+/*
+Creates a Role for every named role of a lab inside of a namespace.
+*/
+func (s *Server) createLabRoles(ctx context.Context, clientset kubernetes.Interface, namespace string, roles map[string][]rbacv1.PolicyRule) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	for name, rules := range roles {
+		role := &rbacv1.Role{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "rbac.authorization.k8s.io/v1",
+				Kind:       "Role",
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      "student-" + name,
+				Namespace: namespace,
+			},
+			Rules: s.clusterPolicy.restrictRules(rules),
+		}
+
+		if _, err := clientset.RbacV1().Roles(namespace).Create(ctx, role, v1.CreateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns the students of a namespace per role.
+*/
+func getStudentsPerRole(students []Student) map[string][]Student {
+	studentsPerRole := make(map[string][]Student)
+
+	for _, student := range students {
+		studentsPerRole[student.role] = append(studentsPerRole[student.role], student)
+	}
+
+	return studentsPerRole
+}
+
+/*
+Checks whether the role of every student is declared by the lab.
+Students that share a ServiceAccount (groups) also share their permissions, so they need the same role.
+*/
+func validateStudentRoles(namespaceStudents map[string][]Student, options *LabOptions) *Error {
+	for namespace, students := range namespaceStudents {
+		for _, student := range students {
+			if _, ok := options.Roles[student.role]; student.role != "" && !ok {
+				return &Error{status: http.StatusBadRequest, message: "Role " + student.role + " of " + student.name + " is not declared in roles"}
+			}
+		}
+
+		if options.IdentityProvider == "" && len(getStudentsPerRole(students)) > 1 {
+			return &Error{status: http.StatusBadRequest, message: "The students of namespace " + namespace + " have different roles, which requires an identityProvider"}
+		}
+	}
+
+	return nil
+}
+
+/*
+Checks whether the students can read a resource of the shared lab namespace, every resource can be read unless the lab restricts them.
+*/
+func isSharedResource(groupResource schema.GroupResource, options *LabOptions) bool {
+	if len(options.SharedResources) == 0 {
+		return true
+	}
+
+	for _, resource := range options.SharedResources {
+		if schema.ParseGroupResource(resource) == groupResource {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Returns read-only rules for the shared lab namespace that only cover the single-instance objects of the manifest, limited to the shared resources of the lab.
+Objects are restricted by name, the pods of shared workloads can't be known up front so every pod can be read.
+The extra shared rules of the lab are added as they are.
+*/
+func (s *Server) getSharedReadRules(clientset kubernetes.Interface, manifest string, options *LabOptions) ([]rbacv1.PolicyRule, error) {
+	// Names of the objects per API group and resource
+	names := map[schema.GroupResource][]string{}
+	hasWorkloads := false
+
+	decoder := yamlutil.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 100)
+	for {
+		unstructuredObj, unstructuredMap, mapping, err := handleManifestHelper(clientset, decoder)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Cluster-scoped and shared external objects can't be covered by a Role of the lab namespace
+		if !isSingleInstance(unstructuredMap) || isClusterScoped(mapping) || isSharedExternal(unstructuredObj) || unstructuredObj.GetName() == "" {
+			continue
+		}
+
+		groupResource := mapping.Resource.GroupResource()
+		if !isSharedResource(groupResource, options) {
+			continue
+		}
+		names[groupResource] = append(names[groupResource], unstructuredObj.GetName())
+
+		if _, ok := getPodSpec(unstructuredObj); ok {
+			hasWorkloads = true
+		}
+	}
+
+	dashboardResource := schema.GroupResource{Resource: "services"}
+	if options.Dashboard && isSharedResource(dashboardResource, options) {
+		names[dashboardResource] = append(names[dashboardResource], dashboardName)
+	}
+
+	// Sort the resources so the Role is the same for every lab with the same manifest
+	groupResources := make([]schema.GroupResource, 0, len(names))
+	for groupResource := range names {
+		groupResources = append(groupResources, groupResource)
+	}
+	sort.Slice(groupResources, func(i, j int) bool {
+		return groupResources[i].String() < groupResources[j].String()
+	})
+
+	var rules []rbacv1.PolicyRule
+	for _, groupResource := range groupResources {
+		resourceNames := names[groupResource]
+		sort.Strings(resourceNames)
+
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups:     []string{groupResource.Group},
+			Resources:     []string{groupResource.Resource},
+			ResourceNames: resourceNames,
+			Verbs:         []string{"get", "list", "watch"},
+		})
+	}
+
+	if hasWorkloads && isSharedResource(schema.GroupResource{Resource: "pods"}, options) {
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups: []string{""},
+			Resources: []string{"pods", "pods/log"},
+			Verbs:     []string{"get", "list", "watch"},
+		})
+	}
+
+	return s.clusterPolicy.restrictRules(append(rules, options.SharedRules...)), nil
+}
+
+/*
+Creates the read-only student Role of the shared lab namespace, generated from the single-instance objects of the manifest.
+Students can't read or modify anything else in the lab namespace (e.g. Secrets or the stored lab data).
+*/
+func (s *Server) createSharedReadRole(ctx context.Context, clientset kubernetes.Interface, labName string, manifest string, options *LabOptions) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	rules, err := s.getSharedReadRules(clientset, manifest, options)
+	if err != nil {
+		return err
+	}
+
+	role := &rbacv1.Role{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "Role",
 		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "student",
+			Namespace: "ns-" + labName,
+		},
+		Rules: rules,
 	}
 
-	if _, err := clientset.RbacV1().Roles(namespace).Create(context.TODO(), role, v1.CreateOptions{}); err != nil {
+	if _, err := clientset.RbacV1().Roles("ns-"+labName).Create(ctx, role, v1.CreateOptions{}); err != nil {
 		return err
 	}
 
@@ -119,9 +521,32 @@ func createRole(clientset *kubernetes.Clientset, name string, namespace string,
 }
 
 /*
-Creates a RoleBinding with a name inside of a namespace. Binds the permissions of roleName to a ServiceAccount with username inside of userNamespace.
+Checks whether a RoleBinding with a name exists inside of a namespace.
+*/
+func roleBindingExists(ctx context.Context, clientset kubernetes.Interface, name string, namespace string) (bool, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	_, err := clientset.RbacV1().RoleBindings(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+/*
+Creates a RoleBinding with a name inside of a namespace. Binds the permissions of roleName to the subjects (ServiceAccounts or users).
+The roleKind is either "Role" or "ClusterRole".
 */
-func createRoleBinding(clientset *kubernetes.Clientset, name string, namespace string, username string, userNamespace string, roleName string) error {
+func createRoleBinding(ctx context.Context, clientset kubernetes.Interface, name string, namespace string, subjects []rbacv1.Subject, roleKind string, roleName string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
 	roleBinding := &rbacv1.RoleBinding{
 		TypeMeta: v1.TypeMeta{
 			APIVersion: "rbac.authorization.k8s.io/v1",
@@ -131,32 +556,95 @@ func createRoleBinding(clientset *kubernetes.Clientset, name string, namespace s
 			Name:      name,
 			Namespace: namespace,
 		},
-		Subjects: []rbacv1.Subject{
-			0: {
-				Kind:      "ServiceAccount",
-				Name:      username,
-				Namespace: userNamespace,
-			},
-		},
+		Subjects: subjects,
 		RoleRef: rbacv1.RoleRef{
-			Kind:     "Role",
+			Kind:     roleKind,
 			Name:     roleName,
 			APIGroup: "rbac.authorization.k8s.io",
 		},
 	}
 
-	if _, err := clientset.RbacV1().RoleBindings(namespace).Create(context.TODO(), roleBinding, v1.CreateOptions{}); err != nil {
+	if _, err := clientset.RbacV1().RoleBindings(namespace).Create(ctx, roleBinding, v1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+Deletes the bindings of a user (or group) outside of its own namespace, bindings that don't exist are skipped.
+*/
+func deleteStudentBindings(ctx context.Context, clientset kubernetes.Interface, labName string, username string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	err := clientset.RbacV1().RoleBindings("ns-"+labName).Delete(ctx, "student-binding-"+username, v1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	err = clientset.RbacV1().ClusterRoleBindings().Delete(ctx, "read-namespaces-crb-"+labName+"-"+username, v1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	err = clientset.RbacV1().ClusterRoleBindings().Delete(ctx, getLabClusterRoleName(labName)+"-"+username, v1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
 		return err
 	}
 
 	return nil
 }
 
+/*
+Requests a new token for the ServiceAccount with a username inside of a namespace with the TokenRequest API.
+The token expires after expirationSeconds (the default of the cluster when 0) and is only valid for the audiences (the API server when empty).
+*/
+func requestServiceAccountToken(ctx context.Context, clientset kubernetes.Interface, username string, namespace string, expirationSeconds int64, audiences []string) (string, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences: audiences,
+		},
+	}
+	if expirationSeconds > 0 {
+		tokenRequest.Spec.ExpirationSeconds = &expirationSeconds
+	}
+
+	tokenRequest, err := clientset.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, username, tokenRequest, v1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return tokenRequest.Status.Token, nil
+}
+
+/*
+Replaces the ServiceAccount with a username inside of a namespace by a new one, which invalidates every token issued for the old one:
+its Secret token is deleted with it and tokens of the TokenRequest API are bound to the old ServiceAccount.
+Returns the token of the new ServiceAccount, the RoleBindings keep referring to it by name.
+*/
+func regenerateServiceAccount(ctx context.Context, clientset kubernetes.Interface, username string, namespace string, useTokenRequest bool, expirationSeconds int64, audiences []string) (string, error) {
+	deleteCtx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	if err := clientset.CoreV1().ServiceAccounts(namespace).Delete(deleteCtx, username, v1.DeleteOptions{}); err != nil {
+		return "", err
+	}
+
+	return createServiceAccount(ctx, clientset, username, namespace, useTokenRequest, expirationSeconds, audiences)
+}
+
 /*
 Creates a ServiceAccount with a username inside of a namespace.
-Returns the Secret token for that ServiceAccount.
+Returns the Secret token for that ServiceAccount, or a short-lived token from the TokenRequest API when useTokenRequest is set.
 */
-func createServiceAccount(clientset *kubernetes.Clientset, username string, namespace string) (string, error) {
+func createServiceAccount(ctx context.Context, clientset kubernetes.Interface, username string, namespace string, useTokenRequest bool, expirationSeconds int64, audiences []string) (string, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
 	serviceAccount := &corev1.ServiceAccount{
 		TypeMeta: v1.TypeMeta{
 			APIVersion: "v1",
@@ -168,13 +656,22 @@ func createServiceAccount(clientset *kubernetes.Clientset, username string, name
 		},
 	}
 
-	serviceAccount, err := clientset.CoreV1().ServiceAccounts(namespace).Create(context.TODO(), serviceAccount, v1.CreateOptions{})
+	serviceAccount, err := clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, serviceAccount, v1.CreateOptions{})
 	if err != nil {
 		return "", err
 	}
 
+	// The ServiceAccount is not persisted in dry-run mode, so it never gets a token
+	if *dryRunMode {
+		return "dry-run", nil
+	}
+
+	if useTokenRequest {
+		return requestServiceAccountToken(ctx, clientset, username, namespace, expirationSeconds, audiences)
+	}
+
 	for {
-		serviceAccount, err = clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), serviceAccount.GetName(), v1.GetOptions{})
+		serviceAccount, err = clientset.CoreV1().ServiceAccounts(namespace).Get(ctx, serviceAccount.GetName(), v1.GetOptions{})
 		if err != nil {
 			return "", err
 		}
@@ -185,7 +682,7 @@ func createServiceAccount(clientset *kubernetes.Clientset, username string, name
 	}
 
 	secretName := serviceAccount.Secrets[0].Name
-	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, v1.GetOptions{})
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, v1.GetOptions{})
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Students are told to try again after this many seconds while their environment is not ready
+const notReadyRetrySeconds = "30"
+
+/*
+Returns the Deployments, StatefulSets and DaemonSets of a namespace that don't have all their pods ready yet, e.g. "Deployment/db".
+*/
+func getPendingWorkloads(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]string, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	var pending []string
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, deployment := range deployments.Items {
+		replicas := int32(1)
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+		if deployment.Status.ReadyReplicas < replicas {
+			pending = append(pending, "Deployment/"+deployment.Name)
+		}
+	}
+
+	statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, statefulSet := range statefulSets.Items {
+		replicas := int32(1)
+		if statefulSet.Spec.Replicas != nil {
+			replicas = *statefulSet.Spec.Replicas
+		}
+		if statefulSet.Status.ReadyReplicas < replicas {
+			pending = append(pending, "StatefulSet/"+statefulSet.Name)
+		}
+	}
+
+	daemonSets, err := clientset.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, daemonSet := range daemonSets.Items {
+		if daemonSet.Status.NumberReady < daemonSet.Status.DesiredNumberScheduled {
+			pending = append(pending, "DaemonSet/"+daemonSet.Name)
+		}
+	}
+
+	return pending, nil
+}
+
+/*
+Checks whether the credentials of a student can be handed out. Labs with withholdUntilReady only hand them out once the hooks
+completed and the workloads are ready in every namespace of the student, so their first experience isn't a half-broken environment.
+*/
+func checkCredentialsReady(ctx context.Context, clientset kubernetes.Interface, options *LabOptions, namespaces []string) *Error {
+	if !options.WithholdUntilReady {
+		return nil
+	}
+
+	for _, namespace := range namespaces {
+		readiness, err := getNamespaceReadiness(ctx, clientset, namespace)
+		if err != nil {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching namespace " + namespace}
+		}
+
+		if !readiness.Ready {
+			return &Error{status: http.StatusServiceUnavailable, message: "The environment in namespace " + namespace + " is not ready yet, its hooks are " + readiness.HookStatus}
+		}
+
+		pending, err := getPendingWorkloads(ctx, clientset, namespace)
+		if err != nil {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching the workloads of namespace " + namespace}
+		}
+
+		if len(pending) > 0 {
+			return &Error{status: http.StatusServiceUnavailable, message: "The environment in namespace " + namespace + " is not ready yet, waiting for " + strings.Join(pending, ", ")}
+		}
+	}
+
+	return nil
+}
+
+/*
+Writes the error of checkCredentialsReady, asking the student to try again later when the environment isn't ready yet.
+*/
+func writeNotReady(w http.ResponseWriter, e *Error) {
+	if e.status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", notReadyRetrySeconds)
+	}
+
+	http.Error(w, e.message, e.status)
+}
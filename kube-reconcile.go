@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+/*
+Returns the interval of the reconciliation loop, configured by SCALAMA_RECONCILE_INTERVAL (e.g. "5m").
+The loop is disabled when the variable is not set.
+*/
+func getReconcileInterval() (time.Duration, error) {
+	value := os.Getenv("SCALAMA_RECONCILE_INTERVAL")
+	if value == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+/*
+Restores an object of the manifest in a namespace using server-side apply, so only the fields managed by ScaLaMa are reset.
+Returns the applied object.
+*/
+func (s *Server) applyObject(ctx context.Context, dynamicInterface dynamic.Interface, mapping *meta.RESTMapping, desired *unstructured.Unstructured, labName string, namespace string, options *LabOptions) (*unstructured.Unstructured, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	obj := s.getDeployedObject(desired, labName, namespace, options)
+	unstructured.RemoveNestedField(obj.Object, "metadata", "single_instance")
+
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	force := true
+	return dynamicInterface.Resource(mapping.Resource).Namespace(namespace).Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: fieldManager, Force: &force})
+}
+
+/*
+Restores every object of the stored manifest that was deleted or modified in the lab namespace or the student namespaces, in the order of their dependencies.
+*/
+func (s *Server) reconcileLab(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string, manifest string, inputs *LabRenderInputs, options *LabOptions) (err error) {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return err
+	}
+
+	// Student namespaces of charts were deployed from their own render, the others from the manifest of the lab
+	namespaceManifests, err := s.renderStoredNamespaceManifests(ctx, inputs, namespaces, options)
+	if err != nil {
+		return err
+	}
+
+	// Restored objects get a new uid, the applied objects are recorded in the inventory also when reconciling fails halfway
+	var applied []InventoryEntry
+	restored := map[string]int{}
+	defer func() {
+		if inventoryErr := updateInventory(ctx, clientset, labName, applied, nil); err == nil {
+			err = inventoryErr
+		}
+
+		var timeline []TimelineEvent
+		for _, namespace := range namespaces {
+			if restored[namespace] > 0 {
+				timeline = append(timeline, TimelineEvent{Namespace: namespace, Type: timelineManifestApplied, Detail: fmt.Sprintf("restored %d objects", restored[namespace])})
+			}
+		}
+		s.logTimeline(ctx, labName, timeline...)
+	}()
+
+	restore := func(unstructuredObj *unstructured.Unstructured, mapping *meta.RESTMapping, namespace string) error {
+		drift, err := s.getObjectDrift(ctx, dynamicInterface, mapping, unstructuredObj, labName, namespace, options)
+		if err != nil {
+			return err
+		}
+
+		if drift.Status == driftStatusInSync {
+			return nil
+		}
+
+		obj, err := s.applyObject(ctx, dynamicInterface, mapping, unstructuredObj, labName, namespace, options)
+		if err != nil {
+			return err
+		}
+		applied = append(applied, newInventoryEntry(mapping, obj))
+		restored[namespace]++
+
+		fmt.Println("Restored", drift.Status, "object", drift.Kind, drift.Name, "in namespace", namespace)
+
+		return waitForReady(ctx, dynamicInterface, mapping, unstructuredObj, namespace)
+	}
+
+	objects, err := getReconciledObjects(manifest)
+	if err != nil {
+		return err
+	}
+
+	for _, unstructuredObj := range objects {
+		gvk := unstructuredObj.GroupVersionKind()
+		mapping, err := getObjectMapping(clientset, &gvk)
+		if err != nil {
+			return err
+		}
+
+		if isCreatedOnce(unstructuredObj, mapping) {
+			if err := restore(unstructuredObj, mapping, getSharedNamespace(unstructuredObj, mapping, labName)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, namespace := range namespaces {
+			if _, ok := namespaceManifests[namespace]; ok {
+				continue
+			}
+
+			if err := restore(unstructuredObj, mapping, namespace); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The shared objects of a namespace render were created with the manifest of the lab
+	for _, namespace := range namespaces {
+		namespaceManifest, ok := namespaceManifests[namespace]
+		if !ok {
+			continue
+		}
+
+		objects, err := getReconciledObjects(namespaceManifest)
+		if err != nil {
+			return err
+		}
+
+		for _, unstructuredObj := range objects {
+			gvk := unstructuredObj.GroupVersionKind()
+			mapping, err := getObjectMapping(clientset, &gvk)
+			if err != nil {
+				return err
+			}
+
+			if isCreatedOnce(unstructuredObj, mapping) {
+				continue
+			}
+
+			if err := restore(unstructuredObj, mapping, namespace); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns the objects of a manifest that are reconciled, in the order they are created. Hooks only run once, a completed or cleaned up hook is not restored.
+*/
+func getReconciledObjects(manifest string) ([]*unstructured.Unstructured, error) {
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err = sortManifestObjects(objects)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, _ = splitHooks(objects)
+	return objects, nil
+}
+
+/*
+Periodically reconciles every lab that has a stored manifest. Errors are logged, the loop only stops when ctx is cancelled.
+*/
+func (s *Server) startReconcileLoop(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		labNames, err := s.getLabNames(ctx, clientset)
+		if err != nil {
+			fmt.Println("Something went wrong while listing the labs:", err)
+			continue
+		}
+
+		for _, labName := range labNames {
+			labData, err := s.getLabData(ctx, labName)
+			if err != nil {
+				fmt.Println("Something went wrong while fetching lab "+labName+":", err)
+				continue
+			}
+
+			manifest, ok := labData["manifest"]
+			if !ok {
+				continue
+			}
+
+			options, err := getStoredLabOptions(labData)
+			if err != nil {
+				fmt.Println("Something went wrong while reading the options of lab "+labName+":", err)
+				continue
+			}
+
+			inputs, err := getStoredRenderInputs(labData)
+			if err != nil {
+				fmt.Println("Something went wrong while reading the render inputs of lab "+labName+":", err)
+				continue
+			}
+
+			if err := s.reconcileLab(ctx, clientset, dynamicInterface, labName, manifest, inputs, options); err != nil {
+				fmt.Println("Something went wrong while reconciling lab "+labName+":", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Where a scheduled task runs: once in the lab namespace, or in every student (and group) namespace
+const (
+	taskScopeLab       = "lab"
+	taskScopeNamespace = "namespace"
+)
+
+var taskScopes = []string{taskScopeLab, taskScopeNamespace}
+
+// A task of a lab that runs on a cron schedule, e.g. a nightly reset of a shared dataset.
+// The task only gets the permissions of its rules, inside of the namespace it runs in.
+type ScheduledTask struct {
+	Name     string              `json:"name"`
+	Schedule string              `json:"schedule"`
+	Scope    string              `json:"scope,omitempty"`
+	Image    string              `json:"image"`
+	Command  []string            `json:"command,omitempty"`
+	Rules    []rbacv1.PolicyRule `json:"rules,omitempty"`
+}
+
+/*
+Returns the name of the CronJob, ServiceAccount, Role and RoleBinding of a scheduled task.
+*/
+func getScheduledTaskName(task ScheduledTask) string {
+	return "scalama-task-" + task.Name
+}
+
+/*
+Checks whether a scheduled task is complete and valid.
+*/
+func validateScheduledTask(task ScheduledTask) *Error {
+	if len(validation.IsDNS1123Label(getScheduledTaskName(task))) > 0 || len(task.Name) > 30 {
+		return &Error{status: http.StatusBadRequest, message: "The name of scheduled task " + task.Name + " must be a DNS label of at most 30 characters"}
+	}
+
+	// Cron expressions have 5 fields, or are a macro like @daily
+	if fields := strings.Fields(task.Schedule); len(fields) != 5 && !(len(fields) == 1 && strings.HasPrefix(task.Schedule, "@")) {
+		return &Error{status: http.StatusBadRequest, message: "The schedule of scheduled task " + task.Name + " must be a cron expression"}
+	}
+
+	if !contains(taskScopes, task.Scope) {
+		return &Error{status: http.StatusBadRequest, message: "The scope of scheduled task " + task.Name + " must be one of " + strings.Join(taskScopes, ", ")}
+	}
+
+	if task.Image == "" {
+		return &Error{status: http.StatusBadRequest, message: "Scheduled task " + task.Name + " needs an image"}
+	}
+
+	for _, rule := range task.Rules {
+		if len(rule.Verbs) == 0 || len(rule.Resources) == 0 {
+			return &Error{status: http.StatusBadRequest, message: "Every rule of scheduled task " + task.Name + " needs verbs and resources"}
+		}
+	}
+
+	return nil
+}
+
+/*
+Creates the CronJob of a scheduled task inside of a namespace, with a ServiceAccount that only has the rules of the task in that namespace.
+*/
+func createScheduledTask(ctx context.Context, clientset kubernetes.Interface, labName string, namespace string, task ScheduledTask) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	name := getScheduledTaskName(task)
+	labels := map[string]string{managedByLabel: managedByLabelVal, labLabel: labName}
+	objectMeta := v1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels}
+
+	serviceAccount := &corev1.ServiceAccount{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ServiceAccount",
+		},
+		ObjectMeta: objectMeta,
+	}
+
+	if _, err := clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, serviceAccount, v1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	if len(task.Rules) > 0 {
+		role := &rbacv1.Role{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "rbac.authorization.k8s.io/v1",
+				Kind:       "Role",
+			},
+			ObjectMeta: objectMeta,
+			Rules:      task.Rules,
+		}
+
+		if _, err := clientset.RbacV1().Roles(namespace).Create(ctx, role, v1.CreateOptions{}); err != nil {
+			return err
+		}
+
+		if err := createRoleBinding(ctx, clientset, name, namespace, []rbacv1.Subject{getServiceAccountSubject(name, namespace)}, "Role", name); err != nil {
+			return err
+		}
+	}
+
+	cronJob := &batchv1.CronJob{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "batch/v1",
+			Kind:       "CronJob",
+		},
+		ObjectMeta: objectMeta,
+		Spec: batchv1.CronJobSpec{
+			Schedule: task.Schedule,
+			// A run that takes longer than the schedule is not started twice
+			ConcurrencyPolicy: batchv1.ForbidConcurrent,
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: labels},
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: v1.ObjectMeta{Labels: labels},
+						Spec: corev1.PodSpec{
+							ServiceAccountName: name,
+							RestartPolicy:      corev1.RestartPolicyOnFailure,
+							Containers: []corev1.Container{
+								{
+									Name:    "task",
+									Image:   task.Image,
+									Command: task.Command,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	_, err := clientset.BatchV1().CronJobs(namespace).Create(ctx, cronJob, v1.CreateOptions{})
+	return err
+}
+
+/*
+Creates the scheduled tasks of a lab with a scope inside of a namespace.
+*/
+func createScheduledTasks(ctx context.Context, clientset kubernetes.Interface, labName string, namespace string, scope string, options *LabOptions) *Error {
+	for _, task := range options.ScheduledTasks {
+		if task.Scope != scope {
+			continue
+		}
+
+		if err := createScheduledTask(ctx, clientset, labName, namespace, task); err != nil {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating scheduled task " + task.Name + " in namespace " + namespace}
+		}
+	}
+
+	return nil
+}
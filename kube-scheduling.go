@@ -0,0 +1,257 @@
+package main
+
+import (
+	"os"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Annotation that allows the cluster autoscaler to evict pods when scaling down spot nodes
+const safeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+
+// Path to the pod spec for every kind of workload
+var podSpecPaths = map[string][]string{
+	"Pod":         {"spec"},
+	"Deployment":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"DaemonSet":   {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+/*
+Returns the pod spec of a workload. The returned map is not a copy, changing it changes the object.
+*/
+func getPodSpec(unstructuredObj *unstructured.Unstructured) (map[string]interface{}, bool) {
+	path, ok := podSpecPaths[unstructuredObj.GetKind()]
+	if !ok {
+		return nil, false
+	}
+
+	podSpec, found, err := unstructured.NestedFieldNoCopy(unstructuredObj.Object, path...)
+	if err != nil || !found {
+		return nil, false
+	}
+
+	podSpecMap, ok := podSpec.(map[string]interface{})
+	return podSpecMap, ok
+}
+
+/*
+Returns all containers and init containers of a pod spec.
+*/
+func getContainers(podSpec map[string]interface{}) []map[string]interface{} {
+	var containers []map[string]interface{}
+
+	for _, field := range []string{"initContainers", "containers"} {
+		list, ok := podSpec[field].([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, container := range list {
+			if containerMap, ok := container.(map[string]interface{}); ok {
+				containers = append(containers, containerMap)
+			}
+		}
+	}
+
+	return containers
+}
+
+/*
+Checks whether a container of the pod spec requests or limits the given resource.
+*/
+func requestsResource(podSpec map[string]interface{}, resource string) bool {
+	for _, container := range getContainers(podSpec) {
+		for _, field := range []string{"requests", "limits"} {
+			if _, found, _ := unstructured.NestedFieldNoCopy(container, "resources", field, resource); found {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/*
+Adds labels to the nodeSelector of a pod spec. Labels already in the nodeSelector are overwritten.
+*/
+func addNodeSelector(podSpec map[string]interface{}, selector map[string]string) {
+	nodeSelector, ok := podSpec["nodeSelector"].(map[string]interface{})
+	if !ok {
+		nodeSelector = map[string]interface{}{}
+	}
+
+	for key, value := range selector {
+		nodeSelector[key] = value
+	}
+
+	podSpec["nodeSelector"] = nodeSelector
+}
+
+/*
+Returns the metadata of the pods of a workload. The returned map is not a copy, changing it changes the object.
+Missing metadata is created.
+*/
+func getPodMetadata(unstructuredObj *unstructured.Unstructured) (map[string]interface{}, bool) {
+	path, ok := podSpecPaths[unstructuredObj.GetKind()]
+	if !ok {
+		return nil, false
+	}
+
+	// The metadata is next to the pod spec
+	parent := unstructuredObj.Object
+	if len(path) > 1 {
+		field, found, err := unstructured.NestedFieldNoCopy(unstructuredObj.Object, path[:len(path)-1]...)
+		if err != nil || !found {
+			return nil, false
+		}
+
+		if parent, ok = field.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+
+	metadata, ok := parent["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		parent["metadata"] = metadata
+	}
+
+	return metadata, true
+}
+
+/*
+Adds annotations to the pods of a workload. Annotations that already exist are overwritten.
+*/
+func addPodAnnotations(unstructuredObj *unstructured.Unstructured, annotations map[string]string) {
+	metadata, ok := getPodMetadata(unstructuredObj)
+	if !ok {
+		return
+	}
+
+	podAnnotations, ok := metadata["annotations"].(map[string]interface{})
+	if !ok {
+		podAnnotations = map[string]interface{}{}
+	}
+
+	for key, value := range annotations {
+		podAnnotations[key] = value
+	}
+
+	metadata["annotations"] = podAnnotations
+}
+
+/*
+Adds a toleration for a taint with key, value and effect to a pod spec.
+*/
+func addToleration(podSpec map[string]interface{}, key string, value string, effect string) {
+	tolerations, _ := podSpec["tolerations"].([]interface{})
+
+	podSpec["tolerations"] = append(tolerations, map[string]interface{}{
+		"key":      key,
+		"operator": "Equal",
+		"value":    value,
+		"effect":   effect,
+	})
+}
+
+/*
+Adds a node affinity to a pod spec for nodes with a label key that has one of values.
+A required affinity is added to every existing node selector term, so the existing terms keep working.
+A preferred affinity is added as a new term with the given weight.
+*/
+func addNodeAffinity(podSpec map[string]interface{}, required bool, weight int64, key string, values []string) {
+	var valueList []interface{}
+	for _, value := range values {
+		valueList = append(valueList, value)
+	}
+
+	expression := map[string]interface{}{
+		"key":      key,
+		"operator": "In",
+		"values":   valueList,
+	}
+
+	affinity, _ := podSpec["affinity"].(map[string]interface{})
+	if affinity == nil {
+		affinity = map[string]interface{}{}
+		podSpec["affinity"] = affinity
+	}
+
+	nodeAffinity, _ := affinity["nodeAffinity"].(map[string]interface{})
+	if nodeAffinity == nil {
+		nodeAffinity = map[string]interface{}{}
+		affinity["nodeAffinity"] = nodeAffinity
+	}
+
+	if !required {
+		preferred, _ := nodeAffinity["preferredDuringSchedulingIgnoredDuringExecution"].([]interface{})
+		nodeAffinity["preferredDuringSchedulingIgnoredDuringExecution"] = append(preferred, map[string]interface{}{
+			"weight":     weight,
+			"preference": map[string]interface{}{"matchExpressions": []interface{}{expression}},
+		})
+
+		return
+	}
+
+	requiredAffinity, _ := nodeAffinity["requiredDuringSchedulingIgnoredDuringExecution"].(map[string]interface{})
+	if requiredAffinity == nil {
+		requiredAffinity = map[string]interface{}{}
+		nodeAffinity["requiredDuringSchedulingIgnoredDuringExecution"] = requiredAffinity
+	}
+
+	terms, _ := requiredAffinity["nodeSelectorTerms"].([]interface{})
+	if len(terms) == 0 {
+		terms = []interface{}{map[string]interface{}{}}
+	}
+
+	for _, term := range terms {
+		termMap, ok := term.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		expressions, _ := termMap["matchExpressions"].([]interface{})
+		termMap["matchExpressions"] = append(expressions, expression)
+	}
+
+	requiredAffinity["nodeSelectorTerms"] = terms
+}
+
+/*
+Returns the labels of spot/preemptible nodes, configured by SCALAMA_SPOT_NODE_SELECTOR (e.g. "eks.amazonaws.com/capacityType=SPOT").
+Defaults to the label of GKE spot nodes.
+*/
+func getDefaultSpotNodeSelector() (map[string]string, error) {
+	value := os.Getenv("SCALAMA_SPOT_NODE_SELECTOR")
+	if value == "" {
+		return map[string]string{"cloud.google.com/gke-spot": "true"}, nil
+	}
+
+	return labels.ConvertSelectorToLabelsMap(value)
+}
+
+/*
+Prefers scheduling the pods of a workload on spot nodes with the given labels, and tolerates the taints of those nodes.
+The pods are also marked as safe to evict.
+*/
+func addSpotScheduling(unstructuredObj *unstructured.Unstructured, podSpec map[string]interface{}, selector map[string]string) {
+	// Sort the labels so the pod spec is the same every time it is generated
+	keys := make([]string, 0, len(selector))
+	for key := range selector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		addToleration(podSpec, key, selector[key], "NoSchedule")
+		addNodeAffinity(podSpec, false, 100, key, []string{selector[key]})
+	}
+
+	addPodAnnotations(unstructuredObj, map[string]string{safeToEvictAnnotation: "true"})
+}
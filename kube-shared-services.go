@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+/*
+Returns the DNS domain of the cluster, configured by SCALAMA_CLUSTER_DOMAIN.
+*/
+func getClusterDomain() string {
+	if domain := os.Getenv("SCALAMA_CLUSTER_DOMAIN"); domain != "" {
+		return domain
+	}
+
+	return "cluster.local"
+}
+
+/*
+Returns the names of the Services in the shared lab namespace that can get an alias in the student namespaces.
+Services that are also created in every student namespace keep their own name, so they don't get an alias.
+*/
+func getSharedServiceNames(objects []*unstructured.Unstructured) []string {
+	studentServices := make(map[string]bool)
+	for _, unstructuredObj := range objects {
+		if unstructuredObj.GetKind() == "Service" && !isSingleInstance(unstructuredObj.Object) {
+			studentServices[unstructuredObj.GetName()] = true
+		}
+	}
+
+	var names []string
+	for _, unstructuredObj := range objects {
+		if unstructuredObj.GetKind() == "Service" && isSingleInstance(unstructuredObj.Object) && !isSharedExternal(unstructuredObj) && !studentServices[unstructuredObj.GetName()] {
+			names = append(names, unstructuredObj.GetName())
+		}
+	}
+
+	return names
+}
+
+/*
+Creates an ExternalName Service in namespace for every shared Service of the lab.
+Lab instructions can then use the same short name (e.g. "database") in every student namespace.
+*/
+func createSharedServiceAliases(ctx context.Context, clientset kubernetes.Interface, labName string, namespace string, names []string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	for _, name := range names {
+		service := &corev1.Service{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "Service",
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    map[string]string{managedByLabel: managedByLabelVal, labLabel: labName},
+			},
+			Spec: corev1.ServiceSpec{
+				Type:         corev1.ServiceTypeExternalName,
+				ExternalName: name + ".ns-" + labName + ".svc." + getClusterDomain(),
+			},
+		}
+
+		if _, err := clientset.CoreV1().Services(namespace).Create(ctx, service, v1.CreateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
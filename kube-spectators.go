@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Spectators (e.g. external examiners) get read-only access to every namespace of a lab until the time annotated on their ServiceAccount
+const (
+	spectatorLabel               = "scalama.io/spectator"
+	spectatorExpiresAtAnnotation = "scalama.io/expires-at"
+)
+
+// The TokenRequest API doesn't issue tokens that expire sooner
+const minSpectatorDuration = 10 * time.Minute
+
+// Read-only access of a spectator to a lab, the token is only returned when the access is created
+type Spectator struct {
+	Name      string    `json:"name"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Token     string    `json:"token,omitempty"`
+}
+
+/*
+Returns the name of the ServiceAccount and RoleBindings of a spectator.
+*/
+func getSpectatorName(name string) string {
+	return "spectator-" + name
+}
+
+/*
+Checks whether a spectator can get access to a lab for a duration.
+*/
+func validateSpectator(name string, duration time.Duration) *Error {
+	if len(validation.IsDNS1123Label(getSpectatorName(name))) > 0 {
+		return &Error{status: http.StatusBadRequest, message: "The name of a spectator must be a DNS label"}
+	}
+
+	if duration < minSpectatorDuration {
+		return &Error{status: http.StatusBadRequest, message: "The duration of spectator access must be at least " + minSpectatorDuration.String()}
+	}
+
+	return nil
+}
+
+/*
+Gives a spectator read-only access to a namespace of a lab with the view ClusterRole.
+*/
+func bindSpectator(ctx context.Context, clientset kubernetes.Interface, labName string, name string, namespace string) error {
+	spectatorName := getSpectatorName(name)
+	subjects := []rbacv1.Subject{getServiceAccountSubject(spectatorName, "ns-"+labName)}
+
+	err := createRoleBinding(ctx, clientset, spectatorName, namespace, subjects, "ClusterRole", "view")
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+
+	return err
+}
+
+/*
+Gives the spectators of a lab that have not expired yet access to a new namespace of the lab.
+*/
+func bindSpectators(ctx context.Context, clientset kubernetes.Interface, labName string, namespace string) *Error {
+	spectators, err := getSpectators(ctx, clientset, labName)
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching the spectators of lab " + labName}
+	}
+
+	for _, spectator := range spectators {
+		if err := bindSpectator(ctx, clientset, labName, spectator.Name, namespace); err != nil {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while giving spectator " + spectator.Name + " access to namespace " + namespace}
+		}
+	}
+
+	return nil
+}
+
+/*
+Creates a spectator of a lab with read-only access to the lab namespace and every student (or group) namespace.
+Returns a token that expires together with the access, the access itself is revoked at expiry.
+*/
+func (s *Server) createSpectatorAccount(ctx context.Context, clientset kubernetes.Interface, labName string, name string, duration time.Duration) (Spectator, error) {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return Spectator{}, err
+	}
+
+	spectatorName := getSpectatorName(name)
+	expiresAt := time.Now().Add(duration).UTC().Truncate(time.Second)
+
+	serviceAccount := &corev1.ServiceAccount{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ServiceAccount",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:        spectatorName,
+			Namespace:   "ns-" + labName,
+			Labels:      map[string]string{managedByLabel: managedByLabelVal, labLabel: labName, spectatorLabel: name},
+			Annotations: map[string]string{spectatorExpiresAtAnnotation: expiresAt.Format(time.RFC3339)},
+		},
+	}
+
+	createCtx, cancel := withOperationTimeout(ctx)
+	_, err = clientset.CoreV1().ServiceAccounts("ns-"+labName).Create(createCtx, serviceAccount, v1.CreateOptions{})
+	cancel()
+	if err != nil {
+		return Spectator{}, err
+	}
+
+	for _, namespace := range append([]string{"ns-" + labName}, namespaces...) {
+		if err := bindSpectator(ctx, clientset, labName, name, namespace); err != nil {
+			return Spectator{}, err
+		}
+	}
+
+	token, err := requestServiceAccountToken(ctx, clientset, spectatorName, "ns-"+labName, int64(duration.Seconds()), nil)
+	if err != nil {
+		return Spectator{}, err
+	}
+
+	s.scheduleSpectatorRevocation(clientset, labName, name, expiresAt)
+
+	return Spectator{Name: name, ExpiresAt: expiresAt, Token: token}, nil
+}
+
+/*
+Returns the spectators of a lab that have not expired yet, sorted by name.
+*/
+func getSpectators(ctx context.Context, clientset kubernetes.Interface, labName string) ([]Spectator, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	serviceAccounts, err := clientset.CoreV1().ServiceAccounts("ns-"+labName).List(ctx, v1.ListOptions{LabelSelector: spectatorLabel})
+	if err != nil {
+		return nil, err
+	}
+
+	spectators := []Spectator{}
+	for _, serviceAccount := range serviceAccounts.Items {
+		expiresAt, err := time.Parse(time.RFC3339, serviceAccount.Annotations[spectatorExpiresAtAnnotation])
+		if err != nil || time.Now().After(expiresAt) {
+			continue
+		}
+
+		spectators = append(spectators, Spectator{Name: serviceAccount.Labels[spectatorLabel], ExpiresAt: expiresAt})
+	}
+
+	sort.Slice(spectators, func(i, j int) bool {
+		return spectators[i].Name < spectators[j].Name
+	})
+
+	return spectators, nil
+}
+
+/*
+Revokes the access of a spectator to a lab. Deleting the ServiceAccount also invalidates its tokens.
+*/
+func (s *Server) revokeSpectator(ctx context.Context, clientset kubernetes.Interface, labName string, name string) error {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	spectatorName := getSpectatorName(name)
+	for _, namespace := range append([]string{"ns-" + labName}, namespaces...) {
+		err := clientset.RbacV1().RoleBindings(namespace).Delete(ctx, spectatorName, v1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	err = clientset.CoreV1().ServiceAccounts("ns-"+labName).Delete(ctx, spectatorName, v1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	fmt.Println("Revoked the access of spectator", name, "to lab", labName)
+	return nil
+}
+
+/*
+Revokes the access of a spectator once it expires. The expiry is read again first,
+so a spectator that was revoked and created again in the meantime keeps its new access.
+*/
+func (s *Server) scheduleSpectatorRevocation(clientset kubernetes.Interface, labName string, name string, expiresAt time.Time) {
+	time.AfterFunc(time.Until(expiresAt), func() {
+		serviceAccount, err := clientset.CoreV1().ServiceAccounts("ns-"+labName).Get(context.TODO(), getSpectatorName(name), v1.GetOptions{})
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				fmt.Println("Something went wrong while fetching spectator "+name+" of lab "+labName+":", err)
+			}
+			return
+		}
+
+		current, err := time.Parse(time.RFC3339, serviceAccount.Annotations[spectatorExpiresAtAnnotation])
+		if err == nil && time.Now().Before(current) {
+			return
+		}
+
+		if err := s.revokeSpectator(context.TODO(), clientset, labName, name); err != nil {
+			fmt.Println("Something went wrong while revoking spectator "+name+" of lab "+labName+":", err)
+		}
+	})
+}
+
+/*
+Schedules the revocation of the spectators of every lab, so access that expires while ScaLaMa is not running is revoked on startup.
+*/
+func (s *Server) scheduleSpectatorRevocations(ctx context.Context, clientset kubernetes.Interface) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	serviceAccounts, err := clientset.CoreV1().ServiceAccounts("").List(ctx, v1.ListOptions{LabelSelector: spectatorLabel})
+	if err != nil {
+		return err
+	}
+
+	for _, serviceAccount := range serviceAccounts.Items {
+		// Spectators without a valid expiry are revoked right away
+		expiresAt, _ := time.Parse(time.RFC3339, serviceAccount.Annotations[spectatorExpiresAtAnnotation])
+		s.scheduleSpectatorRevocation(clientset, serviceAccount.Labels[labLabel], serviceAccount.Labels[spectatorLabel], expiresAt)
+	}
+
+	return nil
+}
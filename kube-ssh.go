@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	sshBastionName = "ssh-bastion"
+	sshBastionPort = 2222
+)
+
+/*
+Returns the image of the SSH bastion, configured by SCALAMA_SSH_IMAGE.
+The image should behave like linuxserver/openssh-server: keys in PUBLIC_KEY_FILE, user in USER_NAME, listening on port 2222.
+*/
+func getSshImage() string {
+	if image := os.Getenv("SCALAMA_SSH_IMAGE"); image != "" {
+		return image
+	}
+
+	return "lscr.io/linuxserver/openssh-server:latest"
+}
+
+/*
+Returns the SSH public keys of a list of students, students without a key are skipped.
+*/
+func getSshKeys(students []Student) []string {
+	var keys []string
+
+	for _, student := range students {
+		if student.sshKey != "" {
+			keys = append(keys, student.sshKey)
+		}
+	}
+
+	return keys
+}
+
+/*
+Deploys an SSH bastion inside of a namespace that accepts the given public keys.
+The bastion is exposed with a Service of serviceType (NodePort or LoadBalancer).
+*/
+func createSshBastion(ctx context.Context, clientset kubernetes.Interface, namespace string, keys []string, serviceType string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	labels := map[string]string{"app": sshBastionName, managedByLabel: managedByLabelVal}
+
+	secret := &corev1.Secret{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      sshBastionName + "-keys",
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		StringData: map[string]string{
+			"authorized_keys": strings.Join(keys, "\n") + "\n",
+		},
+	}
+
+	if _, err := clientset.CoreV1().Secrets(namespace).Create(ctx, secret, v1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      sshBastionName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &v1.LabelSelector{
+				MatchLabels: map[string]string{"app": sshBastionName},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					// The bastion doesn't need access to the Kubernetes API
+					AutomountServiceAccountToken: new(bool),
+					Containers: []corev1.Container{
+						0: {
+							Name:  sshBastionName,
+							Image: getSshImage(),
+							Env: []corev1.EnvVar{
+								{Name: "USER_NAME", Value: "student"},
+								{Name: "PUBLIC_KEY_FILE", Value: "/keys/authorized_keys"},
+							},
+							Ports: []corev1.ContainerPort{
+								0: {Name: "ssh", ContainerPort: sshBastionPort},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								0: {Name: "keys", MountPath: "/keys", ReadOnly: true},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						0: {
+							Name: "keys",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{SecretName: secret.Name},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if _, err := clientset.AppsV1().Deployments(namespace).Create(ctx, deployment, v1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	service := &corev1.Service{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      sshBastionName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceType(serviceType),
+			Selector: map[string]string{"app": sshBastionName},
+			Ports: []corev1.ServicePort{
+				0: {
+					Name:       "ssh",
+					Protocol:   corev1.ProtocolTCP,
+					Port:       22,
+					TargetPort: intstr.FromInt(sshBastionPort),
+				},
+			},
+		},
+	}
+
+	if _, err := clientset.CoreV1().Services(namespace).Create(ctx, service, v1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Pods annotated with scalama.io/runtime-exempt: "true" (e.g. the databases of the manifest) may run longer than the maximum runtime of their lab
+const runtimeExemptAnnotation = "scalama.io/runtime-exempt"
+
+// How often pods that exceed the maximum runtime of their lab are terminated
+const podRuntimeInterval = time.Minute
+
+/*
+Creates a ResourceQuota in a namespace that limits the amount of pods that can exist at the same time.
+*/
+func createPodQuota(ctx context.Context, clientset kubernetes.Interface, namespace string, count int) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	quota := &corev1.ResourceQuota{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ResourceQuota",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "pod-quota",
+			Namespace: namespace,
+			Labels:    map[string]string{managedByLabel: managedByLabelVal},
+		},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{
+				corev1.ResourcePods: resource.MustParse(strconv.Itoa(count)),
+			},
+		},
+	}
+
+	_, err := clientset.CoreV1().ResourceQuotas(namespace).Create(ctx, quota, v1.CreateOptions{})
+	return err
+}
+
+/*
+Deletes the pods of the student (and group) namespaces of a lab that have been running longer than maxRuntime.
+Pods that ScaLaMa deployed itself (e.g. SSH bastions) and exempt pods are kept.
+*/
+func (s *Server) terminateLongRunningPods(ctx context.Context, clientset kubernetes.Interface, labName string, maxRuntime time.Duration, now time.Time) error {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	for _, namespace := range namespaces {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{FieldSelector: "status.phase=Running"})
+		if err != nil {
+			return err
+		}
+
+		for _, pod := range pods.Items {
+			if pod.Status.StartTime == nil || pod.DeletionTimestamp != nil || pod.Labels[managedByLabel] == managedByLabelVal || pod.Annotations[runtimeExemptAnnotation] == "true" {
+				continue
+			}
+
+			if now.Sub(pod.Status.StartTime.Time) <= maxRuntime {
+				continue
+			}
+
+			err := clientset.CoreV1().Pods(namespace).Delete(ctx, pod.Name, v1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+
+			fmt.Println("Terminated pod", pod.Name, "in namespace", namespace, "after running longer than", maxRuntime)
+			s.notifyLab(ctx, labName, eventPodTerminated, "Pod "+pod.Name+" terminated", fmt.Sprintf("Pod %s in namespace %s ran longer than %s", pod.Name, namespace, maxRuntime))
+		}
+	}
+
+	return nil
+}
+
+/*
+Terminates the pods that exceed the maximum runtime of their lab every minute. Errors are logged, the loop only stops when ctx is cancelled.
+*/
+func (s *Server) startPodRuntimeLoop(ctx context.Context, clientset kubernetes.Interface) {
+	ticker := time.NewTicker(podRuntimeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		labNames, err := s.getLabNames(ctx, clientset)
+		if err != nil {
+			fmt.Println("Something went wrong while listing the labs:", err)
+			continue
+		}
+
+		now := time.Now()
+		for _, labName := range labNames {
+			labData, err := s.getLabData(ctx, labName)
+			if err != nil {
+				fmt.Println("Something went wrong while fetching lab "+labName+":", err)
+				continue
+			}
+
+			options, err := getStoredLabOptions(labData)
+			if err != nil {
+				fmt.Println("Something went wrong while reading the options of lab "+labName+":", err)
+				continue
+			}
+
+			if options.MaxPodRuntimeSeconds == 0 {
+				continue
+			}
+
+			maxRuntime := time.Duration(options.MaxPodRuntimeSeconds) * time.Second
+			if err := s.terminateLongRunningPods(ctx, clientset, labName, maxRuntime, now); err != nil {
+				fmt.Println("Something went wrong while terminating the long-running pods of lab "+labName+":", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Kinds of suspicious activity that raise an alert
+const (
+	alertTokenIps            = "token-ips"
+	alertPrivilegeEscalation = "privilege-escalation"
+	alertUnexpectedRegistry  = "unexpected-registry"
+)
+
+// The same alert (e.g. of a crashing Deployment that keeps pulling the same image) is raised at most once an hour
+const alertDedupWindow = time.Hour
+
+// Only the newest alerts of a lab are kept, so a noisy student can't grow the lab data without bounds
+const maxStoredAlerts = 500
+
+// Suspicious activity in a lab (e.g. a token used from many IPs), for academic integrity and security monitoring
+type Alert struct {
+	Id        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Username  string    `json:"username"`
+	Namespace string    `json:"namespace,omitempty"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+/*
+Returns the alerts stored with a lab, oldest first. Returns an empty list if none were stored.
+*/
+func getStoredAlerts(labData map[string]string) ([]Alert, error) {
+	alerts := []Alert{}
+
+	if value, ok := labData["alerts"]; ok {
+		if err := json.Unmarshal([]byte(value), &alerts); err != nil {
+			return nil, err
+		}
+	}
+
+	return alerts, nil
+}
+
+/*
+Stores a new alert of a lab, the oldest alerts are dropped when the lab has more than maxStoredAlerts.
+Alerts that were already raised in the last hour are skipped.
+*/
+func (s *Server) addAlert(ctx context.Context, labName string, alert Alert) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	alert.Id = hex.EncodeToString(id)
+	alert.CreatedAt = time.Now()
+
+	s.alertsLock.Lock()
+	defer s.alertsLock.Unlock()
+
+	labData, err := s.getLabData(ctx, labName)
+	if err != nil {
+		return err
+	}
+
+	alerts, err := getStoredAlerts(labData)
+	if err != nil {
+		return err
+	}
+
+	for _, stored := range alerts {
+		if stored.Kind == alert.Kind && stored.Username == alert.Username && stored.Namespace == alert.Namespace && stored.Message == alert.Message && alert.CreatedAt.Sub(stored.CreatedAt) < alertDedupWindow {
+			return nil
+		}
+	}
+
+	fmt.Println("Alert in lab "+labName+":", alert.Message, "by", alert.Username)
+	alerts = append(alerts, alert)
+	if len(alerts) > maxStoredAlerts {
+		alerts = alerts[len(alerts)-maxStoredAlerts:]
+	}
+
+	encoded, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	if err := s.saveLabData(ctx, labName, map[string]string{"alerts": string(encoded)}); err != nil {
+		return err
+	}
+
+	s.notifyLab(ctx, labName, eventAlert, "Suspicious activity in lab "+labName, alert.Message+" by "+alert.Username)
+	return nil
+}
+
+/*
+Returns the alerts of a lab of a kind and/or of a user (every alert when empty), sorted from newest to oldest.
+*/
+func filterAlerts(alerts []Alert, kind string, username string) []Alert {
+	result := []Alert{}
+	for _, alert := range alerts {
+		if (kind == "" || alert.Kind == kind) && (username == "" || alert.Username == username) {
+			result = append(result, alert)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+
+	return result
+}
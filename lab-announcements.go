@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Name of the ConfigMap in every namespace of a lab with the latest announcement of the instructors
+const announcementConfigMapName = "scalama-announcement"
+
+// A message of the instructors to every student of a lab (e.g. "re-pull the image"), a MOTD is shown prominently by the portal
+type Announcement struct {
+	Message   string    `json:"message"`
+	Motd      bool      `json:"motd"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+/*
+Writes an announcement to the announcement ConfigMap of a namespace, replacing the previous announcement.
+*/
+func writeAnnouncement(ctx context.Context, clientset kubernetes.Interface, labName string, namespace string, announcement Announcement) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	configMap := &corev1.ConfigMap{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      announcementConfigMapName,
+			Namespace: namespace,
+			Labels:    map[string]string{managedByLabel: managedByLabelVal, labLabel: labName},
+		},
+		Data: map[string]string{
+			"message":   announcement.Message,
+			"motd":      strconv.FormatBool(announcement.Motd),
+			"createdAt": announcement.CreatedAt.Format(time.RFC3339),
+		},
+	}
+
+	_, err := clientset.CoreV1().ConfigMaps(namespace).Update(ctx, configMap, v1.UpdateOptions{})
+	if errors.IsNotFound(err) {
+		_, err = clientset.CoreV1().ConfigMaps(namespace).Create(ctx, configMap, v1.CreateOptions{})
+	}
+
+	return err
+}
+
+/*
+Writes an announcement into the lab namespace and every student (or group) namespace of a lab.
+Returns the namespaces the announcement was written to.
+*/
+func (s *Server) broadcastAnnouncement(ctx context.Context, clientset kubernetes.Interface, labName string, announcement Announcement) ([]string, error) {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces = append([]string{"ns-" + labName}, namespaces...)
+	for _, namespace := range namespaces {
+		if err := writeAnnouncement(ctx, clientset, labName, namespace, announcement); err != nil {
+			return nil, err
+		}
+	}
+
+	return namespaces, nil
+}
+
+/*
+Returns the latest announcement in a namespace, nil if there was no announcement yet.
+*/
+func getAnnouncement(ctx context.Context, clientset kubernetes.Interface, namespace string) (*Announcement, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, announcementConfigMapName, v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	// ConfigMaps edited by hand keep their message even when the other keys are invalid
+	createdAt, _ := time.Parse(time.RFC3339, configMap.Data["createdAt"])
+	return &Announcement{Message: configMap.Data["message"], Motd: configMap.Data["motd"] == "true", CreatedAt: createdAt}, nil
+}
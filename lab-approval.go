@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Statuses of a lab that waits for the approval of a cluster admin
+const (
+	labApprovalPending  = "Pending"
+	labApprovalApproved = "Approved"
+	labApprovalRejected = "Rejected"
+)
+
+// The group of the cluster admins, who approve labs unless SCALAMA_LAB_APPROVERS is set
+const defaultLabApprovers = "Group:system:masters"
+
+// The sizes above which a lab waits for the approval of a cluster admin, a threshold of 0 is not checked
+type approvalThresholds struct {
+	students int
+	cpu      resource.Quantity
+	gpus     int
+}
+
+// A lab above the approval thresholds, it is created once a cluster admin approves it
+type LabApproval struct {
+	Id         string       `json:"id"`
+	LabName    string       `json:"labName"`
+	Instructor string       `json:"instructor,omitempty"`
+	Reasons    []string     `json:"reasons"`
+	Estimate   *LabEstimate `json:"estimate"`
+	Status     string       `json:"status"`
+	Comment    string       `json:"comment,omitempty"`
+	DecidedBy  string       `json:"decidedBy,omitempty"`
+	JobId      string       `json:"jobId,omitempty"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	DecidedAt  *time.Time   `json:"decidedAt,omitempty"`
+
+	organization string
+	// The instructor that is notified of the decision, nil if they didn't ask to be notified
+	subscription *NotificationSubscription
+	// The request that creates the lab and the handler it is replayed with, until the lab is decided on
+	request *http.Request
+	create  func(w http.ResponseWriter, r *http.Request)
+}
+
+// The approvals of the labs of a server, by id
+type labApprovalStore struct {
+	sync.Mutex
+	approvals map[string]*LabApproval
+}
+
+/*
+Returns the thresholds above which labs wait for the approval of a cluster admin, configured by SCALAMA_APPROVAL_MAX_STUDENTS,
+SCALAMA_APPROVAL_MAX_CPU (the requested CPU of the whole lab, e.g. "64") and SCALAMA_APPROVAL_MAX_GPUS. Unset thresholds are 0.
+*/
+func getApprovalThresholds() (approvalThresholds, error) {
+	var thresholds approvalThresholds
+	var err error
+
+	if thresholds.students, err = getManifestLimit("SCALAMA_APPROVAL_MAX_STUDENTS", 0); err != nil {
+		return thresholds, err
+	}
+
+	if thresholds.gpus, err = getManifestLimit("SCALAMA_APPROVAL_MAX_GPUS", 0); err != nil {
+		return thresholds, err
+	}
+
+	if value := os.Getenv("SCALAMA_APPROVAL_MAX_CPU"); value != "" {
+		if thresholds.cpu, err = resource.ParseQuantity(value); err != nil || thresholds.cpu.Sign() < 0 {
+			return thresholds, fmt.Errorf("SCALAMA_APPROVAL_MAX_CPU must be a CPU quantity of at least 0, e.g. 64 or 500m")
+		}
+	}
+
+	return thresholds, nil
+}
+
+/*
+Returns the cluster admins that approve or reject labs, configured by SCALAMA_LAB_APPROVERS as comma-separated Kind:name subjects
+(e.g. "User:alice,Group:lab-admins"). By default the members of system:masters approve labs.
+*/
+func getLabApprovers() ([]rbacv1.Subject, error) {
+	value := os.Getenv("SCALAMA_LAB_APPROVERS")
+	if value == "" {
+		value = defaultLabApprovers
+	}
+
+	var approvers []rbacv1.Subject
+	for _, item := range strings.Split(value, ",") {
+		kind, name, _ := strings.Cut(strings.TrimSpace(item), ":")
+		if (kind != "User" && kind != "Group") || name == "" {
+			return nil, fmt.Errorf("SCALAMA_LAB_APPROVERS must be comma-separated User:<name> or Group:<name> subjects")
+		}
+
+		approvers = append(approvers, rbacv1.Subject{Kind: kind, Name: name})
+	}
+
+	return approvers, nil
+}
+
+/*
+Returns why a lab needs the approval of a cluster admin (e.g. "120 students, more than 100") with the estimate of its size.
+Returns no reasons if no threshold is set or the lab is below every threshold.
+*/
+func getApprovalReasons(clientset kubernetes.Interface, students []Student, labName string, manifest string, options *LabOptions, isIndividual bool, isHybrid bool) ([]string, *LabEstimate, *Error) {
+	thresholds, err := getApprovalThresholds()
+	if err != nil {
+		return nil, nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the approval thresholds"}
+	}
+
+	if thresholds.students == 0 && thresholds.cpu.IsZero() && thresholds.gpus == 0 {
+		return nil, nil, nil
+	}
+
+	studentCount := len(getNamespaceNames(students, labName, true))
+	namespaces := getStudentNamespaceCount(studentCount, len(getNamespaceNames(students, labName, false)), isIndividual, isHybrid, options)
+
+	// Only a manifest that can't be decoded makes the estimate fail
+	estimate, total, err := getLabEstimate(clientset, manifest, studentCount, namespaces, options)
+	if err != nil {
+		return nil, nil, &Error{status: http.StatusBadRequest, message: "Something went wrong while estimating the size of lab " + labName + ": " + err.Error()}
+	}
+
+	// The GPUs of the quota of every namespace are reserved for the lab, also when the manifest doesn't request them
+	gpuRequests := total.requests[gpuResource]
+	gpus := int(gpuRequests.Value())
+	if options.GpuCount*namespaces > gpus {
+		gpus = options.GpuCount * namespaces
+	}
+
+	cpu := total.requests["cpu"]
+
+	var reasons []string
+	if thresholds.students > 0 && studentCount > thresholds.students {
+		reasons = append(reasons, strconv.Itoa(studentCount)+" students, more than "+strconv.Itoa(thresholds.students))
+	}
+	if !thresholds.cpu.IsZero() && cpu.Cmp(thresholds.cpu) > 0 {
+		reasons = append(reasons, cpu.String()+" CPU requested, more than "+thresholds.cpu.String())
+	}
+	if thresholds.gpus > 0 && gpus > thresholds.gpus {
+		reasons = append(reasons, strconv.Itoa(gpus)+" GPUs, more than "+strconv.Itoa(thresholds.gpus))
+	}
+
+	return reasons, estimate, nil
+}
+
+/*
+Copies a request so it can be replayed once its lab is approved: its form values, and its uploaded files in memory since the
+files of a request are removed once it is answered.
+*/
+func copyApprovalRequest(r *http.Request) (*http.Request, error) {
+	request := r.Clone(r.Context())
+	request.Body = http.NoBody
+
+	if r.MultipartForm == nil {
+		return request, nil
+	}
+
+	var names []string
+	for name := range r.MultipartForm.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, name := range names {
+		for _, fileHeader := range r.MultipartForm.File[name] {
+			file, err := fileHeader.Open()
+			if err != nil {
+				return nil, err
+			}
+
+			part, err := writer.CreatePart(fileHeader.Header)
+			if err == nil {
+				_, err = io.Copy(part, file)
+			}
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(int64(body.Len()) + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	form.Value = request.MultipartForm.Value
+	request.MultipartForm = form
+
+	return request, nil
+}
+
+/*
+Returns a copy of the approval with id, so it can be read while it is decided on.
+*/
+func (s *Server) getLabApproval(id string) (LabApproval, bool) {
+	s.labApprovals.Lock()
+	defer s.labApprovals.Unlock()
+
+	approval, ok := s.labApprovals.approvals[id]
+	if !ok {
+		return LabApproval{}, false
+	}
+
+	return *approval, true
+}
+
+/*
+Holds a lab above the approval thresholds until a cluster admin approves it, create is called with the request once it is approved.
+Responds with the approval, of which the decision can be followed at /api/v1/approvals/{id}.
+*/
+func (s *Server) requestLabApproval(w http.ResponseWriter, r *http.Request, labName string, reasons []string, estimate *LabEstimate, create func(w http.ResponseWriter, r *http.Request)) {
+	var parameters struct {
+		CredentialsParameters
+		ProvisioningParameters
+		ApprovalNotifyParameters
+	}
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	// The lab is created in the background once it is approved, like asynchronous creations
+	if parameters.Format == credentialsFormatZip {
+		http.Error(w, "Lab "+labName+" needs the approval of a cluster admin ("+strings.Join(reasons, ", ")+"), its credentials are returned as JSON and format zip is not supported", http.StatusBadRequest)
+		return
+	}
+
+	approval := &LabApproval{LabName: labName, Instructor: parameters.Instructor, Reasons: reasons, Estimate: estimate, Status: labApprovalPending, CreatedAt: time.Now(), create: create}
+	if user, ok := r.Context().Value(impersonatedUserKey{}).(*authenticationv1.UserInfo); ok {
+		approval.Instructor = user.Username
+	}
+	if organization := getRequestOrganization(r.Context()); organization != nil {
+		approval.organization = organization.Name
+	}
+
+	if channel := parameters.NotifyChannel; channel != "" {
+		notifier, ok := s.notifiers[channel]
+		if !ok {
+			http.Error(w, "notifyChannel must be one of "+strings.Join(s.getNotificationChannels(), ", "), http.StatusBadRequest)
+			return
+		}
+
+		if err := notifier.validateTarget(parameters.NotifyTarget); err != nil {
+			http.Error(w, "notifyTarget is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		approval.subscription = &NotificationSubscription{Instructor: approval.Instructor, Channel: channel, Target: parameters.NotifyTarget, Events: []string{eventLabApproval}}
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "Something went wrong while creating the approval of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+	approval.Id = hex.EncodeToString(id)
+
+	request, err := copyApprovalRequest(r)
+	if err != nil {
+		http.Error(w, "Something went wrong while storing the request of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+	approval.request = request
+
+	s.labApprovals.Lock()
+	s.labApprovals.approvals[approval.Id] = approval
+	s.labApprovals.Unlock()
+
+	fmt.Println("Lab", labName, "waits for approval:", strings.Join(reasons, ", "))
+
+	approvalCopy, _ := s.getLabApproval(approval.Id)
+	emitWebhook(webhookApprovalRequested, approvalCopy)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPrefix+"/approvals/"+approval.Id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(approvalCopy)
+}
+
+/*
+Checks whether the caller of a request is a cluster admin that approves labs.
+*/
+func (s *Server) checkLabApprover(r *http.Request) (*authenticationv1.UserInfo, *Error) {
+	user, e := getRequestUser(r, s.clientset)
+	if e != nil {
+		return nil, e
+	}
+
+	approvers, err := getLabApprovers()
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: err.Error()}
+	}
+
+	if !isSubject(user, approvers) {
+		return nil, &Error{status: http.StatusForbidden, message: user.Username + " is not allowed to approve labs"}
+	}
+
+	return user, nil
+}
+
+/*
+Returns the approvals of labs, oldest first, by default the labs that still wait for approval. Only cluster admins can list them.
+Within an organization only its labs are listed, named without the prefix of the organization.
+HTTP Parameters:
+ status: <string> (optional, default Pending, ["Pending", "Approved", "Rejected"])
+*/
+func (s *Server) getLabApprovals(w http.ResponseWriter, r *http.Request) {
+	if _, e := s.checkLabApprover(r); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	var parameters ApprovalListParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	status := parameters.Status
+
+	organization := ""
+	if requestOrganization := getRequestOrganization(r.Context()); requestOrganization != nil {
+		organization = requestOrganization.Name
+	}
+
+	approvals := []LabApproval{}
+	s.labApprovals.Lock()
+	for _, approval := range s.labApprovals.approvals {
+		if approval.Status != status || (organization != "" && approval.organization != organization) {
+			continue
+		}
+
+		approvalCopy := *approval
+		approvalCopy.LabName = strings.TrimPrefix(approval.LabName, organization)
+		approvals = append(approvals, approvalCopy)
+	}
+	s.labApprovals.Unlock()
+
+	sort.Slice(approvals, func(i, j int) bool {
+		return approvals[i].CreatedAt.Before(approvals[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(approvals)
+}
+
+/*
+Returns the approval of a lab, e.g. for the instructor that waits for it. Once it is approved, jobId is the creation job of the lab.
+*/
+func (s *Server) getApproval(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	approval, ok := s.getLabApproval(params["id"])
+	if !ok {
+		http.Error(w, "Approval "+params["id"]+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(approval)
+}
+
+/*
+Approves or rejects a lab that waits for approval, only cluster admins can decide. An approved lab is created in the background,
+the creation job is returned in the Location header. The instructor is notified of the decision if they asked to be.
+HTTP Parameters:
+ comment: <string> (optional, e.g. why the lab was rejected)
+*/
+func (s *Server) decideLabApproval(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	user, e := s.checkLabApprover(r)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	var parameters DecisionParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	s.labApprovals.Lock()
+	approval, ok := s.labApprovals.approvals[params["id"]]
+	if !ok {
+		s.labApprovals.Unlock()
+		http.Error(w, "Approval "+params["id"]+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	if approval.Status != labApprovalPending {
+		s.labApprovals.Unlock()
+		http.Error(w, "Lab "+approval.LabName+" was already "+strings.ToLower(approval.Status), http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	approval.Status = labApprovalRejected
+	if params["decision"] == "approve" {
+		approval.Status = labApprovalApproved
+	}
+	approval.Comment = parameters.Comment
+	approval.DecidedBy = user.Username
+	approval.DecidedAt = &now
+
+	request, create := approval.request, approval.create
+	approval.request, approval.create = nil, nil
+	s.labApprovals.Unlock()
+
+	if approval.Status == labApprovalApproved {
+		job, err := s.startCreationJob(request, approval.LabName, create)
+		if err != nil {
+			http.Error(w, "Something went wrong while creating the creation job", http.StatusInternalServerError)
+			return
+		}
+
+		s.labApprovals.Lock()
+		approval.JobId = job.Id
+		s.labApprovals.Unlock()
+	}
+
+	decided, _ := s.getLabApproval(approval.Id)
+
+	if decided.subscription != nil {
+		message := "Lab " + decided.LabName + " was " + strings.ToLower(decided.Status) + " by " + decided.DecidedBy
+		if decided.Comment != "" {
+			message += ": " + decided.Comment
+		}
+		go s.sendNotification([]NotificationSubscription{*decided.subscription}, Notification{Event: eventLabApproval, Lab: decided.LabName, Title: "Lab " + decided.LabName + " " + strings.ToLower(decided.Status), Message: message, CreatedAt: now})
+	}
+	emitWebhook(webhookApprovalDecided, decided)
+
+	w.Header().Set("Content-Type", "application/json")
+	if decided.JobId != "" {
+		w.Header().Set("Location", apiPrefix+"/job/"+decided.JobId)
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(decided)
+}
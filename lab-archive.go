@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often archives that outlived their retention are purged
+const archiveRetentionInterval = time.Hour
+
+// The stored state of a deleted lab (manifest, options, students, requests, ...), kept in the object store for its retention
+type LabArchive struct {
+	Lab           string            `json:"lab"`
+	DeletedAt     time.Time         `json:"deletedAt"`
+	RetentionDays int               `json:"retentionDays,omitempty"`
+	Data          map[string]string `json:"data"`
+}
+
+// An archive in the retention report, without its data
+type ArchiveSummary struct {
+	Key       string     `json:"key"`
+	Lab       string     `json:"lab"`
+	DeletedAt time.Time  `json:"deletedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Size      int        `json:"size"`
+}
+
+// The archives in the object store and the storage they use
+type ArchiveReport struct {
+	Archives  []ArchiveSummary `json:"archives"`
+	TotalSize int              `json:"totalSize"`
+}
+
+/*
+Returns the default amount of days archives are kept after their lab was deleted, configured by SCALAMA_ARCHIVE_RETENTION_DAYS.
+Archives are kept forever when the variable is not set.
+*/
+func getArchiveRetentionDays() (int, error) {
+	value := os.Getenv("SCALAMA_ARCHIVE_RETENTION_DAYS")
+	if value == "" {
+		return 0, nil
+	}
+
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("SCALAMA_ARCHIVE_RETENTION_DAYS must be a positive number")
+	}
+
+	return days, nil
+}
+
+/*
+Returns the key of the archive of a lab deleted at a time.
+*/
+func getArchiveKey(labName string, deletedAt time.Time) string {
+	return "archives/" + labName + "/" + strconv.FormatInt(deletedAt.Unix(), 10) + ".json"
+}
+
+/*
+Returns when an archive expires, with the retention of its lab or else the default retention. Returns nil if it is kept forever.
+*/
+func getArchiveExpiry(archive LabArchive, defaultDays int) *time.Time {
+	days := archive.RetentionDays
+	if days == 0 {
+		days = defaultDays
+	}
+
+	if days == 0 {
+		return nil
+	}
+
+	expiresAt := archive.DeletedAt.AddDate(0, 0, days)
+	return &expiresAt
+}
+
+/*
+Stores the state of a lab that is being deleted in the object store, so its course data remains available for its retention.
+*/
+func (s *Server) archiveLab(ctx context.Context, labName string, labData map[string]string, deletedAt time.Time) error {
+	archive := LabArchive{Lab: labName, DeletedAt: deletedAt.UTC(), Data: labData}
+	if options, err := getStoredLabOptions(labData); err == nil {
+		archive.RetentionDays = options.RetentionDays
+	}
+
+	encoded, err := json.Marshal(archive)
+	if err != nil {
+		return err
+	}
+
+	return s.objectStore.putObject(ctx, getArchiveKey(labName, deletedAt), encoded, "application/json")
+}
+
+/*
+Returns the archives in the object store, optionally only the archives of one lab, the most recently deleted first.
+*/
+func (s *Server) getArchiveReport(ctx context.Context, labName string) (*ArchiveReport, error) {
+	defaultDays, err := getArchiveRetentionDays()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := "archives/"
+	if labName != "" {
+		prefix += labName + "/"
+	}
+
+	keys, err := s.objectStore.listObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ArchiveReport{Archives: []ArchiveSummary{}}
+	for _, key := range keys {
+		data, _, err := s.objectStore.getObject(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		var archive LabArchive
+		if err := json.Unmarshal(data, &archive); err != nil {
+			return nil, err
+		}
+
+		report.Archives = append(report.Archives, ArchiveSummary{
+			Key:       strings.TrimPrefix(key, "archives/"),
+			Lab:       archive.Lab,
+			DeletedAt: archive.DeletedAt,
+			ExpiresAt: getArchiveExpiry(archive, defaultDays),
+			Size:      len(data),
+		})
+		report.TotalSize += len(data)
+	}
+
+	sort.Slice(report.Archives, func(i, j int) bool {
+		return report.Archives[i].DeletedAt.After(report.Archives[j].DeletedAt)
+	})
+
+	return report, nil
+}
+
+/*
+Deletes the archives that outlived their retention. Returns the purged archives.
+*/
+func (s *Server) purgeExpiredArchives(ctx context.Context, now time.Time) ([]ArchiveSummary, error) {
+	report, err := s.getArchiveReport(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []ArchiveSummary
+	for _, archive := range report.Archives {
+		if archive.ExpiresAt == nil || now.Before(*archive.ExpiresAt) {
+			continue
+		}
+
+		if err := s.objectStore.deleteObject(ctx, "archives/"+archive.Key); err != nil {
+			return purged, err
+		}
+
+		purged = append(purged, archive)
+	}
+
+	return purged, nil
+}
+
+/*
+Purges the archives that outlived their retention every hour. Errors are logged, the loop only stops when ctx is cancelled.
+*/
+func (s *Server) startArchiveRetentionLoop(ctx context.Context) {
+	ticker := time.NewTicker(archiveRetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := s.purgeExpiredArchives(ctx, time.Now())
+		for _, archive := range purged {
+			fmt.Println("Purged archive", archive.Key, "of lab", archive.Lab, "deleted at", archive.DeletedAt.Format(time.RFC3339))
+		}
+		if err != nil {
+			fmt.Println("Something went wrong while purging the expired archives:", err)
+		}
+	}
+}
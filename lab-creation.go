@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	creationStatusQueued    = "Queued"
+	creationStatusRunning   = "Running"
+	creationStatusSucceeded = "Succeeded"
+	creationStatusFailed    = "Failed"
+)
+
+// Events of a creation job, streamed by GET /job/{id}/events
+const (
+	creationEventQueued               = "queued"
+	creationEventStarted              = "started"
+	creationEventNamespaceCreated     = "namespace-created"
+	creationEventNamespaceProvisioned = "namespace-provisioned"
+	creationEventManifestDeployed     = "manifest-deployed"
+	creationEventSucceeded            = "succeeded"
+	creationEventFailed               = "failed"
+)
+
+// Clients of the event stream are sent a comment this often, so proxies don't close an idle stream while a namespace is created
+const creationStreamKeepAlive = 15 * time.Second
+
+// The amount of namespaces a creation creates and how far it got
+type CreationProgress struct {
+	Namespaces            int `json:"namespaces"`
+	NamespacesCreated     int `json:"namespacesCreated"`
+	NamespacesProvisioned int `json:"namespacesProvisioned"`
+	ResourcesDeployed     int `json:"resourcesDeployed"`
+}
+
+// A step of a creation job with the progress right after it, the credentials are part of the succeeded event
+type CreationEvent struct {
+	Type        string            `json:"type"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Detail      string            `json:"detail,omitempty"`
+	Progress    CreationProgress  `json:"progress"`
+	Credentials map[string]string `json:"credentials,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+// Progress of the asynchronous creation of a lab (or of adding students to it). Credentials are the response of a synchronous
+// request: the tokens (or identities, or kubeconfigs) of the new namespaces, once the creation succeeded. They are only
+// delivered once, by GET /job/{id} or by the succeeded event, and dropped from the job after that.
+type CreationJob struct {
+	Id            string `json:"id"`
+	LabName       string `json:"labName"`
+	Status        string `json:"status"`
+	QueuePosition int    `json:"queuePosition,omitempty"`
+	CreationProgress
+	Error       string            `json:"error,omitempty"`
+	Warnings    []string          `json:"warnings,omitempty"`
+	Credentials map[string]string `json:"credentials,omitempty"`
+	// The credentials were already delivered
+	CredentialsDelivered bool       `json:"credentialsDelivered,omitempty"`
+	StartedAt            time.Time  `json:"startedAt"`
+	FinishedAt           *time.Time `json:"finishedAt,omitempty"`
+
+	// The jobs of the server the job belongs to, whose lock protects the job
+	store          *creationJobStore
+	provisioningId string
+	events         []CreationEvent
+	// Closed and replaced whenever an event is added, to wake up the event streams of the job
+	changed chan struct{}
+}
+
+// The creation jobs of a server by id, finished jobs are evicted after the job retention
+type creationJobStore struct {
+	sync.Mutex
+	jobs map[string]*CreationJob
+}
+
+type creationJobKey struct{}
+
+// Keeps the values of a request (e.g. the students and the impersonated user) for an asynchronous creation,
+// which is only cancelled when the server shuts down instead of when the client disconnects
+type detachedContext struct {
+	context.Context
+	values context.Context
+}
+
+func (ctx detachedContext) Value(key interface{}) interface{} {
+	return ctx.values.Value(key)
+}
+
+// Records the response of a handler that runs after the actual response was sent
+type jobResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jobResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *jobResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.body.Write(data)
+}
+
+func (w *jobResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+/*
+Creates and stores a new creation job for a lab.
+*/
+func (s *Server) newCreationJob(labName string) (*CreationJob, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	job := &CreationJob{
+		Id:        hex.EncodeToString(id),
+		LabName:   labName,
+		Status:    creationStatusRunning,
+		StartedAt: time.Now(),
+		store:     s.creationJobs,
+		changed:   make(chan struct{}),
+	}
+
+	s.creationJobs.Lock()
+	s.creationJobs.jobs[job.Id] = job
+	s.creationJobs.Unlock()
+
+	return job, nil
+}
+
+/*
+Returns a copy of the creation job with id, so it can be read while the creation continues.
+A job that waits in the provisioning queue is Queued, with its position in the queue.
+With deliver the credentials of a job that succeeded are dropped from it, the copy is the only one that still has them.
+*/
+func (s *Server) getCreationJob(id string, deliver bool) (CreationJob, bool) {
+	s.creationJobs.Lock()
+	job, ok := s.creationJobs.jobs[id]
+	if !ok {
+		s.creationJobs.Unlock()
+		return CreationJob{}, false
+	}
+
+	jobCopy := *job
+	jobCopy.Warnings = append([]string(nil), job.Warnings...)
+	jobCopy.events = nil
+	if deliver {
+		job.dropCredentialsLocked()
+	}
+	s.creationJobs.Unlock()
+
+	if jobCopy.Status == creationStatusRunning && jobCopy.provisioningId != "" {
+		for _, entry := range s.labQueue.list("") {
+			if entry.Id == jobCopy.provisioningId && entry.Position > 0 {
+				jobCopy.Status = creationStatusQueued
+				jobCopy.QueuePosition = entry.Position
+			}
+		}
+	}
+
+	return jobCopy, true
+}
+
+/*
+Returns the creation job of an asynchronous request, nil for synchronous requests. The methods of a nil job do nothing.
+*/
+func getRequestCreationJob(ctx context.Context) *CreationJob {
+	job, _ := ctx.Value(creationJobKey{}).(*CreationJob)
+	return job
+}
+
+/*
+Adds an event to the job with its current progress and wakes up its event streams. The jobs must be locked.
+*/
+func (job *CreationJob) addEventLocked(event CreationEvent) {
+	event.Progress = job.CreationProgress
+	event.CreatedAt = time.Now()
+	job.events = append(job.events, event)
+
+	close(job.changed)
+	job.changed = make(chan struct{})
+}
+
+/*
+Links the job to its entry in the provisioning queue, to report its position while it waits.
+*/
+func (job *CreationJob) setProvisioningEntry(entry *ProvisioningEntry) {
+	if job == nil {
+		return
+	}
+
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	job.provisioningId = entry.Id
+	job.addEventLocked(CreationEvent{Type: creationEventQueued, Detail: "priority " + entry.Priority})
+}
+
+/*
+Records that the job left the provisioning queue, with the amount of namespaces it creates.
+*/
+func (job *CreationJob) start(namespaces int) {
+	if job == nil {
+		return
+	}
+
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	job.Namespaces = namespaces
+	job.addEventLocked(CreationEvent{Type: creationEventStarted})
+}
+
+/*
+Records a namespace that was created.
+*/
+func (job *CreationJob) addNamespaceCreated(namespace string) {
+	if job == nil {
+		return
+	}
+
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	job.NamespacesCreated++
+	job.addEventLocked(CreationEvent{Type: creationEventNamespaceCreated, Namespace: namespace})
+}
+
+/*
+Records a namespace whose students got access to it.
+*/
+func (job *CreationJob) addNamespaceProvisioned(namespace string) {
+	if job == nil {
+		return
+	}
+
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	job.NamespacesProvisioned++
+	job.addEventLocked(CreationEvent{Type: creationEventNamespaceProvisioned, Namespace: namespace})
+}
+
+/*
+Records an object of the manifest that was created. Objects are counted without an event, the events of the namespaces report them.
+*/
+func (job *CreationJob) addResourceDeployed() {
+	if job == nil {
+		return
+	}
+
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	job.ResourcesDeployed++
+}
+
+/*
+Records namespaces in which the manifest was deployed.
+*/
+func (job *CreationJob) addManifestDeployed(namespaces []string) {
+	if job == nil {
+		return
+	}
+
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	for _, namespace := range namespaces {
+		job.addEventLocked(CreationEvent{Type: creationEventManifestDeployed, Namespace: namespace})
+	}
+}
+
+/*
+Drops the credentials of the job (and of its succeeded event) once they were delivered. The jobs must be locked.
+*/
+func (job *CreationJob) dropCredentialsLocked() {
+	if job.Credentials == nil {
+		return
+	}
+
+	job.Credentials = nil
+	job.CredentialsDelivered = true
+	for i := range job.events {
+		if job.events[i].Credentials != nil {
+			job.events[i].Credentials = nil
+			job.events[i].Detail = "credentials were already delivered"
+		}
+	}
+}
+
+/*
+Drops the credentials of the creation job with id once they were delivered.
+*/
+func (s *Server) dropCreationCredentials(id string) {
+	s.creationJobs.Lock()
+	defer s.creationJobs.Unlock()
+
+	if job, ok := s.creationJobs.jobs[id]; ok {
+		job.dropCredentialsLocked()
+	}
+}
+
+/*
+Marks the creation job as finished with the response of the handler: an error for error statuses, or else the credentials.
+The job is evicted once the job retention passed.
+*/
+func (job *CreationJob) finish(w *jobResponseWriter) {
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Warnings = w.header.Values("Warning")
+
+	// The retention was validated at startup
+	retention, _ := getJobRetention()
+	time.AfterFunc(retention, func() {
+		job.store.Lock()
+		defer job.store.Unlock()
+
+		delete(job.store.jobs, job.Id)
+	})
+
+	if w.status >= http.StatusBadRequest {
+		job.Status = creationStatusFailed
+		job.Error = strings.TrimSpace(w.body.String())
+	} else if err := json.Unmarshal(w.body.Bytes(), &job.Credentials); err != nil {
+		job.Status = creationStatusFailed
+		job.Error = "Something went wrong while reading the credentials of lab " + job.LabName
+	} else {
+		job.Status = creationStatusSucceeded
+	}
+
+	if job.Status == creationStatusFailed {
+		job.addEventLocked(CreationEvent{Type: creationEventFailed, Detail: job.Error})
+	} else {
+		job.addEventLocked(CreationEvent{Type: creationEventSucceeded, Credentials: job.Credentials})
+	}
+}
+
+/*
+Returns the events of a job from index on, a channel that is closed once there are newer events, and whether the job finished.
+*/
+func (s *Server) getCreationEvents(id string, index int) ([]CreationEvent, <-chan struct{}, bool, bool) {
+	s.creationJobs.Lock()
+	defer s.creationJobs.Unlock()
+
+	job, ok := s.creationJobs.jobs[id]
+	if !ok {
+		return nil, nil, false, false
+	}
+
+	return append([]CreationEvent(nil), job.events[index:]...), job.changed, job.FinishedAt != nil, true
+}
+
+/*
+Streams the events of a creation job as Server-Sent Events, starting with the events that already happened.
+The stream ends after the succeeded or failed event, or when the client disconnects.
+*/
+func (s *Server) streamCreationEvents(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Something went wrong while streaming the events of job "+id, http.StatusInternalServerError)
+		return
+	}
+
+	if _, _, _, ok := s.getCreationEvents(id, 0); !ok {
+		http.Error(w, "Job "+id+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(creationStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	index := 0
+	for {
+		events, changed, finished, _ := s.getCreationEvents(id, index)
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", index, event.Type, data)
+			index++
+		}
+		flusher.Flush()
+
+		// The credentials are only delivered once
+		for _, event := range events {
+			if event.Credentials != nil {
+				s.dropCreationCredentials(id)
+			}
+		}
+
+		// The last event of a finished job was sent
+		if finished {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+/*
+Starts a creation job that runs a handler that creates a lab (or adds students to it) in the background, with the values of
+the context of the request.
+*/
+func (s *Server) startCreationJob(r *http.Request, labName string, handler func(w http.ResponseWriter, r *http.Request)) (*CreationJob, error) {
+	job, err := s.newCreationJob(labName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.WithValue(detachedContext{Context: s.shutdownContext, values: r.Context()}, creationJobKey{}, job)
+	jobRequest := r.WithContext(ctx)
+
+	go func() {
+		recorder := &jobResponseWriter{header: http.Header{}}
+		handler(recorder, jobRequest)
+		job.finish(recorder)
+
+		if job.Status == creationStatusFailed {
+			fmt.Println("Something went wrong while creating lab "+labName+":", job.Error)
+		}
+	}()
+
+	return job, nil
+}
+
+/*
+Runs a handler that creates a lab (or adds students to it) after responding with a creation job, so classes with hundreds of
+students don't time out. Its progress is served by GET /job/{id}.
+*/
+func (s *Server) runCreationJob(w http.ResponseWriter, r *http.Request, labName string, handler func(w http.ResponseWriter, r *http.Request)) {
+	var parameters CredentialsParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	if parameters.Format == credentialsFormatZip {
+		http.Error(w, "Asynchronous creations return their credentials as JSON, format zip is not supported", http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.startCreationJob(r, labName, handler)
+	if err != nil {
+		http.Error(w, "Something went wrong while creating the creation job", http.StatusInternalServerError)
+		return
+	}
+
+	creationJob, _ := s.getCreationJob(job.Id, false)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPrefix+"/job/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(creationJob)
+}
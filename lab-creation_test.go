@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFinishedCreationJob(t *testing.T) (*Server, *CreationJob) {
+	s := newTestServer(t)
+
+	job, err := s.newCreationJob("lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &jobResponseWriter{header: http.Header{}}
+	json.NewEncoder(recorder).Encode(map[string]string{"ann-lee": "token"})
+	job.finish(recorder)
+
+	return s, job
+}
+
+func TestCreationJobCredentialsAreDeliveredOnce(t *testing.T) {
+	s, job := newFinishedCreationJob(t)
+
+	getJobCredentials := func() CreationJob {
+		r := newTestRequest(http.MethodGet, "/job/"+job.Id, "", map[string]string{"id": job.Id})
+		w := httptest.NewRecorder()
+		s.getJob(w, r)
+
+		var creationJob CreationJob
+		if err := json.NewDecoder(w.Body).Decode(&creationJob); err != nil {
+			t.Fatal(err)
+		}
+		return creationJob
+	}
+
+	if creationJob := getJobCredentials(); creationJob.Credentials["ann-lee"] != "token" {
+		t.Fatalf("expected the credentials of the job, got %v", creationJob.Credentials)
+	}
+
+	creationJob := getJobCredentials()
+	if creationJob.Credentials != nil || !creationJob.CredentialsDelivered {
+		t.Fatalf("expected the credentials to be delivered only once, got %v", creationJob.Credentials)
+	}
+
+	// The succeeded event doesn't keep them either
+	events, _, _, _ := s.getCreationEvents(job.Id, 0)
+	for _, event := range events {
+		if event.Credentials != nil {
+			t.Fatalf("expected event %s to have no credentials", event.Type)
+		}
+	}
+}
+
+func TestCreationJobCredentialsAreDeliveredOnceByEvents(t *testing.T) {
+	s, job := newFinishedCreationJob(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/job/"+job.Id+"/events", nil)
+	w := httptest.NewRecorder()
+	s.streamCreationEvents(w, r, job.Id)
+
+	if !strings.Contains(w.Body.String(), `"ann-lee":"token"`) {
+		t.Fatalf("expected the succeeded event to have the credentials, got %s", w.Body.String())
+	}
+
+	if creationJob, _ := s.getCreationJob(job.Id, false); creationJob.Credentials != nil {
+		t.Fatalf("expected the credentials to be dropped once they were streamed, got %v", creationJob.Credentials)
+	}
+}
+
+func TestFinishedCreationJobIsEvicted(t *testing.T) {
+	t.Setenv("SCALAMA_JOB_RETENTION", "10ms")
+	s, job := newFinishedCreationJob(t)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := s.getCreationJob(job.Id, false); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("expected the finished job to be evicted after the job retention")
+}
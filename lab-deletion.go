@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	deletionStatusRunning   = "Running"
+	deletionStatusSucceeded = "Succeeded"
+	deletionStatusFailed    = "Failed"
+
+	namespaceStatusTerminating = "Terminating"
+	namespaceStatusDeleted     = "Deleted"
+	namespaceStatusStuck       = "Stuck"
+)
+
+// Progress of the deletion of a single namespace of a lab
+type NamespaceDeletion struct {
+	Status     string   `json:"status"`
+	Finalizers []string `json:"finalizers,omitempty"`
+	Message    string   `json:"message,omitempty"`
+}
+
+// Progress of the asynchronous deletion of a lab. Deleted and Errors report every object that was deleted and every step that failed.
+type DeletionJob struct {
+	Id         string                       `json:"id"`
+	LabName    string                       `json:"labName"`
+	Status     string                       `json:"status"`
+	Error      string                       `json:"error,omitempty"`
+	Errors     []string                     `json:"errors,omitempty"`
+	Deleted    []string                     `json:"deleted,omitempty"`
+	Namespaces map[string]NamespaceDeletion `json:"namespaces"`
+	StartedAt  time.Time                    `json:"startedAt"`
+	FinishedAt *time.Time                   `json:"finishedAt,omitempty"`
+
+	// The jobs of the server the job belongs to, whose lock protects the job
+	store *deletionJobStore
+}
+
+// The deletion jobs of a server by id, finished jobs are evicted after the job retention
+type deletionJobStore struct {
+	sync.Mutex
+	jobs map[string]*DeletionJob
+}
+
+/*
+Returns how long the deletion of a lab waits for its namespaces to be gone, configured by SCALAMA_DELETION_TIMEOUT (e.g. "10m").
+*/
+func getDeletionTimeout() (time.Duration, error) {
+	value := os.Getenv("SCALAMA_DELETION_TIMEOUT")
+	if value == "" {
+		return 5 * time.Minute, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+/*
+Returns how long finished creation and deletion jobs can still be read, configured by SCALAMA_JOB_RETENTION (default 1h).
+*/
+func getJobRetention() (time.Duration, error) {
+	value := os.Getenv("SCALAMA_JOB_RETENTION")
+	if value == "" {
+		return time.Hour, nil
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("SCALAMA_JOB_RETENTION must be a duration of at least 0, e.g. 1h")
+	}
+
+	return retention, nil
+}
+
+/*
+Creates and stores a new deletion job for a lab.
+*/
+func (s *Server) newDeletionJob(labName string) (*DeletionJob, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	job := &DeletionJob{
+		Id:         hex.EncodeToString(id),
+		LabName:    labName,
+		Status:     deletionStatusRunning,
+		Namespaces: map[string]NamespaceDeletion{},
+		StartedAt:  time.Now(),
+		store:      s.deletionJobs,
+	}
+
+	s.deletionJobs.Lock()
+	s.deletionJobs.jobs[job.Id] = job
+	s.deletionJobs.Unlock()
+
+	return job, nil
+}
+
+/*
+Returns a copy of the deletion job with id, so it can be read while the deletion continues.
+*/
+func (s *Server) getDeletionJob(id string) (DeletionJob, bool) {
+	s.deletionJobs.Lock()
+	defer s.deletionJobs.Unlock()
+
+	job, ok := s.deletionJobs.jobs[id]
+	if !ok {
+		return DeletionJob{}, false
+	}
+
+	jobCopy := *job
+	jobCopy.Errors = append([]string(nil), job.Errors...)
+	jobCopy.Deleted = append([]string(nil), job.Deleted...)
+	jobCopy.Namespaces = map[string]NamespaceDeletion{}
+	for namespace, deletion := range job.Namespaces {
+		jobCopy.Namespaces[namespace] = deletion
+	}
+
+	return jobCopy, true
+}
+
+/*
+Updates the deletion progress of a namespace.
+*/
+func (job *DeletionJob) setNamespace(namespace string, deletion NamespaceDeletion) {
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	job.Namespaces[namespace] = deletion
+}
+
+/*
+Records a step of the deletion that failed, the deletion continues with the next step.
+*/
+func (job *DeletionJob) addError(message string) {
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	job.Errors = append(job.Errors, message)
+}
+
+/*
+Records an object that was deleted, e.g. clusterrolebindings/read-namespaces-crb-lab-user.
+*/
+func (job *DeletionJob) addDeleted(object string) {
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	job.Deleted = append(job.Deleted, object)
+}
+
+/*
+Marks the deletion job as finished. The job failed if e is not nil. The job is evicted once the job retention passed.
+*/
+func (job *DeletionJob) finish(e *Error) {
+	job.store.Lock()
+	defer job.store.Unlock()
+
+	now := time.Now()
+	job.FinishedAt = &now
+
+	// The retention was validated at startup
+	retention, _ := getJobRetention()
+	time.AfterFunc(retention, func() {
+		job.store.Lock()
+		defer job.store.Unlock()
+
+		delete(job.store.jobs, job.Id)
+	})
+
+	if e != nil {
+		job.Status = deletionStatusFailed
+		job.Error = e.message
+		return
+	}
+
+	job.Status = deletionStatusSucceeded
+}
+
+/*
+Returns the deletion progress of a namespace that still exists, based on its finalizers and conditions.
+*/
+func getNamespaceDeletion(namespace *corev1.Namespace, stuck bool) NamespaceDeletion {
+	deletion := NamespaceDeletion{Status: namespaceStatusTerminating}
+	if stuck {
+		deletion.Status = namespaceStatusStuck
+	}
+
+	for _, finalizer := range namespace.Spec.Finalizers {
+		deletion.Finalizers = append(deletion.Finalizers, string(finalizer))
+	}
+	deletion.Finalizers = append(deletion.Finalizers, namespace.Finalizers...)
+
+	// The conditions explain which content or finalizers are still blocking the deletion
+	var messages []string
+	for _, condition := range namespace.Status.Conditions {
+		if condition.Status == corev1.ConditionTrue {
+			messages = append(messages, condition.Message)
+		}
+	}
+	deletion.Message = strings.Join(messages, "; ")
+
+	return deletion
+}
+
+/*
+Waits until every namespace is fully terminated. Namespaces that are not gone after the timeout are reported as stuck.
+The deletion of namespaces that are not terminating (anymore) is retried.
+*/
+func waitForNamespaceDeletion(ctx context.Context, clientset kubernetes.Interface, job *DeletionJob, namespaces []string, timeout time.Duration) *Error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		remaining := 0
+		stuck := time.Now().After(deadline)
+
+		for _, name := range namespaces {
+			namespace, err := clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				if errors.IsNotFound(err) {
+					job.setNamespace(name, NamespaceDeletion{Status: namespaceStatusDeleted})
+					continue
+				}
+
+				return &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching namespace " + name}
+			}
+
+			remaining++
+			job.setNamespace(name, getNamespaceDeletion(namespace, stuck))
+
+			if namespace.DeletionTimestamp == nil {
+				if err := clientset.CoreV1().Namespaces().Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+					return &Error{status: http.StatusInternalServerError, message: "Something went wrong while deleting namespace " + name}
+				}
+			}
+		}
+
+		if remaining == 0 {
+			return nil
+		}
+
+		if stuck {
+			return &Error{status: http.StatusInternalServerError, message: fmt.Sprintf("%d namespaces of lab %s are stuck terminating", remaining, job.LabName)}
+		}
+
+		select {
+		case <-ctx.Done():
+			return &Error{status: http.StatusServiceUnavailable, message: "The deletion of lab " + job.LabName + " was cancelled while its namespaces were terminating"}
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+/*
+Deletes the ServiceAccount tokens and the records ScaLaMa keeps in a namespace of a lab.
+They are deleted up front, so the credentials of the students are revoked even if the namespace gets stuck terminating.
+*/
+func deleteNamespaceCredentials(ctx context.Context, clientset kubernetes.Interface, job *DeletionJob, namespace string) {
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{FieldSelector: "type=" + string(corev1.SecretTypeServiceAccountToken)})
+	if err != nil {
+		job.addError("Something went wrong while listing the ServiceAccount tokens of namespace " + namespace)
+	} else {
+		for _, secret := range secrets.Items {
+			if secret.Type != corev1.SecretTypeServiceAccountToken {
+				continue
+			}
+
+			if err := clientset.CoreV1().Secrets(namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				job.addError("Something went wrong while deleting Secret " + secret.Name + " in namespace " + namespace)
+				continue
+			}
+
+			job.addDeleted("secrets/" + namespace + "/" + secret.Name)
+		}
+	}
+
+	for _, configMapName := range []string{labConfigMapName, inventoryConfigMapName} {
+		err := clientset.CoreV1().ConfigMaps(namespace).Delete(ctx, configMapName, metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			job.addError("Something went wrong while deleting ConfigMap " + configMapName + " in namespace " + namespace)
+			continue
+		}
+
+		job.addDeleted("configmaps/" + namespace + "/" + configMapName)
+	}
+}
+
+/*
+Deletes everything of a lab and waits until its namespaces are gone, as the user in ctx when impersonation is enabled.
+A step that fails doesn't stop the deletion, every failed step is recorded in the job so a partially deleted lab can be cleaned up.
+Only failing pre-delete hooks stop the deletion before anything is deleted, unless skipHooks is set.
+*/
+func (s *Server) deleteLabResources(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, job *DeletionJob, skipHooks bool) *Error {
+	labName := job.LabName
+
+	timeout, err := getDeletionTimeout()
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while parsing SCALAMA_DELETION_TIMEOUT"}
+	}
+
+	labData, err := s.getLabData(ctx, labName)
+	if err != nil {
+		job.addError("Something went wrong while fetching the stored state of lab " + labName)
+	}
+
+	// The pre-delete hooks export what is needed of the lab (e.g. for grading) before anything is deleted
+	if err == nil && !skipHooks {
+		if e := s.runLabPreDeleteHooks(ctx, clientset, dynamicInterface, labName, labData); e != nil {
+			return e
+		}
+	}
+
+	// The state of the lab is kept for its retention, it is deleted together with the lab namespace
+	if _, ok := labData["manifest"]; s.objectStore != nil && ok {
+		if err := s.archiveLab(ctx, labName, labData, time.Now()); err != nil {
+			job.addError("Something went wrong while archiving lab " + labName)
+		}
+	}
+
+	// Delete all namespaces of which the name starts with ns-labName- or are the general namespace
+	namespaceNames, err := s.listNamespaceNames(ctx, clientset)
+	if err != nil {
+		job.addError("Something went wrong while listing the namespaces")
+	}
+
+	var namespaces []string
+	for _, namespace := range namespaceNames {
+		if namespace == "ns-"+labName || strings.HasPrefix(namespace, "ns-"+labName+"-") {
+			// Helm releases have to be uninstalled before their namespace (and release storage) is gone
+			if err := uninstallHelmReleases(namespace); err != nil {
+				job.addError("Something went wrong while uninstalling the Helm releases in namespace " + namespace)
+			}
+
+			deleteNamespaceCredentials(ctx, clientset, job, namespace)
+
+			if err := clientset.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				job.addError("Something went wrong while deleting namespace " + namespace)
+				continue
+			}
+
+			namespaces = append(namespaces, namespace)
+			job.setNamespace(namespace, NamespaceDeletion{Status: namespaceStatusTerminating})
+		}
+	}
+
+	// Delete all ClusterRoleBindings of which the name starts with read-namespaces-crb-labName- or scalama-lab-labName-
+	clusterRoleBindings, err := s.listClusterRoleBindingNames(ctx, clientset)
+	if err != nil {
+		job.addError("Something went wrong while listing the ClusterRoleBindings")
+	}
+
+	for _, clusterRoleBinding := range clusterRoleBindings {
+		if strings.HasPrefix(clusterRoleBinding, "read-namespaces-crb-"+labName+"-") || strings.HasPrefix(clusterRoleBinding, getLabClusterRoleName(labName)+"-") {
+			err := clientset.RbacV1().ClusterRoleBindings().Delete(ctx, clusterRoleBinding, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				job.addError("Something went wrong while deleting ClusterRoleBinding " + clusterRoleBinding)
+				continue
+			}
+
+			job.addDeleted("clusterrolebindings/" + clusterRoleBinding)
+		}
+	}
+
+	// Delete the ClusterRoles of the lab
+	clusterRoleNames, err := s.listLabClusterRoleNames(ctx, clientset, labName)
+	if err != nil {
+		job.addError("Something went wrong while listing the ClusterRoles of lab " + labName)
+	}
+
+	for _, clusterRoleName := range clusterRoleNames {
+		err = clientset.RbacV1().ClusterRoles().Delete(ctx, clusterRoleName, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			job.addError("Something went wrong while deleting ClusterRole " + clusterRoleName)
+			continue
+		}
+
+		job.addDeleted("clusterroles/" + clusterRoleName)
+	}
+
+	// Cluster-scoped and shared external objects are not deleted together with the namespaces of the lab
+	if err := deleteManagedClusterObjects(ctx, clientset, dynamicInterface, labName); err != nil {
+		job.addError("Something went wrong while deleting the cluster-scoped and shared external objects of lab " + labName)
+	}
+
+	// Remove the IAM identities of the lab from aws-auth on EKS
+	isEks, err := awsAuthExists(ctx, clientset)
+	if err != nil {
+		job.addError("Something went wrong while fetching aws-auth")
+	}
+
+	if isEks {
+		if err := removeAwsAuthUsers(ctx, clientset, labName); err != nil {
+			job.addError("Something went wrong while removing the IAM identities of lab " + labName + " from aws-auth")
+		}
+	}
+
+	// State in an external store is not deleted together with the lab namespace
+	if s.labStore != nil {
+		if err := s.deleteLabData(ctx, labName); err != nil {
+			job.addError("Something went wrong while deleting the stored state of lab " + labName)
+		}
+	}
+
+	if s.isRancher {
+		if err := deleteRancherProject(ctx, dynamicInterface, labName); err != nil {
+			job.addError("Something went wrong while deleting the Rancher project of lab " + labName)
+		}
+	}
+
+	// Namespaces are never actually deleted in dry-run mode
+	if !*dryRunMode {
+		if e := waitForNamespaceDeletion(ctx, clientset, job, namespaces, timeout); e != nil {
+			job.addError(e.message)
+		}
+	}
+
+	if deletionJob, _ := s.getDeletionJob(job.Id); len(deletionJob.Errors) > 0 {
+		return &Error{status: http.StatusInternalServerError, message: fmt.Sprintf("%d steps of the deletion of lab %s failed, see errors", len(deletionJob.Errors), labName)}
+	}
+
+	return nil
+}
+
+// Report of the deletion of a single student or group
+type StudentDeletion struct {
+	Namespace string   `json:"namespace"`
+	Deleted   []string `json:"deleted"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+/*
+Deletes the namespace of a student (or group) and its RBAC outside of it, the rest of the lab is left untouched.
+Students of shared-only labs have no namespace, their ServiceAccount in the lab namespace is deleted instead.
+In hybrid labs groupNamespace is the namespace of the group of the student, their access to it is removed as well.
+A step that fails doesn't stop the deletion, every failed step is recorded in the report.
+*/
+func (s *Server) deleteStudentResources(ctx context.Context, clientset kubernetes.Interface, labName string, username string, groupNamespace string, sharedOnly bool) StudentDeletion {
+	namespace := "ns-" + labName + "-" + username
+	if sharedOnly {
+		namespace = "ns-" + labName
+	}
+	report := StudentDeletion{Namespace: namespace, Deleted: []string{}}
+
+	// Helm releases have to be uninstalled before their namespace (and release storage) is gone
+	if !sharedOnly {
+		if err := uninstallHelmReleases(namespace); err != nil {
+			report.Errors = append(report.Errors, "Something went wrong while uninstalling the Helm releases in namespace "+namespace)
+		}
+	}
+
+	// The access of the student to the lab namespace, and to the namespace of their group in hybrid labs
+	bindingNamespaces := []string{"ns-" + labName}
+	if groupNamespace != "" {
+		bindingNamespaces = append(bindingNamespaces, groupNamespace)
+	}
+
+	for _, bindingNamespace := range bindingNamespaces {
+		err := clientset.RbacV1().RoleBindings(bindingNamespace).Delete(ctx, "student-binding-"+username, metav1.DeleteOptions{})
+		if err == nil {
+			report.Deleted = append(report.Deleted, "rolebindings/"+bindingNamespace+"/student-binding-"+username)
+		} else if !errors.IsNotFound(err) {
+			report.Errors = append(report.Errors, "Something went wrong while deleting RoleBinding student-binding-"+username+" in namespace "+bindingNamespace)
+		}
+	}
+
+	for _, clusterRoleBinding := range []string{"read-namespaces-crb-" + labName + "-" + username, getLabClusterRoleName(labName) + "-" + username} {
+		err := clientset.RbacV1().ClusterRoleBindings().Delete(ctx, clusterRoleBinding, metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, "Something went wrong while deleting ClusterRoleBinding "+clusterRoleBinding)
+			continue
+		}
+
+		report.Deleted = append(report.Deleted, "clusterrolebindings/"+clusterRoleBinding)
+	}
+
+	if sharedOnly {
+		err := clientset.CoreV1().ServiceAccounts(namespace).Delete(ctx, username, metav1.DeleteOptions{})
+		if err == nil {
+			report.Deleted = append(report.Deleted, "serviceaccounts/"+namespace+"/"+username)
+		} else if !errors.IsNotFound(err) {
+			report.Errors = append(report.Errors, "Something went wrong while deleting ServiceAccount "+username+" in namespace "+namespace)
+		}
+
+		return report
+	}
+
+	// The ServiceAccount of the student is deleted together with their namespace
+	if err := clientset.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		report.Errors = append(report.Errors, "Something went wrong while deleting namespace "+namespace)
+	} else {
+		report.Deleted = append(report.Deleted, "namespaces/"+namespace)
+		s.logTimeline(ctx, labName, TimelineEvent{Namespace: namespace, Type: timelineDeleted})
+	}
+
+	return report
+}
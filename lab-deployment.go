@@ -0,0 +1,449 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// Renders the manifest of a lab from the configuration uploaded with a request
+type DeploymentBackend interface {
+	getManifest(s *Server, r *http.Request, parameters *ManifestParameters) (string, *Error)
+}
+
+// A backend that renders the manifest again for every student namespace, with the values of the students of the namespace
+type NamespaceRenderer interface {
+	getNamespaceManifest(s *Server, r *http.Request, parameters *ManifestParameters, extraValues map[string]interface{}) (string, *Error)
+}
+
+// Every deploymentMode and the backend that renders its manifest, new deployment modes only have to be added here
+var deploymentBackends = map[string]DeploymentBackend{
+	"YAML":      rawYamlBackend{},
+	"CHART":     helmReleaseBackend{fromUrl: false},
+	"CHART_URL": helmReleaseBackend{fromUrl: true},
+	"KUSTOMIZE": kustomizeBackend{},
+	"PRESET":    presetBackend{},
+}
+
+// Names of presets, which are also their file names in the preset directory
+var presetNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+/*
+Returns the supported deployment modes, sorted.
+*/
+func getDeploymentModes() []string {
+	var modes []string
+	for mode := range deploymentBackends {
+		modes = append(modes, mode)
+	}
+
+	sort.Strings(modes)
+	return modes
+}
+
+/*
+Returns the manifest of the lab, obtained by the backend of the deploymentMode of the parameters. Manifests that exceed the limits
+of a namespace are rejected.
+*/
+func (s *Server) getManifest(r *http.Request, parameters *ManifestParameters) (string, *Error) {
+	deploymentMode := parameters.DeploymentMode
+	backend, ok := deploymentBackends[deploymentMode]
+	if !ok {
+		return "", &Error{status: http.StatusBadRequest, message: "deploymentMode must be one of " + strings.Join(getDeploymentModes(), ", ")}
+	}
+
+	manifest, e := backend.getManifest(s, r, parameters)
+	if e != nil {
+		return "", e
+	}
+
+	if e := checkManifestLimits(manifest); e != nil {
+		return "", e
+	}
+
+	return manifest, nil
+}
+
+// A manifest uploaded as a YAML file
+type rawYamlBackend struct{}
+
+func (rawYamlBackend) getManifest(s *Server, r *http.Request, parameters *ManifestParameters) (string, *Error) {
+	configFile, e := s.getFormFile(r, "config", "text/yaml")
+	if e != nil {
+		return "", e
+	}
+
+	manifest, err := io.ReadAll(configFile)
+	if err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the manifest"}
+	}
+
+	return string(manifest), nil
+}
+
+// A Helm chart, uploaded as an archive or located by its URL, rendered with the uploaded values
+type helmReleaseBackend struct {
+	fromUrl bool
+}
+
+func (backend helmReleaseBackend) getManifest(s *Server, r *http.Request, parameters *ManifestParameters) (string, *Error) {
+	return backend.getNamespaceManifest(s, r, parameters, nil)
+}
+
+/*
+Renders the uploaded chart, or the chart located by its URL, for a namespace.
+*/
+func (backend helmReleaseBackend) getNamespaceManifest(s *Server, r *http.Request, parameters *ManifestParameters, extraValues map[string]interface{}) (string, *Error) {
+	// The chart is identified by its archive, or by its URL so it doesn't have to be downloaded again
+	chartSource := []byte(parameters.Config)
+	if backend.fromUrl && parameters.Chart != "" {
+		// The version is resolved from the (cached) index of the repository first, so a new latest version isn't hidden by the cache
+		chartUrl, err := s.getRepositoryChartUrl(r.Context(), parameters.Config, parameters.Chart, parameters.ChartVersion)
+		if err != nil {
+			return "", &Error{status: http.StatusBadRequest, message: "Chart " + parameters.Chart + " could not be found: " + err.Error()}
+		}
+		chartSource = []byte(chartUrl)
+	}
+	if !backend.fromUrl {
+		helmFile, e := s.getFormFile(r, "config", "application/gzip", "application/octet-stream")
+		if e != nil {
+			return "", e
+		}
+
+		archive, err := io.ReadAll(helmFile)
+		if err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the chart"}
+		}
+		chartSource = archive
+	}
+
+	return s.renderChart(r, parameters, chartSource, func() (*chart.Chart, *Error) {
+		return backend.loadChart(r.Context(), chartSource)
+	}, extraValues)
+}
+
+/*
+Renders a chart with the uploaded values and the values profile of the chart, the extra values override the uploaded values
+and the uploaded values override the profile. The chart is only loaded when chartSource isn't rendered with the same values yet.
+*/
+func (s *Server) renderChart(r *http.Request, parameters *ManifestParameters, chartSource []byte, loadChart func() (*chart.Chart, *Error), extraValues map[string]interface{}) (string, *Error) {
+	values, e := s.getChartValues(r, parameters)
+	if e != nil {
+		return "", e
+	}
+
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	for key, value := range extraValues {
+		values[key] = value
+	}
+
+	// The manifest of the lab is rendered without a student, templates can still use .Values.student.<column>
+	if _, ok := values["student"]; !ok {
+		values["student"] = map[string]interface{}{}
+	}
+
+	// The same chart with the same values always renders to the same manifest
+	profile := parameters.ValuesProfile
+	digest, err := getChartDigest(chartSource, profile, values)
+	if err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while hashing the chart"}
+	}
+	if manifest, ok := s.getCachedManifest(r.Context(), digest); ok {
+		return manifest, nil
+	}
+
+	helmChart, e := loadChart()
+	if e != nil {
+		return "", e
+	}
+
+	values, e = applyChartProfile(helmChart, profile, values)
+	if e != nil {
+		return "", e
+	}
+
+	// Invalid values are reported before rendering, template errors are much harder to understand
+	if e := validateChartValues(helmChart, values); e != nil {
+		return "", e
+	}
+
+	kubeYaml, err := convertChartToYaml(helmChart, values)
+	if err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while converting chart to YAML"}
+	}
+
+	if err := s.cacheManifest(r.Context(), digest, *kubeYaml); err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "SCALAMA_CHART_CACHE_TTL must be a duration"}
+	}
+
+	return *kubeYaml, nil
+}
+
+/*
+Loads a chart from its archive, or downloads it from its URL.
+Once chart verification is configured, charts located by their URL are only loaded when their signature is valid.
+*/
+func (backend helmReleaseBackend) loadChart(ctx context.Context, chartSource []byte) (*chart.Chart, *Error) {
+	if !backend.fromUrl {
+		helmChart, err := loader.LoadArchive(bytes.NewReader(chartSource))
+		if err != nil {
+			return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while parsing the chart"}
+		}
+
+		return helmChart, nil
+	}
+
+	chartUrl := string(chartSource)
+
+	// Charts downloaded over HTTP(S) are cached, so they aren't downloaded again for every lab and still load during outages
+	if strings.HasPrefix(chartUrl, "http://") || strings.HasPrefix(chartUrl, "https://") {
+		return loadCachedChart(ctx, chartUrl)
+	}
+
+	actionConfig, err := getHelmActionConfig("default")
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while initiating the action configuration"}
+	}
+
+	settings := cli.New()
+
+	// Charts in OCI registries are pulled with the credentials of helm registry login
+	if registry.IsOCI(chartUrl) {
+		registryClient, err := registry.NewClient(registry.ClientOptCredentialsFile(settings.RegistryConfig))
+		if err != nil {
+			return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while initiating the registry client"}
+		}
+		actionConfig.RegistryClient = registryClient
+	}
+
+	iCli := action.NewInstall(actionConfig)
+
+	verify := isChartVerificationEnabled()
+	if verify {
+		var e *Error
+		if registry.IsOCI(chartUrl) {
+			e = verifyOciChart(ctx, chartUrl)
+		} else {
+			e = setChartVerification(iCli, chartUrl)
+		}
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	chartPath, err := iCli.LocateChart(chartUrl, settings)
+	if err != nil {
+		if verify {
+			return nil, &Error{status: http.StatusBadRequest, message: "Chart " + chartUrl + " could not be located or verified: " + err.Error()}
+		}
+
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while locating the chart"}
+	}
+
+	helmChart, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while loading the chart"}
+	}
+
+	return helmChart, nil
+}
+
+/*
+Loads a chart downloaded over HTTP(S) from the chart repository cache. Once chart verification is configured,
+the chart is only loaded when its provenance file is valid.
+*/
+func loadCachedChart(ctx context.Context, chartUrl string) (*chart.Chart, *Error) {
+	keyring := ""
+	if isChartVerificationEnabled() {
+		var e *Error
+		if keyring, e = getChartKeyring(chartUrl); e != nil {
+			return nil, e
+		}
+	}
+
+	chartPath, err := getCachedChart(ctx, chartUrl, keyring)
+	if err != nil {
+		if keyring != "" {
+			return nil, &Error{status: http.StatusBadRequest, message: "Chart " + chartUrl + " could not be downloaded or verified: " + err.Error()}
+		}
+
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while downloading the chart"}
+	}
+
+	helmChart, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while loading the chart"}
+	}
+
+	return helmChart, nil
+}
+
+// A kustomization uploaded as a gzipped tarball, rendered like kubectl kustomize
+type kustomizeBackend struct{}
+
+func (kustomizeBackend) getManifest(s *Server, r *http.Request, parameters *ManifestParameters) (string, *Error) {
+	archiveFile, e := s.getFormFile(r, "config", "application/gzip", "application/octet-stream")
+	if e != nil {
+		return "", e
+	}
+
+	fs, err := extractArchive(archiveFile)
+	if err != nil {
+		return "", &Error{status: http.StatusBadRequest, message: "config must be a gzipped tarball of a kustomization"}
+	}
+
+	root, ok := getKustomizationRoot(fs)
+	if !ok {
+		return "", &Error{status: http.StatusBadRequest, message: "config does not contain a kustomization.yaml"}
+	}
+
+	resources, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fs, root)
+	if err != nil {
+		return "", &Error{status: http.StatusBadRequest, message: "Something went wrong while building the kustomization: " + err.Error()}
+	}
+
+	manifest, err := resources.AsYaml()
+	if err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while converting the kustomization to YAML"}
+	}
+
+	return string(manifest), nil
+}
+
+/*
+Extracts a gzipped tarball into an in-memory file system, so nothing of the upload ends up on disk.
+*/
+func extractArchive(archive io.Reader) (filesys.FileSystem, error) {
+	gzipReader, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	fs := filesys.MakeFsInMemory()
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return fs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+
+		// Paths are kept inside of the root, even if the archive contains ../
+		path := filepath.Join("/", header.Name)
+		if err := fs.MkdirAll(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		if err := fs.WriteFile(path, data); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+Returns the directory of the top-most kustomization in a file system, the archive may wrap it in a directory.
+*/
+func getKustomizationRoot(fs filesys.FileSystem) (string, bool) {
+	kustomizationFiles := make(map[string]bool)
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		kustomizationFiles[name] = true
+	}
+
+	root := ""
+	fs.Walk("/", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !kustomizationFiles[filepath.Base(path)] {
+			return err
+		}
+
+		dir := filepath.Dir(path)
+		if root == "" || strings.Count(dir, "/") < strings.Count(root, "/") {
+			root = dir
+		}
+		return nil
+	})
+
+	return root, root != ""
+}
+
+// A manifest or chart the administrator installed on the server, selected by its name in config.
+// Presets are <name>.yaml manifests, or charts in a <name> directory that are rendered for every namespace like uploaded charts
+type presetBackend struct{}
+
+/*
+Returns the directory of the preset manifests, configured by SCALAMA_PRESET_DIR.
+*/
+func getPresetDir() string {
+	if dir := os.Getenv("SCALAMA_PRESET_DIR"); dir != "" {
+		return dir
+	}
+
+	return "presets"
+}
+
+func (backend presetBackend) getManifest(s *Server, r *http.Request, parameters *ManifestParameters) (string, *Error) {
+	return backend.getNamespaceManifest(s, r, parameters, nil)
+}
+
+func (presetBackend) getNamespaceManifest(s *Server, r *http.Request, parameters *ManifestParameters, extraValues map[string]interface{}) (string, *Error) {
+	name := parameters.Config
+	if !presetNameRegex.MatchString(name) {
+		return "", &Error{status: http.StatusBadRequest, message: "config must be the name of a preset"}
+	}
+
+	manifest, err := os.ReadFile(filepath.Join(getPresetDir(), name+".yaml"))
+	if err == nil {
+		return string(manifest), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading preset " + name}
+	}
+
+	chartDir := filepath.Join(getPresetDir(), name)
+	if _, err := os.Stat(filepath.Join(chartDir, "Chart.yaml")); err != nil {
+		if os.IsNotExist(err) {
+			return "", &Error{status: http.StatusNotFound, message: "Preset " + name + " does not exist"}
+		}
+
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading preset " + name}
+	}
+
+	// Chart presets only change when the server is updated, so they are identified by their name
+	return s.renderChart(r, parameters, []byte("preset:"+name), func() (*chart.Chart, *Error) {
+		helmChart, err := loader.LoadDir(chartDir)
+		if err != nil {
+			return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while loading preset " + name}
+		}
+
+		return helmChart, nil
+	}, extraValues)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The state of a lab, so a frontend can show it without the teachers needing access to the cluster
+type LabDetail struct {
+	Name          string            `json:"name"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	Namespaces    []NamespaceDetail `json:"namespaces"`
+	SharedObjects []SharedObject    `json:"sharedObjects"`
+}
+
+// A namespace of a lab with the ServiceAccounts and workloads in it, the lab namespace comes first
+type NamespaceDetail struct {
+	Name            string     `json:"name"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	ServiceAccounts []string   `json:"serviceAccounts"`
+	Workloads       []Workload `json:"workloads"`
+}
+
+// A Deployment, StatefulSet, DaemonSet, Job or CronJob with its ready pods (e.g. "1/2"), empty for CronJobs
+type Workload struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Ready string `json:"ready,omitempty"`
+}
+
+// An object of the manifest that is only created once for the lab, and whether it still exists
+type SharedObject struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Exists    bool   `json:"exists"`
+}
+
+/*
+Returns the ServiceAccounts of a namespace, without the default ServiceAccount Kubernetes creates in every namespace.
+*/
+func getServiceAccountNames(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]string, error) {
+	serviceAccounts, err := clientset.CoreV1().ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, serviceAccount := range serviceAccounts.Items {
+		if serviceAccount.Name != "default" {
+			names = append(names, serviceAccount.Name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+/*
+Returns the workloads of a namespace with their ready pods, sorted by kind and name.
+*/
+func getWorkloads(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]Workload, error) {
+	workloads := []Workload{}
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, deployment := range deployments.Items {
+		workloads = append(workloads, Workload{Kind: "Deployment", Name: deployment.Name, Ready: fmt.Sprintf("%d/%d", deployment.Status.ReadyReplicas, deployment.Status.Replicas)})
+	}
+
+	statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, statefulSet := range statefulSets.Items {
+		workloads = append(workloads, Workload{Kind: "StatefulSet", Name: statefulSet.Name, Ready: fmt.Sprintf("%d/%d", statefulSet.Status.ReadyReplicas, statefulSet.Status.Replicas)})
+	}
+
+	daemonSets, err := clientset.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, daemonSet := range daemonSets.Items {
+		workloads = append(workloads, Workload{Kind: "DaemonSet", Name: daemonSet.Name, Ready: fmt.Sprintf("%d/%d", daemonSet.Status.NumberReady, daemonSet.Status.DesiredNumberScheduled)})
+	}
+
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs.Items {
+		completions := int32(1)
+		if job.Spec.Completions != nil {
+			completions = *job.Spec.Completions
+		}
+		workloads = append(workloads, Workload{Kind: "Job", Name: job.Name, Ready: fmt.Sprintf("%d/%d", job.Status.Succeeded, completions)})
+	}
+
+	cronJobs, err := clientset.BatchV1().CronJobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, cronJob := range cronJobs.Items {
+		workloads = append(workloads, Workload{Kind: "CronJob", Name: cronJob.Name})
+	}
+
+	sort.SliceStable(workloads, func(i, j int) bool {
+		if workloads[i].Kind != workloads[j].Kind {
+			return workloads[i].Kind < workloads[j].Kind
+		}
+		return workloads[i].Name < workloads[j].Name
+	})
+
+	return workloads, nil
+}
+
+/*
+Checks for every object of the manifest that is only created once (single instance, cluster-scoped or shared external) whether it exists.
+*/
+func getSharedObjects(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string, manifest string) ([]SharedObject, error) {
+	sharedObjects := []SharedObject{}
+
+	decoder := yamlutil.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 100)
+	for {
+		unstructuredObj, _, mapping, err := handleManifestHelper(clientset, decoder)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Hooks are cleaned up once they completed, so they are expected to be gone
+		if isHook(unstructuredObj) || !isCreatedOnce(unstructuredObj, mapping) {
+			continue
+		}
+
+		namespace := getSharedNamespace(unstructuredObj, mapping, labName)
+		sharedObject := SharedObject{Kind: unstructuredObj.GetKind(), Name: unstructuredObj.GetName(), Namespace: namespace, Exists: true}
+
+		_, err = dynamicInterface.Resource(mapping.Resource).Namespace(namespace).Get(ctx, unstructuredObj.GetName(), metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			sharedObject.Exists = false
+		} else if err != nil {
+			return nil, err
+		}
+
+		sharedObjects = append(sharedObjects, sharedObject)
+	}
+
+	return sharedObjects, nil
+}
+
+/*
+Returns the namespaces of a lab with their ServiceAccounts and workloads, and whether the shared objects of its stored manifest exist.
+*/
+func (s *Server) getLabDetail(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string, manifest string) (*LabDetail, error) {
+	namespaces, err := s.listNamespaces(ctx, clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &LabDetail{Namespaces: []NamespaceDetail{}}
+	for _, namespace := range namespaces {
+		if namespace.Name != "ns-"+labName && !strings.HasPrefix(namespace.Name, "ns-"+labName+"-") {
+			continue
+		}
+
+		serviceAccounts, err := getServiceAccountNames(ctx, clientset, namespace.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		workloads, err := getWorkloads(ctx, clientset, namespace.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if namespace.Name == "ns-"+labName {
+			detail.CreatedAt = namespace.CreationTimestamp.Time
+		}
+
+		detail.Namespaces = append(detail.Namespaces, NamespaceDetail{Name: namespace.Name, CreatedAt: namespace.CreationTimestamp.Time, ServiceAccounts: serviceAccounts, Workloads: workloads})
+	}
+
+	// The lab namespace comes first, followed by the student (or group) namespaces
+	sort.SliceStable(detail.Namespaces, func(i, j int) bool {
+		if detail.Namespaces[i].Name == "ns-"+labName || detail.Namespaces[j].Name == "ns-"+labName {
+			return detail.Namespaces[i].Name == "ns-"+labName
+		}
+		return detail.Namespaces[i].Name < detail.Namespaces[j].Name
+	})
+
+	if manifest != "" {
+		if detail.SharedObjects, err = getSharedObjects(ctx, clientset, dynamicInterface, labName, manifest); err != nil {
+			return nil, err
+		}
+	} else {
+		detail.SharedObjects = []SharedObject{}
+	}
+
+	return detail, nil
+}
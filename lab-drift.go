@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	driftStatusInSync   = "InSync"
+	driftStatusModified = "Modified"
+	driftStatusMissing  = "Missing"
+)
+
+// Drift of a single object of the manifest compared to the live object in a namespace
+type ObjectDrift struct {
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	Status string   `json:"status"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Drift of a whole lab, for the shared lab namespace and for every student (or group) namespace
+type LabDrift struct {
+	Shared   []ObjectDrift            `json:"shared"`
+	Students map[string][]ObjectDrift `json:"students"`
+}
+
+/*
+Returns the paths of the fields in desired that have a different value in live.
+Fields that only exist in live (defaults, status, ...) are ignored.
+*/
+func diffFields(desired interface{}, live interface{}, path string) []string {
+	var fields []string
+
+	switch desiredValue := desired.(type) {
+	case map[string]interface{}:
+		liveValue, ok := live.(map[string]interface{})
+		if !ok {
+			return []string{path}
+		}
+
+		// Sort the keys so the diff is the same for every request
+		keys := make([]string, 0, len(desiredValue))
+		for key := range desiredValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fields = append(fields, diffFields(desiredValue[key], liveValue[key], path+"."+key)...)
+		}
+	case []interface{}:
+		liveValue, ok := live.([]interface{})
+		if !ok || len(liveValue) != len(desiredValue) {
+			return []string{path}
+		}
+
+		for i := range desiredValue {
+			fields = append(fields, diffFields(desiredValue[i], liveValue[i], fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	default:
+		if !reflect.DeepEqual(desired, live) {
+			return []string{path}
+		}
+	}
+
+	return fields
+}
+
+/*
+Compares an object of the manifest with the live object with the same name in namespace. The object is compared as it was deployed,
+with the labels, the changes of the lab options and the limits of the cluster policy, so those never show up as drift.
+Only the labels and annotations of the metadata are compared, the status is never compared.
+*/
+func (s *Server) getObjectDrift(ctx context.Context, dynamicInterface dynamic.Interface, mapping *meta.RESTMapping, manifestObj *unstructured.Unstructured, labName string, namespace string, options *LabOptions) (*ObjectDrift, error) {
+	desired := s.getDeployedObject(manifestObj, labName, namespace, options)
+	drift := &ObjectDrift{Kind: desired.GetKind(), Name: desired.GetName(), Status: driftStatusInSync}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	live, err := dynamicInterface.Resource(mapping.Resource).Namespace(namespace).Get(ctx, desired.GetName(), metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			drift.Status = driftStatusMissing
+			return drift, nil
+		}
+
+		return nil, err
+	}
+
+	for key, value := range desired.Object {
+		switch key {
+		case "status":
+			continue
+		case "metadata":
+			for _, field := range []string{"labels", "annotations"} {
+				desiredValue, found, _ := unstructured.NestedFieldNoCopy(desired.Object, "metadata", field)
+				if !found {
+					continue
+				}
+
+				liveValue, _, _ := unstructured.NestedFieldNoCopy(live.Object, "metadata", field)
+				drift.Fields = append(drift.Fields, diffFields(desiredValue, liveValue, ".metadata."+field)...)
+			}
+		default:
+			drift.Fields = append(drift.Fields, diffFields(value, live.Object[key], "."+key)...)
+		}
+	}
+
+	if len(drift.Fields) > 0 {
+		sort.Strings(drift.Fields)
+		drift.Status = driftStatusModified
+	}
+
+	return drift, nil
+}
+
+/*
+Compares the stored manifest of a lab with the live objects in the lab namespace and every student namespace.
+*/
+func (s *Server) getLabDrift(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string, manifest string, inputs *LabRenderInputs, options *LabOptions) (*LabDrift, error) {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Student namespaces of charts are compared with their own render, the others with the manifest of the lab
+	namespaceManifests, err := s.renderStoredNamespaceManifests(ctx, inputs, namespaces, options)
+	if err != nil {
+		return nil, err
+	}
+
+	labDrift := &LabDrift{Shared: []ObjectDrift{}, Students: map[string][]ObjectDrift{}}
+	var labNamespaces []string
+	for _, namespace := range namespaces {
+		labDrift.Students[strings.TrimPrefix(namespace, "ns-"+labName+"-")] = []ObjectDrift{}
+
+		if _, ok := namespaceManifests[namespace]; !ok {
+			labNamespaces = append(labNamespaces, namespace)
+		}
+	}
+
+	if err := s.addManifestDrift(ctx, clientset, dynamicInterface, labDrift, labName, manifest, labNamespaces, true, options); err != nil {
+		return nil, err
+	}
+
+	// The shared objects of a namespace render were created with the manifest of the lab
+	for _, namespace := range namespaces {
+		namespaceManifest, ok := namespaceManifests[namespace]
+		if !ok {
+			continue
+		}
+
+		if err := s.addManifestDrift(ctx, clientset, dynamicInterface, labDrift, labName, namespaceManifest, []string{namespace}, false, options); err != nil {
+			return nil, err
+		}
+	}
+
+	return labDrift, nil
+}
+
+/*
+Adds the drift of the objects of a manifest in namespaces to labDrift, and the drift of its shared objects when withShared is set.
+*/
+func (s *Server) addManifestDrift(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labDrift *LabDrift, labName string, manifest string, namespaces []string, withShared bool, options *LabOptions) error {
+	decoder := yamlutil.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 100)
+	for {
+		unstructuredObj, _, mapping, err := handleManifestHelper(clientset, decoder)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Hooks only run once, they are not restored so they can't drift
+		if isHook(unstructuredObj) {
+			continue
+		}
+
+		if isCreatedOnce(unstructuredObj, mapping) {
+			if !withShared {
+				continue
+			}
+
+			drift, err := s.getObjectDrift(ctx, dynamicInterface, mapping, unstructuredObj, labName, getSharedNamespace(unstructuredObj, mapping, labName), options)
+			if err != nil {
+				return err
+			}
+
+			labDrift.Shared = append(labDrift.Shared, *drift)
+			continue
+		}
+
+		for _, namespace := range namespaces {
+			drift, err := s.getObjectDrift(ctx, dynamicInterface, mapping, unstructuredObj, labName, namespace, options)
+			if err != nil {
+				return err
+			}
+
+			username := strings.TrimPrefix(namespace, "ns-"+labName+"-")
+			labDrift.Students[username] = append(labDrift.Students[username], *drift)
+		}
+	}
+}
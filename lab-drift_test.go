@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var quotaMapping = &meta.RESTMapping{
+	Resource:         schema.GroupVersionResource{Version: "v1", Resource: "resourcequotas"},
+	GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "ResourceQuota"},
+	Scope:            meta.RESTScopeNamespace,
+}
+
+func newManifestQuota(cpu string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ResourceQuota",
+		"metadata":   map[string]interface{}{"name": "compute", "single_instance": false},
+		"spec":       map[string]interface{}{"hard": map[string]interface{}{"requests.cpu": cpu}},
+	}}
+}
+
+func TestObjectDriftOfPolicyClampedQuota(t *testing.T) {
+	s := newServer(getFakeClientSet())
+	s.clusterPolicy = &ClusterPolicy{QuotaCeiling: map[string]string{"requests.cpu": "4"}}
+
+	ctx := context.Background()
+	dynamicInterface := s.dynamicInterface
+	options := &LabOptions{}
+
+	// The quota of the manifest asks for more than the ceiling, it is created with the ceiling
+	manifestQuota := newManifestQuota("8")
+	if _, err := s.createManifestObject(ctx, dynamicInterface, quotaMapping, manifestQuota, "lab", "ns-lab-alice", options); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := s.getObjectDrift(ctx, dynamicInterface, quotaMapping, manifestQuota, "lab", "ns-lab-alice", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.Status != driftStatusInSync {
+		t.Errorf("expected the clamped quota to be %s, got %s with fields %v", driftStatusInSync, drift.Status, drift.Fields)
+	}
+
+	// A student that raises the quota within the ceiling still drifts from the manifest
+	live, err := dynamicInterface.Resource(quotaMapping.Resource).Namespace("ns-lab-alice").Get(ctx, "compute", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unstructured.SetNestedField(live.Object, "2", "spec", "hard", "requests.cpu")
+	if _, err := dynamicInterface.Resource(quotaMapping.Resource).Namespace("ns-lab-alice").Update(ctx, live, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err = s.getObjectDrift(ctx, dynamicInterface, quotaMapping, manifestQuota, "lab", "ns-lab-alice", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.Status != driftStatusModified || len(drift.Fields) != 1 || drift.Fields[0] != ".spec.hard.requests.cpu" {
+		t.Errorf("expected .spec.hard.requests.cpu to be %s, got %s with fields %v", driftStatusModified, drift.Status, drift.Fields)
+	}
+}
+
+func TestObjectDriftOfMissingObject(t *testing.T) {
+	s := newServer(getFakeClientSet())
+
+	drift, err := s.getObjectDrift(context.Background(), s.dynamicInterface, quotaMapping, newManifestQuota("1"), "lab", "ns-lab-bob", &LabOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.Status != driftStatusMissing {
+		t.Errorf("expected %s, got %s", driftStatusMissing, drift.Status)
+	}
+}
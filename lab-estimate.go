@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The resources of objects of a manifest, the pods are counted at the replicas (or parallelism) of their workloads
+type ResourceEstimate struct {
+	Objects  int               `json:"objects"`
+	Pods     int               `json:"pods"`
+	Requests map[string]string `json:"requests"`
+	Storage  string            `json:"storage"`
+}
+
+// The expected size of a lab, so cluster admins can plan node capacity before a course is approved.
+// Namespaces includes the lab namespace, the shared objects are created once in it.
+type LabEstimate struct {
+	Students     int              `json:"students"`
+	Namespaces   int              `json:"namespaces"`
+	PerNamespace ResourceEstimate `json:"perNamespace"`
+	Shared       ResourceEstimate `json:"shared"`
+	Total        ResourceEstimate `json:"total"`
+	Warnings     []string         `json:"warnings"`
+}
+
+// The resources of objects while they are added up
+type resourceTotals struct {
+	objects  int
+	pods     int
+	requests map[string]resource.Quantity
+	storage  resource.Quantity
+}
+
+func newResourceTotals() *resourceTotals {
+	return &resourceTotals{requests: map[string]resource.Quantity{}}
+}
+
+/*
+Multiplies a quantity, e.g. the requests of a pod by the replicas of its Deployment.
+*/
+func scaleQuantity(quantity resource.Quantity, factor int) resource.Quantity {
+	return *resource.NewMilliQuantity(quantity.MilliValue()*int64(factor), quantity.Format)
+}
+
+/*
+Adds requests factor times, e.g. the requests of a pod times the replicas of its Deployment.
+*/
+func (totals *resourceTotals) addRequests(requests map[string]resource.Quantity, factor int) {
+	for name, quantity := range requests {
+		total := totals.requests[name]
+		total.Add(scaleQuantity(quantity, factor))
+		totals.requests[name] = total
+	}
+}
+
+/*
+Adds the totals of other factor times, e.g. the totals of a student namespace times the amount of student namespaces.
+*/
+func (totals *resourceTotals) add(other *resourceTotals, factor int) {
+	totals.objects += other.objects * factor
+	totals.pods += other.pods * factor
+	totals.addRequests(other.requests, factor)
+	totals.storage.Add(scaleQuantity(other.storage, factor))
+}
+
+func (totals *resourceTotals) getEstimate() ResourceEstimate {
+	estimate := ResourceEstimate{Objects: totals.objects, Pods: totals.pods, Requests: map[string]string{}, Storage: totals.storage.String()}
+	for name, quantity := range totals.requests {
+		estimate.Requests[name] = quantity.String()
+	}
+
+	return estimate
+}
+
+/*
+Returns a number field of an object, or defaultValue if it is not set (e.g. the replicas of a Deployment).
+*/
+func getNumberField(obj map[string]interface{}, defaultValue int, fields ...string) int {
+	value, found, err := unstructured.NestedFieldNoCopy(obj, fields...)
+	if err != nil || !found {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(fmt.Sprint(value))
+	if err != nil {
+		return defaultValue
+	}
+
+	return number
+}
+
+/*
+Returns a quantity field of an object, e.g. the storage a PersistentVolumeClaim requests. Invalid quantities are zero.
+*/
+func getQuantityField(obj map[string]interface{}, fields ...string) resource.Quantity {
+	value, found, err := unstructured.NestedFieldNoCopy(obj, fields...)
+	if err != nil || !found {
+		return resource.Quantity{}
+	}
+
+	quantity, err := resource.ParseQuantity(fmt.Sprint(value))
+	if err != nil {
+		return resource.Quantity{}
+	}
+
+	return quantity
+}
+
+/*
+Returns the requests of a container, resources that are only limited are requested at their limit (like Kubernetes defaults them).
+*/
+func getContainerRequests(container interface{}) map[string]resource.Quantity {
+	requests := map[string]resource.Quantity{}
+
+	containerMap, ok := container.(map[string]interface{})
+	if !ok {
+		return requests
+	}
+
+	for _, field := range []string{"limits", "requests"} {
+		resources, _, _ := unstructured.NestedMap(containerMap, "resources", field)
+		for name := range resources {
+			requests[name] = getQuantityField(resources, name)
+		}
+	}
+
+	return requests
+}
+
+/*
+Returns the requests of a pod spec the way the scheduler counts them: the sum of the requests of its containers,
+or the largest request of an init container when that is larger.
+*/
+func getPodRequests(podSpec map[string]interface{}) map[string]resource.Quantity {
+	requests := map[string]resource.Quantity{}
+
+	containers, _ := podSpec["containers"].([]interface{})
+	for _, container := range containers {
+		for name, quantity := range getContainerRequests(container) {
+			total := requests[name]
+			total.Add(quantity)
+			requests[name] = total
+		}
+	}
+
+	initContainers, _ := podSpec["initContainers"].([]interface{})
+	for _, container := range initContainers {
+		for name, quantity := range getContainerRequests(container) {
+			if quantity.Cmp(requests[name]) > 0 {
+				requests[name] = quantity
+			}
+		}
+	}
+
+	return requests
+}
+
+/*
+Adds the pods, requests and storage of an object of the manifest. DaemonSets are counted as a single pod, they run a pod on every node.
+*/
+func (totals *resourceTotals) addObject(obj *unstructured.Unstructured) {
+	totals.objects++
+
+	switch obj.GetKind() {
+	case "PersistentVolumeClaim":
+		totals.storage.Add(getQuantityField(obj.Object, "spec", "resources", "requests", "storage"))
+	case "StatefulSet":
+		templates, _, _ := unstructured.NestedSlice(obj.Object, "spec", "volumeClaimTemplates")
+		for _, template := range templates {
+			if templateMap, ok := template.(map[string]interface{}); ok {
+				storage := getQuantityField(templateMap, "spec", "resources", "requests", "storage")
+				totals.storage.Add(scaleQuantity(storage, getNumberField(obj.Object, 1, "spec", "replicas")))
+			}
+		}
+	}
+
+	podSpec, ok := getPodSpec(obj)
+	if !ok {
+		return
+	}
+
+	pods := 1
+	switch obj.GetKind() {
+	case "Deployment", "StatefulSet", "ReplicaSet":
+		pods = getNumberField(obj.Object, 1, "spec", "replicas")
+	case "Job":
+		pods = getNumberField(obj.Object, 1, "spec", "parallelism")
+	case "CronJob":
+		pods = getNumberField(obj.Object, 1, "spec", "jobTemplate", "spec", "parallelism")
+	}
+
+	totals.pods += pods
+	totals.addRequests(getPodRequests(podSpec), pods)
+}
+
+/*
+Returns the amount of student and group namespaces of a lab, shared-only labs have none.
+*/
+func getStudentNamespaceCount(students int, groups int, isIndividual bool, isHybrid bool, options *LabOptions) int {
+	switch {
+	case options.SharedOnly:
+		return 0
+	case isHybrid:
+		return students + groups
+	case isIndividual:
+		return students
+	default:
+		return groups
+	}
+}
+
+/*
+Estimates the resources of a manifest deployed in the lab namespace and in an amount of student namespaces.
+Returns the estimate and the total resources of the lab.
+*/
+func getLabEstimate(clientset kubernetes.Interface, manifest string, students int, namespaces int, options *LabOptions) (*LabEstimate, *resourceTotals, error) {
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The lab namespace is created for every lab
+	estimate := &LabEstimate{Students: students, Namespaces: namespaces + 1, Warnings: []string{}}
+
+	perNamespace, shared := newResourceTotals(), newResourceTotals()
+	for _, obj := range objects {
+		gvk := obj.GroupVersionKind()
+
+		createdOnce := isSingleInstance(obj.Object)
+		if mapping, err := getObjectMapping(clientset, &gvk); err == nil {
+			createdOnce = isCreatedOnce(obj, mapping)
+		} else {
+			estimate.Warnings = append(estimate.Warnings, gvk.Kind+" "+obj.GetName()+" is not known by the cluster, its scope is guessed from single_instance")
+		}
+
+		if obj.GetKind() == "DaemonSet" {
+			estimate.Warnings = append(estimate.Warnings, "DaemonSet "+obj.GetName()+" runs a pod on every node, it is counted as a single pod")
+		}
+
+		if createdOnce {
+			shared.addObject(obj)
+		} else {
+			perNamespace.addObject(obj)
+		}
+	}
+
+	if options.MaxPods > 0 && perNamespace.pods > options.MaxPods {
+		estimate.Warnings = append(estimate.Warnings, "A namespace has "+strconv.Itoa(perNamespace.pods)+" pods, but maxPods only lets "+strconv.Itoa(options.MaxPods)+" of them run at the same time")
+	}
+
+	total := newResourceTotals()
+	total.add(shared, 1)
+	total.add(perNamespace, namespaces)
+
+	estimate.PerNamespace = perNamespace.getEstimate()
+	estimate.Shared = shared.getEstimate()
+	estimate.Total = total.getEstimate()
+
+	return estimate, total, nil
+}
+
+/*
+Estimates the size of a lab from its manifest and the amount of students (and groups) without creating anything:
+the namespaces, pods, resource requests and storage per student namespace, of the shared objects and in total.
+HTTP Parameters:
+ studentCount: <int> (required unless a roster is sent, the expected amount of students)
+ groupCount: <int> (required for group and hybrid labs without a roster, the expected amount of groups)
+ students, rosterSource, roster, groupCategory: (optional, a roster instead of studentCount, see createLabEnvironment)
+ labName, isIndividual, isHybrid, deploymentMode, config, values, valuesProfile, spec, options: (see createLabEnvironment)
+*/
+func (s *Server) estimateLab(w http.ResponseWriter, r *http.Request) {
+	var parameters EstimateParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	labName := getLabName(r, parameters.LabName)
+	isIndividual := parameters.IsIndividual
+	isHybrid := parameters.IsHybrid
+
+	options, e := s.getLabOptions(r)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	var students, groups int
+	if parameters.StudentCount != nil {
+		students = *parameters.StudentCount
+
+		if parameters.GroupCount == nil {
+			if !isIndividual || isHybrid {
+				http.Error(w, "groupCount is required for group and hybrid labs without a roster", http.StatusBadRequest)
+				return
+			}
+		} else {
+			groups = *parameters.GroupCount
+		}
+	} else {
+		roster, e := s.getRosterStudents(r)
+		if e != nil {
+			http.Error(w, e.message, e.status)
+			return
+		}
+
+		students = len(getNamespaceNames(roster, labName, true))
+		groups = len(getNamespaceNames(roster, labName, false))
+	}
+
+	manifest, e := s.getManifest(r, &parameters.ManifestParameters)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	estimate, _, err := getLabEstimate(s.clientset, manifest, students, getStudentNamespaceCount(students, groups, isIndividual, isHybrid, options), options)
+	if err != nil {
+		http.Error(w, "Something went wrong while decoding the manifest", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimate)
+}
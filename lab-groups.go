@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+)
+
+// Marks the namespace of a merged group with the time it will be deleted
+const retireAtAnnotation = "scalama.io/retire-at"
+
+// Result of merging a group into another group
+type GroupMerge struct {
+	Namespace string    `json:"namespace"`
+	Token     string    `json:"token,omitempty"`
+	Copied    []string  `json:"copied"`
+	Conflicts []string  `json:"conflicts,omitempty"`
+	RetireAt  time.Time `json:"retireAt"`
+}
+
+/*
+Copies the objects of resources (e.g. "configmaps,deployments.apps") from one namespace to another.
+Objects that are owned by another object are recreated by their owner, ServiceAccount tokens are never copied.
+Returns the copied objects and the objects that already existed in the destination namespace.
+*/
+func copyNamespaceResources(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, resources []string, from string, to string) ([]string, []string, error) {
+	copied, conflicts := []string{}, []string{}
+	if len(resources) == 0 {
+		return copied, conflicts, nil
+	}
+
+	gr, err := restmapper.GetAPIGroupResources(clientset.Discovery())
+	if err != nil {
+		return nil, nil, err
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(gr)
+
+	for _, resource := range resources {
+		groupResource := schema.ParseGroupResource(resource)
+		gvr, err := mapper.ResourceFor(groupResource.WithVersion(""))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		list, err := dynamicInterface.Resource(gvr).Namespace(from).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, item := range list.Items {
+			if len(item.GetOwnerReferences()) > 0 {
+				continue
+			}
+
+			if secretType, _, _ := unstructured.NestedString(item.Object, "type"); gvr.Resource == "secrets" && secretType == string(corev1.SecretTypeServiceAccountToken) {
+				continue
+			}
+
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": item.GetAPIVersion(),
+				"kind":       item.GetKind(),
+			}}
+			for key, value := range item.Object {
+				if key != "metadata" && key != "status" {
+					obj.Object[key] = value
+				}
+			}
+			obj.SetName(item.GetName())
+			obj.SetNamespace(to)
+			obj.SetLabels(item.GetLabels())
+			obj.SetAnnotations(item.GetAnnotations())
+
+			name := groupResource.String() + "/" + item.GetName()
+			_, err := dynamicInterface.Resource(gvr).Namespace(to).Create(ctx, obj, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				conflicts = append(conflicts, name)
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+
+			copied = append(copied, name)
+		}
+	}
+
+	return copied, conflicts, nil
+}
+
+/*
+Deletes the namespace of a merged group once the grace period has passed, so the members can still move their work.
+The time it will be deleted is annotated on the namespace, so the deletion is scheduled again when ScaLaMa restarts.
+*/
+func (s *Server) retireNamespace(ctx context.Context, clientset kubernetes.Interface, namespace string, gracePeriod time.Duration) (time.Time, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	retireAt := time.Now().Add(gracePeriod).UTC().Truncate(time.Second)
+
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, retireAtAnnotation, retireAt.Format(time.RFC3339))
+	if _, err := clientset.CoreV1().Namespaces().Patch(ctx, namespace, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return time.Time{}, err
+	}
+
+	s.scheduleNamespaceRetirement(s.shutdownContext, clientset, namespace, retireAt)
+
+	return retireAt, nil
+}
+
+/*
+Deletes a retired namespace once its retirement is due. The annotation is read again first,
+so a namespace that is no longer retired (or retired later) in the meantime is kept.
+*/
+func (s *Server) scheduleNamespaceRetirement(ctx context.Context, clientset kubernetes.Interface, namespace string, retireAt time.Time) {
+	time.AfterFunc(time.Until(retireAt), func() {
+		getCtx, cancel := withOperationTimeout(ctx)
+		defer cancel()
+
+		current, err := clientset.CoreV1().Namespaces().Get(getCtx, namespace, metav1.GetOptions{})
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				fmt.Println("Something went wrong while fetching namespace "+namespace+":", err)
+			}
+			return
+		}
+
+		value, ok := current.Annotations[retireAtAnnotation]
+		if !ok {
+			return
+		}
+		if due, err := time.Parse(time.RFC3339, value); err == nil && time.Now().Before(due) {
+			return
+		}
+
+		// Helm releases have to be uninstalled before their namespace (and release storage) is gone
+		if err := uninstallHelmReleases(namespace); err != nil {
+			fmt.Println("Something went wrong while uninstalling the Helm releases in namespace "+namespace+":", err)
+		}
+
+		deleteCtx, cancel := withOperationTimeout(ctx)
+		defer cancel()
+
+		err = clientset.CoreV1().Namespaces().Delete(deleteCtx, namespace, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			fmt.Println("Something went wrong while deleting namespace "+namespace+":", err)
+		}
+	})
+}
+
+/*
+Schedules the deletion of every retired namespace, so namespaces whose grace period passed while ScaLaMa was not running are deleted on startup.
+*/
+func (s *Server) scheduleNamespaceRetirements(ctx context.Context, clientset kubernetes.Interface) error {
+	namespaces, err := s.listNamespaces(ctx, clientset)
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces {
+		value, ok := namespace.Annotations[retireAtAnnotation]
+		if !ok {
+			continue
+		}
+
+		// Namespaces without a valid retirement time are deleted right away
+		retireAt, _ := time.Parse(time.RFC3339, value)
+		s.scheduleNamespaceRetirement(ctx, clientset, namespace.Name, retireAt)
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Name of the ConfigMap in every namespace of a lab that records the objects created from the manifest
+const inventoryConfigMapName = "scalama-inventory"
+
+// An object ScaLaMa created from the manifest of a lab
+type InventoryEntry struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version"`
+	Resource  string `json:"resource"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Uid       string `json:"uid,omitempty"`
+}
+
+/*
+Returns the inventory entry of an object created from the manifest.
+*/
+func newInventoryEntry(mapping *meta.RESTMapping, obj *unstructured.Unstructured) InventoryEntry {
+	return InventoryEntry{
+		Group:     mapping.Resource.Group,
+		Version:   mapping.Resource.Version,
+		Resource:  mapping.Resource.Resource,
+		Kind:      obj.GetKind(),
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		Uid:       string(obj.GetUID()),
+	}
+}
+
+func (entry InventoryEntry) groupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: entry.Group, Version: entry.Version, Resource: entry.Resource}
+}
+
+func (entry InventoryEntry) key() string {
+	return getObjectKey(entry.groupVersionResource().GroupResource(), entry.Namespace, entry.Name)
+}
+
+/*
+Returns the namespace of which the inventory records an object.
+Cluster-scoped and shared external objects are recorded in the inventory of the lab namespace.
+*/
+func getInventoryNamespace(labName string, entry InventoryEntry) string {
+	if entry.Namespace == "ns-"+labName || strings.HasPrefix(entry.Namespace, "ns-"+labName+"-") {
+		return entry.Namespace
+	}
+
+	return "ns-" + labName
+}
+
+/*
+Returns the inventory of a namespace. Returns an empty inventory if nothing has been recorded yet.
+*/
+func getNamespaceInventory(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]InventoryEntry, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, inventoryConfigMapName, v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return []InventoryEntry{}, nil
+		}
+
+		return nil, err
+	}
+
+	entries := []InventoryEntry{}
+	if value, ok := configMap.Data["objects"]; ok {
+		if err := json.Unmarshal([]byte(value), &entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+/*
+Stores the inventory of a namespace, sorted so unchanged inventories are stored the same.
+*/
+func saveInventory(ctx context.Context, clientset kubernetes.Interface, labName string, namespace string, entries []InventoryEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key() < entries[j].key()
+	})
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+
+	configMap, err := configMaps.Get(ctx, inventoryConfigMapName, v1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      inventoryConfigMapName,
+				Namespace: namespace,
+				Labels:    map[string]string{managedByLabel: managedByLabelVal, labLabel: labName},
+			},
+			Data: map[string]string{"objects": string(data)},
+		}
+
+		_, err = configMaps.Create(ctx, configMap, v1.CreateOptions{})
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data["objects"] = string(data)
+
+	_, err = configMaps.Update(ctx, configMap, v1.UpdateOptions{})
+	return err
+}
+
+/*
+Adds objects to the inventories of a lab and removes the objects in removed.
+An object that is recorded again (e.g. recreated with a new uid) replaces its earlier entry.
+*/
+func updateInventory(ctx context.Context, clientset kubernetes.Interface, labName string, added []InventoryEntry, removed []InventoryEntry) error {
+	changes := make(map[string]map[string]*InventoryEntry)
+	for _, entry := range removed {
+		namespace := getInventoryNamespace(labName, entry)
+		if changes[namespace] == nil {
+			changes[namespace] = map[string]*InventoryEntry{}
+		}
+		changes[namespace][entry.key()] = nil
+	}
+	for i, entry := range added {
+		namespace := getInventoryNamespace(labName, entry)
+		if changes[namespace] == nil {
+			changes[namespace] = map[string]*InventoryEntry{}
+		}
+		changes[namespace][entry.key()] = &added[i]
+	}
+
+	for namespace, namespaceChanges := range changes {
+		entries, err := getNamespaceInventory(ctx, clientset, namespace)
+		if err != nil {
+			return err
+		}
+
+		updated := []InventoryEntry{}
+		for _, entry := range entries {
+			if _, changed := namespaceChanges[entry.key()]; !changed {
+				updated = append(updated, entry)
+			}
+		}
+		for _, entry := range namespaceChanges {
+			if entry != nil {
+				updated = append(updated, *entry)
+			}
+		}
+
+		if err := saveInventory(ctx, clientset, labName, namespace, updated); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns the inventories of the lab namespace and every student namespace of a lab.
+*/
+func (s *Server) getLabInventory(ctx context.Context, clientset kubernetes.Interface, labName string) (map[string][]InventoryEntry, error) {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := make(map[string][]InventoryEntry)
+	for _, namespace := range append([]string{"ns-" + labName}, namespaces...) {
+		entries, err := getNamespaceInventory(ctx, clientset, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		inventory[namespace] = entries
+	}
+
+	return inventory, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Formats in which the credentials of new students are returned, raw tokens (or identities) by default
+const (
+	credentialsFormatToken      = "token"
+	credentialsFormatKubeconfig = "kubeconfig"
+	credentialsFormatZip        = "zip"
+)
+
+var credentialsFormats = []string{credentialsFormatToken, credentialsFormatKubeconfig, credentialsFormatZip}
+
+/*
+Returns the format parameter of a request. Kubeconfigs need the API server configured by SCALAMA_CLUSTER_SERVER,
+and are only generated for labs that use ServiceAccounts.
+*/
+func getCredentialsFormat(r *http.Request, options *LabOptions) (string, *Error) {
+	var parameters CredentialsParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		return "", e
+	}
+	format := parameters.Format
+
+	if format != credentialsFormatToken {
+		if os.Getenv("SCALAMA_CLUSTER_SERVER") == "" {
+			return "", &Error{status: http.StatusBadRequest, message: "Kubeconfigs can only be generated when SCALAMA_CLUSTER_SERVER is set"}
+		}
+
+		if options.IdentityProvider != "" {
+			return "", &Error{status: http.StatusBadRequest, message: "Kubeconfigs can only be generated for labs that use ServiceAccounts"}
+		}
+	}
+
+	return format, nil
+}
+
+/*
+Returns a kubeconfig per user (student or group) for the tokens of their ServiceAccounts, scoped to the namespace of the user
+(the lab namespace for shared-only labs).
+*/
+func getKubeconfigs(ctx context.Context, clientset kubernetes.Interface, labName string, tokens map[string]string, options *LabOptions) (map[string]string, error) {
+	server := os.Getenv("SCALAMA_CLUSTER_SERVER")
+
+	kubeconfigs := make(map[string]string, len(tokens))
+	for username, token := range tokens {
+		student := StudentIdentifiers{Username: username, Namespace: "ns-" + labName + "-" + username}
+		if options.SharedOnly {
+			student.Namespace = "ns-" + labName
+		}
+
+		kubeconfig, err := getStudentKubeconfig(ctx, clientset, server, student, token)
+		if err != nil {
+			return nil, err
+		}
+
+		kubeconfigs[username] = kubeconfig
+	}
+
+	return kubeconfigs, nil
+}
+
+/*
+Writes the credentials of the users, as JSON or as a zip file with a <username>.kubeconfig file per user.
+*/
+func writeCredentials(w http.ResponseWriter, labName string, format string, credentials map[string]string) {
+	if format != credentialsFormatZip {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(credentials)
+		return
+	}
+
+	usernames := make([]string, 0, len(credentials))
+	for username := range credentials {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+labName+"-kubeconfigs.zip\"")
+
+	now := time.Now()
+	archive := zip.NewWriter(w)
+	for _, username := range usernames {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: username + ".kubeconfig", Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return
+		}
+
+		if _, err := file.Write([]byte(credentials[username])); err != nil {
+			return
+		}
+	}
+
+	archive.Close()
+}
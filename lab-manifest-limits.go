@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default limits of the manifest that is deployed in a single namespace
+const (
+	defaultMaxManifestBytes   = 10 * 1024 * 1024
+	defaultMaxManifestObjects = 1000
+)
+
+// Templates that are listed when a manifest exceeds a limit, the largest first
+const maxReportedTemplates = 5
+
+// The size of the objects rendered from a single chart template (or of the whole manifest without templates)
+type templateSize struct {
+	source  string
+	bytes   int
+	objects int
+}
+
+/*
+Returns a limit configured by an environment variable, 0 disables the limit.
+*/
+func getManifestLimit(name string, defaultLimit int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("%s must be a number of at least 0", name)
+	}
+
+	return limit, nil
+}
+
+/*
+Returns the maximum size in bytes and the maximum amount of objects of the manifest of a namespace,
+configured by SCALAMA_MAX_MANIFEST_BYTES (default 10 MiB) and SCALAMA_MAX_MANIFEST_OBJECTS (default 1000).
+*/
+func getManifestLimits() (int, int, error) {
+	maxBytes, err := getManifestLimit("SCALAMA_MAX_MANIFEST_BYTES", defaultMaxManifestBytes)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	maxObjects, err := getManifestLimit("SCALAMA_MAX_MANIFEST_OBJECTS", defaultMaxManifestObjects)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return maxBytes, maxObjects, nil
+}
+
+/*
+Returns the size of the objects of a manifest per chart template, based on the "# Source:" comments Helm adds to every rendered
+template. The objects of manifests without these comments (e.g. YAML) are counted under "manifest".
+*/
+func getTemplateSizes(manifest string) ([]templateSize, error) {
+	sizes := map[string]*templateSize{}
+
+	for _, document := range strings.Split("\n"+manifest, "\n---") {
+		source := "manifest"
+		for _, line := range strings.Split(document, "\n") {
+			if strings.HasPrefix(line, "# Source: ") {
+				source = strings.TrimPrefix(line, "# Source: ")
+				break
+			}
+		}
+
+		objects, err := decodeManifestObjects(document)
+		if err != nil {
+			return nil, err
+		}
+
+		if sizes[source] == nil {
+			sizes[source] = &templateSize{source: source}
+		}
+		sizes[source].bytes += len(document)
+		sizes[source].objects += len(objects)
+	}
+
+	var result []templateSize
+	for _, size := range sizes {
+		if size.objects > 0 {
+			result = append(result, *size)
+		}
+	}
+
+	return result, nil
+}
+
+/*
+Describes the templates that contribute the most objects, or the most bytes, e.g. "chart/templates/pod.yaml (500 objects, 80000 bytes)".
+*/
+func describeLargestTemplates(sizes []templateSize, byBytes bool) string {
+	sort.Slice(sizes, func(i, j int) bool {
+		if byBytes || sizes[i].objects == sizes[j].objects {
+			return sizes[i].bytes > sizes[j].bytes
+		}
+		return sizes[i].objects > sizes[j].objects
+	})
+
+	var templates []string
+	for i, size := range sizes {
+		if i == maxReportedTemplates {
+			break
+		}
+		templates = append(templates, fmt.Sprintf("%s (%d objects, %d bytes)", size.source, size.objects, size.bytes))
+	}
+
+	return strings.Join(templates, ", ")
+}
+
+/*
+Rejects a manifest that is larger or has more objects than the limits of a namespace, so a misconfigured chart can't create
+thousands of objects for every student. The error lists the templates that contribute the most.
+*/
+func checkManifestLimits(manifest string) *Error {
+	maxBytes, maxObjects, err := getManifestLimits()
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: err.Error()}
+	}
+
+	sizes, err := getTemplateSizes(manifest)
+	if err != nil {
+		return &Error{status: http.StatusBadRequest, message: "Something went wrong while decoding the manifest"}
+	}
+
+	if maxBytes > 0 && len(manifest) > maxBytes {
+		return &Error{status: http.StatusRequestEntityTooLarge, message: "The manifest is " + strconv.Itoa(len(manifest)) + " bytes, more than the " + strconv.Itoa(maxBytes) + " bytes a namespace may have (SCALAMA_MAX_MANIFEST_BYTES). Largest templates: " + describeLargestTemplates(sizes, true)}
+	}
+
+	objects := 0
+	for _, size := range sizes {
+		objects += size.objects
+	}
+
+	if maxObjects > 0 && objects > maxObjects {
+		return &Error{status: http.StatusRequestEntityTooLarge, message: "The manifest has " + strconv.Itoa(objects) + " objects, more than the " + strconv.Itoa(maxObjects) + " objects a namespace may have (SCALAMA_MAX_MANIFEST_OBJECTS). Largest templates: " + describeLargestTemplates(sizes, false)}
+	}
+
+	return nil
+}
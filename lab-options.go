@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Which namespaces the students of a lab can see
+const (
+	namespaceVisibilityCluster = "cluster"
+	namespaceVisibilityLab     = "lab"
+)
+
+var namespaceVisibilities = []string{namespaceVisibilityCluster, namespaceVisibilityLab}
+
+// What happens when an object of the manifest already exists in its namespace
+const (
+	conflictStrategyFail  = "fail"
+	conflictStrategySkip  = "skip"
+	conflictStrategyPatch = "patch"
+)
+
+var conflictStrategies = []string{conflictStrategyFail, conflictStrategySkip, conflictStrategyPatch}
+
+// Service types that can expose services of a lab outside of the cluster
+var serviceTypes = []string{"NodePort", "LoadBalancer"}
+
+// Optional settings of a lab, stored with the lab so they can be applied again later
+type LabOptions struct {
+	GpuCount        int               `json:"gpuCount,omitempty"`
+	GpuNodeSelector map[string]string `json:"gpuNodeSelector,omitempty"`
+	GpuTimeSlicing  int               `json:"gpuTimeSlicing,omitempty"`
+
+	Spot             bool              `json:"spot,omitempty"`
+	SpotNodeSelector map[string]string `json:"spotNodeSelector,omitempty"`
+
+	Architecture string `json:"architecture,omitempty"`
+
+	Ssh            bool   `json:"ssh,omitempty"`
+	SshServiceType string `json:"sshServiceType,omitempty"`
+
+	Dashboard            bool   `json:"dashboard,omitempty"`
+	DashboardServiceType string `json:"dashboardServiceType,omitempty"`
+
+	RancherProject       bool     `json:"rancherProject,omitempty"`
+	RancherProjectOwners []string `json:"rancherProjectOwners,omitempty"`
+
+	IdentityProvider string `json:"identityProvider,omitempty"`
+
+	ClusterClass   string `json:"clusterClass,omitempty"`
+	ClusterVersion string `json:"clusterVersion,omitempty"`
+	ClusterWorkers int    `json:"clusterWorkers,omitempty"`
+
+	SharedServiceAliases bool `json:"sharedServiceAliases,omitempty"`
+
+	IngressDomain string `json:"ingressDomain,omitempty"`
+	ExternalDns   bool   `json:"externalDns,omitempty"`
+
+	NamespaceVisibility string `json:"namespaceVisibility,omitempty"`
+
+	Roles map[string][]rbacv1.PolicyRule `json:"roles,omitempty"`
+
+	LabClusterRole bool `json:"labClusterRole,omitempty"`
+
+	TokenExpirationSeconds int64    `json:"tokenExpirationSeconds,omitempty"`
+	TokenAudiences         []string `json:"tokenAudiences,omitempty"`
+
+	ConflictStrategy string `json:"conflictStrategy,omitempty"`
+
+	SharedOnly bool `json:"sharedOnly,omitempty"`
+
+	SharedResources []string            `json:"sharedResources,omitempty"`
+	SharedRules     []rbacv1.PolicyRule `json:"sharedRules,omitempty"`
+
+	ScheduledTasks []ScheduledTask `json:"scheduledTasks,omitempty"`
+
+	EgressIdentity bool              `json:"egressIdentity,omitempty"`
+	EgressLabels   map[string]string `json:"egressLabels,omitempty"`
+
+	LogOutputs []string `json:"logOutputs,omitempty"`
+
+	AccessWindows  []string `json:"accessWindows,omitempty"`
+	AccessTimezone string   `json:"accessTimezone,omitempty"`
+	ClosedAccess   string   `json:"closedAccess,omitempty"`
+
+	MaxPods              int   `json:"maxPods,omitempty"`
+	MaxPodRuntimeSeconds int64 `json:"maxPodRuntimeSeconds,omitempty"`
+
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+
+	RetentionDays int `json:"retentionDays,omitempty"`
+
+	WithholdUntilReady bool `json:"withholdUntilReady,omitempty"`
+
+	PreDeleteWebhook string `json:"preDeleteWebhook,omitempty"`
+}
+
+// Shortest lifetime of a token that the TokenRequest API accepts
+const minTokenTtl = 10 * time.Minute
+
+/*
+Checks whether the tokens of a lab are requested with the TokenRequest API instead of read from ServiceAccount Secrets.
+*/
+func (options *LabOptions) usesTokenRequest() bool {
+	return options.TokenExpirationSeconds > 0 || len(options.TokenAudiences) > 0
+}
+
+/*
+Checks whether a list contains a value
+*/
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Parses a non-negative number form parameter, returns 0 if the parameter is not set.
+*/
+func getFormNumber(r *http.Request, name string) (int, *Error) {
+	value := r.Form.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, &Error{status: http.StatusBadRequest, message: name + " must be a positive number"}
+	}
+
+	return number, nil
+}
+
+/*
+Parses a comma-separated form parameter, empty items are skipped.
+*/
+func getFormList(r *http.Request, name string) []string {
+	var list []string
+
+	for _, item := range strings.Split(r.Form.Get(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+/*
+Parses a label selector form parameter (key=value,key2=value2), returns nil if the parameter is not set.
+*/
+func getFormSelector(r *http.Request, name string) (map[string]string, *Error) {
+	return parseSelector(name, r.Form.Get(name))
+}
+
+/*
+Parses the label selector (key=value,key2=value2) of parameter name, returns nil if value is empty.
+*/
+func parseSelector(name string, value string) (map[string]string, *Error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	selector, err := labels.ConvertSelectorToLabelsMap(value)
+	if err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: name + " must be of the form key=value,key2=value2"}
+	}
+
+	return selector, nil
+}
+
+/*
+Parses the optional roles file of a lab, returns nil if no roles file is uploaded.
+The file maps the name of every role to its RBAC rules, e.g. viewer: [{apiGroups: ["*"], resources: ["*"], verbs: ["get"]}]
+*/
+func (s *Server) getFormRoles(r *http.Request) (map[string][]rbacv1.PolicyRule, *Error) {
+	if !hasFormFile(r, "roles") {
+		return nil, nil
+	}
+
+	rolesFile, e := s.getFormFile(r, "roles", "text/yaml", "application/x-yaml")
+	if e != nil {
+		return nil, e
+	}
+	defer rolesFile.Close()
+
+	data, err := io.ReadAll(rolesFile)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the roles"}
+	}
+
+	var roles map[string][]rbacv1.PolicyRule
+	if err := yaml.UnmarshalStrict(data, &roles); err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "roles must map role names to RBAC rules: " + err.Error()}
+	}
+
+	for name := range roles {
+		if len(validation.IsDNS1123Label(name)) > 0 {
+			return nil, &Error{status: http.StatusBadRequest, message: "role " + name + " must be a valid DNS label"}
+		}
+	}
+
+	return roles, nil
+}
+
+/*
+Parses the optional file with the extra RBAC rules of the shared lab namespace, returns nil if no rules file is uploaded.
+The file is a list of rules, e.g. [{apiGroups: [""], resources: ["pods/exec"], resourceNames: ["debug"], verbs: ["create"]}]
+*/
+func (s *Server) getFormSharedRules(r *http.Request) ([]rbacv1.PolicyRule, *Error) {
+	if !hasFormFile(r, "sharedRules") {
+		return nil, nil
+	}
+
+	rulesFile, e := s.getFormFile(r, "sharedRules", "text/yaml", "application/x-yaml")
+	if e != nil {
+		return nil, e
+	}
+	defer rulesFile.Close()
+
+	data, err := io.ReadAll(rulesFile)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the shared rules"}
+	}
+
+	var rules []rbacv1.PolicyRule
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "sharedRules must be a list of RBAC rules: " + err.Error()}
+	}
+
+	for _, rule := range rules {
+		if len(rule.Verbs) == 0 || len(rule.Resources) == 0 {
+			return nil, &Error{status: http.StatusBadRequest, message: "Every rule of sharedRules needs verbs and resources"}
+		}
+	}
+
+	return rules, nil
+}
+
+/*
+Parses the scheduled tasks of a lab from a YAML file form parameter, returns nil if the parameter is not set.
+Tasks without a scope run once in the lab namespace.
+*/
+func (s *Server) getFormScheduledTasks(r *http.Request) ([]ScheduledTask, *Error) {
+	if !hasFormFile(r, "scheduledTasks") {
+		return nil, nil
+	}
+
+	tasksFile, e := s.getFormFile(r, "scheduledTasks", "text/yaml", "application/x-yaml")
+	if e != nil {
+		return nil, e
+	}
+	defer tasksFile.Close()
+
+	data, err := io.ReadAll(tasksFile)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the scheduled tasks"}
+	}
+
+	var tasks []ScheduledTask
+	if err := yaml.UnmarshalStrict(data, &tasks); err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "scheduledTasks must be a list of scheduled tasks: " + err.Error()}
+	}
+
+	names := make(map[string]bool)
+	for i := range tasks {
+		if tasks[i].Scope == "" {
+			tasks[i].Scope = taskScopeLab
+		}
+
+		if e := validateScheduledTask(tasks[i]); e != nil {
+			return nil, e
+		}
+
+		if names[tasks[i].Name] {
+			return nil, &Error{status: http.StatusBadRequest, message: "There are multiple scheduled tasks named " + tasks[i].Name}
+		}
+		names[tasks[i].Name] = true
+	}
+
+	return tasks, nil
+}
+
+/*
+Parses the optional lab settings from the form.
+HTTP Parameters:
+ gpuCount: <int> (optional, amount of GPUs per namespace)
+ gpuNodeSelector: <string> (optional, default nvidia.com/gpu.present=true)
+ gpuTimeSlicing: <int> (optional, amount of pods that share a GPU)
+ spot: <bool> (optional, default false)
+ spotNodeSelector: <string> (optional, default SCALAMA_SPOT_NODE_SELECTOR or cloud.google.com/gke-spot=true)
+ architecture: <string> (optional, ["amd64", "arm64"])
+ ssh: <bool> (optional, default false, deploys an SSH bastion with the keys of the students)
+ sshServiceType: <string> (optional, ["NodePort", "LoadBalancer"], default NodePort)
+ dashboard: <bool> (optional, default false, deploys a dashboard in the lab namespace)
+ dashboardServiceType: <string> (optional, ["NodePort", "LoadBalancer"], default NodePort)
+ rancherProject: <bool> (optional, default false, attaches the namespaces to a Rancher project of the lab)
+ rancherProjectOwners: <string> (optional, comma-separated Rancher user IDs that own the project)
+ identityProvider: <string> (optional, ["eks", "gke", "aks"], binds the Identity column of the students instead of creating ServiceAccounts)
+ clusterClass: <string> (optional, creates a Cluster API cluster of this ClusterClass in every namespace)
+ clusterVersion: <string> (required with clusterClass, Kubernetes version of the clusters)
+ clusterWorkers: <int> (optional, default 1, amount of worker nodes per cluster)
+ sharedServiceAliases: <bool> (optional, default false, creates an ExternalName Service in every namespace for every shared Service)
+ ingressDomain: <string> (optional, gives Ingresses without a host a subdomain of this domain and prefixes the hosts of student Ingresses with the username)
+ externalDns: <bool> (optional, default false, annotates Ingresses so ExternalDNS creates records for their hosts)
+ namespaceVisibility: <string> (optional, ["cluster", "lab"], default cluster, "lab" only lets students read the namespaces of their own lab)
+ roles: <YAML-file> (optional, named roles with their RBAC rules, assigned to students with the Role column)
+ labClusterRole: <bool> (optional, default false, binds an aggregated ClusterRole of the lab to every student, see createLabClusterRole)
+ tokenTtl: <string> (optional, e.g. "8h", at least 10m, the ServiceAccount tokens expire and can be refreshed)
+ tokenAudiences: <string> (optional, comma-separated audiences the ServiceAccount tokens are valid for)
+ conflictStrategy: <string> (optional, ["fail", "skip", "patch"], default fail, what happens when an object of the manifest already exists)
+ sharedOnly: <bool> (optional, default false, only deploys the single instance objects, the students get read access instead of a namespace)
+ sharedResources: <string> (optional, comma-separated resources (e.g. "services,configmaps,deployments.apps") the students can read in the lab namespace, default every resource of the manifest)
+ sharedRules: <YAML-file> (optional, extra RBAC rules for the students in the lab namespace, e.g. exec into a shared debug pod)
+ scheduledTasks: <YAML-file> (optional, tasks (name, schedule, scope ["lab", "namespace"], image, command, rules) that run as CronJobs in the lab namespace or every namespace)
+ egressIdentity: <bool> (optional, default false, labels every namespace with scalama.io/egress-identity=<lab>-<username> for egress gateway policies)
+ egressLabels: <string> (optional, labels of the form key=value,key2=value2 for every namespace, e.g. the egress gateway of the lab)
+ logOutputs: <string> (optional, comma-separated ClusterOutputs of the Logging operator (e.g. Loki or Elasticsearch) the logs of every namespace are forwarded to)
+ accessWindows: <string> (optional, semicolon-separated windows in which students have access to their namespace, e.g. "mon-fri 08:00-22:00;sat 10:00-16:00")
+ accessTimezone: <string> (optional, default UTC, the time zone of the access windows, e.g. Europe/Brussels)
+ closedAccess: <string> (optional, ["read-only", "none"], default read-only, the access of students outside the access windows)
+ maxPods: <int> (optional, amount of pods that can run at the same time in every namespace)
+ maxPodRuntime: <string> (optional, e.g. "4h", pods that run longer are terminated unless annotated with scalama.io/runtime-exempt: "true")
+ allowedRegistries: <string> (optional, comma-separated registries, e.g. "docker.io,ghcr.io", pods with images from other registries raise an alert)
+ retentionDays: <int> (optional, default SCALAMA_ARCHIVE_RETENTION_DAYS, days the archive of the lab is kept in the object store after it is deleted)
+ withholdUntilReady: <bool> (optional, default false, the portal, LTI launches and tokens are only available to students once the workloads and hooks of their namespace are ready)
+ preDeleteWebhook: <string> (optional, URL that receives a signed lab.pre-delete webhook before the lab is deleted, the deletion waits for a 2xx answer)
+*/
+func (s *Server) getLabOptions(r *http.Request) (*LabOptions, *Error) {
+	options := &LabOptions{}
+
+	var e *Error
+	if options.GpuCount, e = getFormNumber(r, "gpuCount"); e != nil {
+		return nil, e
+	}
+	if options.GpuTimeSlicing, e = getFormNumber(r, "gpuTimeSlicing"); e != nil {
+		return nil, e
+	}
+	if options.GpuNodeSelector, e = getFormSelector(r, "gpuNodeSelector"); e != nil {
+		return nil, e
+	}
+
+	if options.GpuCount > 0 && options.GpuNodeSelector == nil {
+		options.GpuNodeSelector = map[string]string{gpuNodeLabel: "true"}
+	}
+
+	options.Spot = r.Form.Get("spot") == "true"
+	if options.Spot {
+		if options.SpotNodeSelector, e = getFormSelector(r, "spotNodeSelector"); e != nil {
+			return nil, e
+		}
+
+		if options.SpotNodeSelector == nil {
+			defaultSelector, err := getDefaultSpotNodeSelector()
+			if err != nil {
+				return nil, &Error{status: http.StatusInternalServerError, message: "SCALAMA_SPOT_NODE_SELECTOR must be of the form key=value,key2=value2"}
+			}
+
+			options.SpotNodeSelector = defaultSelector
+		}
+	}
+
+	options.Architecture = r.Form.Get("architecture")
+	if options.Architecture != "" {
+		if !contains(supportedArchitectures, options.Architecture) {
+			return nil, &Error{status: http.StatusBadRequest, message: "architecture must be one of " + strings.Join(supportedArchitectures, ", ")}
+		}
+	}
+
+	options.Ssh = r.Form.Get("ssh") == "true"
+	if options.Ssh {
+		options.SshServiceType = r.Form.Get("sshServiceType")
+		if options.SshServiceType == "" {
+			options.SshServiceType = serviceTypes[0]
+		}
+
+		if !contains(serviceTypes, options.SshServiceType) {
+			return nil, &Error{status: http.StatusBadRequest, message: "sshServiceType must be one of " + strings.Join(serviceTypes, ", ")}
+		}
+	}
+
+	options.Dashboard = r.Form.Get("dashboard") == "true"
+	if options.Dashboard {
+		options.DashboardServiceType = r.Form.Get("dashboardServiceType")
+		if options.DashboardServiceType == "" {
+			options.DashboardServiceType = serviceTypes[0]
+		}
+
+		if !contains(serviceTypes, options.DashboardServiceType) {
+			return nil, &Error{status: http.StatusBadRequest, message: "dashboardServiceType must be one of " + strings.Join(serviceTypes, ", ")}
+		}
+	}
+
+	options.RancherProject = r.Form.Get("rancherProject") == "true"
+	if options.RancherProject {
+		if !s.isRancher {
+			return nil, &Error{status: http.StatusBadRequest, message: "rancherProject can only be used on clusters managed by Rancher"}
+		}
+
+		options.RancherProjectOwners = getFormList(r, "rancherProjectOwners")
+	}
+
+	options.ClusterClass = r.Form.Get("clusterClass")
+	if options.ClusterClass != "" {
+		options.ClusterVersion = r.Form.Get("clusterVersion")
+		if options.ClusterVersion == "" {
+			return nil, &Error{status: http.StatusBadRequest, message: "clusterVersion is required when clusterClass is set"}
+		}
+
+		if options.ClusterWorkers, e = getFormNumber(r, "clusterWorkers"); e != nil {
+			return nil, e
+		}
+		if options.ClusterWorkers == 0 {
+			options.ClusterWorkers = 1
+		}
+	}
+
+	options.SharedServiceAliases = r.Form.Get("sharedServiceAliases") == "true"
+
+	options.IngressDomain = r.Form.Get("ingressDomain")
+	if options.IngressDomain != "" && len(validation.IsDNS1123Subdomain(options.IngressDomain)) > 0 {
+		return nil, &Error{status: http.StatusBadRequest, message: "ingressDomain must be a valid domain name"}
+	}
+	options.ExternalDns = r.Form.Get("externalDns") == "true"
+
+	options.NamespaceVisibility = r.Form.Get("namespaceVisibility")
+	if options.NamespaceVisibility == "" {
+		options.NamespaceVisibility = namespaceVisibilityCluster
+	}
+	if !contains(namespaceVisibilities, options.NamespaceVisibility) {
+		return nil, &Error{status: http.StatusBadRequest, message: "namespaceVisibility must be one of " + strings.Join(namespaceVisibilities, ", ")}
+	}
+
+	if options.Roles, e = s.getFormRoles(r); e != nil {
+		return nil, e
+	}
+	options.LabClusterRole = r.Form.Get("labClusterRole") == "true"
+
+	if tokenTtl := r.Form.Get("tokenTtl"); tokenTtl != "" {
+		ttl, err := time.ParseDuration(tokenTtl)
+		if err != nil || ttl < minTokenTtl {
+			return nil, &Error{status: http.StatusBadRequest, message: "tokenTtl must be a duration of at least " + minTokenTtl.String()}
+		}
+
+		options.TokenExpirationSeconds = int64(ttl.Seconds())
+	}
+	options.TokenAudiences = getFormList(r, "tokenAudiences")
+
+	options.ConflictStrategy = r.Form.Get("conflictStrategy")
+	if options.ConflictStrategy == "" {
+		options.ConflictStrategy = conflictStrategyFail
+	}
+	if !contains(conflictStrategies, options.ConflictStrategy) {
+		return nil, &Error{status: http.StatusBadRequest, message: "conflictStrategy must be one of " + strings.Join(conflictStrategies, ", ")}
+	}
+
+	options.IdentityProvider = r.Form.Get("identityProvider")
+	if options.IdentityProvider != "" && !contains(identityProviders, options.IdentityProvider) {
+		return nil, &Error{status: http.StatusBadRequest, message: "identityProvider must be one of " + strings.Join(identityProviders, ", ")}
+	}
+
+	options.SharedResources = getFormList(r, "sharedResources")
+	if options.SharedRules, e = s.getFormSharedRules(r); e != nil {
+		return nil, e
+	}
+
+	if options.ScheduledTasks, e = s.getFormScheduledTasks(r); e != nil {
+		return nil, e
+	}
+
+	options.EgressIdentity = r.Form.Get("egressIdentity") == "true"
+	if options.EgressLabels, e = getFormSelector(r, "egressLabels"); e != nil {
+		return nil, e
+	}
+
+	options.LogOutputs = getFormList(r, "logOutputs")
+	for _, output := range options.LogOutputs {
+		if len(validation.IsDNS1123Subdomain(output)) > 0 {
+			return nil, &Error{status: http.StatusBadRequest, message: "logOutputs must be names of ClusterOutputs"}
+		}
+	}
+
+	for _, window := range strings.Split(r.Form.Get("accessWindows"), ";") {
+		if window = strings.TrimSpace(window); window == "" {
+			continue
+		}
+
+		if _, err := parseAccessWindow(window); err != nil {
+			return nil, &Error{status: http.StatusBadRequest, message: err.Error()}
+		}
+		options.AccessWindows = append(options.AccessWindows, window)
+	}
+	if len(options.AccessWindows) > 0 {
+		options.AccessTimezone = r.Form.Get("accessTimezone")
+		if options.AccessTimezone == "" {
+			options.AccessTimezone = "UTC"
+		}
+		if _, err := time.LoadLocation(options.AccessTimezone); err != nil {
+			return nil, &Error{status: http.StatusBadRequest, message: "accessTimezone must be a time zone, e.g. Europe/Brussels"}
+		}
+
+		options.ClosedAccess = r.Form.Get("closedAccess")
+		if options.ClosedAccess == "" {
+			options.ClosedAccess = closedAccessReadOnly
+		}
+		if !contains(closedAccesses, options.ClosedAccess) {
+			return nil, &Error{status: http.StatusBadRequest, message: "closedAccess must be one of " + strings.Join(closedAccesses, ", ")}
+		}
+	}
+
+	if options.MaxPods, e = getFormNumber(r, "maxPods"); e != nil {
+		return nil, e
+	}
+	if maxPodRuntime := r.Form.Get("maxPodRuntime"); maxPodRuntime != "" {
+		runtime, err := time.ParseDuration(maxPodRuntime)
+		if err != nil || runtime < time.Minute {
+			return nil, &Error{status: http.StatusBadRequest, message: "maxPodRuntime must be a duration of at least 1m"}
+		}
+
+		options.MaxPodRuntimeSeconds = int64(runtime.Seconds())
+	}
+
+	options.AllowedRegistries = getFormList(r, "allowedRegistries")
+
+	if options.RetentionDays, e = getFormNumber(r, "retentionDays"); e != nil {
+		return nil, e
+	}
+
+	options.WithholdUntilReady = r.Form.Get("withholdUntilReady") == "true"
+
+	options.PreDeleteWebhook = r.Form.Get("preDeleteWebhook")
+	if options.PreDeleteWebhook != "" {
+		if err := validateWebhookUrl(options.PreDeleteWebhook); err != nil {
+			return nil, &Error{status: http.StatusBadRequest, message: "preDeleteWebhook must be an http(s) URL"}
+		}
+	}
+
+	// Shared-only labs have no student namespaces to put clusters, bastions or GPU quotas in
+	options.SharedOnly = r.Form.Get("sharedOnly") == "true"
+	if options.SharedOnly && (options.ClusterClass != "" || options.Ssh || options.GpuCount > 0 || options.EgressIdentity || options.EgressLabels != nil || options.MaxPods > 0 || options.MaxPodRuntimeSeconds > 0) {
+		return nil, &Error{status: http.StatusBadRequest, message: "sharedOnly labs can't be combined with clusterClass, ssh, gpuCount, egressIdentity, egressLabels, maxPods or maxPodRuntime"}
+	}
+
+	return options, nil
+}
+
+/*
+Returns the options stored with a lab. Returns empty options if none were stored.
+*/
+func getStoredLabOptions(labData map[string]string) (*LabOptions, error) {
+	options := &LabOptions{}
+
+	if value, ok := labData["options"]; ok {
+		if err := json.Unmarshal([]byte(value), options); err != nil {
+			return nil, err
+		}
+	}
+
+	return options, nil
+}
+
+/*
+Encodes options to the form in which they are stored with a lab.
+*/
+func encodeLabOptions(options *LabOptions) (string, error) {
+	value, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+/*
+Changes an object of the manifest according to the options of the lab, before it is created in labName.
+*/
+func applyLabOptions(unstructuredObj *unstructured.Unstructured, labName string, options *LabOptions) {
+	if unstructuredObj.GetKind() == "Ingress" {
+		setIngressHosts(unstructuredObj, labName, options)
+	}
+
+	podSpec, ok := getPodSpec(unstructuredObj)
+	if !ok {
+		return
+	}
+
+	// Only workloads that use a GPU are scheduled on GPU nodes
+	if requestsResource(podSpec, gpuResource) {
+		if options.GpuNodeSelector != nil {
+			addNodeSelector(podSpec, options.GpuNodeSelector)
+		}
+		if options.GpuTimeSlicing > 0 {
+			addNodeSelector(podSpec, map[string]string{gpuConfigNodeLabel: labName})
+		}
+	}
+
+	if options.Spot {
+		addSpotScheduling(unstructuredObj, podSpec, options.SpotNodeSelector)
+	}
+
+	if options.Architecture != "" {
+		addNodeAffinity(podSpec, true, 0, "kubernetes.io/arch", []string{options.Architecture})
+	}
+}
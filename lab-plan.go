@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/restmapper"
+)
+
+// An object of the manifest a lab would create, without namespace for cluster-scoped objects
+type PlannedObject struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+// A namespace a lab would create, with the students that get access to it and the objects of the manifest in it.
+// Namespaces that already exist are kept as they are, like when students are added to a lab.
+type PlannedNamespace struct {
+	Name     string          `json:"name"`
+	Exists   bool            `json:"exists"`
+	Students []string        `json:"students"`
+	Objects  []PlannedObject `json:"objects"`
+}
+
+// What POST /lab would create, served instead of creating the lab with dryRun
+type LabPlan struct {
+	LabName         string             `json:"labName"`
+	Students        int                `json:"students"`
+	Namespaces      []PlannedNamespace `json:"namespaces"`
+	SharedObjects   []PlannedObject    `json:"sharedObjects"`
+	ApprovalReasons []string           `json:"approvalReasons,omitempty"`
+	Errors          []string           `json:"errors"`
+	Warnings        []string           `json:"warnings"`
+}
+
+/*
+Decodes the objects of a manifest and checks them against the API resources of the cluster.
+Returns the objects created once for the lab, the objects created in every (student) namespace, and the errors of the objects.
+*/
+func planManifestObjects(mapper meta.RESTMapper, manifest string, labName string) ([]PlannedObject, []PlannedObject, []string) {
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		return nil, nil, []string{"Something went wrong while decoding the manifest: " + err.Error()}
+	}
+
+	var shared, perNamespace []PlannedObject
+	var errors []string
+	for _, obj := range objects {
+		gvk := obj.GroupVersionKind()
+		planned := PlannedObject{ApiVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Name: obj.GetName()}
+
+		if planned.Name == "" && obj.GetGenerateName() == "" {
+			errors = append(errors, planned.Kind+" of apiVersion "+planned.ApiVersion+" has no name")
+			continue
+		}
+		if planned.Name == "" {
+			planned.Name = obj.GetGenerateName()
+		}
+
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			errors = append(errors, planned.Kind+" "+planned.Name+": kind "+planned.Kind+" of apiVersion "+planned.ApiVersion+" is not known by the cluster")
+			continue
+		}
+
+		if isCreatedOnce(obj, mapping) {
+			planned.Namespace = getSharedNamespace(obj, mapping, labName)
+			shared = append(shared, planned)
+		} else {
+			perNamespace = append(perNamespace, planned)
+		}
+	}
+
+	return shared, perNamespace, errors
+}
+
+/*
+Returns the objects of a student namespace, in that namespace.
+*/
+func getNamespaceObjects(objects []PlannedObject, namespace string) []PlannedObject {
+	namespaceObjects := []PlannedObject{}
+	for _, object := range objects {
+		object.Namespace = namespace
+		namespaceObjects = append(namespaceObjects, object)
+	}
+
+	return namespaceObjects
+}
+
+/*
+Plans a lab without creating anything: the namespaces of the roster, and the objects of the manifest in the lab namespace and in every
+namespace, checked against the API resources of the cluster. Charts are rendered for every student namespace with the values of its students.
+Responds with 200 if the lab can be created and 422 with every error otherwise.
+*/
+func (s *Server) planLab(w http.ResponseWriter, r *http.Request, students []Student, labName string, deploymentMode string, manifest string, options *LabOptions, isIndividual bool, isHybrid bool) {
+	ctx := r.Context()
+	plan := LabPlan{LabName: labName, Namespaces: []PlannedNamespace{}, SharedObjects: []PlannedObject{}, Errors: []string{}, Warnings: []string{}}
+
+	// The API resources are discovered once, instead of once for every object of every namespace
+	groupResources, err := restmapper.GetAPIGroupResources(s.clientset.Discovery())
+	if err != nil {
+		http.Error(w, "Something went wrong while discovering the API resources of the cluster", http.StatusInternalServerError)
+		return
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
+
+	existingNamespaces, err := s.getExistingNamespaces(ctx, s.clientset)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	if existingNamespaces["ns-"+labName] {
+		if e := checkLabOrganization(ctx, s.clientset, labName, getRequestOrganization(ctx)); e != nil {
+			http.Error(w, e.message, e.status)
+			return
+		}
+		plan.Warnings = append(plan.Warnings, "Lab "+labName+" already exists, only the students without a namespace are added")
+	}
+
+	// The same namespaces as deployLabEnvironment, in hybrid mode a personal namespace for every student and a namespace for every group
+	namespaceStudents := getNamespaceStudents(students, labName, isIndividual || isHybrid)
+	groupStudents := map[string][]Student{}
+	if isHybrid {
+		groupStudents = getNamespaceStudents(students, labName, false)
+	}
+	if options.SharedOnly {
+		namespaceStudents, groupStudents = map[string][]Student{}, map[string][]Student{}
+	}
+	plan.Students = len(getNamespaceNames(students, labName, true))
+
+	if !isIndividual || isHybrid {
+		errors, warnings := validateRoster(students, labName, false)
+		plan.Errors = append(plan.Errors, errors...)
+		plan.Warnings = append(plan.Warnings, warnings...)
+	}
+	if isIndividual || isHybrid {
+		errors, _ := validateRoster(students, labName, true)
+		plan.Errors = append(plan.Errors, errors...)
+	}
+
+	if e := validateStudentRoles(namespaceStudents, options); e != nil {
+		plan.Errors = append(plan.Errors, e.message)
+	}
+
+	if _, e := getCredentialsFormat(r, options); e != nil {
+		plan.Errors = append(plan.Errors, e.message)
+	}
+
+	// The shared objects are only created with the lab, students added later only get the objects of their namespace
+	shared, perNamespace, errors := planManifestObjects(mapper, manifest, labName)
+	if !existingNamespaces["ns-"+labName] {
+		plan.SharedObjects = append(plan.SharedObjects, shared...)
+	}
+	plan.Errors = append(plan.Errors, errors...)
+
+	renderer, isRenderer := deploymentBackends[deploymentMode].(NamespaceRenderer)
+
+	var namespaces []string
+	for namespace := range namespaceStudents {
+		namespaces = append(namespaces, namespace)
+	}
+	for namespace := range groupStudents {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		_, isGroup := groupStudents[namespace]
+		planned := PlannedNamespace{Name: namespace, Exists: existingNamespaces[namespace], Students: []string{}, Objects: getNamespaceObjects(perNamespace, namespace)}
+
+		namespaceMembers := namespaceStudents[namespace]
+		if isGroup {
+			namespaceMembers = groupStudents[namespace]
+		}
+		for _, student := range namespaceMembers {
+			planned.Students = append(planned.Students, student.name)
+		}
+
+		// Charts are rendered again for every student namespace, group namespaces get the manifest of the lab
+		if isRenderer && !isGroup && !planned.Exists {
+			values := getStudentValues(namespaceMembers, labName, namespace, options)
+
+			namespaceManifest, e := s.renderNamespaceManifest(r, renderer, namespace, values, options)
+			if e != nil {
+				plan.Errors = append(plan.Errors, "Namespace "+namespace+": "+e.message)
+			} else {
+				_, namespaceObjects, errors := planManifestObjects(mapper, namespaceManifest, labName)
+				for _, err := range errors {
+					plan.Errors = append(plan.Errors, "Namespace "+namespace+": "+err)
+				}
+				planned.Objects = getNamespaceObjects(namespaceObjects, namespace)
+			}
+		}
+
+		if planned.Exists {
+			planned.Objects = []PlannedObject{}
+		}
+		plan.Namespaces = append(plan.Namespaces, planned)
+	}
+
+	// The plan shows whether the lab would wait for the approval of a cluster admin
+	reasons, _, e := getApprovalReasons(s.clientset, students, labName, manifest, options, isIndividual, isHybrid)
+	if e != nil {
+		plan.Errors = append(plan.Errors, e.message)
+	}
+	plan.ApprovalReasons = reasons
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(plan.Errors) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(plan)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Everything a student needs to see of their environment in a lab, for a student portal page
+type StudentPortal struct {
+	Lab          string             `json:"lab"`
+	Student      StudentIdentifiers `json:"student"`
+	Instructions string             `json:"instructions,omitempty"`
+	Announcement *Announcement      `json:"announcement,omitempty"`
+	Namespaces   []PortalNamespace  `json:"namespaces"`
+}
+
+// The objects and quota usage of a namespace a student has access to
+type PortalNamespace struct {
+	Namespace string                              `json:"namespace"`
+	Pods      []PortalPod                         `json:"pods"`
+	Services  []PortalService                     `json:"services"`
+	Ingresses []PortalIngress                     `json:"ingresses"`
+	Quota     map[string]map[string]ResourceUsage `json:"quota"`
+}
+
+type PortalPod struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	Restarts int32  `json:"restarts"`
+	LogsUrl  string `json:"logsUrl,omitempty"`
+}
+
+type PortalService struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	ClusterIp string   `json:"clusterIp,omitempty"`
+	External  []string `json:"external,omitempty"`
+	Ports     []string `json:"ports"`
+}
+
+type PortalIngress struct {
+	Name string   `json:"name"`
+	Urls []string `json:"urls"`
+}
+
+/*
+Returns the student of a lab a user authenticated as, by their ServiceAccount or the identity of the identity provider.
+Returns false if the user is not a student of the lab.
+*/
+func findPortalStudent(identifiers []StudentIdentifiers, username string) (StudentIdentifiers, bool) {
+	for _, student := range identifiers {
+		if (student.ServiceAccount != "" && student.ServiceAccount == username) || (student.Identity != "" && student.Identity == username) {
+			return student, true
+		}
+	}
+
+	return StudentIdentifiers{}, false
+}
+
+/*
+Returns the link to the logs of a pod, from the template configured by SCALAMA_LOGS_URL (e.g. a Grafana Explore URL)
+in which {namespace} and {pod} are replaced. Returns an empty link when no template is configured.
+*/
+func getLogsUrl(namespace string, pod string) string {
+	template := os.Getenv("SCALAMA_LOGS_URL")
+	if template == "" {
+		return ""
+	}
+
+	return strings.NewReplacer("{namespace}", url.QueryEscape(namespace), "{pod}", url.QueryEscape(pod)).Replace(template)
+}
+
+/*
+Returns the pods, services, ingresses and quota usage of a namespace of a student.
+*/
+func getPortalNamespace(ctx context.Context, clientset kubernetes.Interface, namespace string) (PortalNamespace, error) {
+	portal := PortalNamespace{Namespace: namespace, Pods: []PortalPod{}, Services: []PortalService{}, Ingresses: []PortalIngress{}}
+
+	quota, err := getQuotaUsage(ctx, clientset, namespace)
+	if err != nil {
+		return PortalNamespace{}, err
+	}
+	portal.Quota = quota
+
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return PortalNamespace{}, err
+	}
+
+	for _, pod := range pods.Items {
+		portalPod := PortalPod{Name: pod.Name, Phase: string(pod.Status.Phase), LogsUrl: getLogsUrl(namespace, pod.Name)}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady {
+				portalPod.Ready = condition.Status == corev1.ConditionTrue
+			}
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			portalPod.Restarts += status.RestartCount
+		}
+
+		portal.Pods = append(portal.Pods, portalPod)
+	}
+
+	services, err := clientset.CoreV1().Services(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return PortalNamespace{}, err
+	}
+
+	for _, service := range services.Items {
+		portalService := PortalService{Name: service.Name, Type: string(service.Spec.Type), ClusterIp: service.Spec.ClusterIP, Ports: []string{}}
+		for _, port := range service.Spec.Ports {
+			if port.NodePort != 0 {
+				portalService.Ports = append(portalService.Ports, fmt.Sprintf("%d:%d/%s", port.Port, port.NodePort, port.Protocol))
+			} else {
+				portalService.Ports = append(portalService.Ports, fmt.Sprintf("%d/%s", port.Port, port.Protocol))
+			}
+		}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.Hostname != "" {
+				portalService.External = append(portalService.External, ingress.Hostname)
+			} else if ingress.IP != "" {
+				portalService.External = append(portalService.External, ingress.IP)
+			}
+		}
+		if service.Spec.Type == corev1.ServiceTypeExternalName {
+			portalService.External = append(portalService.External, service.Spec.ExternalName)
+		}
+
+		portal.Services = append(portal.Services, portalService)
+	}
+
+	ingresses, err := clientset.NetworkingV1().Ingresses(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return PortalNamespace{}, err
+	}
+
+	for _, ingress := range ingresses.Items {
+		tlsHosts := make(map[string]bool)
+		for _, tls := range ingress.Spec.TLS {
+			for _, host := range tls.Hosts {
+				tlsHosts[host] = true
+			}
+		}
+
+		portalIngress := PortalIngress{Name: ingress.Name, Urls: []string{}}
+		for _, rule := range ingress.Spec.Rules {
+			if rule.Host == "" {
+				continue
+			}
+
+			scheme := "http://"
+			if tlsHosts[rule.Host] {
+				scheme = "https://"
+			}
+
+			if rule.HTTP == nil || len(rule.HTTP.Paths) == 0 {
+				portalIngress.Urls = append(portalIngress.Urls, scheme+rule.Host+"/")
+				continue
+			}
+			for _, path := range rule.HTTP.Paths {
+				portalIngress.Urls = append(portalIngress.Urls, scheme+rule.Host+path.Path)
+			}
+		}
+
+		portal.Ingresses = append(portal.Ingresses, portalIngress)
+	}
+
+	return portal, nil
+}
+
+/*
+Returns the namespaces a student has access to: their own namespace and the namespace of their group in hybrid labs.
+*/
+func getStudentNamespaces(student StudentIdentifiers) []string {
+	namespaces := []string{student.Namespace}
+	if student.GroupNamespace != "" {
+		namespaces = append(namespaces, student.GroupNamespace)
+	}
+
+	return namespaces
+}
+
+/*
+Returns the portal of a student of a lab: their identifiers, the instructions and latest announcement of the lab,
+and the objects and quota usage of their namespace (and the namespace of their group in hybrid labs).
+*/
+func getStudentPortal(ctx context.Context, clientset kubernetes.Interface, labName string, labData map[string]string, student StudentIdentifiers) (*StudentPortal, error) {
+	portal := &StudentPortal{Lab: labName, Student: student, Instructions: labData["instructions"], Namespaces: []PortalNamespace{}}
+
+	announcement, err := getAnnouncement(ctx, clientset, student.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	portal.Announcement = announcement
+
+	for _, namespace := range getStudentNamespaces(student) {
+		portalNamespace, err := getPortalNamespace(ctx, clientset, namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		portal.Namespaces = append(portal.Namespaces, portalNamespace)
+	}
+
+	return portal, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+/*
+Returns the key that identifies an object of a lab, independent of the version of its resource.
+*/
+func getObjectKey(groupResource schema.GroupResource, namespace string, name string) string {
+	return groupResource.String() + "/" + namespace + "/" + name
+}
+
+/*
+Returns the keys of every object the manifest of a lab desires in the lab namespace and every student namespace.
+Namespaces in namespaceManifests desire the objects of their own manifest instead, the shared objects still come from the manifest of the lab.
+*/
+func getDesiredObjectKeys(clientset kubernetes.Interface, labName string, manifest string, namespaces []string, namespaceManifests map[string]string) (map[string]bool, error) {
+	desired := make(map[string]bool)
+
+	var labNamespaces []string
+	for _, namespace := range namespaces {
+		if _, ok := namespaceManifests[namespace]; !ok {
+			labNamespaces = append(labNamespaces, namespace)
+		}
+	}
+
+	if err := addDesiredObjectKeys(desired, clientset, labName, manifest, labNamespaces, true); err != nil {
+		return nil, err
+	}
+
+	for namespace, namespaceManifest := range namespaceManifests {
+		if err := addDesiredObjectKeys(desired, clientset, labName, namespaceManifest, []string{namespace}, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return desired, nil
+}
+
+/*
+Adds the keys of the objects a manifest desires in namespaces to desired, and those of its shared objects when withShared is set.
+*/
+func addDesiredObjectKeys(desired map[string]bool, clientset kubernetes.Interface, labName string, manifest string, namespaces []string, withShared bool) error {
+	decoder := yamlutil.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 100)
+	for {
+		unstructuredObj, _, mapping, err := handleManifestHelper(clientset, decoder)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		targetNamespaces := namespaces
+		if isCreatedOnce(unstructuredObj, mapping) {
+			if !withShared {
+				continue
+			}
+			targetNamespaces = []string{getSharedNamespace(unstructuredObj, mapping, labName)}
+		}
+
+		for _, namespace := range targetNamespaces {
+			desired[getObjectKey(mapping.Resource.GroupResource(), namespace, unstructuredObj.GetName())] = true
+		}
+	}
+}
+
+/*
+Deletes every object that was created from an earlier manifest of a lab and is no longer part of manifest, like kubectl apply --prune.
+Only the objects in the inventory of the lab are pruned, the objects ScaLaMa creates itself (ServiceAccounts, Roles, ...) are kept.
+Returns the keys of the pruned objects.
+*/
+func (s *Server) pruneLabObjects(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, labName string, manifest string, inputs *LabRenderInputs, options *LabOptions) ([]string, error) {
+	namespaces, err := s.getLabNamespaces(ctx, clientset, labName)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaceManifests, err := s.renderStoredNamespaceManifests(ctx, inputs, namespaces, options)
+	if err != nil {
+		return nil, err
+	}
+
+	desired, err := getDesiredObjectKeys(clientset, labName, manifest, namespaces, namespaceManifests)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory, err := s.getLabInventory(ctx, clientset, labName)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []string{}
+	var removed []InventoryEntry
+	for _, entries := range inventory {
+		for _, entry := range entries {
+			if desired[entry.key()] {
+				continue
+			}
+
+			err := dynamicInterface.Resource(entry.groupVersionResource()).Namespace(entry.Namespace).Delete(ctx, entry.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return nil, err
+			}
+
+			fmt.Println("Pruned object", entry.Kind, entry.Name, "in namespace", entry.Namespace)
+			pruned = append(pruned, entry.key())
+			removed = append(removed, entry)
+		}
+	}
+
+	if err := updateInventory(ctx, clientset, labName, nil, removed); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(pruned)
+	return pruned, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Statuses of a request for more quota, instructors approve or deny pending requests
+const (
+	quotaRequestPending  = "Pending"
+	quotaRequestApproved = "Approved"
+	quotaRequestDenied   = "Denied"
+)
+
+// A request of a student to raise the hard limits of a ResourceQuota of their namespace
+type QuotaRequest struct {
+	Id        string            `json:"id"`
+	Username  string            `json:"username"`
+	Namespace string            `json:"namespace"`
+	Quota     string            `json:"quota"`
+	Hard      map[string]string `json:"hard"`
+	Reason    string            `json:"reason,omitempty"`
+	Status    string            `json:"status"`
+	Comment   string            `json:"comment,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	DecidedBy string            `json:"decidedBy,omitempty"`
+	DecidedAt *time.Time        `json:"decidedAt,omitempty"`
+}
+
+/*
+Returns the quota requests stored with a lab, oldest first. Returns an empty list if none were stored.
+*/
+func getStoredQuotaRequests(labData map[string]string) ([]QuotaRequest, error) {
+	requests := []QuotaRequest{}
+
+	if value, ok := labData["quotaRequests"]; ok {
+		if err := json.Unmarshal([]byte(value), &requests); err != nil {
+			return nil, err
+		}
+	}
+
+	return requests, nil
+}
+
+/*
+Stores the quota requests of a lab.
+*/
+func (s *Server) saveQuotaRequests(ctx context.Context, labName string, requests []QuotaRequest) error {
+	encoded, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+
+	return s.saveLabData(ctx, labName, map[string]string{"quotaRequests": string(encoded)})
+}
+
+/*
+Returns the ResourceQuota of a namespace a request is for. Without a name the namespace must have exactly one ResourceQuota.
+*/
+func getRequestedQuota(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (*corev1.ResourceQuota, *Error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	quotas, err := clientset.CoreV1().ResourceQuotas(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching the quotas of namespace " + namespace}
+	}
+
+	if name == "" {
+		if len(quotas.Items) != 1 {
+			return nil, &Error{status: http.StatusBadRequest, message: fmt.Sprintf("Namespace %s has %d quotas, the quota parameter is required", namespace, len(quotas.Items))}
+		}
+
+		return &quotas.Items[0], nil
+	}
+
+	for i := range quotas.Items {
+		if quotas.Items[i].Name == name {
+			return &quotas.Items[i], nil
+		}
+	}
+
+	return nil, &Error{status: http.StatusNotFound, message: "Namespace " + namespace + " has no quota " + name}
+}
+
+/*
+Checks that a request only raises resources the quota already limits, students can't add or lower limits.
+*/
+func validateQuotaRequest(quota *corev1.ResourceQuota, hard map[string]string) *Error {
+	if len(hard) == 0 {
+		return &Error{status: http.StatusBadRequest, message: "A quota request needs at least one resource"}
+	}
+
+	// The ceiling of the cluster policy is set by the cluster admins, instructors can't raise it
+	if quota.Name == clusterPolicyQuotaName {
+		return &Error{status: http.StatusForbidden, message: "Quota " + quota.Name + " is the ceiling of the cluster policy and can't be raised"}
+	}
+
+	for name, value := range hard {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return &Error{status: http.StatusBadRequest, message: "The requested value of " + name + " is not a quantity"}
+		}
+
+		current, ok := quota.Spec.Hard[corev1.ResourceName(name)]
+		if !ok {
+			return &Error{status: http.StatusBadRequest, message: "Quota " + quota.Name + " does not limit " + name}
+		}
+
+		if quantity.Cmp(current) <= 0 {
+			return &Error{status: http.StatusBadRequest, message: "The requested value of " + name + " must be higher than " + current.String()}
+		}
+	}
+
+	return nil
+}
+
+/*
+Stores a new pending quota request of a student.
+*/
+func (s *Server) addQuotaRequest(ctx context.Context, labName string, request QuotaRequest) (QuotaRequest, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return QuotaRequest{}, err
+	}
+
+	request.Id = hex.EncodeToString(id)
+	request.Status = quotaRequestPending
+	request.CreatedAt = time.Now()
+
+	s.quotaRequestsLock.Lock()
+	defer s.quotaRequestsLock.Unlock()
+
+	labData, err := s.getLabData(ctx, labName)
+	if err != nil {
+		return QuotaRequest{}, err
+	}
+
+	requests, err := getStoredQuotaRequests(labData)
+	if err != nil {
+		return QuotaRequest{}, err
+	}
+
+	return request, s.saveQuotaRequests(ctx, labName, append(requests, request))
+}
+
+/*
+Raises the hard limits of a ResourceQuota to the values of a request. Limits that were raised further in the meantime are kept.
+*/
+func raiseQuota(ctx context.Context, clientset kubernetes.Interface, request QuotaRequest) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	quota, err := clientset.CoreV1().ResourceQuotas(request.Namespace).Get(ctx, request.Quota, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	hard := make(map[string]string)
+	for name, value := range request.Hard {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return err
+		}
+
+		if current, ok := quota.Spec.Hard[corev1.ResourceName(name)]; !ok || quantity.Cmp(current) > 0 {
+			hard[name] = value
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"hard": hard}})
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.CoreV1().ResourceQuotas(request.Namespace).Patch(ctx, request.Quota, types.MergePatchType, patch, v1.PatchOptions{})
+	return err
+}
+
+/*
+Approves or denies a pending quota request, an approved request raises the quota before the decision is stored.
+*/
+func (s *Server) closeQuotaRequest(ctx context.Context, clientset kubernetes.Interface, labName string, id string, approve bool, comment string, decidedBy string) (QuotaRequest, *Error) {
+	s.quotaRequestsLock.Lock()
+	defer s.quotaRequestsLock.Unlock()
+
+	labData, err := s.getLabData(ctx, labName)
+	if err != nil {
+		return QuotaRequest{}, &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching the lab " + labName}
+	}
+
+	requests, err := getStoredQuotaRequests(labData)
+	if err != nil {
+		return QuotaRequest{}, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the quota requests of lab " + labName}
+	}
+
+	for i := range requests {
+		request := &requests[i]
+		if request.Id != id {
+			continue
+		}
+
+		if request.Status != quotaRequestPending {
+			return QuotaRequest{}, &Error{status: http.StatusConflict, message: "Quota request " + id + " is already " + request.Status}
+		}
+
+		request.Status = quotaRequestDenied
+		if approve {
+			if err := raiseQuota(ctx, clientset, *request); err != nil {
+				return QuotaRequest{}, &Error{status: http.StatusInternalServerError, message: "Something went wrong while raising quota " + request.Quota + " of namespace " + request.Namespace}
+			}
+
+			request.Status = quotaRequestApproved
+		}
+
+		now := time.Now()
+		request.Comment = comment
+		request.DecidedBy = decidedBy
+		request.DecidedAt = &now
+
+		if err := s.saveQuotaRequests(ctx, labName, requests); err != nil {
+			return QuotaRequest{}, &Error{status: http.StatusInternalServerError, message: "Something went wrong while storing the quota requests of lab " + labName}
+		}
+
+		return *request, nil
+	}
+
+	return QuotaRequest{}, &Error{status: http.StatusNotFound, message: "Lab " + labName + " has no quota request " + id}
+}
+
+/*
+Returns the quota requests of a lab with a status, sorted from oldest to newest.
+*/
+func filterQuotaRequests(requests []QuotaRequest, status string) []QuotaRequest {
+	result := []QuotaRequest{}
+	for _, request := range requests {
+		if request.Status == status {
+			result = append(result, request)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+
+	return result
+}
+
+/*
+Authenticates the user that decides on a quota request of a lab. Instructors of the organization of the lab were already checked
+by the organization middleware, outside of organizations only lab approvers can decide. Students of the lab can never decide.
+*/
+func (s *Server) checkQuotaRequestDecider(r *http.Request, labName string) (*authenticationv1.UserInfo, *Error) {
+	user, e := getRequestUser(r, s.clientset)
+	if e != nil {
+		return nil, e
+	}
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching the lab " + labName}
+	}
+
+	identifiers, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the students of lab " + labName}
+	}
+
+	if _, ok := findPortalStudent(identifiers, user.Username); ok {
+		return nil, &Error{status: http.StatusForbidden, message: user.Username + " is a student of lab " + labName + " and can't decide on quota requests"}
+	}
+
+	if getRequestOrganization(r.Context()) != nil {
+		return user, nil
+	}
+
+	approvers, err := getLabApprovers()
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: err.Error()}
+	}
+
+	if !isSubject(user, approvers) {
+		return nil, &Error{status: http.StatusForbidden, message: user.Username + " is not allowed to decide on quota requests"}
+	}
+
+	return user, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const quotaStudent = "system:serviceaccount:ns-lab-ann-lee:ann-lee"
+
+func newQuotaRequestServer(t *testing.T) (*Server, QuotaRequest) {
+	s := newTestServer(t,
+		StudentIdentifiers{Id: "1", Name: "Ann Lee", Username: "ann-lee", Namespace: "ns-lab-ann-lee", ServiceAccount: quotaStudent},
+		StudentIdentifiers{Id: "2", Name: "Bob Ray", Username: "bob-ray", Namespace: "ns-lab-bob-ray", ServiceAccount: "system:serviceaccount:ns-lab-bob-ray:bob-ray"},
+	)
+
+	request, err := s.addQuotaRequest(context.Background(), "lab", QuotaRequest{Username: "ann-lee", Namespace: "ns-lab-ann-lee", Quota: "compute", Hard: map[string]string{"requests.cpu": "4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, request
+}
+
+func decideQuotaRequest(s *Server, token string, id string, decision string) *httptest.ResponseRecorder {
+	r := newTestRequest(http.MethodPost, "/lab/lab/quota-requests/"+id+"/"+decision, token, map[string]string{"labName": "lab", "id": id, "decision": decision})
+
+	w := httptest.NewRecorder()
+	s.decideQuotaRequest(w, r)
+	return w
+}
+
+func TestStudentCannotDecideQuotaRequest(t *testing.T) {
+	t.Setenv("SCALAMA_LAB_APPROVERS", "User:admin")
+	s, request := newQuotaRequestServer(t)
+
+	if w := decideQuotaRequest(s, quotaStudent, request.Id, "approve"); w.Code != http.StatusForbidden {
+		t.Errorf("expected the approval of a student to be rejected with %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	if w := decideQuotaRequest(s, "someone", request.Id, "approve"); w.Code != http.StatusForbidden {
+		t.Errorf("expected the approval of a user that is not an approver to be rejected with %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	w := decideQuotaRequest(s, "admin", request.Id, "deny")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected an approver to decide, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var decided QuotaRequest
+	if err := json.NewDecoder(w.Body).Decode(&decided); err != nil {
+		t.Fatal(err)
+	}
+	if decided.Status != quotaRequestDenied || decided.DecidedBy != "admin" {
+		t.Errorf("expected the request to be denied by admin, got %s by %q", decided.Status, decided.DecidedBy)
+	}
+}
+
+func TestStudentCannotRequestQuotaForOtherNamespace(t *testing.T) {
+	s, _ := newQuotaRequestServer(t)
+
+	r := newTestRequest(http.MethodPost, "/lab/lab/students/bob-ray/quota/requests?resources=requests.cpu=4", quotaStudent, map[string]string{"labName": "lab", "username": "bob-ray"})
+
+	w := httptest.NewRecorder()
+	s.requestQuotaIncrease(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a request for the namespace of another student to be rejected with %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+}
+
+func getStudentQuota(s *Server, token string, username string) *httptest.ResponseRecorder {
+	r := newTestRequest(http.MethodGet, "/lab/lab/students/"+username+"/quota", token, map[string]string{"labName": "lab", "username": username})
+
+	w := httptest.NewRecorder()
+	s.getStudentQuota(w, r)
+	return w
+}
+
+func TestInstructorCanSeeQuotaOfEveryNamespace(t *testing.T) {
+	t.Setenv("SCALAMA_LAB_APPROVERS", "User:admin")
+	s, _ := newQuotaRequestServer(t)
+
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns-lab-bob-ray"}}
+	if _, err := s.clientset.CoreV1().Namespaces().Create(context.Background(), namespace, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := getStudentQuota(s, quotaStudent, "bob-ray"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "can only see the quota of their own namespace") {
+		t.Errorf("expected the quota of another student to be rejected with %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	if w := getStudentQuota(s, "someone", "bob-ray"); w.Code != http.StatusForbidden {
+		t.Errorf("expected the quota for a user that is not an instructor to be rejected with %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	if w := getStudentQuota(s, "admin", "bob-ray"); w.Code != http.StatusOK {
+		t.Errorf("expected an approver to see the quota of a student, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := getStudentQuota(s, "admin", "eve-fox"); w.Code != http.StatusNotFound {
+		t.Errorf("expected the quota of an unknown namespace to be %d, got %d: %s", http.StatusNotFound, w.Code, w.Body.String())
+	}
+}
+
+func TestStudentCannotFetchKubeconfigOfOtherCluster(t *testing.T) {
+	t.Setenv("SCALAMA_LAB_APPROVERS", "User:admin")
+	s, _ := newQuotaRequestServer(t)
+
+	for _, token := range []string{quotaStudent, "someone"} {
+		r := newTestRequest(http.MethodGet, "/lab/lab/clusters/bob-ray/kubeconfig", token, map[string]string{"labName": "lab", "username": "bob-ray"})
+
+		w := httptest.NewRecorder()
+		s.getClusterKubeconfig(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected the kubeconfig of bob-ray to be rejected for %s with %d, got %d: %s", token, http.StatusForbidden, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestQuotaRequestDeciders(t *testing.T) {
+	t.Setenv("SCALAMA_LAB_APPROVERS", "User:admin")
+	s, _ := newQuotaRequestServer(t)
+	organization := &Organization{Name: "cs"}
+
+	tests := map[string]struct {
+		token        string
+		organization *Organization
+		status       int
+	}{
+		"student":                    {quotaStudent, nil, http.StatusForbidden},
+		"student in organization":    {quotaStudent, organization, http.StatusForbidden},
+		"not an approver":            {"someone", nil, http.StatusForbidden},
+		"approver":                   {"admin", nil, http.StatusOK},
+		"instructor of organization": {"someone", organization, http.StatusOK},
+		"no token":                   {"", nil, http.StatusUnauthorized},
+	}
+
+	for name, test := range tests {
+		r := newTestRequest(http.MethodPost, "/lab/lab/quota-requests", test.token, map[string]string{"labName": "lab"})
+		if test.organization != nil {
+			r = r.WithContext(context.WithValue(r.Context(), organizationKey{}, test.organization))
+		}
+
+		status := http.StatusOK
+		if _, e := s.checkQuotaRequestDecider(r, "lab"); e != nil {
+			status = e.status
+		}
+		if status != test.status {
+			t.Errorf("%s: expected %d, got %d", name, test.status, status)
+		}
+	}
+}
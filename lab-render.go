@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// The files a NamespaceRenderer renders a manifest with and their content types, the first one is used to pass them again
+var renderFormFiles = map[string][]string{
+	"config": {"application/gzip", "application/octet-stream"},
+	"values": {"text/yaml", "application/x-yaml"},
+}
+
+// The inputs the manifest of a lab was rendered with by a NamespaceRenderer, stored so the manifest of every student namespace
+// can be rendered again to compare it with (or restore) the live objects. Labs of other deployment modes store no inputs.
+type LabRenderInputs struct {
+	DeploymentMode string            `json:"deploymentMode"`
+	Values         map[string]string `json:"values,omitempty"`
+	Files          map[string][]byte `json:"files,omitempty"`
+
+	// The .Values.student of every student namespace, group namespaces get the manifest of the lab
+	NamespaceValues map[string]map[string]interface{} `json:"namespaceValues,omitempty"`
+}
+
+/*
+Returns the inputs the backend of the deploymentMode of the parameters renders the manifest of a request with.
+Returns nil for backends that render once.
+*/
+func (s *Server) getRenderInputs(r *http.Request, parameters *ManifestParameters) (*LabRenderInputs, *Error) {
+	if _, ok := deploymentBackends[parameters.DeploymentMode].(NamespaceRenderer); !ok {
+		return nil, nil
+	}
+
+	inputs := &LabRenderInputs{DeploymentMode: parameters.DeploymentMode, Values: map[string]string{}, Files: map[string][]byte{}, NamespaceValues: map[string]map[string]interface{}{}}
+
+	// The form values a NamespaceRenderer renders a manifest with
+	values := map[string]string{"config": parameters.Config, "chart": parameters.Chart, "chartVersion": parameters.ChartVersion, "valuesProfile": parameters.ValuesProfile}
+	for name, value := range values {
+		if value != "" {
+			inputs.Values[name] = value
+		}
+	}
+
+	for name, contentTypes := range renderFormFiles {
+		// Values such as the URL of a chart are not files
+		if _, _, err := r.FormFile(name); err != nil && r.FormValue(name+"Digest") == "" {
+			continue
+		}
+
+		file, e := s.getFormFile(r, name, contentTypes...)
+		if e != nil {
+			return nil, e
+		}
+
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading file " + name}
+		}
+		inputs.Files[name] = data
+
+		// The file replaces the value of the same name, e.g. the archive of a chart
+		delete(inputs.Values, name)
+	}
+
+	return inputs, nil
+}
+
+/*
+Returns the render inputs stored with a lab. Returns nil if none were stored.
+*/
+func getStoredRenderInputs(labData map[string]string) (*LabRenderInputs, error) {
+	// Labs that are updated to a deployment mode that renders once keep an empty value
+	value := labData["renderInputs"]
+	if value == "" {
+		return nil, nil
+	}
+
+	inputs := &LabRenderInputs{}
+	if err := json.Unmarshal([]byte(value), inputs); err != nil {
+		return nil, err
+	}
+
+	if inputs.NamespaceValues == nil {
+		inputs.NamespaceValues = map[string]map[string]interface{}{}
+	}
+
+	return inputs, nil
+}
+
+/*
+Encodes render inputs to the form in which they are stored with a lab.
+*/
+func encodeRenderInputs(inputs *LabRenderInputs) (string, error) {
+	value, err := json.Marshal(inputs)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+/*
+Returns a request with the form the inputs were rendered from, so a NamespaceRenderer can render them again.
+*/
+func (inputs *LabRenderInputs) newRequest(ctx context.Context) (*http.Request, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	if err := writer.WriteField("deploymentMode", inputs.DeploymentMode); err != nil {
+		return nil, err
+	}
+
+	for name, value := range inputs.Values {
+		if err := writer.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, data := range inputs.Files {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="`+name+`"; filename="`+name+`"`)
+		header.Set("Content-Type", renderFormFiles[name][0])
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	if err := r.ParseMultipartForm(int64(body.Len()) + 1<<20); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+/*
+Renders the manifest of a student namespace with the values of its students, and prepares it like the manifest of the lab.
+*/
+func (s *Server) renderNamespaceManifest(r *http.Request, renderer NamespaceRenderer, namespace string, values map[string]interface{}, options *LabOptions) (string, *Error) {
+	var parameters ManifestParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		return "", e
+	}
+
+	manifest, e := renderer.getNamespaceManifest(s, r, &parameters, map[string]interface{}{"student": values})
+	if e != nil {
+		return "", e
+	}
+
+	// The values of the students can make a chart render many more objects than the manifest of the lab
+	if e := checkManifestLimits(manifest); e != nil {
+		return "", &Error{status: e.status, message: e.message + " in namespace " + namespace}
+	}
+
+	return s.prepareManifest(manifest, options)
+}
+
+/*
+Renders the manifest of every namespace that was rendered for its students again from the stored inputs.
+Namespaces that are not in the result get the manifest of the lab.
+*/
+func (s *Server) renderStoredNamespaceManifests(ctx context.Context, inputs *LabRenderInputs, namespaces []string, options *LabOptions) (map[string]string, error) {
+	manifests := map[string]string{}
+	if inputs == nil {
+		return manifests, nil
+	}
+
+	renderer, ok := deploymentBackends[inputs.DeploymentMode].(NamespaceRenderer)
+	if !ok {
+		return manifests, nil
+	}
+
+	r, err := inputs.newRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, namespace := range namespaces {
+		values, ok := inputs.NamespaceValues[namespace]
+		if !ok {
+			continue
+		}
+
+		manifest, e := s.renderNamespaceManifest(r, renderer, namespace, values, options)
+		if e != nil {
+			return nil, errors.New(e.message)
+		}
+		manifests[namespace] = manifest
+	}
+
+	return manifests, nil
+}
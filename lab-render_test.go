@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderStoredNamespaceManifests(t *testing.T) {
+	presetDir := t.TempDir()
+	t.Setenv("SCALAMA_PRESET_DIR", presetDir)
+
+	chartDir := filepath.Join(presetDir, "greeting")
+	files := map[string]string{
+		"Chart.yaml":               "apiVersion: v2\nname: greeting\nversion: 0.1.0\n",
+		"values.yaml":              "greeting: hello\n",
+		"templates/configmap.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: greeting\ndata:\n  greeting: \"{{ .Values.greeting }} {{ .Values.student.name }}\"\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(chartDir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(chartDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newServer(getFakeClientSet())
+	inputs := &LabRenderInputs{
+		DeploymentMode:  "PRESET",
+		Values:          map[string]string{"config": "greeting"},
+		Files:           map[string][]byte{"values": []byte("greeting: hi\n")},
+		NamespaceValues: map[string]map[string]interface{}{"ns-lab-ann-lee": {"name": "Ann Lee"}},
+	}
+
+	// The inputs are stored and read again like the other data of a lab
+	encodedInputs, err := encodeRenderInputs(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedInputs, err := getStoredRenderInputs(map[string]string{"renderInputs": encodedInputs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, err := s.renderStoredNamespaceManifests(context.Background(), storedInputs, []string{"ns-lab-ann-lee", "ns-lab-group-1"}, &LabOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := manifests["ns-lab-group-1"]; ok {
+		t.Errorf("expected ns-lab-group-1 to get the manifest of the lab, got its own render")
+	}
+	if !strings.Contains(manifests["ns-lab-ann-lee"], "hi Ann Lee") {
+		t.Errorf("expected ns-lab-ann-lee to be rendered with the uploaded values and its student, got %q", manifests["ns-lab-ann-lee"])
+	}
+}
+
+func TestRenderStoredNamespaceManifestsWithoutInputs(t *testing.T) {
+	s := newServer(getFakeClientSet())
+
+	manifests, err := s.renderStoredNamespaceManifests(context.Background(), nil, []string{"ns-lab-ann-lee"}, &LabOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 0 {
+		t.Errorf("expected no namespace renders without inputs, got %v", manifests)
+	}
+}
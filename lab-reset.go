@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Resources that Kubernetes maintains itself, they are never reset
+var systemResources = map[schema.GroupResource]bool{
+	{Resource: "events"}:                                    true,
+	{Group: "events.k8s.io", Resource: "events"}:            true,
+	{Resource: "endpoints"}:                                 true,
+	{Group: "discovery.k8s.io", Resource: "endpointslices"}: true,
+}
+
+/*
+Returns the field manager the API server records for the objects ScaLaMa creates without a field manager, the name of its user agent.
+*/
+func getDefaultFieldManager() string {
+	return strings.Split(rest.DefaultKubernetesUserAgent(), "/")[0]
+}
+
+/*
+Returns the namespaced resources that can be listed and deleted, once per resource even if it is served in multiple versions.
+*/
+func getDeletableNamespacedResources(clientset kubernetes.Interface) ([]schema.GroupVersionResource, error) {
+	_, resourceLists, err := clientset.Discovery().ServerGroupsAndResources()
+	if err != nil && len(resourceLists) == 0 {
+		return nil, err
+	}
+
+	visited := make(map[schema.GroupResource]bool)
+	var resources []schema.GroupVersionResource
+	for _, resourceList := range resourceLists {
+		groupVersion, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			continue
+		}
+
+		for _, resource := range resourceList.APIResources {
+			// Subresources (pods/log) are not objects of their own
+			if !resource.Namespaced || strings.Contains(resource.Name, "/") || !contains(resource.Verbs, "list") || !contains(resource.Verbs, "delete") {
+				continue
+			}
+
+			gvr := groupVersion.WithResource(resource.Name)
+			if visited[gvr.GroupResource()] || systemResources[gvr.GroupResource()] {
+				continue
+			}
+			visited[gvr.GroupResource()] = true
+
+			resources = append(resources, gvr)
+		}
+	}
+
+	return resources, nil
+}
+
+/*
+Checks whether an object of a namespace was created by a student, and not by ScaLaMa or Kubernetes.
+Objects of the inventory or labeled as managed by ScaLaMa are not, neither are objects that one of the field managers of ScaLaMa wrote.
+Objects without field managers can't be attributed, so they are kept as well.
+*/
+func isStudentObject(obj *unstructured.Unstructured, groupResource schema.GroupResource, inventory map[string]bool) bool {
+	if inventory[getObjectKey(groupResource, obj.GetNamespace(), obj.GetName())] || obj.GetLabels()[managedByLabel] == managedByLabelVal {
+		return false
+	}
+
+	// Owned objects (e.g. the pods of a Deployment) are deleted together with their owner
+	if len(obj.GetOwnerReferences()) > 0 {
+		return false
+	}
+
+	// Objects Kubernetes creates in every namespace
+	if (groupResource.Resource == "serviceaccounts" && obj.GetName() == "default") || (groupResource.Resource == "configmaps" && obj.GetName() == "kube-root-ca.crt") {
+		return false
+	}
+	if secretType, _, _ := unstructured.NestedString(obj.Object, "type"); groupResource.Resource == "secrets" && secretType == string(corev1.SecretTypeServiceAccountToken) {
+		return false
+	}
+
+	managedFields := obj.GetManagedFields()
+	if len(managedFields) == 0 {
+		return false
+	}
+
+	defaultFieldManager := getDefaultFieldManager()
+	for _, managedField := range managedFields {
+		if managedField.Manager == fieldManager || managedField.Manager == defaultFieldManager {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+Resets a namespace of a lab by deleting the objects the students created in it.
+The objects of the manifest and the objects ScaLaMa created (ServiceAccounts, Roles, bastions, ...) are kept, unlike deleting the whole namespace.
+Returns the keys of the deleted objects.
+*/
+func resetNamespace(ctx context.Context, clientset kubernetes.Interface, dynamicInterface dynamic.Interface, namespace string) ([]string, error) {
+	resources, err := getDeletableNamespacedResources(clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := getNamespaceInventory(ctx, clientset, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := make(map[string]bool)
+	for _, entry := range entries {
+		inventory[entry.key()] = true
+	}
+
+	deleted := []string{}
+	for _, gvr := range resources {
+		list, err := dynamicInterface.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			// Some resources can be discovered but not listed (e.g. aggregated APIs that are down)
+			if errors.IsNotFound(err) || errors.IsMethodNotSupported(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		for i := range list.Items {
+			obj := &list.Items[i]
+			if !isStudentObject(obj, gvr.GroupResource(), inventory) {
+				continue
+			}
+
+			err := dynamicInterface.Resource(gvr).Namespace(namespace).Delete(ctx, obj.GetName(), metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return nil, err
+			}
+
+			fmt.Println("Reset object", obj.GetKind(), obj.GetName(), "in namespace", namespace)
+			deleted = append(deleted, getObjectKey(gvr.GroupResource(), namespace, obj.GetName()))
+		}
+	}
+
+	sort.Strings(deleted)
+	return deleted, nil
+}
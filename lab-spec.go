@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"sigs.k8s.io/yaml"
+)
+
+// The JSON schema of a lab spec, every option of getLabOptions is a property of options
+const labSpecSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "ScaLaMa lab spec",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "name": {"type": "string", "pattern": "^[a-z0-9]+$"},
+    "grouping": {"type": "string", "enum": ["individual", "group", "hybrid"]},
+    "roster": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "source": {"type": "string", "enum": ["CSV", "XLSX", "JSON", "CANVAS", "BRIGHTSPACE", "LDAP"]},
+        "name": {"type": "string"},
+        "groupCategory": {"type": "string"}
+      }
+    },
+    "deployment": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["mode"],
+      "properties": {
+        "mode": {"type": "string", "enum": ["YAML", "CHART", "CHART_URL", "KUSTOMIZE", "PRESET"]},
+        "source": {"type": "string"},
+        "chart": {"type": "string"},
+        "chartVersion": {"type": "string"},
+        "manifest": {"type": ["string", "array"], "items": {"type": "object"}},
+        "values": {"type": "object"},
+        "valuesProfile": {"type": "string"}
+      }
+    },
+    "instructions": {"type": "string"},
+    "priority": {"type": "string", "enum": ["exam", "normal", "low"]},
+    "roles": {"type": "object"},
+    "sharedRules": {"type": "array", "items": {"type": "object"}},
+    "scheduledTasks": {"type": "array", "items": {"type": "object"}},
+    "options": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "gpuCount": {"type": "integer", "minimum": 0},
+        "gpuNodeSelector": {"type": "string"},
+        "gpuTimeSlicing": {"type": "integer", "minimum": 0},
+        "spot": {"type": "boolean"},
+        "spotNodeSelector": {"type": "string"},
+        "architecture": {"type": "string", "enum": ["amd64", "arm64"]},
+        "ssh": {"type": "boolean"},
+        "sshServiceType": {"type": "string", "enum": ["NodePort", "LoadBalancer"]},
+        "dashboard": {"type": "boolean"},
+        "dashboardServiceType": {"type": "string", "enum": ["NodePort", "LoadBalancer"]},
+        "rancherProject": {"type": "boolean"},
+        "rancherProjectOwners": {"type": ["string", "array"], "items": {"type": "string"}},
+        "identityProvider": {"type": "string", "enum": ["eks", "gke", "aks"]},
+        "clusterClass": {"type": "string"},
+        "clusterVersion": {"type": "string"},
+        "clusterWorkers": {"type": "integer", "minimum": 1},
+        "sharedServiceAliases": {"type": "boolean"},
+        "ingressDomain": {"type": "string"},
+        "externalDns": {"type": "boolean"},
+        "namespaceVisibility": {"type": "string", "enum": ["cluster", "lab"]},
+        "labClusterRole": {"type": "boolean"},
+        "tokenTtl": {"type": "string"},
+        "tokenAudiences": {"type": ["string", "array"], "items": {"type": "string"}},
+        "conflictStrategy": {"type": "string", "enum": ["fail", "skip", "patch"]},
+        "sharedOnly": {"type": "boolean"},
+        "sharedResources": {"type": ["string", "array"], "items": {"type": "string"}},
+        "egressIdentity": {"type": "boolean"},
+        "egressLabels": {"type": ["string", "array"], "items": {"type": "string"}},
+        "logOutputs": {"type": ["string", "array"], "items": {"type": "string"}},
+        "accessWindows": {"type": ["string", "array"], "items": {"type": "string"}},
+        "accessTimezone": {"type": "string"},
+        "closedAccess": {"type": "string", "enum": ["read-only", "none"]},
+        "maxPods": {"type": "integer", "minimum": 0},
+        "maxPodRuntime": {"type": "string"},
+        "allowedRegistries": {"type": ["string", "array"], "items": {"type": "string"}},
+        "retentionDays": {"type": "integer", "minimum": 0},
+        "withholdUntilReady": {"type": "boolean"},
+        "preDeleteWebhook": {"type": "string"}
+      }
+    }
+  }
+}`
+
+// An example of a lab spec, served by GET /lab-spec/example
+const labSpecExample = `# Uploaded as the spec file of POST /lab, together with the students file
+name: databases
+grouping: individual
+deployment:
+  mode: YAML
+  manifest:
+  - apiVersion: apps/v1
+    kind: Deployment
+    metadata:
+      name: db
+    spec:
+      selector:
+        matchLabels: {app: db}
+      template:
+        metadata:
+          labels: {app: db}
+        spec:
+          containers:
+          - name: db
+            image: postgres:16
+instructions: Connect to the database with psql -h db
+roles:
+  reviewer:
+  - apiGroups: [""]
+    resources: ["pods", "pods/log"]
+    verbs: ["get", "list"]
+options:
+  maxPods: 5
+  tokenTtl: 8h
+  ingressDomain: labs.example.com
+  accessWindows:
+  - mon-fri 08:00-22:00
+  retentionDays: 30
+`
+
+// Options that are lists in a spec are joined with a comma, except these options
+var labSpecListSeparators = map[string]string{"accessWindows": ";"}
+
+// A lab spec: everything that is otherwise sent as separate form fields and files of POST /lab
+type LabSpec struct {
+	Name     string `json:"name"`
+	Grouping string `json:"grouping"`
+	Roster   struct {
+		Source        string `json:"source"`
+		Name          string `json:"name"`
+		GroupCategory string `json:"groupCategory"`
+	} `json:"roster"`
+	Deployment struct {
+		Mode          string                 `json:"mode"`
+		Source        string                 `json:"source"`
+		Chart         string                 `json:"chart"`
+		ChartVersion  string                 `json:"chartVersion"`
+		Manifest      interface{}            `json:"manifest"`
+		Values        map[string]interface{} `json:"values"`
+		ValuesProfile string                 `json:"valuesProfile"`
+	} `json:"deployment"`
+	Instructions   string                 `json:"instructions"`
+	Priority       string                 `json:"priority"`
+	Roles          interface{}            `json:"roles"`
+	SharedRules    interface{}            `json:"sharedRules"`
+	ScheduledTasks interface{}            `json:"scheduledTasks"`
+	Options        map[string]interface{} `json:"options"`
+}
+
+/*
+Parses a lab spec and validates it against labSpecSchema.
+*/
+func parseLabSpec(data []byte) (*LabSpec, *Error) {
+	specJson, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "Something went wrong while parsing the spec: " + err.Error()}
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(specJson, &values); err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "The spec must be a YAML object"}
+	}
+
+	if err := chartutil.ValidateAgainstSingleSchema(values, []byte(labSpecSchema)); err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "The spec doesn't match the schema of GET /lab-spec/schema:\n" + strings.TrimSpace(err.Error())}
+	}
+
+	spec := &LabSpec{}
+	if err := json.Unmarshal(specJson, spec); err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "Something went wrong while parsing the spec: " + err.Error()}
+	}
+
+	return spec, nil
+}
+
+/*
+Converts a value of a spec to a form value, lists are joined with separator.
+*/
+func getSpecFormValue(value interface{}, separator string) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = getSpecFormValue(item, separator)
+		}
+		return strings.Join(items, separator)
+	}
+
+	return fmt.Sprint(value)
+}
+
+/*
+Returns the form values and the files (as YAML) a spec stands for.
+*/
+func getSpecForm(spec *LabSpec) (map[string]string, map[string][]byte, error) {
+	values := map[string]string{
+		"labName":        spec.Name,
+		"deploymentMode": spec.Deployment.Mode,
+		"valuesProfile":  spec.Deployment.ValuesProfile,
+		"rosterSource":   spec.Roster.Source,
+		"roster":         spec.Roster.Name,
+		"groupCategory":  spec.Roster.GroupCategory,
+		"instructions":   spec.Instructions,
+		"priority":       spec.Priority,
+	}
+
+	switch spec.Grouping {
+	case "individual":
+		values["isIndividual"] = "true"
+	case "group":
+		values["isIndividual"] = "false"
+	case "hybrid":
+		values["isHybrid"] = "true"
+	}
+
+	// The source of charts located by their URL and of presets is a string, uploaded charts and kustomizations are sent as config
+	if spec.Deployment.Source != "" {
+		values["config"] = spec.Deployment.Source
+	}
+	if spec.Deployment.Chart != "" {
+		values["chart"] = spec.Deployment.Chart
+	}
+	if spec.Deployment.ChartVersion != "" {
+		values["chartVersion"] = spec.Deployment.ChartVersion
+	}
+
+	for name, value := range spec.Options {
+		separator, ok := labSpecListSeparators[name]
+		if !ok {
+			separator = ","
+		}
+		values[name] = getSpecFormValue(value, separator)
+	}
+
+	files := map[string][]byte{}
+
+	// The manifest is a YAML string, or a list of objects
+	switch manifest := spec.Deployment.Manifest.(type) {
+	case string:
+		files["config"] = []byte(manifest)
+	case []interface{}:
+		var documents []string
+		for _, object := range manifest {
+			document, err := yaml.Marshal(object)
+			if err != nil {
+				return nil, nil, err
+			}
+			documents = append(documents, string(document))
+		}
+		files["config"] = []byte(strings.Join(documents, "---\n"))
+	}
+
+	fileValues := map[string]interface{}{"roles": spec.Roles, "sharedRules": spec.SharedRules, "scheduledTasks": spec.ScheduledTasks}
+	if len(spec.Deployment.Values) > 0 {
+		fileValues["values"] = spec.Deployment.Values
+	}
+
+	for name, value := range fileValues {
+		if value == nil {
+			continue
+		}
+
+		file, err := yaml.Marshal(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		files[name] = file
+	}
+
+	return values, files, nil
+}
+
+/*
+Returns form files with the content of files, as if they were uploaded as YAML files.
+*/
+func newFormFiles(files map[string][]byte) (map[string][]*multipart.FileHeader, error) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, name := range names {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="`+name+`"; filename="`+name+`.yaml"`)
+		header.Set("Content-Type", "text/yaml")
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(int64(body.Len()) + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return form.File, nil
+}
+
+/*
+Fills in the form of a request with the lab spec uploaded as spec, an alternative to sending every setting as a separate form field.
+Form fields and files that are sent next to the spec override the spec, e.g. to reuse a spec for another lab name.
+Requests without a spec (that may not even be multipart) are left as is.
+*/
+func (s *Server) applyLabSpec(r *http.Request) *Error {
+	if _, _, err := r.FormFile("spec"); err != nil && r.FormValue("specDigest") == "" {
+		return nil
+	}
+
+	// A spec sent by its digest may come with a urlencoded form or only a query, without multipart form for the files of the spec
+	if r.MultipartForm == nil {
+		r.MultipartForm = &multipart.Form{Value: map[string][]string{}, File: map[string][]*multipart.FileHeader{}}
+	}
+
+	specFile, e := s.getFormFile(r, "spec", "text/yaml", "application/x-yaml")
+	if e != nil {
+		return e
+	}
+
+	data, err := io.ReadAll(specFile)
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading file spec"}
+	}
+
+	spec, e := parseLabSpec(data)
+	if e != nil {
+		return e
+	}
+
+	values, files, err := getSpecForm(spec)
+	if err != nil {
+		return &Error{status: http.StatusBadRequest, message: "Something went wrong while converting the spec"}
+	}
+
+	for name, value := range values {
+		if value != "" && r.Form.Get(name) == "" {
+			r.Form.Set(name, value)
+		}
+	}
+
+	formFiles, err := newFormFiles(files)
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while converting the spec"}
+	}
+
+	for name, fileHeaders := range formFiles {
+		if !hasFormFile(r, name) {
+			r.MultipartForm.File[name] = fileHeaders
+		}
+	}
+
+	return nil
+}
+
+/*
+Applies the lab spec of a request (see applyLabSpec) before the next handler.
+*/
+func (s *Server) labSpecMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e := s.applyLabSpec(r); e != nil {
+			http.Error(w, e.message, e.status)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+Returns the JSON schema of a lab spec.
+*/
+func getLabSpecSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	io.WriteString(w, labSpecSchema)
+}
+
+/*
+Returns an example of a lab spec.
+*/
+func getLabSpecExample(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/yaml")
+	io.WriteString(w, labSpecExample)
+}
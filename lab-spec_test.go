@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An object store in memory, for the handlers that reuse uploads by their digest
+type memoryObjectStore map[string][]byte
+
+func (store memoryObjectStore) putObject(ctx context.Context, key string, data []byte, contentType string) error {
+	store[key] = data
+	return nil
+}
+
+func (store memoryObjectStore) getObject(ctx context.Context, key string) ([]byte, time.Time, error) {
+	data, ok := store[key]
+	if !ok {
+		return nil, time.Time{}, errObjectNotFound
+	}
+
+	return data, time.Time{}, nil
+}
+
+func (store memoryObjectStore) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for key := range store {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (store memoryObjectStore) deleteObject(ctx context.Context, key string) error {
+	delete(store, key)
+	return nil
+}
+
+func TestApplyLabSpecByDigestWithoutMultipartForm(t *testing.T) {
+	s := newTestServer(t)
+	s.objectStore = memoryObjectStore{getUploadKey("spec"): []byte(labSpecExample)}
+
+	requests := map[string]*http.Request{
+		"urlencoded": httptest.NewRequest(http.MethodPost, "/lab", strings.NewReader(url.Values{"specDigest": {"spec"}}.Encode())),
+		"query":      httptest.NewRequest(http.MethodPost, "/lab?specDigest=spec", nil),
+	}
+	requests["urlencoded"].Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	for name, r := range requests {
+		if e := s.applyLabSpec(r); e != nil {
+			t.Fatalf("%s: expected the spec to be applied, got %d: %s", name, e.status, e.message)
+		}
+
+		if labName := r.FormValue("labName"); labName != "databases" {
+			t.Errorf("%s: expected labName databases from the spec, got %q", name, labName)
+		}
+		if !hasFormFile(r, "config") {
+			t.Errorf("%s: expected the manifest of the spec as file config", name)
+		}
+	}
+}
+
+func TestApplyLabSpecRejectsDigestWithoutObjectStore(t *testing.T) {
+	s := newTestServer(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/lab?specDigest=spec", nil)
+	if e := s.applyLabSpec(r); e == nil || e.status != http.StatusBadRequest {
+		t.Errorf("expected a spec digest without object store to be rejected with %d, got %v", http.StatusBadRequest, e)
+	}
+}
+
+/*
+Returns a multipart request that uploads spec with contentType, next to the form fields of values.
+*/
+func newSpecRequest(t *testing.T, spec string, contentType string, values url.Values) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name := range values {
+		if err := writer.WriteField(name, values.Get(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="spec"; filename="lab.yaml"`)
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(spec))
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/lab", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestApplyLabSpec(t *testing.T) {
+	s := newTestServer(t)
+
+	r := newSpecRequest(t, labSpecExample, "text/yaml", url.Values{"labName": {"networks"}})
+	if e := s.applyLabSpec(r); e != nil {
+		t.Fatalf("expected the spec to be applied, got %d: %s", e.status, e.message)
+	}
+
+	// Form fields sent next to the spec override it
+	if labName := r.FormValue("labName"); labName != "networks" {
+		t.Errorf("expected the labName of the form to override the spec, got %q", labName)
+	}
+	if mode, isIndividual := r.FormValue("deploymentMode"), r.FormValue("isIndividual"); mode != "YAML" || isIndividual != "true" {
+		t.Errorf("expected the deployment and grouping of the spec, got %q and %q", mode, isIndividual)
+	}
+	if !hasFormFile(r, "config") {
+		t.Error("expected the manifest of the spec as file config")
+	}
+}
+
+func TestApplyLabSpecRejectsInvalidSpecs(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := map[string]struct {
+		spec        string
+		contentType string
+		status      int
+	}{
+		"not YAML":         {"name: [", "text/yaml", http.StatusBadRequest},
+		"schema":           {"name: db\ngrouping: pairs\ndeployment: {mode: YAML}\n", "text/yaml", http.StatusBadRequest},
+		"unsupported type": {labSpecExample, "application/json", http.StatusUnsupportedMediaType},
+	}
+
+	for name, test := range tests {
+		e := s.applyLabSpec(newSpecRequest(t, test.spec, test.contentType, nil))
+		if e == nil || e.status != test.status {
+			t.Errorf("%s: expected %d, got %+v", name, test.status, e)
+		}
+	}
+}
+
+func TestApplyLabSpecWithoutSpec(t *testing.T) {
+	s := newTestServer(t)
+
+	r := newFormRequest(url.Values{"labName": {"db"}})
+	if e := s.applyLabSpec(r); e != nil {
+		t.Fatalf("expected a request without spec to be left as is, got %d: %s", e.status, e.message)
+	}
+	if r.MultipartForm != nil || r.FormValue("labName") != "db" {
+		t.Errorf("expected the form of the request to be unchanged, got %v", r.Form)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Name of the ConfigMap in the lab namespace that holds the state of the lab
+const labConfigMapName = "scalama-lab"
+
+// Persists the state of labs (manifest, options, students, ...) as key-value pairs per lab
+type LabStore interface {
+	get(ctx context.Context, labName string) (map[string]string, error)
+	save(ctx context.Context, labName string, data map[string]string) error
+	delete(ctx context.Context, labName string) error
+}
+
+// Every SCALAMA_STORE and how it opens its store from SCALAMA_STORE_DSN, new stores only have to be added here.
+// The ConfigMap store is the default and needs no configuration
+var labStores = map[string]func(dsn string) (LabStore, error){
+	"sqlite": func(dsn string) (LabStore, error) {
+		return newSqlLabStore("sqlite3", dsn)
+	},
+	"postgres": func(dsn string) (LabStore, error) {
+		return newSqlLabStore("postgres", dsn)
+	},
+}
+
+/*
+Opens the store configured by SCALAMA_STORE (["configmap", "sqlite", "postgres"], default configmap).
+Returns nil for the ConfigMap store, which uses the clientset of the request.
+*/
+func openLabStore() (LabStore, error) {
+	name := os.Getenv("SCALAMA_STORE")
+	if name == "" || name == "configmap" {
+		return nil, nil
+	}
+
+	open, ok := labStores[name]
+	if !ok {
+		return nil, fmt.Errorf("SCALAMA_STORE %s is not supported", name)
+	}
+
+	return open(os.Getenv("SCALAMA_STORE_DSN"))
+}
+
+/*
+Returns the store of the state of labs.
+*/
+func (s *Server) getLabStore() LabStore {
+	if s.labStore != nil {
+		return s.labStore
+	}
+
+	return configMapLabStore{clientset: s.clientset}
+}
+
+/*
+Returns the data stored for a lab. Returns an empty map if nothing has been stored yet.
+*/
+func (s *Server) getLabData(ctx context.Context, labName string) (map[string]string, error) {
+	return s.getLabStore().get(ctx, labName)
+}
+
+/*
+Stores key-value pairs for a lab. Existing keys are overwritten, other keys are kept.
+*/
+func (s *Server) saveLabData(ctx context.Context, labName string, data map[string]string) error {
+	return s.getLabStore().save(ctx, labName, data)
+}
+
+/*
+Deletes the data stored for a lab, labs without data are skipped.
+*/
+func (s *Server) deleteLabData(ctx context.Context, labName string) error {
+	return s.getLabStore().delete(ctx, labName)
+}
+
+// Stores the state of a lab in a ConfigMap of the lab namespace, so it is deleted together with the lab.
+// The state is always read and written by ScaLaMa itself, not by the impersonated user of the request
+type configMapLabStore struct {
+	clientset kubernetes.Interface
+}
+
+func (store configMapLabStore) get(ctx context.Context, labName string) (map[string]string, error) {
+	ctx, cancel := withOperationTimeout(withoutImpersonation(ctx))
+	defer cancel()
+
+	configMap, err := store.clientset.CoreV1().ConfigMaps("ns-"+labName).Get(ctx, labConfigMapName, v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return map[string]string{}, nil
+		}
+
+		return nil, err
+	}
+
+	if configMap.Data == nil {
+		return map[string]string{}, nil
+	}
+
+	return configMap.Data, nil
+}
+
+func (store configMapLabStore) save(ctx context.Context, labName string, data map[string]string) error {
+	ctx, cancel := withOperationTimeout(withoutImpersonation(ctx))
+	defer cancel()
+
+	configMaps := store.clientset.CoreV1().ConfigMaps("ns-" + labName)
+
+	configMap, err := configMaps.Get(ctx, labConfigMapName, v1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		configMap = &corev1.ConfigMap{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      labConfigMapName,
+				Namespace: "ns-" + labName,
+			},
+			Data: data,
+		}
+
+		_, err = configMaps.Create(ctx, configMap, v1.CreateOptions{})
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	for key, value := range data {
+		configMap.Data[key] = value
+	}
+
+	_, err = configMaps.Update(ctx, configMap, v1.UpdateOptions{})
+	return err
+}
+
+func (store configMapLabStore) delete(ctx context.Context, labName string) error {
+	ctx, cancel := withOperationTimeout(withoutImpersonation(ctx))
+	defer cancel()
+
+	err := store.clientset.CoreV1().ConfigMaps("ns-"+labName).Delete(ctx, labConfigMapName, v1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Stores the state of every lab in a table of an SQL database (SQLite for small installs, Postgres for big ones)
+type sqlLabStore struct {
+	db *sql.DB
+}
+
+/*
+Opens an SQL store with a database/sql driver, and creates its table if it doesn't exist yet.
+*/
+func newSqlLabStore(driver string, dsn string) (LabStore, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("SCALAMA_STORE_DSN is required for the %s store", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS lab_data (
+		lab_name TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (lab_name, key)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return sqlLabStore{db: db}, nil
+}
+
+func (store sqlLabStore) get(ctx context.Context, labName string) (map[string]string, error) {
+	rows, err := store.db.QueryContext(ctx, "SELECT key, value FROM lab_data WHERE lab_name = $1", labName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+
+		data[key] = value
+	}
+
+	return data, rows.Err()
+}
+
+func (store sqlLabStore) save(ctx context.Context, labName string, data map[string]string) error {
+	// The keys of a lab are saved together or not at all
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for key, value := range data {
+		_, err := tx.ExecContext(ctx, `INSERT INTO lab_data (lab_name, key, value) VALUES ($1, $2, $3)
+			ON CONFLICT (lab_name, key) DO UPDATE SET value = excluded.value`, labName, key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store sqlLabStore) delete(ctx context.Context, labName string) error {
+	_, err := store.db.ExecContext(ctx, "DELETE FROM lab_data WHERE lab_name = $1", labName)
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// The identifiers ScaLaMa generated for a student, so external systems (VPN, LDAP sync, ingress auth) can use the same names
+type StudentIdentifiers struct {
+	Id             string `json:"id"`
+	Name           string `json:"name"`
+	Username       string `json:"username"`
+	Namespace      string `json:"namespace"`
+	GroupNamespace string `json:"groupNamespace,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	Identity       string `json:"identity,omitempty"`
+}
+
+/*
+Converts the name of a student to a DNS-safe username: "José O'Neil" => jose-o-neil.
+Names that are already DNS-safe ("First Last" => first-last) keep the username they always had.
+The username is shortened so the namespace of the student in labName is a valid DNS label.
+*/
+func getUsername(name string, labName string) string {
+	var username strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(name)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// Accents are dropped, é => e
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) || r == '-':
+			username.WriteRune(r)
+		default:
+			username.WriteRune('-')
+		}
+	}
+
+	maxLength := validation.DNS1123LabelMaxLength - len("ns-"+labName+"-")
+	result := username.String()
+	if len(result) > maxLength {
+		result = result[:maxLength]
+	}
+
+	return strings.Trim(result, "-")
+}
+
+/*
+Returns the identifiers of the students that got access to a lab, the username is also the name of their ServiceAccount.
+*/
+func getStudentIdentifiers(students []Student, labName string, isIndividual bool, isHybrid bool, options *LabOptions) []StudentIdentifiers {
+	var identifiers []StudentIdentifiers
+
+	for _, student := range students {
+		// In hybrid and shared-only labs the credentials of every student are personal
+		namespace := getNamespaceName(student, labName, isIndividual || isHybrid || options.SharedOnly)
+		if namespace == "" {
+			// Students without a group get no namespace
+			continue
+		}
+
+		studentIdentifiers := StudentIdentifiers{
+			Id:        student.id,
+			Name:      student.name,
+			Username:  strings.TrimPrefix(namespace, "ns-"+labName+"-"),
+			Namespace: namespace,
+			Identity:  student.identity,
+		}
+
+		if isHybrid {
+			studentIdentifiers.GroupNamespace = getNamespaceName(student, labName, false)
+		}
+
+		// The ServiceAccounts of shared-only labs are in the lab namespace
+		if options.SharedOnly {
+			studentIdentifiers.Namespace = "ns-" + labName
+		}
+
+		if options.IdentityProvider == "" {
+			studentIdentifiers.ServiceAccount = "system:serviceaccount:" + studentIdentifiers.Namespace + ":" + studentIdentifiers.Username
+		}
+
+		identifiers = append(identifiers, studentIdentifiers)
+	}
+
+	return identifiers
+}
+
+/*
+Returns the identifiers of the students stored with a lab. Returns an empty list if none were stored.
+*/
+func getStoredStudentIdentifiers(labData map[string]string) ([]StudentIdentifiers, error) {
+	identifiers := []StudentIdentifiers{}
+
+	if value, ok := labData["students"]; ok {
+		if err := json.Unmarshal([]byte(value), &identifiers); err != nil {
+			return nil, err
+		}
+	}
+
+	return identifiers, nil
+}
+
+/*
+Adds the identifiers of new students to the identifiers stored with a lab, a student that is added again replaces their earlier identifiers.
+Returns the encoded identifiers, sorted by username and id so the mapping is stable.
+*/
+func mergeStudentIdentifiers(labData map[string]string, identifiers []StudentIdentifiers) (string, error) {
+	stored, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		return "", err
+	}
+
+	merged := make(map[string]StudentIdentifiers)
+	for _, studentIdentifiers := range append(stored, identifiers...) {
+		merged[studentIdentifiers.Username+"/"+studentIdentifiers.Id] = studentIdentifiers
+	}
+
+	result := []StudentIdentifiers{}
+	for _, studentIdentifiers := range merged {
+		result = append(result, studentIdentifiers)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Username != result[j].Username {
+			return result[i].Username < result[j].Username
+		}
+
+		return result[i].Id < result[j].Id
+	})
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+/*
+Removes the students of a deleted namespace (of a group or a single student) from the identifiers stored with a lab,
+members of a hybrid lab keep their personal namespace. Returns the encoded identifiers.
+*/
+func removeGroupStudentIdentifiers(labData map[string]string, groupNamespace string) (string, error) {
+	stored, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		return "", err
+	}
+
+	result := []StudentIdentifiers{}
+	for _, studentIdentifiers := range stored {
+		if studentIdentifiers.Namespace == groupNamespace {
+			continue
+		}
+
+		if studentIdentifiers.GroupNamespace == groupNamespace {
+			studentIdentifiers.GroupNamespace = ""
+		}
+
+		result = append(result, studentIdentifiers)
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+/*
+Removes a student of a shared-only lab from the identifiers stored with a lab, every student of the lab has the lab namespace as namespace.
+Returns the encoded identifiers.
+*/
+func removeSharedStudentIdentifiers(labData map[string]string, username string) (string, error) {
+	stored, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		return "", err
+	}
+
+	result := []StudentIdentifiers{}
+	for _, studentIdentifiers := range stored {
+		if studentIdentifiers.Username != username {
+			result = append(result, studentIdentifiers)
+		}
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// A lab as listed by GET /lab, with its lab namespace and the namespaces of its students (and groups)
+type LabSummary struct {
+	Name           string             `json:"name"`
+	Namespace      string             `json:"namespace"`
+	CreatedAt      time.Time          `json:"createdAt"`
+	NamespaceCount int                `json:"namespaceCount"`
+	Namespaces     []NamespaceSummary `json:"namespaces"`
+}
+
+type NamespaceSummary struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+/*
+Returns every lab with its namespaces, sorted by name. With an organization only its labs are returned, named without the prefix of the organization.
+*/
+func (s *Server) getLabSummaries(ctx context.Context, clientset kubernetes.Interface, organization *Organization) ([]LabSummary, error) {
+	namespaces, err := s.listNamespaces(ctx, clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	labs := make(map[string]*LabSummary)
+	for _, namespace := range namespaces {
+		// Lab names never contain a -, student namespaces always do
+		labName := strings.TrimPrefix(namespace.Name, "ns-")
+		if labName == namespace.Name || labName == "" || strings.Contains(labName, "-") {
+			continue
+		}
+
+		if organization != nil && namespace.Labels[organizationLabel] != organization.Name {
+			continue
+		}
+
+		labs[labName] = &LabSummary{Name: labName, Namespace: namespace.Name, CreatedAt: namespace.CreationTimestamp.Time, Namespaces: []NamespaceSummary{}}
+		if organization != nil {
+			labs[labName].Name = strings.TrimPrefix(labName, organization.Name)
+		}
+	}
+
+	for _, namespace := range namespaces {
+		parts := strings.SplitN(strings.TrimPrefix(namespace.Name, "ns-"), "-", 2)
+		lab, ok := labs[parts[0]]
+		if !strings.HasPrefix(namespace.Name, "ns-") || len(parts) != 2 || !ok {
+			continue
+		}
+
+		lab.Namespaces = append(lab.Namespaces, NamespaceSummary{Name: namespace.Name, CreatedAt: namespace.CreationTimestamp.Time})
+	}
+
+	summaries := []LabSummary{}
+	for _, lab := range labs {
+		sort.Slice(lab.Namespaces, func(i, j int) bool {
+			return lab.Namespaces[i].Name < lab.Namespaces[j].Name
+		})
+		lab.NamespaceCount = len(lab.Namespaces)
+
+		summaries = append(summaries, *lab)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+
+	return summaries, nil
+}
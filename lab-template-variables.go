@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+)
+
+// A value charts get for a student namespace, under .Values.student.<name>
+type TemplateVariable struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Example     interface{} `json:"example"`
+
+	value func(student Student, labName string, namespace string, options *LabOptions) interface{}
+}
+
+// Every value of .Values.student, the values of a namespace are computed from this list so it is always complete
+var templateVariables = []TemplateVariable{
+	{
+		Name:        "id",
+		Description: "The id of the student in the roster",
+		Example:     "123456",
+		value: func(student Student, labName string, namespace string, options *LabOptions) interface{} {
+			return student.id
+		},
+	},
+	{
+		Name:        "name",
+		Description: "The name of the student in the roster",
+		Example:     "Ann Lee",
+		value: func(student Student, labName string, namespace string, options *LabOptions) interface{} {
+			return student.name
+		},
+	},
+	{
+		Name:        "group",
+		Description: "The number of the group of the student, -1 if the student has no group",
+		Example:     1,
+		value: func(student Student, labName string, namespace string, options *LabOptions) interface{} {
+			return student.group
+		},
+	},
+	{
+		Name:        "username",
+		Description: "The DNS-safe username of the student (or group), also the name of the ServiceAccount",
+		Example:     "ann-lee",
+		value: func(student Student, labName string, namespace string, options *LabOptions) interface{} {
+			return strings.TrimPrefix(namespace, "ns-"+labName+"-")
+		},
+	},
+	{
+		Name:        "namespace",
+		Description: "The namespace that is rendered",
+		Example:     "ns-lab-ann-lee",
+		value: func(student Student, labName string, namespace string, options *LabOptions) interface{} {
+			return namespace
+		},
+	},
+	{
+		Name:        "lab",
+		Description: "The name of the lab",
+		Example:     "lab",
+		value: func(student Student, labName string, namespace string, options *LabOptions) interface{} {
+			return labName
+		},
+	},
+	{
+		Name:        "ingressHost",
+		Description: "The host Ingresses without a host get in the namespace, empty if the lab has no ingressDomain",
+		Example:     "ann-lee.lab.example.com",
+		value: func(student Student, labName string, namespace string, options *LabOptions) interface{} {
+			if options.IngressDomain == "" {
+				return ""
+			}
+
+			return getIngressHost("", labName, namespace, options.IngressDomain)
+		},
+	},
+}
+
+/*
+Returns the values a chart gets for a student namespace under .Values.student: the template variables and the other columns of the roster.
+The columns can't override the template variables. The students of a group namespace share the values of the first student of the group.
+*/
+func getStudentValues(students []Student, labName string, namespace string, options *LabOptions) map[string]interface{} {
+	values := make(map[string]interface{})
+	if len(students) == 0 {
+		return values
+	}
+
+	student := students[0]
+	for column, value := range student.values {
+		values[column] = value
+	}
+
+	for _, variable := range templateVariables {
+		values[variable.Name] = variable.value(student, labName, namespace, options)
+	}
+
+	return values
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Lifecycle events of a student (or group) namespace
+const (
+	timelineCreated          = "created"
+	timelineManifestApplied  = "manifest-applied"
+	timelineReset            = "reset"
+	timelineLocked           = "locked"
+	timelineUnlocked         = "unlocked"
+	timelineDeleted          = "deleted"
+	timelineTokenRegenerated = "token-regenerated"
+)
+
+// Only the newest events of a namespace are kept, e.g. an access window locks and unlocks a namespace every day
+const maxTimelineEvents = 200
+
+// A change to the environment of a student, to resolve disputes about when an environment changed
+type TimelineEvent struct {
+	Namespace string    `json:"namespace"`
+	Type      string    `json:"type"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+/*
+Returns the events stored with a lab per namespace, oldest first. Returns an empty timeline if none were stored.
+*/
+func getStoredTimeline(labData map[string]string) (map[string][]TimelineEvent, error) {
+	timeline := map[string][]TimelineEvent{}
+
+	if value, ok := labData["timeline"]; ok {
+		if err := json.Unmarshal([]byte(value), &timeline); err != nil {
+			return nil, err
+		}
+	}
+
+	return timeline, nil
+}
+
+/*
+Stores events of the namespaces of a lab at once, the oldest events of a namespace are dropped when it has more than maxTimelineEvents.
+*/
+func (s *Server) recordTimeline(ctx context.Context, labName string, events ...TimelineEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	s.timelineLock.Lock()
+	defer s.timelineLock.Unlock()
+
+	labData, err := s.getLabData(ctx, labName)
+	if err != nil {
+		return err
+	}
+
+	timeline, err := getStoredTimeline(labData)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, event := range events {
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = now
+		}
+
+		namespaceEvents := append(timeline[event.Namespace], event)
+		if len(namespaceEvents) > maxTimelineEvents {
+			namespaceEvents = namespaceEvents[len(namespaceEvents)-maxTimelineEvents:]
+		}
+		timeline[event.Namespace] = namespaceEvents
+	}
+
+	encoded, err := json.Marshal(timeline)
+	if err != nil {
+		return err
+	}
+
+	return s.saveLabData(ctx, labName, map[string]string{"timeline": string(encoded)})
+}
+
+/*
+Records events of the namespaces of a lab. The timeline is informational, so errors are logged instead of failing the change itself.
+*/
+func (s *Server) logTimeline(ctx context.Context, labName string, events ...TimelineEvent) {
+	if err := s.recordTimeline(ctx, labName, events...); err != nil {
+		fmt.Println("Something went wrong while recording the timeline of lab "+labName+":", err)
+	}
+}
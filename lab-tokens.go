@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The combined result of issuing tokens for several users (students or groups), the users that failed are in Errors
+type TokenIssuance struct {
+	Tokens map[string]string `json:"tokens"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+/*
+Returns the ServiceAccounts of the students of a lab per username, the members of a group share the ServiceAccount of the group.
+*/
+func getServiceAccountNamespaces(identifiers []StudentIdentifiers) map[string]string {
+	namespaces := map[string]string{}
+	for _, studentIdentifiers := range identifiers {
+		if studentIdentifiers.ServiceAccount != "" {
+			namespaces[studentIdentifiers.Username] = studentIdentifiers.Namespace
+		}
+	}
+
+	return namespaces
+}
+
+/*
+Issues a token for the ServiceAccount of every username, every student of the lab without usernames. With regenerate the
+ServiceAccounts are replaced first, so the earlier tokens (including legacy Secret tokens) stop working.
+A user that fails doesn't stop the others, its error is part of the result.
+*/
+func (s *Server) issueLabTokens(ctx context.Context, clientset kubernetes.Interface, labName string, identifiers []StudentIdentifiers, usernames []string, regenerate bool, options *LabOptions) TokenIssuance {
+	issuance := TokenIssuance{Tokens: map[string]string{}, Errors: map[string]string{}}
+
+	namespaces := getServiceAccountNamespaces(identifiers)
+	if len(usernames) == 0 {
+		for username := range namespaces {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+	}
+
+	var timeline []TimelineEvent
+	for _, username := range usernames {
+		namespace, ok := namespaces[username]
+		if !ok {
+			issuance.Errors[username] = username + " has no ServiceAccount in lab " + labName
+			continue
+		}
+
+		var token string
+		var err error
+		if regenerate {
+			token, err = regenerateServiceAccount(ctx, clientset, username, namespace, options.usesTokenRequest(), options.TokenExpirationSeconds, options.TokenAudiences)
+		} else {
+			token, err = requestServiceAccountToken(ctx, clientset, username, namespace, options.TokenExpirationSeconds, options.TokenAudiences)
+		}
+
+		if errors.IsNotFound(err) {
+			issuance.Errors[username] = username + " has no ServiceAccount in lab " + labName
+			continue
+		}
+		if err != nil {
+			issuance.Errors[username] = "Something went wrong while issuing a token for " + username
+			continue
+		}
+
+		issuance.Tokens[username] = token
+		if regenerate {
+			timeline = append(timeline, TimelineEvent{Namespace: namespace, Type: timelineTokenRegenerated, Detail: "ServiceAccount " + username})
+		}
+	}
+
+	s.logTimeline(ctx, labName, timeline...)
+
+	return issuance
+}
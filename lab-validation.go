@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// The result of validating a lab without provisioning it, served by POST /validate
+type LabValidation struct {
+	Valid      bool     `json:"valid"`
+	Errors     []string `json:"errors"`
+	Warnings   []string `json:"warnings"`
+	LabName    string   `json:"labName"`
+	Students   int      `json:"students"`
+	Namespaces []string `json:"namespaces"`
+}
+
+/*
+Prepares a rendered manifest for a lab: converts it for OpenShift and checks the architecture of its images, the dependencies
+between its objects and its hooks, so nothing is created for a manifest that can't be deployed.
+*/
+func (s *Server) prepareManifest(manifest string, options *LabOptions) (string, *Error) {
+	// OpenShift exposes services with Routes instead of Ingresses
+	if s.isOpenShift {
+		convertedManifest, err := convertManifestForOpenShift(manifest)
+		if err != nil {
+			return "", &Error{status: http.StatusBadRequest, message: "Something went wrong while converting the manifest for OpenShift"}
+		}
+
+		manifest = convertedManifest
+	}
+
+	// Make sure the images of the manifest can run on the architecture of the lab
+	if options.Architecture != "" {
+		if e := validateImageArchitectures(manifest, options.Architecture); e != nil {
+			return "", e
+		}
+	}
+
+	// Dependencies between the objects of the manifest are checked before anything is created
+	if e := validateManifestDependencies(manifest); e != nil {
+		return "", e
+	}
+
+	if e := validateManifestHooks(manifest); e != nil {
+		return "", e
+	}
+
+	return manifest, nil
+}
+
+/*
+Checks the namespaces a roster results in: every namespace name must be valid, and students of individual labs must not share a namespace.
+Students without a group get no namespace in group labs, they are returned as warnings.
+*/
+func validateRoster(students []Student, labName string, isIndividual bool) ([]string, []string) {
+	var errors, warnings []string
+
+	for namespace, namespaceStudents := range getNamespaceStudents(students, labName, isIndividual) {
+		if len(validation.IsDNS1123Label(namespace)) > 0 {
+			errors = append(errors, "Namespace "+namespace+" of "+namespaceStudents[0].name+" is not a valid namespace name (at most 63 lowercase letters, digits and -)")
+		}
+
+		if isIndividual && len(namespaceStudents) > 1 {
+			errors = append(errors, strconv.Itoa(len(namespaceStudents))+" students share namespace "+namespace+", usernames must be unique")
+		}
+	}
+
+	for _, student := range students {
+		if getNamespaceName(student, labName, isIndividual) == "" {
+			warnings = append(warnings, student.name+" has no group and gets no namespace")
+		}
+	}
+
+	return errors, warnings
+}
+
+/*
+Validates a lab and its roster without provisioning anything, e.g. as a pre-commit check of the lab spec in a course repository.
+Takes the same parameters as POST /lab: the spec, options and manifest are checked, and the roster is read and checked.
+Responds with 200 if the lab is valid and 422 with every error otherwise.
+HTTP Parameters: see createLabEnvironment
+*/
+func (s *Server) validateLab(w http.ResponseWriter, r *http.Request) {
+	result := LabValidation{Errors: []string{}, Warnings: []string{}, Namespaces: []string{}}
+
+	// The checks of the manifest, the roster and the credentials decode their parameters again, their errors are only reported once
+	addError := func(message string) {
+		if !contains(result.Errors, message) {
+			result.Errors = append(result.Errors, message)
+		}
+	}
+
+	r.ParseForm()
+	if e := s.applyLabSpec(r); e != nil {
+		result.Errors = append(result.Errors, e.message)
+	}
+
+	// Every parameter is decoded, also when an earlier one is invalid
+	var parameters LabParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		addError(e.message)
+	}
+
+	result.LabName = getLabName(r, parameters.LabName)
+	isIndividual := parameters.IsIndividual
+	isHybrid := parameters.IsHybrid
+
+	if result.LabName == "" {
+		result.Errors = append(result.Errors, "labName is required")
+	} else if len(validation.IsDNS1123Label("ns-"+result.LabName)) > 0 {
+		result.Errors = append(result.Errors, "Lab namespace ns-"+result.LabName+" is not a valid namespace name")
+	}
+
+	options, e := s.getLabOptions(r)
+	if e != nil {
+		result.Errors = append(result.Errors, e.message)
+	}
+
+	if options != nil {
+		if manifest, e := s.getManifest(r, &parameters.ManifestParameters); e != nil {
+			addError(e.message)
+		} else if _, e := s.prepareManifest(manifest, options); e != nil {
+			result.Errors = append(result.Errors, e.message)
+		}
+
+		if _, e := getCredentialsFormat(r, options); e != nil {
+			addError(e.message)
+		}
+	}
+
+	students, e := s.getRosterStudents(r)
+	if e != nil {
+		addError(e.message)
+	} else {
+		result.Students = len(students)
+		if len(students) == 0 {
+			result.Warnings = append(result.Warnings, "The roster has no students")
+		}
+
+		namespaceStudents := getNamespaceStudents(students, result.LabName, isIndividual || isHybrid)
+		if !isIndividual || isHybrid {
+			errors, warnings := validateRoster(students, result.LabName, false)
+			result.Errors = append(result.Errors, errors...)
+			result.Warnings = append(result.Warnings, warnings...)
+		}
+		if isIndividual || isHybrid {
+			errors, _ := validateRoster(students, result.LabName, true)
+			result.Errors = append(result.Errors, errors...)
+		}
+
+		if options != nil && !options.SharedOnly {
+			result.Namespaces = append(result.Namespaces, getNamespaceNames(students, result.LabName, isIndividual || isHybrid)...)
+			if isHybrid {
+				result.Namespaces = append(result.Namespaces, getNamespaceNames(students, result.LabName, false)...)
+			}
+
+			if e := validateStudentRoles(namespaceStudents, options); e != nil {
+				result.Errors = append(result.Errors, e.message)
+			}
+		}
+	}
+
+	result.Valid = len(result.Errors) == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Valid {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
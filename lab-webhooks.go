@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events external systems (e.g. LMS sync scripts or billing) receive webhooks for
+const (
+	webhookLabCreated   = "lab.created"
+	webhookStudentAdded = "student.added"
+	webhookLabDeleted   = "lab.deleted"
+	webhookPreDelete    = "lab.pre-delete"
+
+	webhookApprovalRequested = "lab.approval-requested"
+	webhookApprovalDecided   = "lab.approval-decided"
+)
+
+// A failed delivery is retried after 1s, 2s, ... until it was attempted this many times
+const webhookAttempts = 3
+
+// The body of an outbound webhook
+type WebhookEvent struct {
+	Id        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+/*
+Returns the URLs that receive the webhooks of every lab event, configured by SCALAMA_WEBHOOK_URLS (comma-separated).
+*/
+func getWebhookUrls() []string {
+	var urls []string
+	for _, url := range strings.Split(os.Getenv("SCALAMA_WEBHOOK_URLS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+
+	return urls
+}
+
+/*
+Signs the body of a webhook sent at a timestamp with the secret configured by SCALAMA_WEBHOOK_SECRET, as HMAC-SHA256 of "<timestamp>.<body>".
+The timestamp is part of the signature so receivers can reject replayed webhooks. Returns an empty signature without secret.
+*/
+func signWebhook(timestamp string, body []byte) string {
+	secret := os.Getenv("SCALAMA_WEBHOOK_SECRET")
+	if secret == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Delivers a webhook to a URL, retrying failed deliveries with backoff.
+*/
+func deliverWebhook(url string, event WebhookEvent, body []byte) error {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		headers := map[string]string{
+			"X-ScaLaMa-Event":     event.Type,
+			"X-ScaLaMa-Delivery":  event.Id,
+			"X-ScaLaMa-Timestamp": timestamp,
+		}
+		if signature := signWebhook(timestamp, body); signature != "" {
+			headers["X-ScaLaMa-Signature"] = signature
+		}
+
+		if err = postJson(context.Background(), url, body, headers); err == nil {
+			return nil
+		}
+
+		if attempt < webhookAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+
+	return err
+}
+
+/*
+Creates a webhook of a lab event with a new id. Returns the event and its encoded body.
+*/
+func newWebhookEvent(eventType string, data interface{}) (WebhookEvent, []byte, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return WebhookEvent{}, nil, err
+	}
+
+	event := WebhookEvent{Id: hex.EncodeToString(id), Type: eventType, CreatedAt: time.Now(), Data: data}
+	body, err := json.Marshal(event)
+	return event, body, err
+}
+
+/*
+Sends a webhook of a lab event to every configured URL, in the background so the caller isn't slowed down by the receivers.
+Failed deliveries are logged.
+*/
+func emitWebhook(eventType string, data interface{}) {
+	urls := getWebhookUrls()
+	if len(urls) == 0 {
+		return
+	}
+
+	event, body, err := newWebhookEvent(eventType, data)
+	if err != nil {
+		fmt.Println("Something went wrong while creating a "+eventType+" webhook:", err)
+		return
+	}
+
+	for _, url := range urls {
+		go func(url string) {
+			if err := deliverWebhook(url, event, body); err != nil {
+				fmt.Println("Something went wrong while delivering a "+eventType+" webhook to "+url+":", err)
+			}
+		}(url)
+	}
+}
+
+/*
+Calls the pre-delete webhook of a lab and waits for it, e.g. so an external system can take a final snapshot or export the work of the students.
+The webhook is signed like the other webhooks, the deletion only continues once the receiver answered with a 2xx status.
+*/
+func callPreDeleteWebhook(url string, labName string, namespaces []string) error {
+	event, body, err := newWebhookEvent(webhookPreDelete, map[string]interface{}{"lab": labName, "namespaces": namespaces})
+	if err != nil {
+		return err
+	}
+
+	return deliverWebhook(url, event, body)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+// Prefix of the claims LTI adds to the id_token of a launch
+const ltiClaimPrefix = "https://purl.imsglobal.org/spec/lti/claim/"
+
+// A launch is only accepted shortly after its login was initiated
+const ltiLoginTimeout = 10 * time.Minute
+
+// The public keys of a platform are fetched again after this time, or when a token is signed with an unknown key
+const ltiKeysTtl = time.Hour
+
+// An LMS (e.g. Canvas, Moodle or Brightspace) on which ScaLaMa is registered as LTI 1.3 tool
+type LtiPlatform struct {
+	Issuer        string   `json:"issuer"`
+	ClientId      string   `json:"clientId"`
+	AuthUrl       string   `json:"authUrl"`
+	JwksUrl       string   `json:"jwksUrl"`
+	DeploymentIds []string `json:"deploymentIds,omitempty"`
+}
+
+// What a student gets when they launch a lab from the LMS: their portal and a kubeconfig to access their namespace
+type LtiLaunch struct {
+	Portal     *StudentPortal `json:"portal"`
+	Kubeconfig string         `json:"kubeconfig,omitempty"`
+}
+
+// A login that was initiated by a platform and waits for its launch
+type ltiLogin struct {
+	platform *LtiPlatform
+	nonce    string
+	expires  time.Time
+}
+
+// The public keys of a platform, by key id
+type ltiKeys struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// The logins of a server that were initiated but not launched yet, by state
+type ltiLoginStore struct {
+	sync.Mutex
+	logins map[string]ltiLogin
+}
+
+// The public keys of the platforms of a server, by JWKS URL
+type platformKeyCache struct {
+	sync.Mutex
+	keys map[string]ltiKeys
+}
+
+/*
+Reads the LTI platforms from the file configured by SCALAMA_LTI_PLATFORMS, e.g.
+[{issuer: https://canvas.instructure.com, clientId: "10000000000001", authUrl: https://sso.canvaslms.com/api/lti/authorize_redirect, jwksUrl: https://sso.canvaslms.com/api/lti/security/jwks}]
+*/
+func loadLtiPlatforms() ([]LtiPlatform, error) {
+	path := os.Getenv("SCALAMA_LTI_PLATFORMS")
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var platforms []LtiPlatform
+	if err := yaml.UnmarshalStrict(data, &platforms); err != nil {
+		return nil, err
+	}
+
+	for _, platform := range platforms {
+		if platform.Issuer == "" || platform.ClientId == "" || platform.AuthUrl == "" || platform.JwksUrl == "" {
+			return nil, fmt.Errorf("LTI platform %q needs an issuer, clientId, authUrl and jwksUrl", platform.Issuer)
+		}
+	}
+
+	return platforms, nil
+}
+
+/*
+Returns the platform of an issuer and client id. The client id can be omitted if the issuer has only one registration.
+*/
+func (s *Server) findLtiPlatform(issuer string, clientId string) (*LtiPlatform, bool) {
+	var found *LtiPlatform
+	for i := range s.ltiPlatforms {
+		platform := &s.ltiPlatforms[i]
+		if platform.Issuer != issuer || (clientId != "" && platform.ClientId != clientId) {
+			continue
+		}
+
+		// Without client id the registration is ambiguous
+		if found != nil {
+			return nil, false
+		}
+		found = platform
+	}
+
+	return found, found != nil
+}
+
+/*
+Returns a random hex string for the state and nonce of a login.
+*/
+func getLtiRandom() (string, error) {
+	value := make([]byte, 16)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(value), nil
+}
+
+/*
+Remembers a login initiated by a platform. Returns its state and nonce, expired logins are forgotten.
+*/
+func (s *Server) addLtiLogin(platform *LtiPlatform) (string, string, error) {
+	state, err := getLtiRandom()
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce, err := getLtiRandom()
+	if err != nil {
+		return "", "", err
+	}
+
+	s.ltiLogins.Lock()
+	defer s.ltiLogins.Unlock()
+
+	now := time.Now()
+	for key, login := range s.ltiLogins.logins {
+		if now.After(login.expires) {
+			delete(s.ltiLogins.logins, key)
+		}
+	}
+
+	s.ltiLogins.logins[state] = ltiLogin{platform: platform, nonce: nonce, expires: now.Add(ltiLoginTimeout)}
+	return state, nonce, nil
+}
+
+/*
+Returns the login of a state and forgets it, so every login can be launched only once.
+*/
+func (s *Server) takeLtiLogin(state string) (ltiLogin, bool) {
+	s.ltiLogins.Lock()
+	defer s.ltiLogins.Unlock()
+
+	login, ok := s.ltiLogins.logins[state]
+	delete(s.ltiLogins.logins, state)
+
+	return login, ok && time.Now().Before(login.expires)
+}
+
+/*
+Fetches the RSA public keys of a platform from its JWKS URL.
+*/
+func fetchLtiKeys(ctx context.Context, jwksUrl string) (map[string]*rsa.PublicKey, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", jwksUrl, response.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range jwks.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	return keys, nil
+}
+
+/*
+Returns the public key a platform signed a token with, from the cache unless the key is unknown or the cache expired.
+*/
+func (s *Server) getLtiKey(ctx context.Context, platform *LtiPlatform, kid string) (*rsa.PublicKey, error) {
+	s.ltiKeyCache.Lock()
+	defer s.ltiKeyCache.Unlock()
+
+	cached, ok := s.ltiKeyCache.keys[platform.JwksUrl]
+	if key, known := cached.keys[kid]; ok && known && time.Since(cached.fetched) < ltiKeysTtl {
+		return key, nil
+	}
+
+	keys, err := fetchLtiKeys(ctx, platform.JwksUrl)
+	if err != nil {
+		return nil, err
+	}
+	s.ltiKeyCache.keys[platform.JwksUrl] = ltiKeys{keys: keys, fetched: time.Now()}
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("the platform has no key %q", kid)
+	}
+
+	return key, nil
+}
+
+/*
+Verifies the id_token of a launch: its RS256 signature with the keys of the platform, its issuer, audience, expiry and nonce,
+and that it launches a resource link of an allowed deployment. Returns the claims of the token.
+*/
+func (s *Server) verifyLtiToken(ctx context.Context, platform *LtiPlatform, token string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("the id_token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("the id_token must be signed with RS256")
+	}
+
+	key, err := s.getLtiKey(ctx, platform, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, fmt.Errorf("the signature of the id_token is invalid")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if claims["iss"] != platform.Issuer {
+		return nil, fmt.Errorf("the id_token was not issued by %s", platform.Issuer)
+	}
+
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == platform.ClientId
+	case []interface{}:
+		for _, value := range aud {
+			audience = audience || value == platform.ClientId
+		}
+	}
+	if !audience {
+		return nil, fmt.Errorf("the id_token is not meant for client %s", platform.ClientId)
+	}
+
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("the id_token expired")
+	}
+
+	if claims["nonce"] != nonce {
+		return nil, fmt.Errorf("the nonce of the id_token does not match the login")
+	}
+
+	if claims[ltiClaimPrefix+"message_type"] != "LtiResourceLinkRequest" || claims[ltiClaimPrefix+"version"] != "1.3.0" {
+		return nil, fmt.Errorf("only LTI 1.3.0 resource link launches are supported")
+	}
+
+	deploymentId, _ := claims[ltiClaimPrefix+"deployment_id"].(string)
+	if len(platform.DeploymentIds) > 0 && !contains(platform.DeploymentIds, deploymentId) {
+		return nil, fmt.Errorf("deployment %s is not allowed", deploymentId)
+	}
+
+	return claims, nil
+}
+
+/*
+Decodes the base64url JSON of a part of a JWT into v.
+*/
+func decodeJwtPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decoded, v)
+}
+
+/*
+Returns a string claim of an object claim of a launch, e.g. the lab custom parameter.
+*/
+func getLtiClaim(claims map[string]interface{}, claim string, key string) string {
+	object, _ := claims[ltiClaimPrefix+claim].(map[string]interface{})
+	value, _ := object[key].(string)
+	return value
+}
+
+/*
+Returns the student of a lab that launched it, by their LMS user id (the subject or SIS id must be the id in the roster)
+or by their email address (the identity of the student in labs that use an identity provider).
+*/
+func findLtiStudent(identifiers []StudentIdentifiers, claims map[string]interface{}) (StudentIdentifiers, bool) {
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	sourcedId := getLtiClaim(claims, "lis", "person_sourcedid")
+
+	for _, student := range identifiers {
+		if student.Id != "" && (student.Id == subject || student.Id == sourcedId) {
+			return student, true
+		}
+		if email != "" && student.Identity == email {
+			return student, true
+		}
+	}
+
+	return StudentIdentifiers{}, false
+}
+
+/*
+Returns the kubeconfig of a student with a token for their ServiceAccount, for the API server configured by SCALAMA_CLUSTER_SERVER.
+The CA of the cluster is read from the kube-root-ca.crt ConfigMap of the namespace.
+*/
+func getStudentKubeconfig(ctx context.Context, clientset kubernetes.Interface, server string, student StudentIdentifiers, token string) (string, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	cluster := &clientcmdapi.Cluster{Server: server}
+	rootCa, err := clientset.CoreV1().ConfigMaps(student.Namespace).Get(ctx, "kube-root-ca.crt", v1.GetOptions{})
+	if err == nil {
+		cluster.CertificateAuthorityData = []byte(rootCa.Data["ca.crt"])
+	}
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters["scalama"] = cluster
+	config.AuthInfos[student.Username] = &clientcmdapi.AuthInfo{Token: token}
+	config.Contexts["scalama"] = &clientcmdapi.Context{Cluster: "scalama", AuthInfo: student.Username, Namespace: student.Namespace}
+	config.CurrentContext = "scalama"
+
+	kubeconfig, err := clientcmd.Write(*config)
+	return string(kubeconfig), err
+}
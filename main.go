@@ -2,28 +2,124 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
-	"helm.sh/helm/v3/pkg/action"
-	"helm.sh/helm/v3/pkg/chart/loader"
-	"helm.sh/helm/v3/pkg/cli"
-	"helm.sh/helm/v3/pkg/kube"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 )
 
 type contextKey string
 
-// Singletons
-var clientset *kubernetes.Clientset
-var dynamicInterface dynamic.Interface
+// Prefix of the current version of the API
+const apiPrefix = "/api/v1"
+
+// The dependencies of the handlers, injected so the API can run against any cluster (or a fake one in demo mode)
+type Server struct {
+	clientset        kubernetes.Interface
+	dynamicInterface dynamic.Interface
+
+	// Detected at startup
+	isOpenShift bool
+	isRancher   bool
+
+	// Nil when the state is stored in the lab namespace (SCALAMA_STORE) or everything is only kept in memory (SCALAMA_OBJECT_STORE_URL)
+	labStore    LabStore
+	objectStore ObjectStore
+
+	// The organizations of the instance, by name. Without organizations every lab is in the same scope
+	organizations map[string]*Organization
+	// Empty when SCALAMA_CLUSTER_POLICY is not set
+	clusterPolicy *ClusterPolicy
+	ltiPlatforms  []LtiPlatform
+
+	// The timeout of a single Kubernetes operation, carried by the context of requests and background loops
+	operationTimeout time.Duration
+	// Cancelled when the server shuts down, which also cancels the Kubernetes operations of the asynchronous creations
+	shutdownContext context.Context
+
+	// Nil until the informers are started
+	informerFactory        informers.SharedInformerFactory
+	managedInformerFactory informers.SharedInformerFactory
+
+	notifiers map[string]Notifier
+
+	// The state of the server that is only kept in memory
+	chartCache           *manifestCache
+	chartRepositoryCache *repositoryIndexCache
+	tokenIps             *ipTracker
+	labApprovals         *labApprovalStore
+	creationJobs         *creationJobStore
+	deletionJobs         *deletionJobStore
+	labQueue             *provisioningQueue
+	ltiLogins            *ltiLoginStore
+	ltiKeyCache          *platformKeyCache
+	// The digests of the uploads this server already stored, so an upload that is read multiple times is only stored once
+	storedUploads sync.Map
+
+	// The alerts, quota requests, timeline and notification subscriptions of a lab are read, changed and stored again, one change at a time
+	alertsLock        sync.Mutex
+	quotaRequestsLock sync.Mutex
+	timelineLock      sync.Mutex
+	subscriptionsLock sync.Mutex
+}
+
+func newServer(clientset kubernetes.Interface, dynamicInterface dynamic.Interface) *Server {
+	return &Server{
+		clientset:        clientset,
+		dynamicInterface: dynamicInterface,
+		organizations:    map[string]*Organization{},
+		clusterPolicy:    &ClusterPolicy{},
+		operationTimeout: defaultOperationTimeout,
+		shutdownContext:  context.Background(),
+		notifiers:        newNotifiers(),
+
+		chartCache:           &manifestCache{manifests: map[string]cachedManifest{}},
+		chartRepositoryCache: &repositoryIndexCache{indexes: map[string]cachedIndex{}},
+		tokenIps:             newIpTracker(),
+		labApprovals:         &labApprovalStore{approvals: map[string]*LabApproval{}},
+		creationJobs:         &creationJobStore{jobs: map[string]*CreationJob{}},
+		deletionJobs:         &deletionJobStore{jobs: map[string]*DeletionJob{}},
+		labQueue:             newProvisioningQueue(),
+		ltiLogins:            &ltiLoginStore{logins: map[string]ltiLogin{}},
+		ltiKeyCache:          &platformKeyCache{keys: map[string]ltiKeys{}},
+	}
+}
+
+/*
+Returns the name of the namespace of a student. Returns an empty string if the student has no namespace (no group).
+*/
+func getNamespaceName(student Student, labName string, isIndividual bool) string {
+	if isIndividual {
+		// Convert "First Last" to first-last to ns-labname-first-last
+		return fmt.Sprintf("ns-%s-%s", labName, getUsername(student.name, labName))
+	}
+
+	if student.group == -1 {
+		return ""
+	}
+
+	// Convert groupNumber to ns-labname-group-#
+	return fmt.Sprintf("ns-%s-group-%d", labName, student.group)
+}
 
 /*
 Returns a list of names of namespaces that should be created from a list of students
@@ -31,35 +127,58 @@ Returns a list of names of namespaces that should be created from a list of stud
 func getNamespaceNames(students []Student, labName string, isIndividual bool) []string {
 	var namespaces []string
 
-	if isIndividual {
-		for _, student := range students {
-			// Convert "First Last" to first-last to ns-labname-first-last
-			name := strings.ToLower(strings.Join(strings.Split(student.name, " "), "-"))
-			namespaces = append(namespaces, fmt.Sprintf("ns-%s-%s", labName, name))
-		}
+	// Keep track of the namespaces that were already added (e.g. groups)
+	visited := make(map[string]bool)
 
-		return namespaces
+	for _, student := range students {
+		namespace := getNamespaceName(student, labName, isIndividual)
+		if namespace != "" && !visited[namespace] {
+			namespaces = append(namespaces, namespace)
+			visited[namespace] = true
+		}
 	}
 
-	// Keep track of the groups that already have a namespace
-	visited := make(map[int]bool)
+	return namespaces
+}
+
+/*
+Returns the students of every namespace
+*/
+func getNamespaceStudents(students []Student, labName string, isIndividual bool) map[string][]Student {
+	namespaceStudents := make(map[string][]Student)
 
 	for _, student := range students {
-		if student.group != -1 && !visited[student.group] {
-			// Convert groupNumber to ns-labname-group-#
-			namespaces = append(namespaces, fmt.Sprintf("ns-%s-group-%d", labName, student.group))
-			visited[student.group] = true
+		namespace := getNamespaceName(student, labName, isIndividual)
+		if namespace != "" {
+			namespaceStudents[namespace] = append(namespaceStudents[namespace], student)
 		}
 	}
 
-	return namespaces
+	return namespaceStudents
+}
+
+/*
+Checks whether a file with name filename is uploaded, or an earlier upload of it is referenced with <filename>Digest.
+*/
+func hasFormFile(r *http.Request, filename string) bool {
+	if _, _, err := r.FormFile(filename); err != http.ErrMissingFile {
+		return true
+	}
+
+	return r.FormValue(filename+"Digest") != ""
 }
 
 /*
 Checks if file in form with name filename is one of the supported types.
-Returns file if supported.
+Returns file if supported. With an object store the file is stored, and <filename>Digest (the SHA-256 of an earlier upload) can be used instead of uploading it again.
 */
-func getFormFile(r *http.Request, filename string, contentTypes ...string) (io.ReadCloser, *Error) {
+func (s *Server) getFormFile(r *http.Request, filename string, contentTypes ...string) (io.ReadCloser, *Error) {
+	if digest := r.FormValue(filename + "Digest"); digest != "" {
+		if _, _, err := r.FormFile(filename); err == http.ErrMissingFile {
+			return s.getStoredUpload(r.Context(), filename, digest)
+		}
+	}
+
 	file, fileHeader, err := r.FormFile(filename)
 	if err != nil {
 		return nil, &Error{status: http.StatusBadRequest, message: "Something went wrong while reading file " + filename}
@@ -83,24 +202,31 @@ func getFormFile(r *http.Request, filename string, contentTypes ...string) (io.R
 		return nil, &Error{status: http.StatusUnsupportedMediaType, message: filename + " must be one of " + contentTypesStr + " types"}
 	}
 
-	return file, nil
+	// Rosters hold personal data and are never reused, so they are not stored
+	if filename == "students" {
+		return file, nil
+	}
+
+	storedFile, err := s.storeUpload(r.Context(), file, filename, fileHeader)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while storing file " + filename + " in the object store"}
+	}
+
+	return storedFile, nil
 }
 
 /*
-Converts students.csv file to a list of students in HTTP context
+Converts the roster of the lab to a list of students in HTTP context
 */
-func studentsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+func (s *Server) studentsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// students contains a csv file
-		studentsFile, err := getFormFile(r, "students", "text/csv")
-
+		// students is read from an uploaded file or an external system, based on rosterSource
+		students, err := s.getRosterStudents(r)
 		if err != nil {
 			http.Error(w, err.message, err.status)
 			return
 		}
 
-		students := getStudentsFromCsv(studentsFile)
-
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, contextKey("students"), students)
 		r = r.WithContext(ctx)
@@ -112,272 +238,3091 @@ func studentsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 /*
 Creates lab environments for students.
 HTTP Parameters:
- students: <CSV-file>
+ students: <CSV-file>, <XLSX-file> OR <JSON-file> (not used when the roster comes from an external system)
+ rosterSource: <string> (optional, default CSV, ["CSV", "XLSX", "JSON", "CANVAS", "BRIGHTSPACE", "LDAP"])
+ roster: <string> (required for CANVAS, BRIGHTSPACE and LDAP: the course, org unit or group DN of the students)
+ groupCategory: <string> (optional, the group set of CANVAS or BRIGHTSPACE the groups are taken from)
  isIndividual: <bool> 	(optional, default true)
+ isHybrid: <bool> (optional, default false, every group gets a shared namespace and every member a personal namespace)
  labName: <string>
- deploymentMode: <string> (["YAML", "CHART", "CHART_URL"])
- configuration: <YAML-file>, <TAR-file> OR <string>
+ deploymentMode: <string> (["YAML", "CHART", "CHART_URL", "KUSTOMIZE", "PRESET"])
+ configuration: <YAML-file>, <TAR-file> OR <string> (the name of the preset for PRESET)
+ chart: <string> (optional for CHART_URL, the name of the chart in the repository of which configuration is the URL)
+ chartVersion: <string> (optional, default the latest version, the version (or semver range) of chart)
+ values: <YAML-file> (optional, overrides the values of the chart, validated against its values.schema.json)
+ valuesProfile: <string> (optional, a values profile stored in the chart as profiles/<valuesProfile>.yaml, e.g. small or large, overridden by values)
+ options: see getLabOptions (optional)
+ instructions: <string> (optional, the instructions of the lab (e.g. Markdown) that students see in their portal)
+ priority: <string> (optional, default normal, ["exam", "normal", "low"], labs submitted at the same time are provisioned by priority)
+ instructor: <string> (optional, labs of instructors are provisioned fairly, the impersonated user is used when impersonation is enabled)
+ format: <string> (optional, default token, ["token", "kubeconfig", "zip"], kubeconfigs per student as JSON or as a zip file, needs SCALAMA_CLUSTER_SERVER)
+ async: <bool> (optional, default false, responds with a job right away and creates the lab in the background, see GET /job/{id})
+ dryRun: <bool> (optional, default false, creates nothing and returns the namespaces and objects the lab would create, 422 with the errors that would make it fail)
+ spec: <YAML-file> (optional, a lab spec with the other parameters, see GET /lab-spec/schema and GET /lab-spec/example, parameters sent next to it override it)
+ notifyChannel: <string> (optional, ["EMAIL", "SLACK", "TEAMS", "WEBHOOK"], the instructor is notified on it when a cluster admin decides on a lab that needs approval)
+ notifyTarget: <string> (required with notifyChannel, the email address or webhook URL that is notified)
+<file>Digest: <string> (optional, e.g. configDigest, the SHA-256 of an earlier upload of the file that is reused from the object store)
+Charts are rendered for every student namespace with the identifiers and other roster columns of its students as .Values.student.
+With SCALAMA_CHART_KEYRING or SCALAMA_COSIGN_KEY, CHART_URL charts must have a valid provenance file or cosign signature.
+CHART_URL charts and repository indexes downloaded over HTTP(S) are cached for SCALAMA_CHART_REPOSITORY_CACHE_TTL.
+Labs above the SCALAMA_APPROVAL_MAX_* thresholds are held until a cluster admin approves them, see GET /approvals.
+The cluster policy of SCALAMA_CLUSTER_POLICY is enforced in every lab, whatever the parameters ask for, see GET /cluster-policy.
 */
-func createLabEnvironment(w http.ResponseWriter, r *http.Request) {
+func (s *Server) createLabEnvironment(w http.ResponseWriter, r *http.Request) {
 
 	// Get students from HTTP context
 	students := r.Context().Value(contextKey("students")).([]Student)
 
 	// Parse parameters
-	r.ParseForm()
-	labName := strings.ReplaceAll(r.Form.Get("labName"), "-", "") // Remove - from labname
-	deploymentMode := r.Form.Get("deploymentMode")
-	isIndividual := r.Form.Get("isIndividual") != "false" // default value true
+	var parameters LabParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	labName := getLabName(r, parameters.LabName)
+	deploymentMode := parameters.DeploymentMode
+	isIndividual := parameters.IsIndividual
+	isHybrid := parameters.IsHybrid
+
+	options, e := s.getLabOptions(r)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	manifest, e := s.getManifest(r, &parameters.ManifestParameters)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	manifest, e = s.prepareManifest(manifest, options)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	// Nothing is created for a dry run, the namespaces and objects the lab would create are returned instead
+	if parameters.DryRun {
+		s.planLab(w, r, students, labName, deploymentMode, manifest, options, isIndividual, isHybrid)
+		return
+	}
+
+	// Charts (and chart presets) are rendered again for every student namespace, also when students are added later
+	inputs, e := s.getRenderInputs(r, &parameters.ManifestParameters)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	reasons, estimate, e := getApprovalReasons(s.clientset, students, labName, manifest, options, isIndividual, isHybrid)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	if len(reasons) > 0 {
+		s.requestLabApproval(w, r, labName, reasons, estimate, func(w http.ResponseWriter, r *http.Request) {
+			s.deployLabEnvironment(w, r, students, labName, inputs, manifest, options, isIndividual, isHybrid)
+		})
+		return
+	}
+
+	// Large classes are created in the background, their progress is served by GET /job/{id}
+	if parameters.Async {
+		s.runCreationJob(w, r, labName, func(w http.ResponseWriter, r *http.Request) {
+			s.deployLabEnvironment(w, r, students, labName, inputs, manifest, options, isIndividual, isHybrid)
+		})
+		return
+	}
+
+	s.deployLabEnvironment(w, r, students, labName, inputs, manifest, options, isIndividual, isHybrid)
+}
+
+/*
+Creates the namespaces of the students that don't have one yet and deploys the manifest in them, creating the lab first if it doesn't exist.
+With render inputs the student namespaces get their own render of the chart instead, inputs is nil for manifests that are deployed as is.
+Returns the tokens (or identities) of the new namespaces.
+*/
+func (s *Server) deployLabEnvironment(w http.ResponseWriter, r *http.Request, students []Student, labName string, inputs *LabRenderInputs, manifest string, options *LabOptions, isIndividual bool, isHybrid bool) {
+	// Kubernetes operations are cancelled when the client disconnects or the server shuts down
+	ctx := r.Context()
+
+	// Labs that are submitted at the same time are provisioned in order of their priority, see provisioning-queue.go
+	entry, e := newProvisioningEntry(r, labName)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	// The progress of asynchronous creations, nil for synchronous requests
+	job := getRequestCreationJob(ctx)
+	job.setProvisioningEntry(entry)
+
+	if err := s.labQueue.acquire(ctx, entry); err != nil {
+		http.Error(w, "Something went wrong while waiting in the provisioning queue for lab "+labName, http.StatusServiceUnavailable)
+		return
+	}
+	defer s.labQueue.release(entry)
 
 	namespaces := getNamespaceNames(students, labName, isIndividual)
+	namespaceStudents := getNamespaceStudents(students, labName, isIndividual)
+
+	// In hybrid mode every student gets a personal namespace, and the namespace of their group is shared with the other members
+	groupNamespaces := map[string]bool{}
+	if isHybrid {
+		namespaces = getNamespaceNames(students, labName, true)
+		namespaceStudents = getNamespaceStudents(students, labName, true)
+
+		for _, groupNamespace := range getNamespaceNames(students, labName, false) {
+			namespaces = append(namespaces, groupNamespace)
+			groupNamespaces[groupNamespace] = true
+		}
+	}
 
-	// Check if the lab already exists, if it doesn't create the namespace for it and create a read-only role for the lab namespace
-	labExists, err := namespaceExists(clientset, "ns-"+labName)
+	// Shared-only labs only deploy the single instance objects, the students get read access to the lab namespace instead of a namespace
+	if options.SharedOnly {
+		namespaces, namespaceStudents = nil, map[string][]Student{}
+	}
+
+	if e := validateStudentRoles(namespaceStudents, options); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	format, e := getCredentialsFormat(r, options)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	// Check if the lab already exists, if it doesn't create the namespace for it and create a read-only role for the shared objects of the lab namespace
+	// The namespaces are listed once, instead of once for every namespace of the lab
+	existingNamespaces, err := s.getExistingNamespaces(ctx, s.clientset)
 	if err != nil {
 		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
 		return
 	}
 
+	labExists := existingNamespaces["ns-"+labName]
+
+	// Students are only added to an existing lab of the same organization
+	organization := getRequestOrganization(ctx)
+	if labExists {
+		if e := checkLabOrganization(ctx, s.clientset, labName, organization); e != nil {
+			http.Error(w, e.message, e.status)
+			return
+		}
+	}
+
 	if !labExists {
-		err := createNamespace(clientset, "ns-"+labName)
+		err := s.createNamespace(ctx, s.clientset, s.dynamicInterface, "ns-"+labName)
 		if err != nil {
 			http.Error(w, "Something went wrong while creating namespace ns-"+labName, http.StatusInternalServerError)
 			return
 		}
 
-		err = createRole(clientset, "student", "ns-"+labName, []string{"list", "get", "watch"})
+		if organization != nil {
+			if err := setLabOrganization(ctx, s.clientset, labName, organization); err != nil {
+				http.Error(w, "Something went wrong while adding lab "+labName+" to organization "+organization.Name, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = s.createSharedReadRole(ctx, s.clientset, labName, manifest, options)
 		if err != nil {
 			http.Error(w, "Something went wrong while creating role for namespace ns-"+labName, http.StatusInternalServerError)
 			return
 		}
+
+		if e := createScheduledTasks(ctx, s.clientset, labName, "ns-"+labName, taskScopeLab, options); e != nil {
+			http.Error(w, e.message, e.status)
+			return
+		}
+
+		if len(options.LogOutputs) > 0 {
+			if err := createLogFlow(ctx, s.dynamicInterface, labName, "ns-"+labName, options.LogOutputs); err != nil {
+				http.Error(w, "Something went wrong while forwarding the logs of namespace ns-"+labName, http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 
-	// List of namespaces that are new (in case of adding groups/students to existing labs)
-	// Used to keep track in which namespaces the configuration should be deployed
-	var newNamespaces []string
+	// Group the namespaces of the lab in a Rancher project
+	if options.RancherProject {
+		if err := createRancherProject(ctx, s.dynamicInterface, labName); err != nil {
+			http.Error(w, "Something went wrong while creating the Rancher project for lab "+labName, http.StatusInternalServerError)
+			return
+		}
 
-	// Create the namespaces
-	for _, namespace := range namespaces {
-		// Check if namespace already exists
-		namespaceExists, err := namespaceExists(clientset, namespace)
-		if err != nil {
-			http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		if err := attachNamespaceToRancherProject(ctx, s.clientset, "ns-"+labName, labName); err != nil {
+			http.Error(w, "Something went wrong while attaching namespace ns-"+labName+" to the Rancher project", http.StatusInternalServerError)
 			return
 		}
 
-		if namespaceExists {
-			continue
+		for _, owner := range options.RancherProjectOwners {
+			if err := createRancherProjectRoleBinding(ctx, s.dynamicInterface, labName, owner, "project-owner"); err != nil {
+				http.Error(w, "Something went wrong while making "+owner+" owner of the Rancher project", http.StatusInternalServerError)
+				return
+			}
 		}
+	}
 
-		err = createNamespace(clientset, namespace)
-		if err != nil {
-			http.Error(w, "Something went wrong while creating namespace "+namespace, http.StatusInternalServerError)
+	// Lab-wide permissions are aggregated into a ClusterRole of the lab
+	if options.LabClusterRole {
+		if err := s.createLabClusterRole(ctx, s.clientset, labName); err != nil {
+			http.Error(w, "Something went wrong while creating ClusterRole "+getLabClusterRoleName(labName), http.StatusInternalServerError)
 			return
 		}
+	}
 
-		newNamespaces = append(newNamespaces, namespace)
+	// Give the students a dashboard in which they can log in with their own token
+	if options.Dashboard {
+		if err := createDashboard(ctx, s.clientset, labName, options.DashboardServiceType); err != nil {
+			http.Error(w, "Something went wrong while creating the dashboard for lab "+labName, http.StatusInternalServerError)
+			return
+		}
 	}
 
-	userConfigs := map[string]string{}
+	// Share the GPUs of the lab between multiple pods
+	if options.GpuTimeSlicing > 0 {
+		if err := saveTimeSlicingConfig(ctx, s.clientset, labName, options.GpuTimeSlicing); err != nil {
+			http.Error(w, "Something went wrong while configuring GPU time-slicing for lab "+labName, http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Create users and apply RBAC authorization
-	for _, namespace := range newNamespaces {
-		username := strings.Replace(namespace, "ns-"+labName+"-", "", -1)
+	// List of namespaces that are new (in case of adding groups/students to existing labs)
+	// Used to keep track in which namespaces the configuration should be deployed
+	var newNamespaces []string
 
-		// Create a ServiceAccount for the user
-		token, err := createServiceAccount(clientset, username, namespace)
-		if err != nil {
-			http.Error(w, "Something went wrong while creating service account "+username+" in namespace "+namespace, http.StatusInternalServerError)
-			return
+	missingNamespaces := 0
+	for _, namespace := range namespaces {
+		if !existingNamespaces[namespace] {
+			missingNamespaces++
 		}
+	}
+	job.start(missingNamespaces)
 
-		// Create a full-permission Role for the namespace
-		if err = createRole(clientset, "student", namespace, []string{"*"}); err != nil {
-			http.Error(w, "Something went wrong while creating Role student for namespace "+namespace, http.StatusInternalServerError)
-			return
+	// Create the namespaces
+	for _, namespace := range namespaces {
+		// Check if namespace already exists
+		if existingNamespaces[namespace] {
+			continue
 		}
 
-		// Bind the full-permission Role to the ServiceAccount of the user
-		if err = createRoleBinding(clientset, "student-binding", namespace, username, namespace, "student"); err != nil {
-			http.Error(w, "Something went wrong while creating RoleBinding student-binding for namespace "+namespace+" and user "+username, http.StatusInternalServerError)
+		if err := s.createNamespace(ctx, s.clientset, s.dynamicInterface, namespace); err != nil {
+			http.Error(w, "Something went wrong while creating namespace "+namespace, http.StatusInternalServerError)
 			return
 		}
+		job.addNamespaceCreated(namespace)
 
-		// Bind the read-only Role from the lab namespace to the ServiceAccount of the user
-		if err = createRoleBinding(clientset, "student-binding-"+username, "ns-"+labName, username, namespace, "student"); err != nil {
-			http.Error(w, "Something went wrong while creating RoleBinding student-binding-"+username+" for namespace ns-"+labName, http.StatusInternalServerError)
-			return
+		if options.RancherProject {
+			if err := attachNamespaceToRancherProject(ctx, s.clientset, namespace, labName); err != nil {
+				http.Error(w, "Something went wrong while attaching namespace "+namespace+" to the Rancher project", http.StatusInternalServerError)
+				return
+			}
 		}
 
-		// Bind the read-namespaces-cr to the ServiceAccount of the user
-		if err = createReadNamespacesClusterRoleBinding(clientset, labName, username, namespace); err != nil {
-			http.Error(w, "Something went wrong while creating ClusterRoleBinding for user "+username, http.StatusInternalServerError)
+		newNamespaces = append(newNamespaces, namespace)
+	}
+
+	// The students can only read the namespaces of the lab, which now include the new namespaces
+	if options.NamespaceVisibility == namespaceVisibilityLab {
+		if err := s.updateLabNamespacesClusterRole(ctx, s.clientset, labName); err != nil {
+			http.Error(w, "Something went wrong while updating ClusterRole read-namespaces-cr-"+labName, http.StatusInternalServerError)
 			return
 		}
-
-		// Add the token to the list of tokens
-		userConfigs[username] = token
 	}
 
-	// Get the manifest in different ways based on deploymentMode
-	var manifestFile io.Reader
-	switch deploymentMode {
-	case "YAML":
-		configFile, err := getFormFile(r, "config", "text/yaml")
+	// Shared Services of the lab namespace that get an alias in every namespace
+	var sharedServices []string
+	if options.SharedServiceAliases {
+		objects, err := decodeManifestObjects(manifest)
 		if err != nil {
-			http.Error(w, err.message, err.status)
+			http.Error(w, "Something went wrong while decoding the manifest", http.StatusBadRequest)
 			return
 		}
 
-		manifestFile = configFile
-	case "CHART":
-		helmFile, e := getFormFile(r, "config", "application/gzip", "application/octet-stream")
+		sharedServices = getSharedServiceNames(objects)
+	}
+
+	userConfigs := map[string]string{}
+
+	// Create users and apply RBAC authorization
+	for _, namespace := range newNamespaces {
+		username := strings.Replace(namespace, "ns-"+labName+"-", "", -1)
+
+		if groupNamespaces[namespace] {
+			if e := s.provisionGroupNamespace(ctx, labName, namespace, options); e != nil {
+				http.Error(w, e.message, e.status)
+				return
+			}
+			job.addNamespaceProvisioned(namespace)
+
+			continue
+		}
+		token, e := s.provisionNamespace(ctx, labName, namespace, namespaceStudents[namespace], options, sharedServices)
 		if e != nil {
 			http.Error(w, e.message, e.status)
 			return
 		}
+		job.addNamespaceProvisioned(namespace)
 
-		chart, err := loader.LoadArchive(helmFile)
-		if err != nil {
-			http.Error(w, "Something went wrong while parsing the chart", http.StatusInternalServerError)
-			return
-		}
+		// Add the token (or the identities) to the list of tokens
+		userConfigs[username] = token
+	}
 
-		kubeYaml, err := convertChartToYaml(chart)
-		if err != nil {
-			http.Error(w, "Something went wrong while converting chart to YAML", http.StatusInternalServerError)
-			return
+	if options.SharedOnly {
+		for _, student := range students {
+			username := strings.TrimPrefix(getNamespaceName(student, labName, true), "ns-"+labName+"-")
+
+			token, provisioned, e := s.provisionCourseStudent(ctx, labName, username, student, options)
+			if e != nil {
+				http.Error(w, e.message, e.status)
+				return
+			}
+
+			if provisioned {
+				userConfigs[username] = token
+			}
 		}
+	}
+
+	// Give the new students access to the shared namespace of their group, which may already exist
+	if isHybrid {
+		for _, namespace := range newNamespaces {
+			if groupNamespaces[namespace] {
+				continue
+			}
 
-		manifestFile = strings.NewReader(*kubeYaml)
-	case "CHART_URL":
-		chartUrl := r.Form.Get("config")
+			student := namespaceStudents[namespace][0]
+			if groupNamespace := getNamespaceName(student, labName, false); groupNamespace != "" {
+				if e := s.bindGroupMember(ctx, labName, namespace, groupNamespace, student, options); e != nil {
+					http.Error(w, e.message, e.status)
+					return
+				}
+			}
+		}
+	}
 
-		actionConfig := new(action.Configuration)
+	// Warn the instructor up front when the roles don't let the students use the objects of the manifest
+	objects, err := decodeManifestObjects(manifest)
+	if err != nil {
+		http.Error(w, "Something went wrong while decoding the manifest", http.StatusBadRequest)
+		return
+	}
 
-		kubeconfigPath := getKubeConfig()
-		if err := actionConfig.Init(kube.GetConfig(*kubeconfigPath, "", "default"), "default", os.Getenv("HELM_DRIVER"), nil); err != nil {
-			http.Error(w, "Something went wrong while initiating the action configuration", http.StatusInternalServerError)
-			return
+	var studentNamespaces []string
+	for _, namespace := range newNamespaces {
+		if !groupNamespaces[namespace] {
+			studentNamespaces = append(studentNamespaces, namespace)
 		}
+	}
+
+	accessWarnings := reviewLabAccess(ctx, s.clientset, labName, studentNamespaces, namespaceStudents, options, objects)
+	for _, warning := range accessWarnings {
+		w.Header().Add("Warning", getWarningHeader(warning))
+	}
+
+	encodedOptions, err := encodeLabOptions(options)
+	if err != nil {
+		http.Error(w, "Something went wrong while encoding the lab options", http.StatusInternalServerError)
+		return
+	}
+
+	// Keep the generated identifiers of the students, so they can be exported to external systems
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	identifiers := getStudentIdentifiers(students, labName, isIndividual, isHybrid, options)
+	encodedStudents, err := mergeStudentIdentifiers(labData, identifiers)
+	if err != nil {
+		http.Error(w, "Something went wrong while encoding the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
 
-		settings := cli.New()
-		iCli := action.NewInstall(actionConfig)
+	// Charts (and chart presets) are rendered again for every student namespace, so they can use the values of its students
+	perNamespace := inputs != nil
 
-		chartPath, err := iCli.LocateChart(chartUrl, settings)
+	// Store the manifest so the lab can later be compared with the live objects
+	labUpdate := map[string]string{"manifest": manifest, "options": encodedOptions, "students": encodedStudents, "isIndividual": strconv.FormatBool(isIndividual), "isHybrid": strconv.FormatBool(isHybrid)}
+	var instructions InstructionsParameters
+	if e := decodeForm(r, &instructions); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	if instructions.Instructions != "" {
+		labUpdate["instructions"] = instructions.Instructions
+	}
+
+	// The inputs are stored with the values of every student namespace, so the namespaces can be rendered again later
+	if inputs != nil {
+		storedInputs, err := getStoredRenderInputs(labData)
 		if err != nil {
-			http.Error(w, "Something went wrong while locating the chart", http.StatusInternalServerError)
+			http.Error(w, "Something went wrong while reading the render inputs of lab "+labName, http.StatusInternalServerError)
 			return
 		}
+		if storedInputs != nil {
+			for namespace, values := range storedInputs.NamespaceValues {
+				inputs.NamespaceValues[namespace] = values
+			}
+		}
 
-		chart, err := loader.Load(chartPath)
-		if err != nil {
-			http.Error(w, "Something went wrong while loading the chart", http.StatusInternalServerError)
-			return
+		for _, namespace := range studentNamespaces {
+			inputs.NamespaceValues[namespace] = getStudentValues(namespaceStudents[namespace], labName, namespace, options)
 		}
 
-		kubeYaml, err := convertChartToYaml(chart)
+		encodedInputs, err := encodeRenderInputs(inputs)
 		if err != nil {
-			http.Error(w, "Something went wrong while converting chart to YAML", http.StatusInternalServerError)
+			http.Error(w, "Something went wrong while encoding the render inputs of lab "+labName, http.StatusInternalServerError)
 			return
 		}
+		labUpdate["renderInputs"] = encodedInputs
+	}
+
+	if err := s.saveLabData(r.Context(), labName, labUpdate); err != nil {
+		http.Error(w, "Something went wrong while storing the manifest", http.StatusInternalServerError)
+		return
+	}
 
-		manifestFile = strings.NewReader(*kubeYaml)
+	manifestNamespaces := newNamespaces
+	if perNamespace {
+		manifestNamespaces = nil
+		for _, namespace := range newNamespaces {
+			if groupNamespaces[namespace] {
+				manifestNamespaces = append(manifestNamespaces, namespace)
+			}
+		}
 	}
 
 	// Deploy the manifest on the namespaces
-	if err := handleManifest(clientset, dynamicInterface, manifestFile, labName, newNamespaces, labExists); err != nil {
+	if err := s.handleManifest(ctx, s.clientset, s.dynamicInterface, strings.NewReader(manifest), labName, manifestNamespaces, labExists, options); err != nil {
 		http.Error(w, "Something went wrong while deploying manifest", http.StatusInternalServerError)
 		return
 	}
+	job.addManifestDeployed(manifestNamespaces)
 
-	fmt.Println(newNamespaces)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(userConfigs)
-}
-
-func deleteLab(w http.ResponseWriter, r *http.Request) {
-	// Get URL parameter
-	params := mux.Vars(r)
-	labName := strings.ReplaceAll(params["labName"], "-", "") // Remove - from labname
+	if perNamespace {
+		// The namespaces are rendered from the stored inputs, like when they are reconciled later
+		renderer := deploymentBackends[inputs.DeploymentMode].(NamespaceRenderer)
+		renderRequest, err := inputs.newRequest(ctx)
+		if err != nil {
+			http.Error(w, "Something went wrong while reading the render inputs of lab "+labName, http.StatusInternalServerError)
+			return
+		}
 
-	// Delete all namespaces of which the name starts with ns-labName- or are the general namespace
-	namespaces, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		http.Error(w, "Something went wrong while listing the namespaces", http.StatusInternalServerError)
-		return
-	}
+		for _, namespace := range studentNamespaces {
+			namespaceManifest, e := s.renderNamespaceManifest(renderRequest, renderer, namespace, inputs.NamespaceValues[namespace], options)
+			if e != nil {
+				http.Error(w, e.message, e.status)
+				return
+			}
 
-	for _, namespace := range namespaces.Items {
-		if namespace.Name == "ns-"+labName || strings.HasPrefix(namespace.Name, "ns-"+labName+"-") {
-			if err := clientset.CoreV1().Namespaces().Delete(context.TODO(), namespace.Name, metav1.DeleteOptions{}); err != nil {
-				http.Error(w, "Something went wrong while deleting namespace "+namespace.Name, http.StatusInternalServerError)
+			// The shared objects were already created with the manifest of the lab
+			if err := s.handleManifest(ctx, s.clientset, s.dynamicInterface, strings.NewReader(namespaceManifest), labName, []string{namespace}, true, options); err != nil {
+				http.Error(w, "Something went wrong while deploying manifest in namespace "+namespace, http.StatusInternalServerError)
 				return
 			}
+			job.addManifestDeployed([]string{namespace})
 		}
 	}
 
-	// Delete all ClusterRoleBindings of which the name starts with read-namespaces-crb-labName-
-	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		http.Error(w, "Something went wrong while listing the ClusterRoleBindings", http.StatusInternalServerError)
-		return
+	// One summary per deploy, the access warnings themselves are returned to the instructor
+	fmt.Println("[deploy]", labName, "deployed the manifest in", len(newNamespaces), "new namespaces with", len(accessWarnings), "access warnings")
+
+	var timeline []TimelineEvent
+	for _, namespace := range newNamespaces {
+		timeline = append(timeline, TimelineEvent{Namespace: namespace, Type: timelineCreated}, TimelineEvent{Namespace: namespace, Type: timelineManifestApplied})
 	}
+	s.logTimeline(r.Context(), labName, timeline...)
 
-	for _, clusterRoleBinding := range clusterRoleBindings.Items {
-		if strings.HasPrefix(clusterRoleBinding.Name, "read-namespaces-crb-"+labName+"-") {
-			if err := clientset.RbacV1().ClusterRoleBindings().Delete(context.TODO(), clusterRoleBinding.Name, metav1.DeleteOptions{}); err != nil {
-				http.Error(w, "Something went wrong while deleting namespace "+clusterRoleBinding.Name, http.StatusInternalServerError)
-				return
-			}
+	// Students added to an existing lab are announced one by one
+	if labExists {
+		for _, student := range identifiers {
+			emitWebhook(webhookStudentAdded, map[string]interface{}{"lab": labName, "student": student})
 		}
+	} else {
+		emitWebhook(webhookLabCreated, map[string]interface{}{"lab": labName, "namespaces": newNamespaces, "students": identifiers})
 	}
 
-}
+	// Students get a kubeconfig they can use right away instead of a token they have to assemble into one
+	if format != credentialsFormatToken {
+		if userConfigs, err = getKubeconfigs(ctx, s.clientset, labName, userConfigs, options); err != nil {
+			http.Error(w, "Something went wrong while creating the kubeconfigs of lab "+labName, http.StatusInternalServerError)
+			return
+		}
+	}
 
-func hello(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, "Hello world!")
+	writeCredentials(w, labName, format, userConfigs)
 }
 
 /*
-Helper function that creates the read-namespaces-cr if it does not yet exist
+Returns the subjects that get access to the namespace of a user (or group), either its ServiceAccount or the cloud identities of its students.
 */
-func createNamespaceClusterRoleIfNotExists() error {
-	readNamespaceClusterRoleExists, err := readNamespaceClusterRoleExists(clientset)
-	if err != nil {
-		return err
-	}
-	if !readNamespaceClusterRoleExists {
-		if err := createReadNamespacesClusterRole(clientset); err != nil {
-			return err
-		}
+func getNamespaceSubjects(username string, namespace string, students []Student, options *LabOptions) []rbacv1.Subject {
+	if options.IdentityProvider == "" {
+		return []rbacv1.Subject{getServiceAccountSubject(username, namespace)}
 	}
 
-	return nil
+	return getIdentitySubjects(getIdentities(students))
+}
+
+/*
+Prepares the shared namespace of a group in hybrid mode. The members get access with the subjects of their personal namespace,
+so the group namespace has no credentials of its own.
+*/
+func (s *Server) provisionGroupNamespace(ctx context.Context, labName string, namespace string, options *LabOptions) *Error {
+	if err := s.createStudentRole(ctx, s.clientset, namespace); err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating Role student for namespace " + namespace}
+	}
+
+	if err := s.createLabRoles(ctx, s.clientset, namespace, options.Roles); err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating the roles of namespace " + namespace}
+	}
+
+	// Limit the amount of GPUs the namespace can request
+	if options.GpuCount > 0 {
+		if err := createGpuQuota(ctx, s.clientset, namespace, options.GpuCount); err != nil {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating GPU quota for namespace " + namespace}
+		}
+	}
+
+	// Limit the amount of pods that run at the same time, e.g. against crypto-mining
+	if options.MaxPods > 0 {
+		if err := createPodQuota(ctx, s.clientset, namespace, options.MaxPods); err != nil {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating pod quota for namespace " + namespace}
+		}
+	}
+
+	if e := applyOrganizationQuota(ctx, s.clientset, namespace); e != nil {
+		return e
+	}
+
+	if e := s.applyClusterPolicy(ctx, s.clientset, namespace); e != nil {
+		return e
+	}
+
+	if err := labelEgressNamespace(ctx, s.clientset, labName, namespace, options); err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while labeling namespace " + namespace + " for egress"}
+	}
+
+	if len(options.LogOutputs) > 0 {
+		if err := createLogFlow(ctx, s.dynamicInterface, labName, namespace, options.LogOutputs); err != nil {
+			return &Error{status: http.StatusInternalServerError, message: "Something went wrong while forwarding the logs of namespace " + namespace}
+		}
+	}
+
+	if e := createScheduledTasks(ctx, s.clientset, labName, namespace, taskScopeNamespace, options); e != nil {
+		return e
+	}
+
+	return bindSpectators(ctx, s.clientset, labName, namespace)
+}
+
+/*
+Gives a student access to the shared namespace of their group in hybrid mode, with the subjects of their personal namespace.
+*/
+func (s *Server) bindGroupMember(ctx context.Context, labName string, namespace string, groupNamespace string, student Student, options *LabOptions) *Error {
+	username := strings.TrimPrefix(namespace, "ns-"+labName+"-")
+	subjects := getNamespaceSubjects(username, namespace, []Student{student}, options)
+	roleKind, roleName := s.getRoleRef(student.role)
+
+	if err := createRoleBinding(ctx, s.clientset, "student-binding-"+username, groupNamespace, subjects, roleKind, roleName); err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating RoleBinding student-binding-" + username + " for namespace " + groupNamespace}
+	}
+
+	return nil
+}
+
+/*
+Gives a student of a shared-only lab read access to the shared objects of the lab namespace, with a ServiceAccount in the lab namespace or their identity.
+Returns the token of the ServiceAccount or the identity, and false if the student already had access.
+*/
+func (s *Server) provisionCourseStudent(ctx context.Context, labName string, username string, student Student, options *LabOptions) (string, bool, *Error) {
+	namespace := "ns-" + labName
+
+	exists, err := roleBindingExists(ctx, s.clientset, "student-binding-"+username, namespace)
+	if err != nil {
+		return "", false, &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching RoleBinding student-binding-" + username + " for namespace " + namespace}
+	}
+	if exists {
+		return "", false, nil
+	}
+
+	token := student.identity
+	if options.IdentityProvider == "" {
+		token, err = createServiceAccount(ctx, s.clientset, username, namespace, options.usesTokenRequest(), options.TokenExpirationSeconds, options.TokenAudiences)
+		if err != nil {
+			return "", false, &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating service account " + username + " in namespace " + namespace}
+		}
+	} else if options.IdentityProvider == "eks" {
+		if err = addAwsAuthUsers(ctx, s.clientset, labName, getIdentities([]Student{student})); err != nil {
+			return "", false, &Error{status: http.StatusInternalServerError, message: "Something went wrong while mapping the IAM identity of " + username + " in aws-auth"}
+		}
+	}
+
+	subjects := getNamespaceSubjects(username, namespace, []Student{student}, options)
+
+	if err = createRoleBinding(ctx, s.clientset, "student-binding-"+username, namespace, subjects, "Role", "student"); err != nil {
+		return "", false, &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating RoleBinding student-binding-" + username + " for namespace " + namespace}
+	}
+
+	if err = s.createReadNamespacesClusterRoleBinding(ctx, s.clientset, labName, username, namespace, subjects, getReadNamespacesClusterRoleName(labName, options)); err != nil {
+		return "", false, &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating ClusterRoleBinding read-namespaces-crb-" + labName + "-" + username}
+	}
+
+	return token, true, nil
+}
+
+/*
+Gives the students of a namespace access to it and creates everything the options of the lab require inside of it.
+Returns the token of the ServiceAccount, or the identities of the students when a cloud identity provider is used.
+*/
+func (s *Server) provisionNamespace(ctx context.Context, labName string, namespace string, students []Student, options *LabOptions, sharedServices []string) (string, *Error) {
+	username := strings.Replace(namespace, "ns-"+labName+"-", "", -1)
+	var err error
+
+	// The credentials of the namespace, either the token of a ServiceAccount or the cloud identities of the students
+	var token string
+
+	if options.IdentityProvider == "" {
+		// Create a ServiceAccount for the user
+		token, err = createServiceAccount(ctx, s.clientset, username, namespace, options.usesTokenRequest(), options.TokenExpirationSeconds, options.TokenAudiences)
+		if err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating service account " + username + " in namespace " + namespace}
+		}
+	} else {
+		identities := getIdentities(students)
+
+		// EKS only knows IAM identities that are mapped in aws-auth
+		if options.IdentityProvider == "eks" {
+			if err = addAwsAuthUsers(ctx, s.clientset, labName, identities); err != nil {
+				return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while mapping the IAM identities of " + username + " in aws-auth"}
+			}
+		}
+
+		token = strings.Join(identities, ",")
+	}
+
+	subjects := getNamespaceSubjects(username, namespace, students, options)
+
+	// Create a full-permission Role and the named roles of the lab for the namespace
+	if err = s.createStudentRole(ctx, s.clientset, namespace); err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating Role student for namespace " + namespace}
+	}
+
+	if err = s.createLabRoles(ctx, s.clientset, namespace, options.Roles); err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating the roles of namespace " + namespace}
+	}
+
+	// Bind the role of every student to the user, students that share a ServiceAccount always share their role
+	for role, roleStudents := range getStudentsPerRole(students) {
+		roleKind, roleName := s.getRoleRef(role)
+
+		bindingName := "student-binding"
+		if role != "" {
+			bindingName += "-" + role
+		}
+
+		roleSubjects := subjects
+		if options.IdentityProvider != "" {
+			roleSubjects = getIdentitySubjects(getIdentities(roleStudents))
+		}
+
+		if err = createRoleBinding(ctx, s.clientset, bindingName, namespace, roleSubjects, roleKind, roleName); err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating RoleBinding " + bindingName + " for namespace " + namespace + " and user " + username}
+		}
+	}
+
+	// Bind the read-only Role from the lab namespace to the user
+	if err = createRoleBinding(ctx, s.clientset, "student-binding-"+username, "ns-"+labName, subjects, "Role", "student"); err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating RoleBinding student-binding-" + username + " for namespace ns-" + labName}
+	}
+
+	// Bind the lab-wide permissions of the aggregated ClusterRole to the user
+	if options.LabClusterRole {
+		if err = s.createLabClusterRoleBinding(ctx, s.clientset, labName, username, subjects); err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating ClusterRoleBinding " + getLabClusterRoleName(labName) + "-" + username}
+		}
+	}
+
+	// Bind the read-namespaces ClusterRole to the user
+	if err = s.createReadNamespacesClusterRoleBinding(ctx, s.clientset, labName, username, namespace, subjects, getReadNamespacesClusterRoleName(labName, options)); err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating ClusterRoleBinding for user " + username}
+	}
+
+	// Limit the amount of GPUs the namespace can request
+	if options.GpuCount > 0 {
+		if err = createGpuQuota(ctx, s.clientset, namespace, options.GpuCount); err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating GPU quota for namespace " + namespace}
+		}
+	}
+
+	// Limit the amount of pods that run at the same time, e.g. against crypto-mining
+	if options.MaxPods > 0 {
+		if err = createPodQuota(ctx, s.clientset, namespace, options.MaxPods); err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating pod quota for namespace " + namespace}
+		}
+	}
+
+	// Give the students of the namespace shell access with their SSH keys
+	if keys := getSshKeys(students); options.Ssh && len(keys) > 0 {
+		if err = createSshBastion(ctx, s.clientset, namespace, keys, options.SshServiceType); err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating SSH bastion for namespace " + namespace}
+		}
+	}
+
+	// Make the shared Services reachable with the same short name in every namespace
+	if len(sharedServices) > 0 {
+		if err = createSharedServiceAliases(ctx, s.clientset, labName, namespace, sharedServices); err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating the shared Service aliases for namespace " + namespace}
+		}
+	}
+
+	// Provision a whole cluster for the user, the admin kubeconfig is available once it is ready
+	if options.ClusterClass != "" {
+		if err = createWorkloadCluster(ctx, s.dynamicInterface, username, namespace, labName, options.ClusterClass, options.ClusterVersion, options.ClusterWorkers); err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating the cluster of " + username}
+		}
+	}
+
+	// Every namespace of an organization gets the default quota of the organization
+	if e := applyOrganizationQuota(ctx, s.clientset, namespace); e != nil {
+		return "", e
+	}
+
+	// The quota ceiling and NetworkPolicy of the cluster policy apply to every lab, whatever the instructor asks for
+	if e := s.applyClusterPolicy(ctx, s.clientset, namespace); e != nil {
+		return "", e
+	}
+
+	// Egress gateways recognize the traffic of the students by the labels of their namespace
+	if err = labelEgressNamespace(ctx, s.clientset, labName, namespace, options); err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while labeling namespace " + namespace + " for egress"}
+	}
+
+	// The logs of the students are kept centrally, also after their namespace is deleted
+	if len(options.LogOutputs) > 0 {
+		if err = createLogFlow(ctx, s.dynamicInterface, labName, namespace, options.LogOutputs); err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while forwarding the logs of namespace " + namespace}
+		}
+	}
+
+	if e := createScheduledTasks(ctx, s.clientset, labName, namespace, taskScopeNamespace, options); e != nil {
+		return "", e
+	}
+
+	// Spectators that already have access to the lab can read the new namespace as well
+	if e := bindSpectators(ctx, s.clientset, labName, namespace); e != nil {
+		return "", e
+	}
+
+	return token, nil
+}
+
+/*
+Adds students to an existing lab (e.g. late enrollments) with the stored manifest and options of the lab, so only the roster is uploaded.
+Students that already have an environment are skipped. Charts with per-namespace values are rendered again for every new namespace
+from the stored render inputs of the lab, other labs deploy the stored manifest as is.
+Returns the tokens (or identities) of the new namespaces.
+HTTP Parameters:
+ students: <CSV-file>, <XLSX-file> OR <JSON-file> (not used when the roster comes from an external system)
+ rosterSource, roster, groupCategory, format, async: (optional, see createLabEnvironment)
+*/
+func (s *Server) addStudents(w http.ResponseWriter, r *http.Request) {
+	// Get students from HTTP context
+	students := r.Context().Value(contextKey("students")).([]Student)
+
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	manifest, ok := labData["manifest"]
+	if !ok {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	// Labs that were created before their layout was stored are individual labs
+	isIndividual := labData["isIndividual"] != "false"
+	isHybrid := labData["isHybrid"] == "true"
+
+	// Charts are rendered for the new students with the inputs the lab was created with, other labs deploy the stored manifest as is
+	inputs, err := getStoredRenderInputs(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the render inputs of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	var parameters StudentsParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	if parameters.Async {
+		s.runCreationJob(w, r, labName, func(w http.ResponseWriter, r *http.Request) {
+			s.deployLabEnvironment(w, r, students, labName, inputs, manifest, options, isIndividual, isHybrid)
+		})
+		return
+	}
+
+	s.deployLabEnvironment(w, r, students, labName, inputs, manifest, options, isIndividual, isHybrid)
+}
+
+/*
+Recreates the environment of a student (or group) of an existing lab, e.g. a student that was removed and added again.
+The stored manifest and options of the lab are used, and new credentials are returned.
+There are no snapshots of student namespaces, so the environment is always provisioned fresh.
+HTTP Parameters:
+ identity: <string> (required when the lab uses an identity provider)
+ sshKey: <string> (optional)
+ role: <string> (optional, one of the roles of the lab)
+*/
+func (s *Server) reprovisionStudent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	username := params["username"]
+	namespace := "ns-" + labName + "-" + username
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	manifest, ok := labData["manifest"]
+	if !ok {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if options.SharedOnly {
+		http.Error(w, "Lab "+labName+" is shared-only, its students have no environment to reprovision", http.StatusBadRequest)
+		return
+	}
+
+	var parameters ReprovisionParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	student := Student{name: username, group: -1, identity: parameters.Identity, sshKey: parameters.SshKey, role: parameters.Role}
+	if options.IdentityProvider != "" && student.identity == "" {
+		http.Error(w, "identity is required for labs that use identity provider "+options.IdentityProvider, http.StatusBadRequest)
+		return
+	}
+
+	if e := validateStudentRoles(map[string][]Student{namespace: {student}}, options); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	exists, err := s.namespaceExists(ctx, s.clientset, namespace)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	if exists {
+		http.Error(w, username+" still has an environment in lab "+labName, http.StatusConflict)
+		return
+	}
+
+	// Bindings outside of the namespace were not removed together with it
+	if err := deleteStudentBindings(ctx, s.clientset, labName, username); err != nil {
+		http.Error(w, "Something went wrong while removing the old bindings of "+username, http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.createNamespace(ctx, s.clientset, s.dynamicInterface, namespace); err != nil {
+		http.Error(w, "Something went wrong while creating namespace "+namespace, http.StatusInternalServerError)
+		return
+	}
+
+	if options.RancherProject {
+		if err := attachNamespaceToRancherProject(ctx, s.clientset, namespace, labName); err != nil {
+			http.Error(w, "Something went wrong while attaching namespace "+namespace+" to the Rancher project", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if options.NamespaceVisibility == namespaceVisibilityLab {
+		if err := s.updateLabNamespacesClusterRole(ctx, s.clientset, labName); err != nil {
+			http.Error(w, "Something went wrong while updating ClusterRole read-namespaces-cr-"+labName, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var sharedServices []string
+	if options.SharedServiceAliases {
+		objects, err := decodeManifestObjects(manifest)
+		if err != nil {
+			http.Error(w, "Something went wrong while decoding the manifest", http.StatusInternalServerError)
+			return
+		}
+
+		sharedServices = getSharedServiceNames(objects)
+	}
+
+	token, e := s.provisionNamespace(ctx, labName, namespace, []Student{student}, options, sharedServices)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	// A namespace that was rendered for its students is rendered again
+	inputs, err := getStoredRenderInputs(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the render inputs of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	namespaceManifests, err := s.renderStoredNamespaceManifests(ctx, inputs, []string{namespace}, options)
+	if err != nil {
+		http.Error(w, "Something went wrong while rendering the manifest of namespace "+namespace, http.StatusInternalServerError)
+		return
+	}
+
+	if namespaceManifest, ok := namespaceManifests[namespace]; ok {
+		manifest = namespaceManifest
+	}
+
+	// Only the objects of the student namespaces are deployed, the shared objects still exist
+	if err := s.handleManifest(ctx, s.clientset, s.dynamicInterface, strings.NewReader(manifest), labName, []string{namespace}, true, options); err != nil {
+		http.Error(w, "Something went wrong while deploying manifest", http.StatusInternalServerError)
+		return
+	}
+
+	s.logTimeline(r.Context(), labName, TimelineEvent{Namespace: namespace, Type: timelineCreated, Detail: "reprovisioned"}, TimelineEvent{Namespace: namespace, Type: timelineManifestApplied})
+
+	for _, identifiers := range getStudentIdentifiers([]Student{student}, labName, true, false, options) {
+		emitWebhook(webhookStudentAdded, map[string]interface{}{"lab": labName, "student": identifiers})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{username: token})
+}
+
+/*
+Returns a new token for the ServiceAccount of a user (student or group), with the expiration and audiences of the lab.
+Students use this to refresh short-lived tokens, older tokens stay valid until they expire.
+With withholdUntilReady the token is only returned once the namespace is ready.
+*/
+func (s *Server) refreshToken(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	username := params["username"]
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if options.IdentityProvider != "" {
+		http.Error(w, "Lab "+labName+" uses the identities of the students instead of tokens", http.StatusBadRequest)
+		return
+	}
+
+	// The ServiceAccounts of shared-only labs are in the lab namespace
+	namespace := "ns-" + labName + "-" + username
+	if options.SharedOnly {
+		namespace = "ns-" + labName
+	}
+
+	if e := checkCredentialsReady(r.Context(), s.clientset, options, []string{namespace}); e != nil {
+		writeNotReady(w, e)
+		return
+	}
+
+	token, err := requestServiceAccountToken(r.Context(), s.clientset, username, namespace, options.TokenExpirationSeconds, options.TokenAudiences)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			http.Error(w, username+" has no ServiceAccount in lab "+labName, http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, "Something went wrong while requesting a token for "+username, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{username: token})
+}
+
+/*
+Replaces the ServiceAccount of a user (student or group) when its token leaked or got lost, and returns the new token.
+Unlike refreshToken every earlier token of the user stops working, the namespace and its objects are kept.
+*/
+func (s *Server) regenerateToken(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	username := params["username"]
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if options.IdentityProvider != "" {
+		http.Error(w, "Lab "+labName+" uses the identities of the students instead of tokens", http.StatusBadRequest)
+		return
+	}
+
+	// The ServiceAccounts of shared-only labs are in the lab namespace
+	namespace := "ns-" + labName + "-" + username
+	if options.SharedOnly {
+		namespace = "ns-" + labName
+	}
+
+	token, err := regenerateServiceAccount(r.Context(), s.clientset, username, namespace, options.usesTokenRequest(), options.TokenExpirationSeconds, options.TokenAudiences)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			http.Error(w, username+" has no ServiceAccount in lab "+labName, http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, "Something went wrong while regenerating the token of "+username, http.StatusInternalServerError)
+		return
+	}
+
+	s.logTimeline(r.Context(), labName, TimelineEvent{Namespace: namespace, Type: timelineTokenRegenerated, Detail: "ServiceAccount " + username})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{username: token})
+}
+
+/*
+(Re)issues the tokens of several students of a lab in one call, e.g. to move the students from legacy Secret tokens to bound tokens
+or after a mass revocation. Returns the new tokens and, per student, why no token could be issued.
+HTTP Parameters:
+ usernames: <string> (optional, comma-separated, default every student of the lab)
+ regenerate: <bool> (optional, default false, replaces the ServiceAccounts so every earlier token stops working)
+*/
+func (s *Server) issueTokens(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := labData["manifest"]; !ok {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if options.IdentityProvider != "" {
+		http.Error(w, "Lab "+labName+" uses the identities of the students instead of tokens", http.StatusBadRequest)
+		return
+	}
+
+	identifiers, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	var parameters TokenIssuanceParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	issuance := s.issueLabTokens(r.Context(), s.clientset, labName, identifiers, parameters.Usernames, parameters.Regenerate, options)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(issuance)
+}
+
+/*
+Rolls out a new manifest to the namespaces of an existing lab (PUT or PATCH /lab/{labName}), e.g. to fix a broken manifest of a
+live lab. Objects are created or updated with server-side apply, and with prune the objects of the previous manifest that are
+no longer part of the new manifest are deleted.
+HTTP Parameters:
+ deploymentMode: <string> (required, same as when the lab was created)
+ config, chart, chartVersion, values, valuesProfile: (the manifest, same as when the lab was created)
+ <file>Digest: <string> (optional, e.g. configDigest, the SHA-256 of an earlier upload of the file that is reused from the object store)
+ prune: <bool> (optional, default false)
+ instructions: <string> (optional, replaces the instructions of the lab)
+*/
+func (s *Server) updateLab(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	ctx := r.Context()
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := labData["manifest"]; !ok {
+		http.Error(w, "No manifest is stored for lab "+labName, http.StatusNotFound)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	var parameters LabUpdateParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	manifest, e := s.getManifest(r, &parameters.ManifestParameters)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	manifest, e = s.prepareManifest(manifest, options)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	// The student namespaces are rendered again with the new inputs and the values they were created with
+	inputs, e := s.getRenderInputs(r, &parameters.ManifestParameters)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	encodedInputs := ""
+	if inputs != nil {
+		storedInputs, err := getStoredRenderInputs(labData)
+		if err != nil {
+			http.Error(w, "Something went wrong while reading the render inputs of lab "+labName, http.StatusInternalServerError)
+			return
+		}
+		if storedInputs != nil {
+			inputs.NamespaceValues = storedInputs.NamespaceValues
+		}
+
+		if encodedInputs, err = encodeRenderInputs(inputs); err != nil {
+			http.Error(w, "Something went wrong while encoding the render inputs of lab "+labName, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Applying the manifest creates the new objects and updates the changed ones
+	if err := s.reconcileLab(ctx, s.clientset, s.dynamicInterface, labName, manifest, inputs, options); err != nil {
+		http.Error(w, "Something went wrong while rolling out the manifest of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	pruned := []string{}
+	if parameters.Prune {
+		pruned, err = s.pruneLabObjects(ctx, s.clientset, s.dynamicInterface, labName, manifest, inputs, options)
+		if err != nil {
+			http.Error(w, "Something went wrong while pruning the objects of lab "+labName, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	labUpdate := map[string]string{"manifest": manifest, "renderInputs": encodedInputs}
+	if parameters.Instructions != "" {
+		labUpdate["instructions"] = parameters.Instructions
+	}
+	if err := s.saveLabData(r.Context(), labName, labUpdate); err != nil {
+		http.Error(w, "Something went wrong while storing the manifest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"pruned": pruned})
+}
+
+/*
+Starts the deletion of a lab in the background. Returns the deletion job, of which the progress can be followed at /api/v1/deletions/{id}
+until SCALAMA_JOB_RETENTION after it finished.
+The pre-delete hooks of the lab run first, the lab is not deleted when one of them fails.
+HTTP Parameters:
+ skipHooks: <bool> (optional, default false, deletes the lab without running its pre-delete hooks)
+*/
+func (s *Server) deleteLab(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	var parameters LabDeletionParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	skipHooks := parameters.SkipHooks
+
+	job, err := s.newDeletionJob(labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while creating the deletion job", http.StatusInternalServerError)
+		return
+	}
+
+	// The subscriptions are deleted together with the lab
+	var subscriptions []NotificationSubscription
+	if labData, err := s.getLabData(r.Context(), labName); err == nil {
+		subscriptions, _ = getStoredSubscriptions(labData)
+	}
+
+	// The deletion outlives the request, it is only cancelled when the server shuts down but still runs as the impersonated user
+	ctx := detachedContext{Context: s.shutdownContext, values: r.Context()}
+
+	go func() {
+		e := s.deleteLabResources(ctx, s.clientset, s.dynamicInterface, job, skipHooks)
+		if e != nil {
+			fmt.Println("Something went wrong while deleting lab "+labName+":", e.message)
+		} else {
+			s.sendNotification(subscriptions, Notification{Event: eventLabDeleted, Lab: labName, Title: "Lab " + labName + " deleted", Message: "Every namespace of lab " + labName + " was deleted", CreatedAt: time.Now()})
+			emitWebhook(webhookLabDeleted, map[string]interface{}{"lab": labName})
+		}
+
+		job.finish(e)
+	}()
+
+	deletionJob, _ := s.getDeletionJob(job.Id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPrefix+"/deletions/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(deletionJob)
+}
+
+/*
+Removes a student (or group) from a lab: deletes their namespace with its ServiceAccount, their RoleBindings and their ClusterRoleBindings.
+The other namespaces of the lab are left untouched. Returns the deleted objects, and the steps that failed if the student was only partially removed.
+*/
+func (s *Server) deleteStudent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	username := params["username"]
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	identifiers, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	// In hybrid labs the student also has access to the namespace of their group
+	groupNamespace := ""
+	for _, student := range identifiers {
+		if student.Username == username && student.GroupNamespace != "" {
+			groupNamespace = student.GroupNamespace
+		}
+	}
+
+	// Students of shared-only labs only have a RoleBinding in the lab namespace
+	var exists bool
+	if options.SharedOnly {
+		exists, err = roleBindingExists(ctx, s.clientset, "student-binding-"+username, "ns-"+labName)
+	} else {
+		exists, err = s.namespaceExists(ctx, s.clientset, "ns-"+labName+"-"+username)
+	}
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the environment of "+username, http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, username+" has no environment in lab "+labName, http.StatusNotFound)
+		return
+	}
+
+	report := s.deleteStudentResources(ctx, s.clientset, labName, username, groupNamespace, options.SharedOnly)
+
+	// The student is no longer part of the lab
+	var encodedStudents string
+	if options.SharedOnly {
+		encodedStudents, err = removeSharedStudentIdentifiers(labData, username)
+	} else {
+		encodedStudents, err = removeGroupStudentIdentifiers(labData, report.Namespace)
+	}
+	if err == nil {
+		err = s.saveLabData(r.Context(), labName, map[string]string{"students": encodedStudents})
+	}
+	if err != nil {
+		report.Errors = append(report.Errors, "Something went wrong while removing "+username+" from lab "+labName)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(report.Errors) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+/*
+Deletes the namespace of a group and its RBAC, e.g. for a disbanded group. The other namespaces of the lab are left untouched.
+Returns the deleted objects, and the steps that failed if the group was only partially deleted.
+*/
+func (s *Server) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	groupNumber, err := strconv.Atoi(params["groupNumber"])
+	if err != nil || groupNumber < 0 {
+		http.Error(w, "groupNumber must be a number", http.StatusBadRequest)
+		return
+	}
+
+	groupNamespace := getNamespaceName(Student{group: groupNumber}, labName, false)
+
+	exists, err := s.namespaceExists(r.Context(), s.clientset, groupNamespace)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "Group "+params["groupNumber"]+" has no namespace in lab "+labName, http.StatusNotFound)
+		return
+	}
+
+	report := s.deleteStudentResources(r.Context(), s.clientset, labName, strings.TrimPrefix(groupNamespace, "ns-"+labName+"-"), "", false)
+
+	// The students of the group are no longer part of the lab
+	labData, err := s.getLabData(r.Context(), labName)
+	if err == nil {
+		var encodedStudents string
+		encodedStudents, err = removeGroupStudentIdentifiers(labData, groupNamespace)
+		if err == nil {
+			err = s.saveLabData(r.Context(), labName, map[string]string{"students": encodedStudents})
+		}
+	}
+	if err != nil {
+		report.Errors = append(report.Errors, "Something went wrong while removing the students of "+groupNamespace+" from lab "+labName)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(report.Errors) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+/*
+Merges a group into another group. The members of the group get access to the namespace of the other group,
+the resources in copyResources are copied and the namespace of the group is deleted after the grace period.
+The ServiceAccount of the group is moved to the other namespace, its new token is returned.
+HTTP Parameters:
+ into: <int> (required, the group the group is merged into)
+ copyResources: <string> (optional, comma-separated resources (e.g. "configmaps,deployments.apps") copied to the other namespace)
+ gracePeriod: <string> (optional, default 24h, how long the namespace of the group is kept)
+*/
+func (s *Server) mergeGroup(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	ctx := r.Context()
+
+	groupNumber, err := strconv.Atoi(params["groupNumber"])
+	if err != nil || groupNumber < 0 {
+		http.Error(w, "groupNumber must be a number", http.StatusBadRequest)
+		return
+	}
+
+	var parameters GroupMergeParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	into := *parameters.Into
+	if into == groupNumber {
+		http.Error(w, "into must be the number of another group", http.StatusBadRequest)
+		return
+	}
+
+	gracePeriod, err := time.ParseDuration(parameters.GracePeriod)
+	if err != nil || gracePeriod < 0 {
+		http.Error(w, "gracePeriod must be a duration", http.StatusBadRequest)
+		return
+	}
+
+	groupNamespace := getNamespaceName(Student{group: groupNumber}, labName, false)
+	intoNamespace := getNamespaceName(Student{group: into}, labName, false)
+
+	for _, namespace := range []string{groupNamespace, intoNamespace} {
+		exists, err := s.namespaceExists(ctx, s.clientset, namespace)
+		if err != nil {
+			http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+			return
+		}
+
+		if !exists {
+			http.Error(w, "Namespace "+namespace+" of lab "+labName+" does not exist", http.StatusNotFound)
+			return
+		}
+	}
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	students, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	merge := GroupMerge{Namespace: intoNamespace}
+	roleKind, roleName := s.getStudentRoleRef()
+
+	var members []StudentIdentifiers
+	var groupIdentities []string
+	for _, student := range students {
+		switch {
+		case student.GroupNamespace == groupNamespace:
+			// Members of a hybrid group keep their personal namespace, they only get access to the other group namespace
+			subjects := []rbacv1.Subject{getServiceAccountSubject(student.Username, student.Namespace)}
+			if student.ServiceAccount == "" {
+				subjects = getIdentitySubjects([]string{student.Identity})
+			}
+
+			if err := createRoleBinding(ctx, s.clientset, "student-binding-"+student.Username, intoNamespace, subjects, roleKind, roleName); err != nil {
+				http.Error(w, "Something went wrong while creating RoleBinding student-binding-"+student.Username+" for namespace "+intoNamespace, http.StatusInternalServerError)
+				return
+			}
+
+			student.GroupNamespace = intoNamespace
+			members = append(members, student)
+		case student.Namespace == groupNamespace:
+			groupIdentities = append(groupIdentities, student.Identity)
+			members = append(members, student)
+		}
+	}
+
+	// Members of a group without personal namespaces share the credentials of the group
+	if len(members) > 0 && members[0].Namespace == groupNamespace {
+		username := strings.TrimPrefix(groupNamespace, "ns-"+labName+"-")
+
+		subjects := getIdentitySubjects(groupIdentities)
+		if options.IdentityProvider == "" {
+			// The ServiceAccount would be deleted together with the namespace of the group, so it is moved to the other namespace
+			merge.Token, err = createServiceAccount(ctx, s.clientset, username, intoNamespace, options.usesTokenRequest(), options.TokenExpirationSeconds, options.TokenAudiences)
+			if err != nil {
+				http.Error(w, "Something went wrong while creating service account "+username+" in namespace "+intoNamespace, http.StatusInternalServerError)
+				return
+			}
+
+			subjects = []rbacv1.Subject{getServiceAccountSubject(username, intoNamespace)}
+
+			if err := deleteStudentBindings(ctx, s.clientset, labName, username); err != nil {
+				http.Error(w, "Something went wrong while deleting the bindings of "+username, http.StatusInternalServerError)
+				return
+			}
+
+			if err := createRoleBinding(ctx, s.clientset, "student-binding-"+username, "ns-"+labName, subjects, "Role", "student"); err != nil {
+				http.Error(w, "Something went wrong while creating RoleBinding student-binding-"+username+" for namespace ns-"+labName, http.StatusInternalServerError)
+				return
+			}
+
+			if options.LabClusterRole {
+				if err := s.createLabClusterRoleBinding(ctx, s.clientset, labName, username, subjects); err != nil {
+					http.Error(w, "Something went wrong while creating ClusterRoleBinding "+getLabClusterRoleName(labName)+"-"+username, http.StatusInternalServerError)
+					return
+				}
+			}
+
+			if err := s.createReadNamespacesClusterRoleBinding(ctx, s.clientset, labName, username, intoNamespace, subjects, getReadNamespacesClusterRoleName(labName, options)); err != nil {
+				http.Error(w, "Something went wrong while creating ClusterRoleBinding for user "+username, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := createRoleBinding(ctx, s.clientset, "student-binding-"+username, intoNamespace, subjects, roleKind, roleName); err != nil {
+			http.Error(w, "Something went wrong while creating RoleBinding student-binding-"+username+" for namespace "+intoNamespace, http.StatusInternalServerError)
+			return
+		}
+
+		for i := range members {
+			members[i].Namespace = intoNamespace
+			if options.IdentityProvider == "" {
+				members[i].ServiceAccount = "system:serviceaccount:" + intoNamespace + ":" + username
+			}
+		}
+	}
+
+	merge.Copied, merge.Conflicts, err = copyNamespaceResources(ctx, s.clientset, s.dynamicInterface, parameters.CopyResources, groupNamespace, intoNamespace)
+	if err != nil {
+		http.Error(w, "Something went wrong while copying the resources of namespace "+groupNamespace, http.StatusInternalServerError)
+		return
+	}
+
+	encodedStudents, err := mergeStudentIdentifiers(labData, members)
+	if err != nil {
+		http.Error(w, "Something went wrong while encoding the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.saveLabData(r.Context(), labName, map[string]string{"students": encodedStudents}); err != nil {
+		http.Error(w, "Something went wrong while saving the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if merge.RetireAt, err = s.retireNamespace(ctx, s.clientset, groupNamespace, gracePeriod); err != nil {
+		http.Error(w, "Something went wrong while retiring namespace "+groupNamespace, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merge)
+}
+
+/*
+Returns the variables charts can use as .Values.student.<name> in every student namespace.
+Other columns of the roster are also available under their normalized header, e.g. "Dataset URL" => .Values.student.dataseturl.
+*/
+func getTemplateVariables(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templateVariables)
+}
+
+/*
+Returns the progress of a lab deletion, including the namespaces that are still terminating.
+*/
+func (s *Server) getDeletion(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+
+	deletionJob, ok := s.getDeletionJob(params["id"])
+	if !ok {
+		http.Error(w, "Deletion "+params["id"]+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deletionJob)
+}
+
+/*
+Returns the progress of the asynchronous creation of a lab, and the credentials of the new namespaces once it succeeded.
+The credentials are only returned once, the job can be read until SCALAMA_JOB_RETENTION after it finished.
+*/
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+
+	creationJob, ok := s.getCreationJob(params["id"], true)
+	if !ok {
+		http.Error(w, "Job "+params["id"]+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(creationJob)
+}
+
+/*
+Streams the progress of the asynchronous creation of a lab as Server-Sent Events, with an event for every namespace that is
+created, provisioned and deployed, so a frontend can show a live progress bar.
+*/
+func (s *Server) getJobEvents(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+
+	s.streamCreationEvents(w, r, params["id"])
+}
+
+/*
+Returns the state of a lab: its namespaces with their ServiceAccounts and workloads, and whether the objects of the manifest that are only created once exist.
+*/
+func (s *Server) getLab(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	exists, err := s.namespaceExists(r.Context(), s.clientset, "ns-"+labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	detail, err := s.getLabDetail(r.Context(), s.clientset, s.dynamicInterface, labName, labData["manifest"])
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the state of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+	// Labs of an organization are shown without the prefix of the organization
+	detail.Name = params["labName"]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+/*
+Returns the namespaces of a lab: the lab namespace followed by the student (or group) namespaces.
+Students of labs with lab visibility can't list namespaces, so this is how they find the namespaces they can read.
+*/
+func (s *Server) getNamespaces(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	exists, err := s.namespaceExists(r.Context(), s.clientset, "ns-"+labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	namespaces, err := s.getLabNamespaces(r.Context(), s.clientset, labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while listing the namespaces of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(append([]string{"ns-" + labName}, namespaces...))
+}
+
+/*
+Returns the canonical username and namespace of every student of a lab, the same identifiers ScaLaMa used to provision them.
+*/
+func (s *Server) getStudents(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := labData["manifest"]; !ok {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	students, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(students)
+}
+
+/*
+Returns whether the namespaces of a lab are ready, a namespace is ready once the post-deploy hooks of the manifest completed in it.
+*/
+func (s *Server) getReadiness(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	exists, err := s.namespaceExists(r.Context(), s.clientset, "ns-"+labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	namespaces, err := s.getLabNamespaces(r.Context(), s.clientset, labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while listing the namespaces of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	readiness := map[string]NamespaceReadiness{}
+	for _, namespace := range namespaces {
+		if readiness[namespace], err = getNamespaceReadiness(r.Context(), s.clientset, namespace); err != nil {
+			http.Error(w, "Something went wrong while fetching namespace "+namespace, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readiness)
+}
+
+/*
+Authenticates the user that accesses the namespace of a student (or group) in a lab and returns their username.
+Students of the lab can only access their own namespace or the namespace of their group, the denied message explains what they can do instead.
+If instructors are allowed, the instructors of the organization of the lab and the lab approvers can access every namespace of the lab.
+*/
+func (s *Server) checkNamespaceAccess(r *http.Request, labName string, namespace string, denied string, allowInstructors bool) (string, *Error) {
+	user, e := getRequestUser(r, s.clientset)
+	if e != nil {
+		return "", e
+	}
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching the lab " + labName}
+	}
+
+	identifiers, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the students of lab " + labName}
+	}
+
+	username := user.Username
+	if student, ok := findPortalStudent(identifiers, user.Username); ok {
+		username = student.Username
+		if namespace != student.Namespace && namespace != student.GroupNamespace {
+			return "", &Error{status: http.StatusForbidden, message: username + " " + denied}
+		}
+	} else if !allowInstructors {
+		return "", &Error{status: http.StatusForbidden, message: user.Username + " is not a student of lab " + labName}
+	} else if getRequestOrganization(r.Context()) == nil {
+		approvers, err := getLabApprovers()
+		if err != nil {
+			return "", &Error{status: http.StatusInternalServerError, message: err.Error()}
+		}
+
+		if !isSubject(user, approvers) {
+			return "", &Error{status: http.StatusForbidden, message: user.Username + " is not a student or instructor of lab " + labName}
+		}
+	}
+
+	exists, err := s.namespaceExists(r.Context(), s.clientset, namespace)
+	if err != nil {
+		return "", &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching namespaces"}
+	}
+
+	if !exists {
+		return "", &Error{status: http.StatusNotFound, message: "Namespace " + namespace + " does not exist in lab " + labName}
+	}
+
+	return username, nil
+}
+
+/*
+Resets the namespace of a student (or group) by deleting the objects the students created in it.
+The objects of the manifest and everything ScaLaMa created for the namespace are kept. Returns the deleted objects.
+Students can only reset their own namespace, instructors and lab approvers can reset every namespace of the lab.
+*/
+func (s *Server) resetStudentNamespace(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	namespace := "ns-" + labName + "-" + params["username"]
+
+	if _, e := s.checkNamespaceAccess(r, labName, namespace, "can only reset their own namespace", true); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	deleted, err := resetNamespace(r.Context(), s.clientset, s.dynamicInterface, namespace)
+	if err != nil {
+		http.Error(w, "Something went wrong while resetting namespace "+namespace, http.StatusInternalServerError)
+		return
+	}
+
+	s.logTimeline(r.Context(), labName, TimelineEvent{Namespace: namespace, Type: timelineReset, Detail: fmt.Sprintf("deleted %d objects", len(deleted))})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"deleted": deleted})
+}
+
+/*
+Returns how much of every resource limited by the ResourceQuotas of the namespace of a student (or group) is used, compared to the hard limits.
+Students can only see the quota of their own namespace, instructors and lab approvers can see every namespace of the lab.
+*/
+func (s *Server) getStudentQuota(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	namespace := "ns-" + labName + "-" + params["username"]
+
+	if _, e := s.checkNamespaceAccess(r, labName, namespace, "can only see the quota of their own namespace", true); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	usage, err := getQuotaUsage(r.Context(), s.clientset, namespace)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the quotas of namespace "+namespace, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+/*
+Returns the portal of the student that calls it with their token: the pods, services, ingresses (with their URLs),
+links to the logs of the pods and quota usage of their namespaces, and the instructions and latest announcement of the lab.
+*/
+func (s *Server) getPortal(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	user, e := getRequestUser(r, s.clientset)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	identifiers, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	student, ok := findPortalStudent(identifiers, user.Username)
+	if !ok {
+		http.Error(w, user.Username+" is not a student of lab "+labName, http.StatusForbidden)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if e := checkCredentialsReady(r.Context(), s.clientset, options, getStudentNamespaces(student)); e != nil {
+		writeNotReady(w, e)
+		return
+	}
+
+	portal, err := getStudentPortal(r.Context(), s.clientset, labName, labData, student)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the environment of "+student.Username, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(portal)
+}
+
+/*
+Starts an LTI 1.3 launch (OIDC third-party initiated login): redirects the browser back to the platform to authenticate the student.
+HTTP Parameters:
+ iss: <string> (required, the issuer of the platform)
+ login_hint: <string> (required)
+ target_link_uri: <string> (required, the launch endpoint)
+ lti_message_hint: <string> (optional)
+ client_id: <string> (optional, required when ScaLaMa has multiple registrations on the platform)
+*/
+func (s *Server) ltiLogin(w http.ResponseWriter, r *http.Request) {
+	var parameters LtiLoginParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	platform, ok := s.findLtiPlatform(parameters.Iss, parameters.ClientId)
+	if !ok {
+		http.Error(w, "Unknown LTI platform "+parameters.Iss, http.StatusBadRequest)
+		return
+	}
+
+	state, nonce, err := s.addLtiLogin(platform)
+	if err != nil {
+		http.Error(w, "Something went wrong while starting the LTI login", http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{
+		"scope":         {"openid"},
+		"response_type": {"id_token"},
+		"response_mode": {"form_post"},
+		"prompt":        {"none"},
+		"client_id":     {platform.ClientId},
+		"redirect_uri":  {parameters.TargetLinkUri},
+		"login_hint":    {parameters.LoginHint},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	if hint := parameters.LtiMessageHint; hint != "" {
+		query.Set("lti_message_hint", hint)
+	}
+
+	http.Redirect(w, r, platform.AuthUrl+"?"+query.Encode(), http.StatusFound)
+}
+
+/*
+Completes an LTI 1.3 launch from the LMS: verifies the id_token of the platform, maps the student to their namespace in the lab
+of the custom parameter "lab", and returns their portal and a kubeconfig (when SCALAMA_CLUSTER_SERVER is set and the lab uses ServiceAccounts).
+HTTP Parameters:
+ id_token: <string> (required)
+ state: <string> (required)
+*/
+func (s *Server) ltiLaunch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var parameters LtiLaunchParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	login, ok := s.takeLtiLogin(parameters.State)
+	if !ok {
+		http.Error(w, "The LTI launch expired or was already used, launch the lab again from the LMS", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := s.verifyLtiToken(ctx, login.platform, parameters.IdToken, login.nonce)
+	if err != nil {
+		http.Error(w, "The LTI launch is invalid: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	lab := getLtiClaim(claims, "custom", "lab")
+	if lab == "" {
+		http.Error(w, "The LTI link has no custom parameter lab", http.StatusBadRequest)
+		return
+	}
+	labName := getLabName(r, lab)
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	identifiers, err := getStoredStudentIdentifiers(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the students of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	student, ok := findLtiStudent(identifiers, claims)
+	if !ok {
+		http.Error(w, "You are not a student of lab "+labName, http.StatusForbidden)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if e := checkCredentialsReady(ctx, s.clientset, options, getStudentNamespaces(student)); e != nil {
+		writeNotReady(w, e)
+		return
+	}
+
+	launch := &LtiLaunch{}
+	if server := os.Getenv("SCALAMA_CLUSTER_SERVER"); server != "" && options.IdentityProvider == "" {
+		token, err := requestServiceAccountToken(ctx, s.clientset, student.Username, student.Namespace, options.TokenExpirationSeconds, options.TokenAudiences)
+		if err != nil {
+			http.Error(w, "Something went wrong while requesting a token for "+student.Username, http.StatusInternalServerError)
+			return
+		}
+
+		if launch.Kubeconfig, err = getStudentKubeconfig(ctx, s.clientset, server, student, token); err != nil {
+			http.Error(w, "Something went wrong while creating the kubeconfig of "+student.Username, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if launch.Portal, err = getStudentPortal(ctx, s.clientset, labName, labData, student); err != nil {
+		http.Error(w, "Something went wrong while fetching the environment of "+student.Username, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(launch)
+}
+
+/*
+Requests higher hard limits for a ResourceQuota of the namespace of a student (or group), the request waits for an instructor.
+The student authenticates with their own bearer token, and can only request quota for their namespace or the namespace of their group.
+HTTP Parameters:
+ resources: <string> (required, the requested limits, e.g. "requests.cpu=4,limits.memory=8Gi")
+ quota: <string> (optional, the name of the ResourceQuota, required if the namespace has multiple quotas)
+ reason: <string> (optional)
+*/
+func (s *Server) requestQuotaIncrease(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	namespace := "ns-" + labName + "-" + params["username"]
+
+	// The request is recorded for the authenticated student, not for the username of the URL
+	username, e := s.checkNamespaceAccess(r, labName, namespace, "can only request quota for their own namespace", false)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	// Parse parameters
+	var parameters QuotaRequestParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	hard, e := parseSelector("resources", parameters.Resources)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	quota, e := getRequestedQuota(r.Context(), s.clientset, namespace, parameters.Quota)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	if e := validateQuotaRequest(quota, hard); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	request, err := s.addQuotaRequest(r.Context(), labName, QuotaRequest{
+		Username:  username,
+		Namespace: namespace,
+		Quota:     quota.Name,
+		Hard:      hard,
+		Reason:    parameters.Reason,
+	})
+	if err != nil {
+		http.Error(w, "Something went wrong while storing the quota request of "+username, http.StatusInternalServerError)
+		return
+	}
+
+	s.notifyLab(r.Context(), labName, eventQuotaRequest, "Quota request of "+username, fmt.Sprintf("%s requests %s for quota %s: %s", username, parameters.Resources, quota.Name, request.Reason))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(request)
+}
+
+/*
+Returns the quota requests of a lab, by default the requests that still wait for approval.
+HTTP Parameters:
+ status: <string> (optional, default Pending, ["Pending", "Approved", "Denied"])
+*/
+func (s *Server) getQuotaRequests(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	var parameters QuotaRequestListParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	status := parameters.Status
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	requests, err := getStoredQuotaRequests(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the quota requests of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filterQuotaRequests(requests, status))
+}
+
+/*
+Approves or denies a pending quota request of a lab. Approving raises the ResourceQuota of the namespace to the requested limits.
+Only instructors of the organization of the lab and lab approvers can decide, students of the lab never can.
+HTTP Parameters:
+ comment: <string> (optional, e.g. why the request was denied)
+*/
+func (s *Server) decideQuotaRequest(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	user, e := s.checkQuotaRequestDecider(r, labName)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	var parameters DecisionParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	request, e := s.closeQuotaRequest(r.Context(), s.clientset, labName, params["id"], params["decision"] == "approve", parameters.Comment, user.Username)
+	if e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+/*
+Subscribes an instructor to events of a lab on a notification channel, replacing their previous subscription on that channel.
+HTTP Parameters:
+ instructor: <string> (required, e.g. the username of the instructor)
+ channel: <string> (required, ["EMAIL", "SLACK", "TEAMS", "WEBHOOK"])
+ target: <string> (required, the email address or the URL of the (incoming) webhook)
+ events: <string> (optional, comma-separated, ["alert", "lab-deleted", "pod-terminated", "quota-request"], default every event)
+*/
+func (s *Server) subscribeNotifications(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	// Parse parameters
+	var parameters SubscriptionParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	subscription := NotificationSubscription{Instructor: parameters.Instructor, Channel: parameters.Channel, Target: parameters.Target, Events: parameters.Events}
+
+	notifier, ok := s.notifiers[subscription.Channel]
+	if !ok {
+		http.Error(w, "channel must be one of "+strings.Join(s.getNotificationChannels(), ", "), http.StatusBadRequest)
+		return
+	}
+
+	if err := notifier.validateTarget(subscription.Target); err != nil {
+		http.Error(w, "target is invalid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(subscription.Events) == 0 {
+		subscription.Events = notificationEvents
+	}
+
+	_, err := s.updateSubscriptions(r.Context(), labName, func(subscriptions []NotificationSubscription) []NotificationSubscription {
+		result := []NotificationSubscription{}
+		for _, existing := range subscriptions {
+			if existing.Instructor != subscription.Instructor || existing.Channel != subscription.Channel {
+				result = append(result, existing)
+			}
+		}
+
+		return append(result, subscription)
+	})
+	if err != nil {
+		http.Error(w, "Something went wrong while storing the notification subscriptions of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+/*
+Returns the notification subscriptions of the instructors of a lab.
+*/
+func (s *Server) getNotificationSubscriptions(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	subscriptions, err := getStoredSubscriptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the notification subscriptions of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+/*
+Unsubscribes an instructor from the notifications of a lab.
+HTTP Parameters:
+ channel: <string> (optional, only unsubscribes from this channel)
+*/
+func (s *Server) unsubscribeNotifications(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	instructor := params["instructor"]
+
+	var parameters UnsubscribeParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	channel := parameters.Channel
+
+	removed := false
+	_, err := s.updateSubscriptions(r.Context(), labName, func(subscriptions []NotificationSubscription) []NotificationSubscription {
+		result := []NotificationSubscription{}
+		for _, existing := range subscriptions {
+			if existing.Instructor == instructor && (channel == "" || existing.Channel == channel) {
+				removed = true
+				continue
+			}
+
+			result = append(result, existing)
+		}
+
+		return result
+	})
+	if err != nil {
+		http.Error(w, "Something went wrong while storing the notification subscriptions of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, instructor+" has no notification subscriptions in lab "+labName, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Receives the audit events of the API server (its audit webhook backend, authenticated with SCALAMA_AUDIT_TOKEN as bearer token)
+and raises alerts for suspicious activity in the labs.
+*/
+func (s *Server) receiveAuditEvents(w http.ResponseWriter, r *http.Request) {
+	token := getAuditToken()
+	if token == "" {
+		http.Error(w, "The audit webhook is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "The audit token is invalid", http.StatusUnauthorized)
+		return
+	}
+
+	events := &auditv1.EventList{}
+	if err := json.NewDecoder(r.Body).Decode(events); err != nil {
+		http.Error(w, "Something went wrong while decoding the audit events", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	for i := range events.Items {
+		if err := s.processAuditEvent(r.Context(), &events.Items[i], now); err != nil {
+			fmt.Println("Something went wrong while processing audit event "+string(events.Items[i].AuditID)+":", err)
+		}
+	}
+}
+
+/*
+Returns the lifecycle events of the namespace of a student (or group), oldest first.
+The events are kept with the lab, so the timeline of a removed student remains available.
+*/
+func (s *Server) getStudentTimeline(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	username := params["username"]
+	namespace := "ns-" + labName + "-" + username
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	timeline, err := getStoredTimeline(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the timeline of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	events, ok := timeline[namespace]
+	if !ok {
+		http.Error(w, username+" has no timeline in lab "+labName, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+/*
+Returns the alerts of suspicious activity in a lab, newest first.
+HTTP Parameters:
+ kind: <string> (optional, ["token-ips", "privilege-escalation", "unexpected-registry"])
+ username: <string> (optional, only the alerts of this user)
+*/
+func (s *Server) getAlerts(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	var parameters AlertListParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	alerts, err := getStoredAlerts(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the alerts of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filterAlerts(alerts, parameters.Kind, parameters.Username))
+}
+
+/*
+Gives a spectator (e.g. an external examiner) read-only access to every namespace of a lab for a limited time.
+Returns the token of the spectator, the access is revoked automatically when it expires.
+HTTP Parameters:
+ name: <string> (required, a DNS label)
+ duration: <string> (optional, default 8h, at least 10m)
+*/
+func (s *Server) createSpectator(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	var parameters SpectatorParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	name := parameters.Name
+	duration, err := time.ParseDuration(parameters.Duration)
+	if err != nil {
+		http.Error(w, "duration must be a duration (e.g. 8h)", http.StatusBadRequest)
+		return
+	}
+
+	if e := validateSpectator(name, duration); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	exists, err := s.namespaceExists(r.Context(), s.clientset, "ns-"+labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	spectator, err := s.createSpectatorAccount(r.Context(), s.clientset, labName, name, duration)
+	if err != nil {
+		if errors.IsAlreadyExists(err) {
+			http.Error(w, "Spectator "+name+" already has access to lab "+labName, http.StatusConflict)
+			return
+		}
+
+		http.Error(w, "Something went wrong while giving spectator "+name+" access to lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(spectator)
+}
+
+/*
+Writes an announcement of the instructors into every namespace of a lab, replacing the previous announcement.
+HTTP Parameters:
+ message: <string> (required, e.g. "Re-pull the image of exercise 2")
+ motd: <bool> (optional, default false, shows the announcement as message of the day in the portal)
+*/
+func (s *Server) createAnnouncement(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	var parameters AnnouncementParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	announcement := Announcement{Message: parameters.Message, Motd: parameters.Motd, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+
+	exists, err := s.namespaceExists(r.Context(), s.clientset, "ns-"+labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching namespaces", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	namespaces, err := s.broadcastAnnouncement(r.Context(), s.clientset, labName, announcement)
+	if err != nil {
+		http.Error(w, "Something went wrong while writing the announcement to the namespaces of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"announcement": announcement, "namespaces": namespaces})
+}
+
+/*
+Returns the spectators of a lab whose access has not expired yet.
+*/
+func (s *Server) getSpectators(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	spectators, err := getSpectators(r.Context(), s.clientset, labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the spectators of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spectators)
+}
+
+/*
+Revokes the access of a spectator to a lab before it expires.
+*/
+func (s *Server) deleteSpectator(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	name := params["name"]
+
+	if err := s.revokeSpectator(r.Context(), s.clientset, labName, name); err != nil {
+		http.Error(w, "Something went wrong while revoking spectator "+name+" of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Returns the labs with the namespaces of their students and groups. Within an organization only its labs are listed.
+*/
+func (s *Server) getLabs(w http.ResponseWriter, r *http.Request) {
+	labs, err := s.getLabSummaries(r.Context(), s.clientset, getRequestOrganization(r.Context()))
+	if err != nil {
+		http.Error(w, "Something went wrong while listing the labs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labs)
+}
+
+/*
+Returns the labs that are being provisioned and the labs that wait in the provisioning queue, with their position.
+Within an organization only its labs are listed.
+*/
+func (s *Server) getProvisioningQueue(w http.ResponseWriter, r *http.Request) {
+	organization := ""
+	if requestOrganization := getRequestOrganization(r.Context()); requestOrganization != nil {
+		organization = requestOrganization.Name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.labQueue.list(organization))
+}
+
+/*
+Returns the labs of an organization, only the admins of the organization can see every lab.
+*/
+func (s *Server) getOrganizationLabs(w http.ResponseWriter, r *http.Request) {
+	organization := getRequestOrganization(r.Context())
+
+	if isAdmin, _ := r.Context().Value(organizationAdminKey{}).(bool); !isAdmin {
+		http.Error(w, "Only the admins of organization "+organization.Name+" can list its labs", http.StatusForbidden)
+		return
+	}
+
+	labNames, err := getOrganizationLabs(r.Context(), s.clientset, organization)
+	if err != nil {
+		http.Error(w, "Something went wrong while listing the labs of organization "+organization.Name, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labNames)
+}
+
+/*
+Returns the uploads in the object store, so a lab can reuse one with <file>Digest instead of uploading it again.
+HTTP Parameters:
+ field: <string> (optional, only the uploads of this file, e.g. config or values)
+*/
+func (s *Server) getArtifacts(w http.ResponseWriter, r *http.Request) {
+	if s.objectStore == nil {
+		http.Error(w, "Uploads are only kept with an object store, see SCALAMA_OBJECT_STORE_URL", http.StatusNotFound)
+		return
+	}
+
+	var parameters ArtifactListParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	artifacts, err := s.getStoredArtifacts(r.Context(), parameters.Field)
+	if err != nil {
+		http.Error(w, "Something went wrong while listing the artifacts in the object store", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+/*
+Returns the archives of deleted labs in the object store with when they expire, and the storage they use.
+HTTP Parameters:
+ lab: <string> (optional, only the archives of this lab)
+*/
+func (s *Server) getArchives(w http.ResponseWriter, r *http.Request) {
+	if s.objectStore == nil {
+		http.Error(w, "Deleted labs are only archived with an object store, see SCALAMA_OBJECT_STORE_URL", http.StatusNotFound)
+		return
+	}
+
+	var parameters ArchiveListParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	labName := ""
+	if lab := parameters.Lab; lab != "" {
+		labName = getLabName(r, lab)
+	}
+
+	report, err := s.getArchiveReport(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while listing the archives in the object store", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+/*
+Returns an archive of a deleted lab with its stored state, e.g. to export the students and requests of an old course.
+*/
+func (s *Server) getArchive(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	if s.objectStore == nil {
+		http.Error(w, "Deleted labs are only archived with an object store, see SCALAMA_OBJECT_STORE_URL", http.StatusNotFound)
+		return
+	}
+
+	data, _, err := s.objectStore.getObject(r.Context(), "archives/"+labName+"/"+params["id"]+".json")
+	if err == errObjectNotFound {
+		http.Error(w, "Lab "+labName+" has no archive "+params["id"], http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the archive from the object store", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+/*
+Compares the stored manifest of a lab with the live objects in its namespaces.
+Returns the drift of every object for the lab namespace and per student (or group).
+*/
+func (s *Server) getDrift(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	labData, err := s.getLabData(r.Context(), labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	manifest, ok := labData["manifest"]
+	if !ok {
+		http.Error(w, "No manifest is stored for lab "+labName, http.StatusNotFound)
+		return
+	}
+
+	options, err := getStoredLabOptions(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the options of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	inputs, err := getStoredRenderInputs(labData)
+	if err != nil {
+		http.Error(w, "Something went wrong while reading the render inputs of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	labDrift, err := s.getLabDrift(r.Context(), s.clientset, s.dynamicInterface, labName, manifest, inputs, options)
+	if err != nil {
+		http.Error(w, "Something went wrong while comparing the manifest with the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labDrift)
+}
+
+/*
+Returns the objects ScaLaMa created from the manifest of a lab, per namespace of the lab.
+*/
+func (s *Server) getInventory(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameter
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+
+	labExists, err := s.namespaceExists(r.Context(), s.clientset, "ns-"+labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	if !labExists {
+		http.Error(w, "Lab "+labName+" does not exist", http.StatusNotFound)
+		return
+	}
+
+	inventory, err := s.getLabInventory(r.Context(), s.clientset, labName)
+	if err != nil {
+		http.Error(w, "Something went wrong while fetching the inventory of lab "+labName, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inventory)
+}
+
+/*
+Returns the admin kubeconfig of the Cluster API cluster of a user (student or group) of a lab.
+Students can only fetch the kubeconfig of their own cluster, instructors and lab approvers can fetch every cluster of the lab.
+*/
+func (s *Server) getClusterKubeconfig(w http.ResponseWriter, r *http.Request) {
+	// Get URL parameters
+	params := mux.Vars(r)
+	labName := getLabName(r, params["labName"])
+	username := params["username"]
+	namespace := "ns-" + labName + "-" + username
+
+	if _, e := s.checkNamespaceAccess(r, labName, namespace, "can only fetch the kubeconfig of their own cluster", true); e != nil {
+		http.Error(w, e.message, e.status)
+		return
+	}
+
+	kubeconfig, err := getWorkloadClusterKubeconfig(r.Context(), s.clientset, username, namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			http.Error(w, "The cluster of "+username+" is not provisioned yet", http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, "Something went wrong while fetching the kubeconfig of "+username, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/yaml")
+	w.Write(kubeconfig)
+}
+
+/*
+Registers the routes of the API on router. Every route that changes the cluster or the state of a lab runs as the impersonated user, except:
+ - /lti/login and /lti/launch, the LMS authenticates with a signed id_token instead of a bearer token
+ - /audit, the API server posts its audit events with the token of the webhook, which is not a user of ScaLaMa
+ - the quota request of a student, which only stores the request in the ConfigMap of the lab that students can't write
+*/
+func (s *Server) registerRoutes(router *mux.Router) {
+	router.HandleFunc("/lab", s.impersonationMiddleware(s.labSpecMiddleware(s.studentsMiddleware(s.createLabEnvironment)))).Methods("POST")
+	router.HandleFunc("/lab", s.getLabs).Methods("GET")
+	router.HandleFunc("/provisioning", s.getProvisioningQueue).Methods("GET")
+	router.HandleFunc("/lab/{labName}", s.getLab).Methods("GET")
+	router.HandleFunc("/lab/{labName}", s.impersonationMiddleware(s.updateLab)).Methods("PUT", "PATCH")
+	router.HandleFunc("/lab/{labName}", s.impersonationMiddleware(s.deleteLab)).Methods("DELETE")
+	router.HandleFunc("/deletions/{id}", s.getDeletion).Methods("GET")
+	router.HandleFunc("/job/{id}", s.getJob).Methods("GET")
+	router.HandleFunc("/job/{id}/events", s.getJobEvents).Methods("GET")
+	router.HandleFunc("/approvals", s.getLabApprovals).Methods("GET")
+	router.HandleFunc("/approvals/{id}", s.getApproval).Methods("GET")
+	router.HandleFunc("/approvals/{id}/{decision:approve|reject}", s.impersonationMiddleware(s.decideLabApproval)).Methods("POST")
+	router.HandleFunc("/template-variables", getTemplateVariables).Methods("GET")
+	router.HandleFunc("/lab-spec/schema", getLabSpecSchema).Methods("GET")
+	router.HandleFunc("/lab-spec/example", getLabSpecExample).Methods("GET")
+	router.HandleFunc("/validate", s.impersonationMiddleware(s.validateLab)).Methods("POST")
+	router.HandleFunc("/estimate", s.impersonationMiddleware(s.labSpecMiddleware(s.estimateLab))).Methods("POST")
+	router.HandleFunc("/cluster-policy", s.getClusterPolicy).Methods("GET")
+	router.HandleFunc("/openapi", s.getOpenApi).Methods("GET")
+	router.HandleFunc("/openapi/ui", getSwaggerUi).Methods("GET")
+	router.HandleFunc("/artifacts", s.getArtifacts).Methods("GET")
+	router.HandleFunc("/archives", s.getArchives).Methods("GET")
+	router.HandleFunc("/archives/{labName}/{id:[0-9]+}", s.getArchive).Methods("GET")
+	router.HandleFunc("/lab/{labName}/groups/{groupNumber}", s.impersonationMiddleware(s.deleteGroup)).Methods("DELETE")
+	router.HandleFunc("/lab/{labName}/groups/{groupNumber}/merge", s.impersonationMiddleware(s.mergeGroup)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/students/{username}", s.impersonationMiddleware(s.reprovisionStudent)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/students/{username}", s.impersonationMiddleware(s.deleteStudent)).Methods("DELETE")
+	router.HandleFunc("/lab/{labName}/students/{username}/token", s.impersonationMiddleware(s.refreshToken)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/token/{username}", s.impersonationMiddleware(s.regenerateToken)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/tokens", s.impersonationMiddleware(s.issueTokens)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/namespaces", s.getNamespaces).Methods("GET")
+	router.HandleFunc("/lab/{labName}/students", s.getStudents).Methods("GET")
+	router.HandleFunc("/lab/{labName}/students", s.impersonationMiddleware(s.studentsMiddleware(s.addStudents))).Methods("POST")
+	router.HandleFunc("/lab/{labName}/students/{username}/quota", s.getStudentQuota).Methods("GET")
+	router.HandleFunc("/lab/{labName}/portal", s.getPortal).Methods("GET")
+	router.HandleFunc("/lti/login", s.ltiLogin).Methods("GET", "POST")
+	router.HandleFunc("/lti/launch", s.ltiLaunch).Methods("POST")
+	router.HandleFunc("/lab/{labName}/announcements", s.impersonationMiddleware(s.createAnnouncement)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/students/{username}/quota/requests", s.requestQuotaIncrease).Methods("POST")
+	router.HandleFunc("/lab/{labName}/quota-requests", s.getQuotaRequests).Methods("GET")
+	router.HandleFunc("/lab/{labName}/quota-requests/{id}/{decision:approve|deny}", s.impersonationMiddleware(s.decideQuotaRequest)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/alerts", s.getAlerts).Methods("GET")
+	router.HandleFunc("/lab/{labName}/notifications", s.getNotificationSubscriptions).Methods("GET")
+	router.HandleFunc("/lab/{labName}/notifications", s.impersonationMiddleware(s.subscribeNotifications)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/notifications/{instructor}", s.impersonationMiddleware(s.unsubscribeNotifications)).Methods("DELETE")
+	router.HandleFunc("/audit", s.receiveAuditEvents).Methods("POST")
+	router.HandleFunc("/lab/{labName}/spectators", s.impersonationMiddleware(s.createSpectator)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/spectators", s.getSpectators).Methods("GET")
+	router.HandleFunc("/lab/{labName}/spectators/{name}", s.impersonationMiddleware(s.deleteSpectator)).Methods("DELETE")
+	router.HandleFunc("/lab/{labName}/students/{username}/reset", s.impersonationMiddleware(s.resetStudentNamespace)).Methods("POST")
+	router.HandleFunc("/lab/{labName}/students/{username}/timeline", s.getStudentTimeline).Methods("GET")
+	router.HandleFunc("/lab/{labName}/drift", s.getDrift).Methods("GET")
+	router.HandleFunc("/lab/{labName}/readiness", s.getReadiness).Methods("GET")
+	router.HandleFunc("/lab/{labName}/inventory", s.getInventory).Methods("GET")
+	router.HandleFunc("/lab/{labName}/clusters/{username}/kubeconfig", s.getClusterKubeconfig).Methods("GET")
+}
+
+/*
+Marks the routes without version prefix as deprecated, and points to the same route under the prefix.
+*/
+func deprecationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiPrefix+r.URL.Path+">; rel=\"successor-version\"")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hello(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "Hello world!")
+}
+
+/*
+Helper function that creates the read-namespaces-cr if it does not yet exist
+*/
+func (s *Server) createNamespaceClusterRoleIfNotExists(ctx context.Context) error {
+	readNamespaceClusterRoleExists, err := readNamespaceClusterRoleExists(ctx, s.clientset)
+	if err != nil {
+		return err
+	}
+	if !readNamespaceClusterRoleExists {
+		if err := createReadNamespacesClusterRole(ctx, s.clientset); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func main() {
-	// Initialise singletons
-	cs, dd, err := getClientSet()
+	flag.Parse()
+
+	var s *Server
+	if *demoMode {
+		s = newServer(getFakeClientSet())
+		fmt.Println("Running in demo mode against an in-memory cluster")
+	} else {
+		clientset, dynamicInterface, err := getClientSet()
+		if err != nil {
+			panic(err.Error())
+		}
+		s = newServer(clientset, dynamicInterface)
+
+		if *dryRunMode {
+			fmt.Println("Running in dry-run mode, changes are validated but not persisted")
+		}
+	}
+
+	openShift, err := detectOpenShift(s.clientset)
+	if err != nil {
+		panic(err.Error())
+	}
+	s.isOpenShift = openShift
+
+	rancher, err := detectRancher(s.clientset)
+	if err != nil {
+		panic(err.Error())
+	}
+	s.isRancher = rancher
+
+	timeout, err := getOperationTimeout()
+	if err != nil {
+		panic(err.Error())
+	}
+	s.operationTimeout = timeout
+
+	// The concurrency is read whenever a lab is provisioned, so a wrong value is reported at startup
+	if _, err := getProvisioningConcurrency(); err != nil {
+		panic(err.Error())
+	}
+
+	if _, _, err := getManifestLimits(); err != nil {
+		panic(err.Error())
+	}
+
+	if _, err := getChartRepositoryCacheTtl(); err != nil {
+		panic(err.Error())
+	}
+
+	if _, err := getJobRetention(); err != nil {
+		panic(err.Error())
+	}
+
+	if _, err := getApprovalThresholds(); err != nil {
+		panic(err.Error())
+	}
+
+	if _, err := getLabApprovers(); err != nil {
+		panic(err.Error())
+	}
+
+	loadedOrganizations, err := loadOrganizations()
+	if err != nil {
+		panic(err.Error())
+	}
+	s.organizations = loadedOrganizations
+
+	loadedClusterPolicy, err := loadClusterPolicy()
+	if err != nil {
+		panic(err.Error())
+	}
+	s.clusterPolicy = loadedClusterPolicy
+
+	loadedLtiPlatforms, err := loadLtiPlatforms()
+	if err != nil {
+		panic(err.Error())
+	}
+	s.ltiPlatforms = loadedLtiPlatforms
+
+	openedObjectStore, err := openObjectStore()
+	if err != nil {
+		panic(err.Error())
+	}
+	s.objectStore = openedObjectStore
+
+	openedLabStore, err := openLabStore()
+	if err != nil {
+		panic(err.Error())
+	}
+	s.labStore = openedLabStore
+
+	// Cancelled on shutdown, which also cancels the Kubernetes operations of requests that are still running.
+	// Requests and background loops derive their context from it, so it also carries the operation timeout
+	ctx, stop := signal.NotifyContext(withOperationTimeoutValue(context.Background(), s.operationTimeout), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s.shutdownContext = ctx
+
+	// Existence checks and listings are served from the caches of the informers
+	if err := s.startInformers(ctx, s.clientset); err != nil {
+		panic(err.Error())
+	}
+
+	if err := s.createNamespaceClusterRoleIfNotExists(ctx); err != nil {
+		panic(err.Error())
+	}
+
+	if err := s.scheduleSpectatorRevocations(ctx, s.clientset); err != nil {
+		panic(err.Error())
+	}
+
+	// Merged groups whose grace period passed while ScaLaMa was not running are deleted now, the others are scheduled again
+	if err := s.scheduleNamespaceRetirements(ctx, s.clientset); err != nil {
+		panic(err.Error())
+	}
+
+	// Start the optional reconciliation loop that restores instructor-managed objects
+	reconcileInterval, err := getReconcileInterval()
 	if err != nil {
 		panic(err.Error())
 	}
-	clientset = cs
-	dynamicInterface = dd
+	if reconcileInterval > 0 {
+		go s.startReconcileLoop(ctx, s.clientset, s.dynamicInterface, reconcileInterval)
+	}
+
+	// Students only have full access to their namespaces during the access windows of their lab
+	go s.startAccessWindowLoop(ctx, s.clientset)
 
-	if err := createNamespaceClusterRoleIfNotExists(); err != nil {
+	// Pods that run longer than the maximum runtime of their lab are terminated
+	go s.startPodRuntimeLoop(ctx, s.clientset)
+
+	// The archives of deleted labs are purged once they outlived their retention
+	if _, err := getArchiveRetentionDays(); err != nil {
 		panic(err.Error())
 	}
+	if s.objectStore != nil {
+		go s.startArchiveRetentionLoop(ctx)
+	}
 
 	// Set up API
 	router := mux.NewRouter()
-
 	router.HandleFunc("/", hello).Methods("GET")
-	router.HandleFunc("/lab", studentsMiddleware(createLabEnvironment)).Methods("POST")
-	router.HandleFunc("/lab/{labName}", deleteLab).Methods("DELETE")
 
-	http.Handle("/", router)
+	// Probes of the ScaLaMa Deployment, outside the API so they are never deprecated or scoped to an organization
+	router.HandleFunc("/healthz", getServerHealth).Methods("GET")
+	router.HandleFunc("/readyz", s.getServerReadiness).Methods("GET")
+
+	// Every organization has its own lab names, with the same routes under its prefix
+	organizationRouter := router.PathPrefix(apiPrefix + "/orgs/{organization}").Subrouter()
+	organizationRouter.Use(s.organizationMiddleware)
+	organizationRouter.HandleFunc("/labs", s.getOrganizationLabs).Methods("GET")
+	s.registerRoutes(organizationRouter)
+
+	s.registerRoutes(router.PathPrefix(apiPrefix).Subrouter())
+
+	// The routes without prefix are kept for existing scripts
+	legacyRouter := router.NewRoute().Subrouter()
+	legacyRouter.Use(deprecationMiddleware)
+	s.registerRoutes(legacyRouter)
+
+	server := &http.Server{
+		Addr:        ":3000",
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		fmt.Println("Shutting down")
+		server.Shutdown(context.Background())
+	}()
+
 	fmt.Println("Listening on :3000")
-	http.ListenAndServe(":3000", nil)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		panic(err.Error())
+	}
 }
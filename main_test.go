@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Returns a server on a fake cluster with lab "lab", whose students are stored like a created lab stores them.
+The TokenReviews of the fake cluster authenticate every token as the user with that name.
+*/
+func newTestServer(t *testing.T, students ...StudentIdentifiers) *Server {
+	t.Helper()
+
+	s := newServer(getFakeClientSet())
+	if len(students) == 0 {
+		return s
+	}
+
+	encoded, err := json.Marshal(students)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveLabData(context.Background(), "lab", map[string]string{"students": string(encoded)}); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+/*
+Returns a request of the user of token (none if empty) with the URL parameters of its route.
+*/
+func newTestRequest(method string, target string, token string, vars map[string]string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return mux.SetURLVars(r, vars)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Events of a lab instructors can be notified about
+const (
+	eventQuotaRequest  = "quota-request"
+	eventAlert         = "alert"
+	eventPodTerminated = "pod-terminated"
+	eventLabDeleted    = "lab-deleted"
+)
+
+// Instructors are notified of the decision on their lab on the channel they asked for when it needed approval
+const eventLabApproval = "lab-approval"
+
+var notificationEvents = []string{eventAlert, eventLabDeleted, eventPodTerminated, eventQuotaRequest}
+
+// Something that happened in a lab, sent to the instructors that subscribed to its event
+type Notification struct {
+	Event     string    `json:"event"`
+	Lab       string    `json:"lab"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// The channel an instructor is notified on about some events of a lab, the target is an email address or a webhook URL
+type NotificationSubscription struct {
+	Instructor string   `json:"instructor"`
+	Channel    string   `json:"channel"`
+	Target     string   `json:"target"`
+	Events     []string `json:"events"`
+}
+
+// Sends notifications to a target of a channel
+type Notifier interface {
+	validateTarget(target string) error
+	notify(ctx context.Context, target string, notification Notification) error
+}
+
+/*
+Returns every notification channel and how it sends notifications, new channels only have to be added here.
+*/
+func newNotifiers() map[string]Notifier {
+	return map[string]Notifier{
+		"EMAIL":   emailNotifier{},
+		"SLACK":   slackNotifier{},
+		"TEAMS":   teamsNotifier{},
+		"WEBHOOK": webhookNotifier{},
+	}
+}
+
+/*
+Returns the supported notification channels, sorted.
+*/
+func (s *Server) getNotificationChannels() []string {
+	var channels []string
+	for channel := range s.notifiers {
+		channels = append(channels, channel)
+	}
+
+	sort.Strings(channels)
+	return channels
+}
+
+/*
+Checks that a webhook target is an absolute http(s) URL.
+*/
+func validateWebhookUrl(target string) error {
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return fmt.Errorf("%s is not an http(s) URL", target)
+	}
+
+	return nil
+}
+
+/*
+POSTs a JSON body to a webhook.
+*/
+func postWebhook(ctx context.Context, target string, body interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return postJson(ctx, target, encoded, nil)
+}
+
+/*
+POSTs an encoded JSON body with extra headers (e.g. a signature) to a URL, any response other than 2xx is an error.
+*/
+func postJson(ctx context.Context, target string, encoded []byte, headers map[string]string) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", target, response.Status)
+	}
+
+	return nil
+}
+
+// Emails sent with the SMTP server configured by SCALAMA_SMTP_ADDR (host:port), SCALAMA_SMTP_FROM
+// and optionally SCALAMA_SMTP_USERNAME and SCALAMA_SMTP_PASSWORD
+type emailNotifier struct{}
+
+func (emailNotifier) validateTarget(target string) error {
+	if os.Getenv("SCALAMA_SMTP_ADDR") == "" || os.Getenv("SCALAMA_SMTP_FROM") == "" {
+		return fmt.Errorf("email notifications require SCALAMA_SMTP_ADDR and SCALAMA_SMTP_FROM")
+	}
+
+	_, err := mail.ParseAddress(target)
+	return err
+}
+
+func (emailNotifier) notify(ctx context.Context, target string, notification Notification) error {
+	addr, from := os.Getenv("SCALAMA_SMTP_ADDR"), os.Getenv("SCALAMA_SMTP_FROM")
+
+	var auth smtp.Auth
+	if username := os.Getenv("SCALAMA_SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SCALAMA_SMTP_PASSWORD"), strings.Split(addr, ":")[0])
+	}
+
+	// Header values can't contain line breaks
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace("[ScaLaMa] " + notification.Title)
+	message := "From: " + from + "\r\nTo: " + target + "\r\nSubject: " + subject + "\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n" + notification.Message + "\r\n"
+
+	return smtp.SendMail(addr, auth, from, []string{target}, []byte(message))
+}
+
+// Slack incoming webhooks
+type slackNotifier struct{}
+
+func (slackNotifier) validateTarget(target string) error {
+	return validateWebhookUrl(target)
+}
+
+func (slackNotifier) notify(ctx context.Context, target string, notification Notification) error {
+	return postWebhook(ctx, target, map[string]string{"text": "*" + notification.Title + "*\n" + notification.Message})
+}
+
+// Microsoft Teams incoming webhooks, which take message cards
+type teamsNotifier struct{}
+
+func (teamsNotifier) validateTarget(target string) error {
+	return validateWebhookUrl(target)
+}
+
+func (teamsNotifier) notify(ctx context.Context, target string, notification Notification) error {
+	return postWebhook(ctx, target, map[string]string{
+		"@type":    "MessageCard",
+		"@context": "http://schema.org/extensions",
+		"summary":  notification.Title,
+		"title":    notification.Title,
+		"text":     notification.Message,
+	})
+}
+
+// Generic webhooks, which get the notification as JSON
+type webhookNotifier struct{}
+
+func (webhookNotifier) validateTarget(target string) error {
+	return validateWebhookUrl(target)
+}
+
+func (webhookNotifier) notify(ctx context.Context, target string, notification Notification) error {
+	return postWebhook(ctx, target, notification)
+}
+
+/*
+Returns the notification subscriptions stored with a lab. Returns an empty list if none were stored.
+*/
+func getStoredSubscriptions(labData map[string]string) ([]NotificationSubscription, error) {
+	subscriptions := []NotificationSubscription{}
+
+	if value, ok := labData["notifications"]; ok {
+		if err := json.Unmarshal([]byte(value), &subscriptions); err != nil {
+			return nil, err
+		}
+	}
+
+	return subscriptions, nil
+}
+
+/*
+Changes the subscriptions of a lab with change, which returns the new subscriptions.
+*/
+func (s *Server) updateSubscriptions(ctx context.Context, labName string, change func([]NotificationSubscription) []NotificationSubscription) ([]NotificationSubscription, error) {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+
+	labData, err := s.getLabData(ctx, labName)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions, err := getStoredSubscriptions(labData)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions = change(subscriptions)
+	encoded, err := json.Marshal(subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return subscriptions, s.saveLabData(ctx, labName, map[string]string{"notifications": string(encoded)})
+}
+
+/*
+Sends a notification to every subscription of its event. Subscriptions that fail are logged, the others are still notified.
+*/
+func (s *Server) sendNotification(subscriptions []NotificationSubscription, notification Notification) {
+	for _, subscription := range subscriptions {
+		if !contains(subscription.Events, notification.Event) {
+			continue
+		}
+
+		notifier, ok := s.notifiers[subscription.Channel]
+		if !ok {
+			continue
+		}
+
+		if err := notifier.notify(context.Background(), subscription.Target, notification); err != nil {
+			fmt.Println("Something went wrong while notifying "+subscription.Instructor+" via "+subscription.Channel+":", err)
+		}
+	}
+}
+
+/*
+Notifies the instructors of a lab that subscribed to an event, in the background so the caller isn't slowed down by the channels.
+*/
+func (s *Server) notifyLab(ctx context.Context, labName string, event string, title string, message string) {
+	labData, err := s.getLabData(ctx, labName)
+	if err != nil {
+		fmt.Println("Something went wrong while fetching lab "+labName+":", err)
+		return
+	}
+
+	subscriptions, err := getStoredSubscriptions(labData)
+	if err != nil {
+		fmt.Println("Something went wrong while reading the notification subscriptions of lab "+labName+":", err)
+		return
+	}
+
+	go s.sendNotification(subscriptions, Notification{Event: event, Lab: labName, Title: title, Message: message, CreatedAt: time.Now()})
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returned by an object store for keys without object
+var errObjectNotFound = errors.New("object not found")
+
+// Keeps uploads and rendered charts outside of the memory of a single ScaLaMa, so every replica can reuse them
+type ObjectStore interface {
+	putObject(ctx context.Context, key string, data []byte, contentType string) error
+	getObject(ctx context.Context, key string) ([]byte, time.Time, error)
+	listObjects(ctx context.Context, prefix string) ([]string, error)
+	deleteObject(ctx context.Context, key string) error
+}
+
+// An uploaded file in the object store, labs that upload the same content share one artifact
+type Artifact struct {
+	Digest      string    `json:"digest"`
+	Field       string    `json:"field"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+	Size        int       `json:"size"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+}
+
+/*
+Opens the S3-compatible object store (S3, MinIO, ...) configured by SCALAMA_OBJECT_STORE_URL (e.g. http://minio:9000), SCALAMA_OBJECT_STORE_BUCKET,
+SCALAMA_OBJECT_STORE_REGION (default us-east-1), SCALAMA_OBJECT_STORE_ACCESS_KEY and SCALAMA_OBJECT_STORE_SECRET_KEY.
+Returns nil if no object store is configured.
+*/
+func openObjectStore() (ObjectStore, error) {
+	endpoint := os.Getenv("SCALAMA_OBJECT_STORE_URL")
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil || endpointUrl.Host == "" {
+		return nil, fmt.Errorf("SCALAMA_OBJECT_STORE_URL must be a URL")
+	}
+
+	bucket := os.Getenv("SCALAMA_OBJECT_STORE_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("SCALAMA_OBJECT_STORE_BUCKET is required with SCALAMA_OBJECT_STORE_URL")
+	}
+
+	region := os.Getenv("SCALAMA_OBJECT_STORE_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return s3ObjectStore{
+		endpoint:  endpointUrl,
+		bucket:    bucket,
+		region:    region,
+		accessKey: os.Getenv("SCALAMA_OBJECT_STORE_ACCESS_KEY"),
+		secretKey: os.Getenv("SCALAMA_OBJECT_STORE_SECRET_KEY"),
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+/*
+Returns the key of an upload in the object store, uploads are stored by the SHA-256 digest of their content.
+*/
+func getUploadKey(digest string) string {
+	return "uploads/" + digest
+}
+
+/*
+Returns the key of the description of an upload in the object store.
+*/
+func getArtifactKey(digest string) string {
+	return "artifacts/" + digest + ".json"
+}
+
+/*
+Stores an uploaded file in the object store by its digest, so it can be reused by later requests with <name>Digest instead of uploading it again.
+Content that is already stored (by any lab) is not stored again. Returns the content of the file, which can only be read once.
+*/
+func (s *Server) storeUpload(ctx context.Context, file io.ReadCloser, field string, fileHeader *multipart.FileHeader) (io.ReadCloser, error) {
+	if s.objectStore == nil {
+		return file, nil
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+	digest := hex.EncodeToString(hash[:])
+	if _, ok := s.storedUploads.Load(digest); ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	// Another replica may have stored the same content already
+	_, _, err = s.objectStore.getObject(ctx, getArtifactKey(digest))
+	if err == errObjectNotFound {
+		artifact := Artifact{
+			Digest:      digest,
+			Field:       field,
+			Filename:    fileHeader.Filename,
+			ContentType: fileHeader.Header.Get("Content-Type"),
+			Size:        len(data),
+			UploadedAt:  time.Now().UTC(),
+		}
+
+		encoded, err := json.Marshal(artifact)
+		if err != nil {
+			return nil, err
+		}
+
+		// The content is stored before its description, so every listed artifact can be fetched
+		if err := s.objectStore.putObject(ctx, getUploadKey(digest), data, "application/octet-stream"); err != nil {
+			return nil, err
+		}
+		if err := s.objectStore.putObject(ctx, getArtifactKey(digest), encoded, "application/json"); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	s.storedUploads.Store(digest, true)
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+/*
+Returns the artifacts in the object store, optionally only the uploads of one field (e.g. config), the newest first.
+*/
+func (s *Server) getStoredArtifacts(ctx context.Context, field string) ([]Artifact, error) {
+	keys, err := s.objectStore.listObjects(ctx, "artifacts/")
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := []Artifact{}
+	for _, key := range keys {
+		data, _, err := s.objectStore.getObject(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		var artifact Artifact
+		if err := json.Unmarshal(data, &artifact); err != nil {
+			return nil, err
+		}
+
+		if field == "" || artifact.Field == field {
+			artifacts = append(artifacts, artifact)
+		}
+	}
+
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].UploadedAt.After(artifacts[j].UploadedAt)
+	})
+
+	return artifacts, nil
+}
+
+/*
+Returns an earlier upload from the object store by its digest.
+*/
+func (s *Server) getStoredUpload(ctx context.Context, name string, digest string) (io.ReadCloser, *Error) {
+	if s.objectStore == nil {
+		return nil, &Error{status: http.StatusBadRequest, message: name + "Digest can only be used with an object store"}
+	}
+
+	data, _, err := s.objectStore.getObject(ctx, getUploadKey(digest))
+	if err == errObjectNotFound {
+		return nil, &Error{status: http.StatusNotFound, message: "No upload with digest " + digest + " is stored for " + name}
+	}
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching the upload of " + name + " from the object store"}
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// A bucket of an S3-compatible object store, addressed with path-style URLs so MinIO needs no DNS per bucket
+type s3ObjectStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (store s3ObjectStore) putObject(ctx context.Context, key string, data []byte, contentType string) error {
+	response, err := store.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the object store returned %s for PUT %s", response.Status, key)
+	}
+
+	return nil
+}
+
+func (store s3ObjectStore) getObject(ctx context.Context, key string) ([]byte, time.Time, error) {
+	response, err := store.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, time.Time{}, errObjectNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("the object store returned %s for GET %s", response.Status, key)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	lastModified, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return data, lastModified, nil
+}
+
+func (store s3ObjectStore) deleteObject(ctx context.Context, key string) error {
+	response, err := store.do(ctx, http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// Deleting a key without object also succeeds
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the object store returned %s for DELETE %s", response.Status, key)
+	}
+
+	return nil
+}
+
+// The part of a ListObjectsV2 response that is needed to list every key
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (store s3ObjectStore) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		response, err := store.do(ctx, http.MethodGet, "", nil, "", query)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListBucketResult
+		if response.StatusCode != http.StatusOK {
+			err = fmt.Errorf("the object store returned %s for listing %s", response.Status, prefix)
+		} else {
+			err = xml.NewDecoder(response.Body).Decode(&result)
+		}
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+
+		// Buckets return at most 1000 keys per page
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+/*
+Performs a request for an object (or the bucket when key is empty), signed with AWS Signature Version 4.
+*/
+func (store s3ObjectStore) do(ctx context.Context, method string, key string, body []byte, contentType string, query ...url.Values) (*http.Response, error) {
+	objectUrl := *store.endpoint
+	objectUrl.Path = strings.TrimSuffix(objectUrl.Path, "/") + "/" + store.bucket
+	if key != "" {
+		objectUrl.Path += "/" + key
+	}
+	if len(query) > 0 {
+		objectUrl.RawQuery = strings.ReplaceAll(query[0].Encode(), "+", "%20")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, objectUrl.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	signS3Request(request, body, store.region, store.accessKey, store.secretKey, time.Now())
+	return store.client.Do(request)
+}
+
+/*
+Returns the HMAC-SHA256 of data with key.
+*/
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/*
+Signs a request to S3 with AWS Signature Version 4, the host, the x-amz-* headers and the other headers already set on the request are signed.
+*/
+func signS3Request(request *http.Request, body []byte, region string, accessKey string, secretKey string, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := now.UTC().Format("20060102")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		strings.ReplaceAll(request.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSha256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSha256(signingKey, region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
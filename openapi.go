@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The documentation of an operation of the API. Its path, path parameters and methods come from the registered routes,
+// so every route is part of the OpenAPI document, also the routes without documentation.
+type apiOperation struct {
+	summary string
+	// A value of the struct the handler decodes the form (or query) parameters into with decodeForm, nil for operations without them
+	parameters interface{}
+	// Whether the options of getLabOptions (the options of the lab spec) are parameters of the operation
+	labOptions bool
+	// A value of the type of the JSON response, nil for responses without body or that are not JSON
+	response interface{}
+	// The status of a successful response, default 200
+	status int
+	// The content type of a response that is not JSON
+	contentType string
+}
+
+// The announcement of POST /lab/{labName}/announcements with the namespaces it was written to
+type announcementResponse struct {
+	Announcement Announcement `json:"announcement"`
+	Namespaces   []string     `json:"namespaces"`
+}
+
+// Every documented operation, by method and path (without the patterns of the path parameters)
+var apiOperations = map[string]apiOperation{
+	"POST /lab":                                              {summary: "Creates lab environments for students, returns the credentials per student (or group)", parameters: LabParameters{}, labOptions: true, response: map[string]string{}},
+	"GET /lab":                                               {summary: "Returns the labs with the namespaces of their students and groups", response: []LabSummary{}},
+	"GET /provisioning":                                      {summary: "Returns the labs that are being provisioned and that wait in the provisioning queue", response: []ProvisioningEntry{}},
+	"GET /lab/{labName}":                                     {summary: "Returns the state of a lab", response: LabDetail{}},
+	"PUT /lab/{labName}":                                     {summary: "Rolls out a new manifest to the namespaces of a lab", parameters: LabUpdateParameters{}, response: map[string][]string{}},
+	"PATCH /lab/{labName}":                                   {summary: "Rolls out a new manifest to the namespaces of a lab", parameters: LabUpdateParameters{}, response: map[string][]string{}},
+	"DELETE /lab/{labName}":                                  {summary: "Starts the deletion of a lab in the background", parameters: LabDeletionParameters{}, response: DeletionJob{}, status: http.StatusAccepted},
+	"GET /deletions/{id}":                                    {summary: "Returns the progress of the deletion of a lab", response: DeletionJob{}},
+	"GET /job/{id}":                                          {summary: "Returns the progress of the asynchronous creation of a lab, the credentials are only returned once", response: CreationJob{}},
+	"GET /job/{id}/events":                                   {summary: "Streams the progress of the asynchronous creation of a lab as Server-Sent Events", contentType: "text/event-stream"},
+	"GET /template-variables":                                {summary: "Returns every value charts get for a student namespace under .Values.student", response: []TemplateVariable{}},
+	"GET /lab-spec/schema":                                   {summary: "Returns the JSON schema of a lab spec", contentType: "application/schema+json"},
+	"GET /lab-spec/example":                                  {summary: "Returns an example of a lab spec", contentType: "text/yaml"},
+	"POST /validate":                                         {summary: "Validates a lab and its roster without provisioning anything, responds with 422 when the lab is invalid", parameters: LabParameters{}, labOptions: true, response: LabValidation{}},
+	"POST /estimate":                                         {summary: "Estimates the namespaces, pods, resource requests and storage of a lab without creating anything", parameters: EstimateParameters{}, labOptions: true, response: LabEstimate{}},
+	"GET /cluster-policy":                                    {summary: "Returns the cluster policy every lab is held to", response: ClusterPolicy{}},
+	"GET /approvals":                                         {summary: "Returns the labs that wait for (or got) the approval of a cluster admin", parameters: ApprovalListParameters{}, response: []LabApproval{}},
+	"GET /approvals/{id}":                                    {summary: "Returns the approval of a lab", response: LabApproval{}},
+	"POST /approvals/{id}/{decision}":                        {summary: "Approves (and creates) or rejects a lab that waits for approval", parameters: DecisionParameters{}, response: LabApproval{}},
+	"GET /artifacts":                                         {summary: "Returns the uploads in the object store", parameters: ArtifactListParameters{}, response: []Artifact{}},
+	"GET /archives":                                          {summary: "Returns the archives of deleted labs in the object store", parameters: ArchiveListParameters{}, response: ArchiveReport{}},
+	"GET /archives/{labName}/{id}":                           {summary: "Returns an archive of a deleted lab", response: map[string]interface{}{}},
+	"DELETE /lab/{labName}/groups/{groupNumber}":             {summary: "Deletes the namespace of a group and its RBAC", response: StudentDeletion{}},
+	"POST /lab/{labName}/groups/{groupNumber}/merge":         {summary: "Merges a group into another group", parameters: GroupMergeParameters{}, response: GroupMerge{}},
+	"POST /lab/{labName}/students/{username}":                {summary: "Recreates the environment of a student (or group), returns its new credentials", parameters: ReprovisionParameters{}, response: map[string]string{}},
+	"DELETE /lab/{labName}/students/{username}":              {summary: "Removes a student (or group) from a lab", response: StudentDeletion{}},
+	"POST /lab/{labName}/students/{username}/token":          {summary: "Returns a new token for the ServiceAccount of a user, earlier tokens stay valid", response: map[string]string{}},
+	"POST /lab/{labName}/token/{username}":                   {summary: "Replaces the ServiceAccount of a user and returns its new token, earlier tokens stop working", response: map[string]string{}},
+	"POST /lab/{labName}/tokens":                             {summary: "(Re)issues the tokens of several students of a lab", parameters: TokenIssuanceParameters{}, response: TokenIssuance{}},
+	"GET /lab/{labName}/namespaces":                          {summary: "Returns the lab namespace followed by the student (or group) namespaces", response: []string{}},
+	"GET /lab/{labName}/students":                            {summary: "Returns the username and namespace of every student of a lab", response: []StudentIdentifiers{}},
+	"POST /lab/{labName}/students":                           {summary: "Adds students to an existing lab, returns the credentials of the new namespaces", parameters: StudentsParameters{}, response: map[string]string{}},
+	"GET /lab/{labName}/students/{username}/quota":           {summary: "Returns the quota usage of the namespace of a student (or group), per ResourceQuota", response: map[string]map[string]ResourceUsage{}},
+	"GET /lab/{labName}/portal":                              {summary: "Returns the portal of the student that calls it with their token", response: StudentPortal{}},
+	"GET /lti/login":                                         {summary: "Starts an LTI 1.3 launch, redirects back to the platform", parameters: LtiLoginParameters{}, status: http.StatusFound},
+	"POST /lti/login":                                        {summary: "Starts an LTI 1.3 launch, redirects back to the platform", parameters: LtiLoginParameters{}, status: http.StatusFound},
+	"POST /lti/launch":                                       {summary: "Completes an LTI 1.3 launch, returns the portal and kubeconfig of the student", parameters: LtiLaunchParameters{}, response: LtiLaunch{}},
+	"POST /lab/{labName}/announcements":                      {summary: "Writes an announcement into every namespace of a lab", parameters: AnnouncementParameters{}, response: announcementResponse{}, status: http.StatusCreated},
+	"POST /lab/{labName}/students/{username}/quota/requests": {summary: "Requests higher hard limits for a ResourceQuota of the namespace of the student that calls it with their token", parameters: QuotaRequestParameters{}, response: QuotaRequest{}, status: http.StatusCreated},
+	"GET /lab/{labName}/quota-requests":                      {summary: "Returns the quota requests of a lab", parameters: QuotaRequestListParameters{}, response: []QuotaRequest{}},
+	"POST /lab/{labName}/quota-requests/{id}/{decision}":     {summary: "Approves or denies a pending quota request, only instructors and lab approvers can decide", parameters: DecisionParameters{}, response: QuotaRequest{}},
+	"GET /lab/{labName}/alerts":                              {summary: "Returns the alerts of suspicious activity in a lab, newest first", parameters: AlertListParameters{}, response: []Alert{}},
+	"GET /lab/{labName}/notifications":                       {summary: "Returns the notification subscriptions of a lab", response: []NotificationSubscription{}},
+	"POST /lab/{labName}/notifications":                      {summary: "Subscribes an instructor to events of a lab on a notification channel", parameters: SubscriptionParameters{}, response: NotificationSubscription{}, status: http.StatusCreated},
+	"DELETE /lab/{labName}/notifications/{instructor}":       {summary: "Unsubscribes an instructor from the notifications of a lab", parameters: UnsubscribeParameters{}, status: http.StatusNoContent},
+	"POST /audit":                                            {summary: "Receives the audit events of the API server (an audit.k8s.io EventList), authenticated with SCALAMA_AUDIT_TOKEN"},
+	"POST /lab/{labName}/spectators":                         {summary: "Gives a spectator read-only access to every namespace of a lab for a limited time", parameters: SpectatorParameters{}, response: Spectator{}, status: http.StatusCreated},
+	"GET /lab/{labName}/spectators":                          {summary: "Returns the spectators of a lab whose access has not expired yet", response: []Spectator{}},
+	"DELETE /lab/{labName}/spectators/{name}":                {summary: "Revokes the access of a spectator", status: http.StatusNoContent},
+	"POST /lab/{labName}/students/{username}/reset":          {summary: "Deletes the objects the students created in their namespace", response: map[string][]string{}},
+	"GET /lab/{labName}/students/{username}/timeline":        {summary: "Returns the lifecycle events of the namespace of a student (or group)", response: []TimelineEvent{}},
+	"GET /lab/{labName}/drift":                               {summary: "Compares the stored manifest of a lab with the live objects in its namespaces", response: LabDrift{}},
+	"GET /lab/{labName}/readiness":                           {summary: "Returns whether the namespaces of a lab are ready", response: map[string]NamespaceReadiness{}},
+	"GET /lab/{labName}/inventory":                           {summary: "Returns the objects ScaLaMa created from the manifest of a lab, per namespace", response: map[string][]InventoryEntry{}},
+	"GET /lab/{labName}/clusters/{username}/kubeconfig":      {summary: "Returns the admin kubeconfig of the Cluster API cluster of a user", contentType: "text/yaml"},
+	"GET /openapi":                                           {summary: "Returns this OpenAPI document", contentType: "application/json"},
+	"GET /openapi/ui":                                        {summary: "Serves a Swagger UI for this OpenAPI document", contentType: "text/html"},
+}
+
+// A path parameter with the pattern it must match in a route, e.g. {id:[0-9]+}
+var pathParameterPattern = regexp.MustCompile(`\{([^}:]+)(?::([^}]*))?\}`)
+
+// The schemas of the response types, by the name of their Go type
+type openApiSchemas map[string]interface{}
+
+/*
+Returns the schema of a Go type as it is encoded to JSON. Named structs are added to the schemas and referenced.
+*/
+func (schemas openApiSchemas) get(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemas.get(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemas.get(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemas.get(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return schemas.getStruct(t)
+		}
+
+		if _, ok := schemas[t.Name()]; !ok {
+			// Added before its fields, so types that contain themselves refer to it
+			schemas[t.Name()] = map[string]interface{}{}
+			schemas[t.Name()] = schemas.getStruct(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	// interface{} can be any value
+	return map[string]interface{}{}
+}
+
+/*
+Returns the schema of the exported fields of a struct, the fields of embedded structs are part of it.
+*/
+func (schemas openApiSchemas) getStruct(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			for name, property := range schemas.getStruct(embedded)["properties"].(map[string]interface{}) {
+				properties[name] = property
+			}
+			continue
+		}
+
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = schemas.get(field.Type)
+	}
+
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+/*
+Returns the schema of every parameter of a struct of parameters (see decodeForm) by name, and the names of the required parameters.
+*/
+func getParameterSchemas(t reflect.Type) (map[string]interface{}, []string) {
+	schemas := map[string]interface{}{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			embeddedSchemas, embeddedRequired := getParameterSchemas(field.Type)
+			for name, schema := range embeddedSchemas {
+				schemas[name] = schema
+			}
+			required = append(required, embeddedRequired...)
+			continue
+		}
+
+		name := field.Tag.Get("form")
+		if name == "" {
+			continue
+		}
+
+		schema := map[string]interface{}{"type": "string"}
+		description := field.Tag.Get("description")
+
+		var enum []string
+		if values := field.Tag.Get("enum"); values != "" {
+			enum = strings.Split(values, ",")
+		}
+
+		switch {
+		case field.Type == formFileType:
+			schema["format"] = "binary"
+		case field.Type.Kind() == reflect.Bool:
+			schema["type"] = "boolean"
+		case field.Type.Kind() == reflect.Ptr:
+			schema["type"] = "integer"
+			schema["minimum"] = 0
+		case field.Type.Kind() == reflect.Slice:
+			// Lists are sent as one comma-separated string
+			list := "comma-separated"
+			if enum != nil {
+				list += ", any of " + strings.Join(enum, ", ")
+			}
+			description = strings.TrimSuffix(list+", "+description, ", ")
+		case enum != nil:
+			schema["enum"] = enum
+		}
+
+		if value := field.Tag.Get("default"); value != "" {
+			if schema["type"] == "boolean" {
+				schema["default"] = value == "true"
+			} else {
+				schema["default"] = value
+			}
+		}
+
+		if description != "" {
+			schema["description"] = description
+		}
+
+		schemas[name] = schema
+		if field.Tag.Get("required") == "true" {
+			required = append(required, name)
+		}
+	}
+
+	sort.Strings(required)
+	return schemas, required
+}
+
+/*
+Returns the options of getLabOptions as form parameters, based on the options of the lab spec. Lists are sent as comma-separated strings
+(semicolon-separated for accessWindows).
+*/
+func getLabOptionParameters() map[string]interface{} {
+	var schema struct {
+		Properties struct {
+			Options struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"options"`
+		} `json:"properties"`
+	}
+	json.Unmarshal([]byte(labSpecSchema), &schema)
+
+	parameters := map[string]interface{}{}
+	for name, option := range schema.Properties.Options.Properties {
+		if _, ok := option["type"].(string); !ok {
+			separator := ","
+			if labSpecListSeparators[name] != "" {
+				separator = labSpecListSeparators[name]
+			}
+			option = map[string]interface{}{"type": "string", "description": "a list separated by " + separator}
+		}
+		parameters[name] = option
+	}
+
+	return parameters
+}
+
+/*
+Returns the OpenAPI operation of a route for a method.
+*/
+func getOpenApiOperation(method string, operation apiOperation, pathParameters []interface{}, schemas openApiSchemas) map[string]interface{} {
+	parameters := append([]interface{}{}, pathParameters...)
+
+	properties, required := map[string]interface{}{}, []string(nil)
+	if operation.parameters != nil {
+		properties, required = getParameterSchemas(reflect.TypeOf(operation.parameters))
+	}
+	if operation.labOptions {
+		for name, option := range getLabOptionParameters() {
+			properties[name] = option
+		}
+	}
+
+	result := map[string]interface{}{}
+	if operation.summary != "" {
+		result["summary"] = operation.summary
+	}
+
+	// Only the bodies of POST, PUT and PATCH requests are parsed as form, the parameters of other requests are part of the query
+	if method == http.MethodGet || method == http.MethodDelete {
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			parameters = append(parameters, map[string]interface{}{"name": name, "in": "query", "required": contains(required, name), "schema": properties[name]})
+		}
+	} else if len(properties) > 0 {
+		contentType := "application/x-www-form-urlencoded"
+		for _, property := range properties {
+			if property.(map[string]interface{})["format"] == "binary" {
+				contentType = "multipart/form-data"
+			}
+		}
+
+		body := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			body["required"] = required
+		}
+		result["requestBody"] = map[string]interface{}{"content": map[string]interface{}{contentType: map[string]interface{}{"schema": body}}}
+	}
+
+	if len(parameters) > 0 {
+		result["parameters"] = parameters
+	}
+
+	status := operation.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	response := map[string]interface{}{"description": http.StatusText(status)}
+	if operation.response != nil {
+		response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": schemas.get(reflect.TypeOf(operation.response))}}
+	} else if operation.contentType != "" {
+		response["content"] = map[string]interface{}{operation.contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	}
+
+	result["responses"] = map[string]interface{}{
+		strconv.Itoa(status): response,
+		"default":            map[string]interface{}{"description": "The error", "content": map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}},
+	}
+
+	return result
+}
+
+/*
+Returns the OpenAPI 3 document of the API, generated from the registered routes and their documentation in apiOperations.
+*/
+func (s *Server) getOpenApiDocument() (map[string]interface{}, error) {
+	router := mux.NewRouter()
+	s.registerRoutes(router)
+
+	paths := map[string]interface{}{}
+	schemas := openApiSchemas{}
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		// OpenAPI paths have no patterns, the patterns become the schema of the path parameters
+		var pathParameters []interface{}
+		for _, match := range pathParameterPattern.FindAllStringSubmatch(template, -1) {
+			schema := map[string]interface{}{"type": "string"}
+			if match[2] == "[0-9]+" {
+				schema["type"] = "integer"
+			} else if match[2] != "" {
+				schema["enum"] = strings.Split(match[2], "|")
+			}
+
+			pathParameters = append(pathParameters, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": schema})
+		}
+		path := pathParameterPattern.ReplaceAllString(template, "{$1}")
+
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		for _, method := range methods {
+			paths[path].(map[string]interface{})[strings.ToLower(method)] = getOpenApiOperation(method, apiOperations[method+" "+path], pathParameters, schemas)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "ScaLaMa",
+			"version":     strings.TrimPrefix(apiPrefix, "/api/"),
+			"description": "Scalable lab management on Kubernetes. The same routes are served per organization under " + apiPrefix + "/orgs/{organization}.",
+		},
+		"servers":    []interface{}{map[string]interface{}{"url": apiPrefix}},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}, nil
+}
+
+// A Swagger UI for the OpenAPI document, served next to it
+const swaggerUi = `<!DOCTYPE html>
+<html>
+<head>
+  <title>ScaLaMa API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "../openapi", dom_id: "#swagger-ui"})</script>
+</body>
+</html>
+`
+
+/*
+Returns the OpenAPI 3 document of the API, so clients can be generated for it.
+*/
+func (s *Server) getOpenApi(w http.ResponseWriter, r *http.Request) {
+	document, err := s.getOpenApiDocument()
+	if err != nil {
+		http.Error(w, "Something went wrong while generating the OpenAPI document", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
+
+/*
+Serves a Swagger UI for the OpenAPI document.
+*/
+func getSwaggerUi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	io.WriteString(w, swaggerUi)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Label on the lab namespace with the organization the lab belongs to
+const organizationLabel = "scalama.io/organization"
+
+// Name of the ResourceQuota with the default quota of an organization in every student (and group) namespace
+const organizationQuotaName = "organization-quota"
+
+// Organization names are prefixed to the names of their labs, which never contain a -
+var organizationNameRegex = regexp.MustCompile(`^[a-z0-9]{1,15}$`)
+
+// A department (e.g. a faculty) with its own lab names, instructors and admins
+type Organization struct {
+	Name         string            `json:"name"`
+	Instructors  []rbacv1.Subject  `json:"instructors,omitempty"`
+	Admins       []rbacv1.Subject  `json:"admins,omitempty"`
+	DefaultQuota map[string]string `json:"defaultQuota,omitempty"`
+}
+
+// Keys of the organization of a request and whether the caller is one of its admins
+type organizationKey struct{}
+type organizationAdminKey struct{}
+
+/*
+Reads the organizations from the file configured by SCALAMA_ORGANIZATIONS, e.g.
+[{name: cs, instructors: [{kind: Group, name: cs-staff}], admins: [{kind: User, name: alice}], defaultQuota: {requests.cpu: "2"}}]
+*/
+func loadOrganizations() (map[string]*Organization, error) {
+	path := os.Getenv("SCALAMA_ORGANIZATIONS")
+	if path == "" {
+		return map[string]*Organization{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Organization
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*Organization)
+	for i := range list {
+		organization := &list[i]
+		if !organizationNameRegex.MatchString(organization.Name) {
+			return nil, fmt.Errorf("the name of organization %q must be at most 15 lowercase letters and digits", organization.Name)
+		}
+
+		if _, ok := result[organization.Name]; ok {
+			return nil, fmt.Errorf("organization %s is defined twice", organization.Name)
+		}
+
+		for name, value := range organization.DefaultQuota {
+			if _, err := resource.ParseQuantity(value); err != nil {
+				return nil, fmt.Errorf("the default quota of %s for organization %s is not a quantity", name, organization.Name)
+			}
+		}
+
+		result[organization.Name] = organization
+	}
+
+	return result, nil
+}
+
+/*
+Checks whether a user is one of the subjects, directly or through one of their groups.
+*/
+func isSubject(user *authenticationv1.UserInfo, subjects []rbacv1.Subject) bool {
+	for _, subject := range subjects {
+		switch subject.Kind {
+		case "User":
+			if subject.Name == user.Username {
+				return true
+			}
+		case "Group":
+			if contains(user.Groups, subject.Name) {
+				return true
+			}
+		case "ServiceAccount":
+			if "system:serviceaccount:"+subject.Namespace+":"+subject.Name == user.Username {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/*
+Returns the organization of a request, nil for the routes without organization.
+*/
+func getRequestOrganization(ctx context.Context) *Organization {
+	organization, _ := ctx.Value(organizationKey{}).(*Organization)
+	return organization
+}
+
+/*
+Returns the name of a lab as it is used in the cluster. Hyphens are removed,
+and the labs of an organization are prefixed with its name so every organization has its own lab names.
+*/
+func getLabName(r *http.Request, name string) string {
+	labName := strings.ReplaceAll(name, "-", "") // Remove - from labname
+
+	if organization := getRequestOrganization(r.Context()); organization != nil {
+		return organization.Name + labName
+	}
+
+	return labName
+}
+
+/*
+Checks whether an existing lab belongs to an organization (or to no organization when it is nil), so organizations can't reach each other's labs.
+Labs that don't exist yet belong to no one.
+*/
+func checkLabOrganization(ctx context.Context, clientset kubernetes.Interface, labName string, organization *Organization) *Error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, "ns-"+labName, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while fetching namespace ns-" + labName}
+	}
+
+	name := ""
+	if organization != nil {
+		name = organization.Name
+	}
+
+	if namespace.Labels[organizationLabel] != name {
+		return &Error{status: http.StatusConflict, message: "Lab " + labName + " belongs to another organization"}
+	}
+
+	return nil
+}
+
+/*
+Labels the lab namespace with the organization the lab belongs to.
+*/
+func setLabOrganization(ctx context.Context, clientset kubernetes.Interface, labName string, organization *Organization) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, "ns-"+labName, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if namespace.Labels == nil {
+		namespace.Labels = map[string]string{}
+	}
+	namespace.Labels[organizationLabel] = organization.Name
+
+	_, err = clientset.CoreV1().Namespaces().Update(ctx, namespace, v1.UpdateOptions{})
+	return err
+}
+
+/*
+Creates the default quota of an organization in a student (or group) namespace.
+*/
+func createOrganizationQuota(ctx context.Context, clientset kubernetes.Interface, namespace string, organization *Organization) error {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	hard := corev1.ResourceList{}
+	for name, value := range organization.DefaultQuota {
+		hard[corev1.ResourceName(name)] = resource.MustParse(value)
+	}
+
+	quota := &corev1.ResourceQuota{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ResourceQuota",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      organizationQuotaName,
+			Namespace: namespace,
+			Labels:    map[string]string{managedByLabel: managedByLabelVal, organizationLabel: organization.Name},
+		},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: hard,
+		},
+	}
+
+	_, err := clientset.CoreV1().ResourceQuotas(namespace).Create(ctx, quota, v1.CreateOptions{})
+	return err
+}
+
+/*
+Creates the default quota of the organization of a request in a namespace, namespaces without organization have no default quota.
+*/
+func applyOrganizationQuota(ctx context.Context, clientset kubernetes.Interface, namespace string) *Error {
+	organization := getRequestOrganization(ctx)
+	if organization == nil || len(organization.DefaultQuota) == 0 {
+		return nil
+	}
+
+	if err := createOrganizationQuota(ctx, clientset, namespace, organization); err != nil {
+		return &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating the quota of organization " + organization.Name + " for namespace " + namespace}
+	}
+
+	return nil
+}
+
+/*
+Returns the names of the labs of an organization, without the prefix of the organization.
+*/
+func getOrganizationLabs(ctx context.Context, clientset kubernetes.Interface, organization *Organization) ([]string, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, v1.ListOptions{LabelSelector: organizationLabel + "=" + organization.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	labNames := []string{}
+	for _, namespace := range namespaces.Items {
+		labNames = append(labNames, strings.TrimPrefix(namespace.Name, "ns-"+organization.Name))
+	}
+	sort.Strings(labNames)
+
+	return labNames, nil
+}
+
+/*
+Only lets the instructors and admins of an organization use the routes of the organization, and only for the labs of the organization.
+*/
+func (s *Server) organizationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+
+		organization, ok := s.organizations[params["organization"]]
+		if !ok {
+			http.Error(w, "Organization "+params["organization"]+" does not exist", http.StatusNotFound)
+			return
+		}
+
+		user, e := getRequestUser(r, s.clientset)
+		if e != nil {
+			http.Error(w, e.message, e.status)
+			return
+		}
+
+		isAdmin := isSubject(user, organization.Admins)
+		if !isAdmin && !isSubject(user, organization.Instructors) {
+			http.Error(w, user.Username+" is not an instructor of organization "+organization.Name, http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), organizationKey{}, organization)
+		ctx = context.WithValue(ctx, organizationAdminKey{}, isAdmin)
+		r = r.WithContext(ctx)
+
+		if labName, ok := params["labName"]; ok {
+			if e := checkLabOrganization(ctx, s.clientset, getLabName(r, labName), organization); e != nil {
+				http.Error(w, e.message, e.status)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOrganizationMiddleware(t *testing.T) {
+	s := newTestServer(t)
+	s.organizations["cs"] = &Organization{
+		Name:        "cs",
+		Instructors: []rbacv1.Subject{{Kind: "User", Name: "ann"}},
+		Admins:      []rbacv1.Subject{{Kind: "User", Name: "bob"}},
+	}
+
+	// Lab db of organization cs, and lab web that belongs to another organization under the same name
+	for name, organization := range map[string]string{"ns-csdb": "cs", "ns-csweb": "math"} {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{organizationLabel: organization}}}
+		if _, err := s.clientset.CoreV1().Namespaces().Create(context.Background(), namespace, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]struct {
+		token        string
+		organization string
+		labName      string
+		status       int
+		label        string
+		isAdmin      bool
+	}{
+		"unknown organization":        {"ann", "math", "db", http.StatusNotFound, "", false},
+		"no token":                    {"", "cs", "db", http.StatusUnauthorized, "", false},
+		"not an instructor":           {"eve", "cs", "db", http.StatusForbidden, "", false},
+		"instructor":                  {"ann", "cs", "db", http.StatusOK, "csdb", false},
+		"admin":                       {"bob", "cs", "db", http.StatusOK, "csdb", true},
+		"new lab":                     {"ann", "cs", "ai", http.StatusOK, "csai", false},
+		"lab of another organization": {"ann", "cs", "web", http.StatusConflict, "", false},
+	}
+
+	for name, test := range tests {
+		var labName string
+		var isAdmin bool
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			labName = getLabName(r, test.labName)
+			isAdmin, _ = r.Context().Value(organizationAdminKey{}).(bool)
+		})
+
+		r := newTestRequest(http.MethodGet, "/api/v1/orgs/"+test.organization+"/lab/"+test.labName, test.token, map[string]string{"organization": test.organization, "labName": test.labName})
+		w := httptest.NewRecorder()
+		s.organizationMiddleware(next).ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d: %s", name, test.status, w.Code, w.Body.String())
+			continue
+		}
+		if labName != test.label || isAdmin != test.isAdmin {
+			t.Errorf("%s: expected lab %q (admin %v) for the next handler, got %q (admin %v)", name, test.label, test.isAdmin, labName, isAdmin)
+		}
+	}
+}
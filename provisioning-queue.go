@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// Priorities of the provisioning of a lab, exam labs are provisioned before the other labs
+const (
+	priorityExam   = "exam"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var priorities = []string{priorityExam, priorityNormal, priorityLow}
+
+const (
+	provisioningStatusQueued  = "Queued"
+	provisioningStatusRunning = "Running"
+)
+
+// A lab that waits for (or is being) provisioned. Position is 1 for the lab that is provisioned next, 0 once it is running.
+type ProvisioningEntry struct {
+	Id         string     `json:"id"`
+	Lab        string     `json:"lab"`
+	Instructor string     `json:"instructor,omitempty"`
+	Priority   string     `json:"priority"`
+	Status     string     `json:"status"`
+	Position   int        `json:"position"`
+	EnqueuedAt time.Time  `json:"enqueuedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+
+	organization string
+	ready        chan struct{}
+}
+
+// Only a limited amount of labs is provisioned at the same time, the other labs wait in the queue
+type provisioningQueue struct {
+	sync.Mutex
+	waiting []*ProvisioningEntry
+	running []*ProvisioningEntry
+	// When every instructor last had a lab provisioned, so instructors with many labs can't starve the others
+	lastServed map[string]time.Time
+}
+
+func newProvisioningQueue() *provisioningQueue {
+	return &provisioningQueue{lastServed: map[string]time.Time{}}
+}
+
+/*
+Returns how many labs are provisioned at the same time, configured by SCALAMA_PROVISIONING_CONCURRENCY (default 2).
+*/
+func getProvisioningConcurrency() (int, error) {
+	value := os.Getenv("SCALAMA_PROVISIONING_CONCURRENCY")
+	if value == "" {
+		return 2, nil
+	}
+
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 1 {
+		return 0, fmt.Errorf("SCALAMA_PROVISIONING_CONCURRENCY must be a number of at least 1")
+	}
+
+	return concurrency, nil
+}
+
+/*
+Returns the index of the waiting entry that is provisioned next: the highest priority first, then the instructor that was served
+the longest ago (instructors that were never served first), then the entry that waits the longest.
+*/
+func nextProvisioningEntry(waiting []*ProvisioningEntry, lastServed map[string]time.Time) int {
+	next := 0
+	for i := 1; i < len(waiting); i++ {
+		candidate, current := waiting[i], waiting[next]
+
+		candidateRank, currentRank := indexOf(priorities, candidate.Priority), indexOf(priorities, current.Priority)
+		if candidateRank != currentRank {
+			if candidateRank < currentRank {
+				next = i
+			}
+			continue
+		}
+
+		candidateServed, currentServed := lastServed[candidate.Instructor], lastServed[current.Instructor]
+		if !candidateServed.Equal(currentServed) {
+			if candidateServed.Before(currentServed) {
+				next = i
+			}
+			continue
+		}
+
+		if candidate.EnqueuedAt.Before(current.EnqueuedAt) {
+			next = i
+		}
+	}
+
+	return next
+}
+
+/*
+Returns the index of a value in a list, or the length of the list if it isn't in the list.
+*/
+func indexOf(list []string, value string) int {
+	for i, item := range list {
+		if item == value {
+			return i
+		}
+	}
+
+	return len(list)
+}
+
+/*
+Starts the waiting entries as long as fewer labs than the concurrency are being provisioned. The queue must be locked.
+*/
+func (queue *provisioningQueue) dispatch(concurrency int) {
+	for len(queue.waiting) > 0 && len(queue.running) < concurrency {
+		i := nextProvisioningEntry(queue.waiting, queue.lastServed)
+		entry := queue.waiting[i]
+		queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+
+		now := time.Now()
+		entry.Status = provisioningStatusRunning
+		entry.StartedAt = &now
+		queue.running = append(queue.running, entry)
+		queue.lastServed[entry.Instructor] = now
+
+		close(entry.ready)
+	}
+}
+
+/*
+Creates the queue entry of a lab for the request that provisions it, with the priority parameter (default normal) and the instructor:
+the impersonated user when impersonation is enabled, or else the instructor parameter.
+*/
+func newProvisioningEntry(r *http.Request, labName string) (*ProvisioningEntry, *Error) {
+	var parameters ProvisioningParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		return nil, e
+	}
+	priority := parameters.Priority
+
+	instructor := parameters.Instructor
+	if user, ok := r.Context().Value(impersonatedUserKey{}).(*authenticationv1.UserInfo); ok {
+		instructor = user.Username
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while creating the provisioning of lab " + labName}
+	}
+
+	entry := &ProvisioningEntry{Id: hex.EncodeToString(id), Lab: labName, Instructor: instructor, Priority: priority, Status: provisioningStatusQueued, ready: make(chan struct{})}
+	if organization := getRequestOrganization(r.Context()); organization != nil {
+		entry.organization = organization.Name
+	}
+
+	return entry, nil
+}
+
+/*
+Waits in the queue until the lab of an entry can be provisioned, the entry has to be released once the lab is provisioned.
+Returns an error if ctx is cancelled while waiting (e.g. the instructor disconnected), the entry then left the queue.
+*/
+func (queue *provisioningQueue) acquire(ctx context.Context, entry *ProvisioningEntry) error {
+	concurrency, err := getProvisioningConcurrency()
+	if err != nil {
+		return err
+	}
+
+	entry.EnqueuedAt = time.Now()
+
+	queue.Lock()
+	queue.waiting = append(queue.waiting, entry)
+	queue.dispatch(concurrency)
+	queue.Unlock()
+
+	select {
+	case <-entry.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+
+	// The entry may have been started right before ctx was cancelled
+	select {
+	case <-entry.ready:
+		queue.releaseLocked(entry, concurrency)
+	default:
+		for i, waiting := range queue.waiting {
+			if waiting == entry {
+				queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+/*
+Removes a provisioned lab from the queue, so the next lab can be provisioned.
+*/
+func (queue *provisioningQueue) release(entry *ProvisioningEntry) {
+	concurrency, err := getProvisioningConcurrency()
+	if err != nil {
+		concurrency = 1
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+
+	queue.releaseLocked(entry, concurrency)
+}
+
+/*
+Removes a lab from the running labs and starts the next waiting labs. The queue must be locked.
+*/
+func (queue *provisioningQueue) releaseLocked(entry *ProvisioningEntry, concurrency int) {
+	for i, running := range queue.running {
+		if running == entry {
+			queue.running = append(queue.running[:i], queue.running[i+1:]...)
+			break
+		}
+	}
+
+	queue.dispatch(concurrency)
+}
+
+/*
+Returns the labs that are being provisioned followed by the waiting labs in the order they will be provisioned, with their position.
+With an organization only its labs are returned, named without the prefix of the organization. Their position is still their
+position in the whole queue.
+*/
+func (queue *provisioningQueue) list(organization string) []ProvisioningEntry {
+	queue.Lock()
+	defer queue.Unlock()
+
+	var entries []ProvisioningEntry
+	for _, entry := range queue.running {
+		entries = append(entries, *entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedAt.Before(*entries[j].StartedAt)
+	})
+
+	// The order of the waiting labs depends on the instructors that are served before them
+	waiting := append([]*ProvisioningEntry{}, queue.waiting...)
+	lastServed := map[string]time.Time{}
+	for instructor, served := range queue.lastServed {
+		lastServed[instructor] = served
+	}
+
+	for position := 1; len(waiting) > 0; position++ {
+		i := nextProvisioningEntry(waiting, lastServed)
+		entry := *waiting[i]
+		waiting = append(waiting[:i], waiting[i+1:]...)
+
+		entry.Position = position
+		lastServed[entry.Instructor] = time.Now().Add(time.Duration(position) * time.Nanosecond)
+		entries = append(entries, entry)
+	}
+
+	result := []ProvisioningEntry{}
+	for _, entry := range entries {
+		if organization == "" {
+			result = append(result, entry)
+		} else if entry.organization == organization {
+			entry.Lab = strings.TrimPrefix(entry.Lab, organization)
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Reads the students of a lab, either from an uploaded file or from an external system
+type RosterSource interface {
+	getStudents(s *Server, r *http.Request, parameters *RosterParameters) ([]Student, *Error)
+}
+
+// Every rosterSource and how it reads the students, new sources only have to be added here
+var rosterSources = map[string]RosterSource{
+	"CSV":         csvRoster{},
+	"XLSX":        xlsxRoster{},
+	"JSON":        jsonRoster{},
+	"CANVAS":      canvasRoster{},
+	"BRIGHTSPACE": brightspaceRoster{},
+	"LDAP":        ldapRoster{},
+}
+
+/*
+Returns the supported roster sources, sorted.
+*/
+func getRosterSources() []string {
+	var sources []string
+	for source := range rosterSources {
+		sources = append(sources, source)
+	}
+
+	sort.Strings(sources)
+	return sources
+}
+
+/*
+Returns the students of a request, read by the source of the rosterSource parameter (default CSV).
+*/
+func (s *Server) getRosterStudents(r *http.Request) ([]Student, *Error) {
+	var parameters RosterParameters
+	if e := decodeForm(r, &parameters); e != nil {
+		return nil, e
+	}
+
+	source, ok := rosterSources[parameters.RosterSource]
+	if !ok {
+		return nil, &Error{status: http.StatusBadRequest, message: "rosterSource must be one of " + strings.Join(getRosterSources(), ", ")}
+	}
+
+	return source.getStudents(s, r, &parameters)
+}
+
+// The students uploaded as a CSV file
+type csvRoster struct{}
+
+func (csvRoster) getStudents(s *Server, r *http.Request, parameters *RosterParameters) ([]Student, *Error) {
+	studentsFile, e := s.getFormFile(r, "students", "text/csv")
+	if e != nil {
+		return nil, e
+	}
+
+	return getStudentsFromCsv(studentsFile), nil
+}
+
+// The students uploaded as an Excel workbook, with the same columns as the CSV file on the first sheet
+type xlsxRoster struct{}
+
+func (xlsxRoster) getStudents(s *Server, r *http.Request, parameters *RosterParameters) ([]Student, *Error) {
+	studentsFile, e := s.getFormFile(r, "students", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "application/octet-stream")
+	if e != nil {
+		return nil, e
+	}
+
+	data, err := io.ReadAll(studentsFile)
+	if err != nil {
+		return nil, &Error{status: http.StatusInternalServerError, message: "Something went wrong while reading the students"}
+	}
+
+	rows, err := getXlsxRows(data)
+	if err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "students must be an XLSX workbook: " + err.Error()}
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	header := rows[0]
+	var students []Student
+	for _, row := range rows[1:] {
+		// Trailing empty cells are not stored in the workbook
+		for len(row) < 3 || len(row) < len(header) {
+			row = append(row, "")
+		}
+		if row[0] == "" || row[1] == "" {
+			continue
+		}
+
+		students = append(students, *NewStudent(header, row))
+	}
+
+	return students, nil
+}
+
+// The parts of an XLSX workbook needed to read the values of its first sheet
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Id string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		Id     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxSharedStrings struct {
+	Items []struct {
+		Text []string `xml:"t"`
+		Runs []struct {
+			Text string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"si"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Reference string `xml:"r,attr"`
+			Type      string `xml:"t,attr"`
+			Value     string `xml:"v"`
+			Inline    struct {
+				Text string `xml:"t"`
+			} `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// Column letters of a cell reference: AB12 => AB
+var cellColumnRegex = regexp.MustCompile(`^[A-Z]+`)
+
+/*
+Decodes an XML file of an XLSX archive. Returns false if the archive doesn't contain the file.
+*/
+func decodeXlsxFile(archive *zip.Reader, name string, v interface{}) (bool, error) {
+	file, err := archive.Open(name)
+	if err != nil {
+		return false, nil
+	}
+	defer file.Close()
+
+	return true, xml.NewDecoder(file).Decode(v)
+}
+
+/*
+Returns the values of the cells of the first sheet of an XLSX workbook, row per row.
+*/
+func getXlsxRows(data []byte) ([][]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	// The first sheet of the workbook, resolved through the relationships of the workbook
+	sheetPath := "xl/worksheets/sheet1.xml"
+	var workbook xlsxWorkbook
+	var relationships xlsxRelationships
+	if ok, err := decodeXlsxFile(archive, "xl/workbook.xml", &workbook); err != nil || !ok {
+		return nil, fmt.Errorf("the workbook is missing")
+	}
+	if ok, _ := decodeXlsxFile(archive, "xl/_rels/workbook.xml.rels", &relationships); ok && len(workbook.Sheets) > 0 {
+		for _, relationship := range relationships.Relationships {
+			if relationship.Id == workbook.Sheets[0].Id {
+				sheetPath = path.Join("xl", strings.TrimPrefix(relationship.Target, "/xl/"))
+			}
+		}
+	}
+
+	var sharedStrings xlsxSharedStrings
+	if _, err := decodeXlsxFile(archive, "xl/sharedStrings.xml", &sharedStrings); err != nil {
+		return nil, err
+	}
+
+	var sheet xlsxSheet
+	if ok, err := decodeXlsxFile(archive, sheetPath, &sheet); err != nil || !ok {
+		return nil, fmt.Errorf("the first sheet is missing")
+	}
+
+	var rows [][]string
+	for _, sheetRow := range sheet.Rows {
+		var row []string
+		for i, cell := range sheetRow.Cells {
+			// Empty cells are not stored, so the column is taken from the reference of the cell
+			column := i
+			if letters := cellColumnRegex.FindString(cell.Reference); letters != "" {
+				column = 0
+				for _, letter := range letters {
+					column = column*26 + int(letter-'A'+1)
+				}
+				column--
+			}
+			for len(row) <= column {
+				row = append(row, "")
+			}
+
+			switch cell.Type {
+			case "s":
+				index, err := strconv.Atoi(cell.Value)
+				if err != nil || index < 0 || index >= len(sharedStrings.Items) {
+					return nil, fmt.Errorf("cell %s refers to an unknown string", cell.Reference)
+				}
+
+				item := sharedStrings.Items[index]
+				text := strings.Join(item.Text, "")
+				for _, run := range item.Runs {
+					text += run.Text
+				}
+				row[column] = text
+			case "inlineStr":
+				row[column] = cell.Inline.Text
+			default:
+				row[column] = cell.Value
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// The students uploaded as a JSON array
+type jsonRoster struct{}
+
+// A student of a JSON roster, group is omitted for a student without a group
+type jsonStudent struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Group    *int   `json:"group"`
+	SshKey   string `json:"sshKey"`
+	Identity string `json:"identity"`
+	Role     string `json:"role"`
+
+	Values map[string]string `json:"values"`
+}
+
+func (jsonRoster) getStudents(s *Server, r *http.Request, parameters *RosterParameters) ([]Student, *Error) {
+	studentsFile, e := s.getFormFile(r, "students", "application/json")
+	if e != nil {
+		return nil, e
+	}
+
+	var jsonStudents []jsonStudent
+	if err := json.NewDecoder(studentsFile).Decode(&jsonStudents); err != nil {
+		return nil, &Error{status: http.StatusBadRequest, message: "students must be a JSON array of students: " + err.Error()}
+	}
+
+	var students []Student
+	for _, jsonStudent := range jsonStudents {
+		if jsonStudent.Id == "" || jsonStudent.Name == "" {
+			return nil, &Error{status: http.StatusBadRequest, message: "Every student must have an id and a name"}
+		}
+
+		student := Student{id: jsonStudent.Id, name: jsonStudent.Name, group: -1, sshKey: jsonStudent.SshKey, identity: jsonStudent.Identity, role: jsonStudent.Role, values: jsonStudent.Values}
+		if jsonStudent.Group != nil {
+			student.group = *jsonStudent.Group
+		}
+
+		students = append(students, student)
+	}
+
+	return students, nil
+}
+
+// Matches the URL of the next page in a Link header, as used by Canvas
+var nextLinkRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+/*
+Decodes the JSON response of a GET request to an LMS, authenticated with a bearer token.
+Returns the URL of the next page, if the response is paginated with a Link header.
+*/
+func getLmsJson(ctx context.Context, url string, token string, v interface{}) (string, error) {
+	ctx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Accept", "application/json")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", url, response.Status)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return "", err
+	}
+
+	next := ""
+	if match := nextLinkRegex.FindStringSubmatch(response.Header.Get("Link")); match != nil {
+		next = match[1]
+	}
+
+	return next, nil
+}
+
+// The students enrolled in a Canvas course, configured by SCALAMA_CANVAS_URL and SCALAMA_CANVAS_TOKEN
+type canvasRoster struct{}
+
+type canvasUser struct {
+	Id        int    `json:"id"`
+	Name      string `json:"name"`
+	SisUserId string `json:"sis_user_id"`
+}
+
+type canvasGroup struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+/*
+Returns every item of a paginated Canvas list.
+*/
+func getCanvasList[T any](ctx context.Context, url string, token string) ([]T, error) {
+	var items []T
+	for url != "" {
+		var page []T
+
+		next, err := getLmsJson(ctx, url, token, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, page...)
+		url = next
+	}
+
+	return items, nil
+}
+
+/*
+Reads the students of a Canvas course.
+HTTP Parameters:
+ roster: <string> (the id of the course)
+ groupCategory: <string> (optional, the id of the group set the groups of the students are taken from)
+*/
+func (canvasRoster) getStudents(s *Server, r *http.Request, parameters *RosterParameters) ([]Student, *Error) {
+	baseUrl, token := strings.TrimSuffix(os.Getenv("SCALAMA_CANVAS_URL"), "/"), os.Getenv("SCALAMA_CANVAS_TOKEN")
+	if baseUrl == "" || token == "" {
+		return nil, &Error{status: http.StatusBadRequest, message: "Canvas is not configured, SCALAMA_CANVAS_URL and SCALAMA_CANVAS_TOKEN are required"}
+	}
+
+	courseId := parameters.Roster
+	if courseId == "" {
+		return nil, &Error{status: http.StatusBadRequest, message: "roster must be the id of a Canvas course"}
+	}
+
+	users, err := getCanvasList[canvasUser](r.Context(), baseUrl+"/api/v1/courses/"+courseId+"/users?enrollment_type[]=student&per_page=100", token)
+	if err != nil {
+		return nil, &Error{status: http.StatusBadGateway, message: "Something went wrong while fetching the students of Canvas course " + courseId}
+	}
+
+	// The groups of the group set, numbered by their name: Group # => #
+	userGroups := make(map[int]int)
+	if groupCategory := parameters.GroupCategory; groupCategory != "" {
+		groups, err := getCanvasList[canvasGroup](r.Context(), baseUrl+"/api/v1/group_categories/"+groupCategory+"/groups?per_page=100", token)
+		if err != nil {
+			return nil, &Error{status: http.StatusBadGateway, message: "Something went wrong while fetching the groups of Canvas group set " + groupCategory}
+		}
+
+		for _, group := range groups {
+			members, err := getCanvasList[canvasUser](r.Context(), baseUrl+"/api/v1/groups/"+strconv.Itoa(group.Id)+"/users?per_page=100", token)
+			if err != nil {
+				return nil, &Error{status: http.StatusBadGateway, message: "Something went wrong while fetching the members of Canvas group " + group.Name}
+			}
+
+			for _, member := range members {
+				userGroups[member.Id] = parseGroupNumber(group.Name)
+			}
+		}
+	}
+
+	var students []Student
+	for _, user := range users {
+		id := user.SisUserId
+		if id == "" {
+			id = strconv.Itoa(user.Id)
+		}
+
+		group, ok := userGroups[user.Id]
+		if !ok {
+			group = -1
+		}
+
+		students = append(students, Student{id: id, name: user.Name, group: group})
+	}
+
+	return students, nil
+}
+
+// The students of a Brightspace org unit, configured by SCALAMA_BRIGHTSPACE_URL and SCALAMA_BRIGHTSPACE_TOKEN
+type brightspaceRoster struct{}
+
+type brightspaceUser struct {
+	Identifier               string `json:"Identifier"`
+	DisplayName              string `json:"DisplayName"`
+	OrgDefinedId             string `json:"OrgDefinedId"`
+	ClasslistRoleDisplayName string `json:"ClasslistRoleDisplayName"`
+}
+
+type brightspaceGroup struct {
+	Name        string `json:"Name"`
+	Enrollments []int  `json:"Enrollments"`
+}
+
+/*
+Reads the students of a Brightspace course offering.
+HTTP Parameters:
+ roster: <string> (the id of the org unit)
+ groupCategory: <string> (optional, the id of the group category the groups of the students are taken from)
+*/
+func (brightspaceRoster) getStudents(s *Server, r *http.Request, parameters *RosterParameters) ([]Student, *Error) {
+	baseUrl, token := strings.TrimSuffix(os.Getenv("SCALAMA_BRIGHTSPACE_URL"), "/"), os.Getenv("SCALAMA_BRIGHTSPACE_TOKEN")
+	if baseUrl == "" || token == "" {
+		return nil, &Error{status: http.StatusBadRequest, message: "Brightspace is not configured, SCALAMA_BRIGHTSPACE_URL and SCALAMA_BRIGHTSPACE_TOKEN are required"}
+	}
+
+	orgUnitId := parameters.Roster
+	if orgUnitId == "" {
+		return nil, &Error{status: http.StatusBadRequest, message: "roster must be the id of a Brightspace org unit"}
+	}
+
+	var users []brightspaceUser
+	if _, err := getLmsJson(r.Context(), baseUrl+"/d2l/api/le/1.67/"+orgUnitId+"/classlist/", token, &users); err != nil {
+		return nil, &Error{status: http.StatusBadGateway, message: "Something went wrong while fetching the classlist of Brightspace org unit " + orgUnitId}
+	}
+
+	userGroups := make(map[string]int)
+	if groupCategory := parameters.GroupCategory; groupCategory != "" {
+		var groups []brightspaceGroup
+		if _, err := getLmsJson(r.Context(), baseUrl+"/d2l/api/lp/1.31/"+orgUnitId+"/groupcategories/"+groupCategory+"/groups/", token, &groups); err != nil {
+			return nil, &Error{status: http.StatusBadGateway, message: "Something went wrong while fetching the groups of Brightspace group category " + groupCategory}
+		}
+
+		for _, group := range groups {
+			for _, userId := range group.Enrollments {
+				userGroups[strconv.Itoa(userId)] = parseGroupNumber(group.Name)
+			}
+		}
+	}
+
+	var students []Student
+	for _, user := range users {
+		if user.ClasslistRoleDisplayName != "Student" {
+			continue
+		}
+
+		group, ok := userGroups[user.Identifier]
+		if !ok {
+			group = -1
+		}
+
+		students = append(students, Student{id: user.OrgDefinedId, name: user.DisplayName, group: group})
+	}
+
+	return students, nil
+}
+
+// The members of an LDAP group, configured by SCALAMA_LDAP_URL, SCALAMA_LDAP_BIND_DN, SCALAMA_LDAP_BIND_PASSWORD and SCALAMA_LDAP_BASE_DN
+type ldapRoster struct{}
+
+/*
+Reads the students that are a member of an LDAP group, identified by their uid and named by their cn.
+Students are not in a group, unless the entries have a scalamaGroup attribute (Group #).
+HTTP Parameters:
+ roster: <string> (the DN of the LDAP group)
+*/
+func (ldapRoster) getStudents(s *Server, r *http.Request, parameters *RosterParameters) ([]Student, *Error) {
+	url := os.Getenv("SCALAMA_LDAP_URL")
+	if url == "" {
+		return nil, &Error{status: http.StatusBadRequest, message: "LDAP is not configured, SCALAMA_LDAP_URL is required"}
+	}
+
+	groupDn := parameters.Roster
+	if groupDn == "" {
+		return nil, &Error{status: http.StatusBadRequest, message: "roster must be the DN of an LDAP group"}
+	}
+
+	conn, err := ldap.DialURL(url)
+	if err != nil {
+		return nil, &Error{status: http.StatusBadGateway, message: "Something went wrong while connecting to the LDAP server"}
+	}
+	defer conn.Close()
+	conn.SetTimeout(getContextOperationTimeout(r.Context()))
+
+	if bindDn := os.Getenv("SCALAMA_LDAP_BIND_DN"); bindDn != "" {
+		if err := conn.Bind(bindDn, os.Getenv("SCALAMA_LDAP_BIND_PASSWORD")); err != nil {
+			return nil, &Error{status: http.StatusBadGateway, message: "Something went wrong while binding to the LDAP server"}
+		}
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		os.Getenv("SCALAMA_LDAP_BASE_DN"), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(memberOf="+ldap.EscapeFilter(groupDn)+")",
+		[]string{"uid", "cn", "sshPublicKey", "scalamaGroup"},
+		nil,
+	)
+
+	result, err := conn.SearchWithPaging(searchRequest, 100)
+	if err != nil {
+		return nil, &Error{status: http.StatusBadGateway, message: "Something went wrong while searching the members of " + groupDn}
+	}
+
+	var students []Student
+	for _, entry := range result.Entries {
+		uid, cn := entry.GetAttributeValue("uid"), entry.GetAttributeValue("cn")
+		if uid == "" || cn == "" {
+			continue
+		}
+
+		students = append(students, Student{
+			id:     uid,
+			name:   cn,
+			group:  parseGroupNumber(entry.GetAttributeValue("scalamaGroup")),
+			sshKey: entry.GetAttributeValue("sshPublicKey"),
+		})
+	}
+
+	return students, nil
+}
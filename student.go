@@ -11,6 +11,14 @@ type Student struct {
 	id    string
 	name  string
 	group int
+
+	// Optional columns, identified by their header
+	sshKey   string
+	identity string
+	role     string
+
+	// Other columns, exposed to charts as .Values.student.<column>
+	values map[string]string
 }
 
 func trimLeftChar(s string) string {
@@ -22,8 +30,32 @@ func trimLeftChar(s string) string {
 	return s[:0]
 }
 
-// OrgDefinedId, Username, Group
-func NewStudent(csvRow []string) *Student {
+/*
+Normalizes the header of an optional column: "SSH Key" => sshkey
+*/
+func normalizeColumnName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), ""))
+}
+
+/*
+Parses the number of a group: Group # => #. Returns -1 if the student has no group.
+*/
+func parseGroupNumber(name string) int {
+	fields := strings.Fields(name)
+	if len(fields) < 2 {
+		return -1
+	}
+
+	group, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return -1
+	}
+
+	return group
+}
+
+// OrgDefinedId, Username, Group, optional columns (SSH Key, Identity, Role, any other column)
+func NewStudent(header []string, csvRow []string) *Student {
 	s := new(Student)
 
 	s.id = csvRow[0]
@@ -39,13 +71,24 @@ func NewStudent(csvRow []string) *Student {
 		s.name = trimLeftChar(s.name)
 	}
 
-	// Parse group number: Group # => #
-	groupStr := strings.Split(csvRow[2], " ")[1]
-	group, err := strconv.Atoi(groupStr)
-	if err != nil {
-		s.group = -1
-	} else {
-		s.group = group
+	s.group = parseGroupNumber(csvRow[2])
+
+	for i := 3; i < len(csvRow) && i < len(header); i++ {
+		value := strings.TrimSpace(csvRow[i])
+
+		switch normalizeColumnName(header[i]) {
+		case "sshkey":
+			s.sshKey = value
+		case "identity":
+			s.identity = value
+		case "role":
+			s.role = value
+		default:
+			if s.values == nil {
+				s.values = make(map[string]string)
+			}
+			s.values[normalizeColumnName(header[i])] = value
+		}
 	}
 
 	return s
@@ -56,7 +99,7 @@ func getStudentsFromCsv(file io.Reader) []Student {
 
 	// Getting rid of the header row
 	// TODO: throw error if incorrect format
-	_, err := reader.Read()
+	header, err := reader.Read()
 	if err == io.EOF {
 		return nil
 	}
@@ -70,7 +113,7 @@ func getStudentsFromCsv(file io.Reader) []Student {
 			break
 		}
 
-		s := NewStudent(row)
+		s := NewStudent(header, row)
 		students = append(students, *s)
 	}
 